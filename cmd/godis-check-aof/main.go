@@ -0,0 +1,62 @@
+package main
+
+import (
+	"Tiny-Godis/core"
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+)
+
+const usage = "Usage: godis-check-aof [--fix] <file.manifest|file.aof>"
+
+func main() {
+	flags := pflag.NewFlagSet("godis-check-aof", pflag.ExitOnError)
+	fix := flags.Bool("fix", false, "truncate the file at the first bad record")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(os.Args[1:])
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	results, err := core.CheckAof(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot check aof: "+err.Error())
+		os.Exit(1)
+	}
+	if len(results) == 0 {
+		fmt.Println("AOF is empty")
+		return
+	}
+	for _, result := range results {
+		fmt.Printf("AOF analyzed: filename=%s, size=%d, ok_up_to=%d, diff=%d\n",
+			result.Filename, result.Size, result.ValidSize, result.Size-result.ValidSize)
+	}
+
+	last := results[len(results)-1]
+	if last.Valid() {
+		fmt.Println("AOF is valid")
+		return
+	}
+	fmt.Printf("AOF %s is not valid: %s\n", last.Filename, last.Err.Error())
+	if !*fix {
+		fmt.Println("Use --fix to truncate the file at the first bad record")
+		os.Exit(1)
+	}
+	if !last.Last {
+		// truncating a middle file loses all commands after it and breaks the following files
+		fmt.Println("Only the last file of a multi part AOF could be fixed")
+		os.Exit(1)
+	}
+	err = core.FixAofFile(last)
+	if err != nil {
+		fmt.Println("Failed to truncate AOF: " + err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Successfully truncated AOF %s to %d bytes, %d bytes discarded\n",
+		last.Filename, last.ValidSize, last.Size-last.ValidSize)
+}
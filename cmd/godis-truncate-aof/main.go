@@ -0,0 +1,48 @@
+package main
+
+import (
+	"Tiny-Godis/core"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/spf13/pflag"
+)
+
+const usage = "Usage: godis-truncate-aof <unix-ms> <file.manifest|file.aof>"
+
+// godis-truncate-aof removes commands executed after the given time from aof,
+// aof must be written with aof-timestamp-enabled. Stop the server and back up aof before running it.
+func main() {
+	flags := pflag.NewFlagSet("godis-truncate-aof", pflag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, usage)
+	}
+	_ = flags.Parse(os.Args[1:])
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	until, err := strconv.ParseInt(flags.Arg(0), 10, 64)
+	if err != nil || until <= 0 {
+		fmt.Fprintln(os.Stderr, "Invalid timestamp: "+flags.Arg(0))
+		os.Exit(1)
+	}
+
+	results, err := core.TruncateAofToTimestamp(flags.Arg(1), until)
+	for _, result := range results {
+		fmt.Printf("AOF analyzed: filename=%s, size=%d, ok_up_to=%d, ok_up_to_timestamp=%d\n",
+			result.Filename, result.Size, result.ValidSize, result.Timestamp)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot truncate aof: "+err.Error())
+		os.Exit(1)
+	}
+	if len(results) == 0 || !results[len(results)-1].ReachedUntil {
+		fmt.Printf("No command executed after %d, AOF is not changed\n", until)
+		return
+	}
+	last := results[len(results)-1]
+	fmt.Printf("Successfully truncated AOF %s to %d bytes, %d bytes discarded\n",
+		last.Filename, last.ValidSize, last.Size-last.ValidSize)
+}
@@ -3,18 +3,105 @@ package core
 import (
 	"Tiny-Godis/lib/config"
 	"Tiny-Godis/lib/logger"
-	"Tiny-Godis/redis/parser"
+	"Tiny-Godis/lib/sync/atomic"
 	"Tiny-Godis/redis/reply"
+	"bufio"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	syncAtomic "sync/atomic"
 	"time"
 )
 
+const (
+	// FsyncAlways do fsync for every command
+	FsyncAlways = "always"
+	// FsyncEverySec do fsync every second
+	FsyncEverySec = "everysec"
+	// FsyncNo lets operating system decides when to do fsync
+	FsyncNo = "no"
+)
+
 var pExpireAtBytes = []byte("PEXPIREAT")
 
+// aofPayload is a command line waiting to be appended to the aof file
+type aofPayload struct {
+	cmdLine *reply.MultiBulkReply
+	// done receives the write or fsync error after cmdLine has been handled, only used by appendfsync always
+	done chan error
+	// unix time in milliseconds when the command executed, only used by aof-timestamp-enabled
+	timestamp int64
+}
+
+// aofStatus records the result of the latest aof write and fsync, reported by INFO persistence
+type aofStatus struct {
+	mu             sync.Mutex
+	lastWriteErr   error
+	lastFsyncErr   error
+	lastRewriteErr error
+	delayedFsync   int64
+	fsyncInFlight  atomic.Boolean
+}
+
+func (s *aofStatus) setWriteErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastWriteErr = err
+}
+
+func (s *aofStatus) getWriteErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastWriteErr
+}
+
+func (s *aofStatus) setFsyncErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastFsyncErr = err
+}
+
+func (s *aofStatus) getFsyncErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastFsyncErr
+}
+
+func (s *aofStatus) setRewriteErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastRewriteErr = err
+}
+
+func (s *aofStatus) getRewriteErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastRewriteErr
+}
+
+func statusString(err error) string {
+	if err != nil {
+		return "err"
+	}
+	return "ok"
+}
+
+func parseFsyncPolicy(policy string) string {
+	switch strings.ToLower(policy) {
+	case FsyncAlways:
+		return FsyncAlways
+	case FsyncNo:
+		return FsyncNo
+	default:
+		return FsyncEverySec
+	}
+}
+
 func makeAofCmd(cmd string, args [][]byte) *reply.MultiBulkReply {
 	params := make([][]byte, len(args)+1)
 	params[0] = []byte(cmd)
@@ -30,175 +117,629 @@ func makeExpireAofCmd(key string, expireAt time.Time) *reply.MultiBulkReply {
 	return reply.MakeMultiBulkReply(params)
 }
 
-func (db *DB) AddAof(args *reply.MultiBulkReply) {
-	if config.Properties.AppendOnly && db.aofChan != nil {
-		db.aofChan <- args
+// AddAof queues a command line for the aof file, with appendfsync always it waits
+// until the command is on disk and returns the write or fsync error
+func (db *DB) AddAof(args *reply.MultiBulkReply) error {
+	if !config.Properties.AppendOnly {
+		return nil
 	}
+	db.aofChanLock.RLock()
+	defer db.aofChanLock.RUnlock()
+	if db.aofChan == nil || db.aofClosed {
+		return nil
+	}
+	p := &aofPayload{cmdLine: args}
+	if config.Properties.AofTimestampEnabled {
+		p.timestamp = time.Now().UnixNano() / 1e6
+	}
+	if db.aofFsync == FsyncAlways {
+		// reply to client only after the command is on disk
+		p.done = make(chan error, 1)
+		db.aofChan <- p
+		return <-p.done
+	}
+	db.aofChan <- p
+	return nil
 }
 
 func (db *DB) handleAof() {
-	for cmd := range db.aofChan {
+	for p := range db.aofChan {
 		db.aofPause.RLock()
-		func() {
+		err := func() error {
 			defer db.aofPause.RUnlock()
-			if db.aofRewriteBuffer != nil {
-				db.aofRewriteBuffer <- cmd
+			buf := p.cmdLine.ToBytes()
+			if p.timestamp > 0 {
+				// payloads stamped by concurrent commands may arrive out of order,
+				// a late one shares the latest annotation so that annotations never go backwards
+				ts := p.timestamp
+				if ts < db.aofLastTimestamp {
+					ts = db.aofLastTimestamp
+				}
+				if ts != db.aofLastTimestamp || db.aofAnnotateNext {
+					buf = append(makeTimestampAnnotation(ts), buf...)
+					db.aofLastTimestamp = ts
+					db.aofAnnotateNext = false
+				}
+			}
+			if err := db.writeAof(buf); err != nil {
+				return err
 			}
-			_, err := db.aofFile.Write(cmd.ToBytes())
-			if err != nil {
-				logger.Warn(err)
+			if db.aofFsync == FsyncAlways {
+				return db.fsyncAof()
 			}
+			return nil
 		}()
+		if p.done != nil {
+			p.done <- err
+		}
 	}
 	db.aofFinished <- struct{}{}
 }
 
-func (db *DB) loadAof(maxByte int64) {
+// writeAof appends buf to aof file, data failed to write will be kept in aofPending and retried later
+// the caller must hold aofPause
+func (db *DB) writeAof(buf []byte) error {
+	if len(db.aofPending) > 0 {
+		buf = append(db.aofPending, buf...)
+		db.aofPending = nil
+	}
+	n, err := db.aofFile.Write(buf)
+	syncAtomic.AddInt64(&db.aofCurrentSize, int64(n))
+	if err == nil {
+		if db.aofStatus.getWriteErr() != nil {
+			logger.Info("aof write error looks solved, can write again")
+		}
+		db.aofStatus.setWriteErr(nil)
+		return nil
+	}
+	logger.Warn("write aof file failed: ", err)
+	if n > 0 {
+		// try to remove the partial command, otherwise retry from where it stopped
+		stat, statErr := db.aofFile.Stat()
+		if statErr != nil || db.aofFile.Truncate(stat.Size()-int64(n)) != nil {
+			buf = buf[n:]
+		} else {
+			syncAtomic.AddInt64(&db.aofCurrentSize, -int64(n))
+		}
+	}
+	db.aofPending = buf
+	db.aofStatus.setWriteErr(err)
+	return err
+}
+
+// fsyncAof flushes aof file to disk and records the result
+func (db *DB) fsyncAof() error {
+	err := db.aofFile.Sync()
+	if err != nil {
+		logger.Warn("aof file fsync failed: ", err)
+	}
+	db.aofStatus.setFsyncErr(err)
+	return err
+}
+
+// aofCron retries failed writes, starts scheduled or automatic rewrite and
+// performs fsync in background for appendfsync everysec
+func (db *DB) aofCron() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.aofCronStop:
+			return
+		case <-ticker.C:
+		}
+		db.aofPause.Lock()
+		if len(db.aofPending) > 0 {
+			db.writeAof(nil)
+		}
+		db.aofPause.Unlock()
+
+		db.tryStartRewrite()
+
+		if db.aofFsync != FsyncEverySec {
+			continue
+		}
+		if db.aofStatus.fsyncInFlight.Get() {
+			// the previous fsync has not returned in one second, the disk may be busy
+			syncAtomic.AddInt64(&db.aofStatus.delayedFsync, 1)
+			logger.Warn("asynchronous aof fsync is taking too long (disk is busy?)")
+			continue
+		}
+		db.aofStatus.fsyncInFlight.Set(true)
+		go func() {
+			defer db.aofStatus.fsyncInFlight.Set(false)
+			// rewrite may switch aofFile meanwhile
+			db.aofPause.RLock()
+			defer db.aofPause.RUnlock()
+			db.fsyncAof()
+		}()
+	}
+}
+
+// checkAofWritable rejects write commands while aof write keeps failing, just like redis
+func (db *DB) checkAofWritable() reply.ErrorReply {
+	if db.aofChan == nil {
+		return nil
+	}
+	err := db.aofStatus.getWriteErr()
+	if err == nil {
+		return nil
+	}
+	return reply.MakeErrReply("MISCONF Errors writing to the AOF file: " + err.Error())
+}
+
+// checkAofSynced reports a failed write or fsync to write commands which, under appendfsync always,
+// should reply only after their changes are on disk
+func (db *DB) checkAofSynced() reply.ErrorReply {
+	if db.aofChan == nil || db.aofFsync != FsyncAlways {
+		return nil
+	}
+	if errReply := db.checkAofWritable(); errReply != nil {
+		return errReply
+	}
+	if err := db.aofStatus.getFsyncErr(); err != nil {
+		return reply.MakeErrReply("MISCONF Errors writing to the AOF file: " + err.Error())
+	}
+	return nil
+}
+
+// openAof loads the multi-part aof described by manifest and opens the latest incr file for appending.
+// An aof file written by older version, which is a single appendfilename, will be upgraded to the base file.
+func (db *DB) openAof() error {
+	err := os.MkdirAll(db.aofDir, 0755)
+	if err != nil {
+		return err
+	}
+	m, err := loadManifest(db.aofDir, db.aofPrefix)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		m, err = db.upgradeLegacyAof()
+		if err != nil {
+			return err
+		}
+	}
+	db.aofManifest = m
+	err = db.loadAof(config.Properties.AofLoadUntil)
+	if err != nil {
+		return err
+	}
+	if config.Properties.AofLoadUntil > 0 {
+		// the recovered dataset lives in memory only, aof files are left as they are
+		return nil
+	}
+	m = db.aofManifest
+	db.deleteHistoryAof()
+
+	if len(m.incrList) == 0 {
+		m = m.copy()
+		m.currIncrSeq++
+		m.incrList = append(m.incrList, &aofInfo{
+			fileName: incrFileName(db.aofPrefix, m.currIncrSeq),
+			seq:      m.currIncrSeq,
+			fileType: aofIncrType,
+		})
+		err = persistManifest(db.aofDir, db.aofPrefix, m)
+		if err != nil {
+			return err
+		}
+		db.aofManifest = m
+	}
+	lastIncr := m.incrList[len(m.incrList)-1]
+	f, err := os.OpenFile(filepath.Join(db.aofDir, lastIncr.fileName), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	db.aofFile = f
+	db.aofCurrentSize = db.aofFilesSize()
+	db.aofBaseSize = db.aofCurrentSize
+	return nil
+}
+
+// upgradeLegacyAof moves the single file aof into aof dir as the base file
+func (db *DB) upgradeLegacyAof() (*aofManifest, error) {
+	m := &aofManifest{}
+	legacyName := config.Properties.AppendFilename
+	stat, err := os.Stat(legacyName)
+	if err != nil || stat.IsDir() {
+		return m, nil
+	}
+	m.currBaseSeq = 1
+	m.base = &aofInfo{
+		fileName: baseFileName(db.aofPrefix, m.currBaseSeq, false),
+		seq:      m.currBaseSeq,
+		fileType: aofBaseType,
+	}
+	err = os.Rename(legacyName, filepath.Join(db.aofDir, m.base.fileName))
+	if err != nil {
+		return nil, err
+	}
+	err = persistManifest(db.aofDir, db.aofPrefix, m)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("upgraded legacy aof file " + legacyName + " to " + m.base.fileName)
+	return m, nil
+}
+
+// aofFilesSize returns the total size of base and incr files
+func (db *DB) aofFilesSize() int64 {
+	var size int64
+	for _, info := range db.aofManifest.files() {
+		stat, err := os.Stat(filepath.Join(db.aofDir, info.fileName))
+		if err == nil {
+			size += stat.Size()
+		}
+	}
+	return size
+}
+
+// aofLoadError means an aof file is corrupted and could not be loaded
+type aofLoadError struct {
+	filename string
+	err      error
+}
+
+func (e *aofLoadError) Error() string {
+	return fmt.Sprintf("bad aof file %s: %s, use 'godis-check-aof --fix %s' to repair it",
+		e.filename, e.err.Error(), e.filename)
+}
+
+// loadAof replays base file and incr files in order.
+// If until is positive, only commands executed no later than until are replayed, aof files are not changed
+func (db *DB) loadAof(until int64) error {
 	aofChan := db.aofChan
 	db.aofChan = nil
 	defer func() {
 		db.aofChan = aofChan
 	}()
 
-	f, err := os.Open(db.aofFileName)
+	files := db.aofManifest.files()
+	for i, info := range files {
+		err := db.loadAofFile(filepath.Join(db.aofDir, info.fileName), i == len(files)-1, until)
+		if untilErr, ok := err.(*aofUntilError); ok {
+			if info.fileType == aofBaseType {
+				return fmt.Errorf("cannot load aof until %d, the earliest recoverable time is %d", until, untilErr.timestamp)
+			}
+			logger.Info(fmt.Sprintf("aof loaded until %d, stopped at offset %d of %s",
+				until, untilErr.offset, info.fileName))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadAofFile replays an aof file. Only the last file is allowed to end with an incomplete command,
+// which will be truncated if aof-load-truncated is enabled
+func (db *DB) loadAofFile(filename string, last bool, until int64) error {
+	f, err := os.Open(filename)
 	if err != nil {
-		if _, ok := err.(*os.PathError); ok {
-			return
+		if os.IsNotExist(err) {
+			return nil
 		}
-		logger.Warn(err)
-		return
+		return err
 	}
 	defer func() {
 		_ = f.Close()
 	}()
 
-	var reader io.Reader
-	if maxByte > 0 {
-		reader = io.LimitReader(f, maxByte)
-	} else {
-		reader = f
+	reader := bufio.NewReader(f)
+	var offset int64
+	if hasRdbPreamble(reader) {
+		offset, err = db.loadRdb(reader)
+		if err != nil {
+			return &aofLoadError{filename: filename, err: err}
+		}
 	}
 
-	ch := parser.ParseStream(reader)
-	for payload := range ch {
-		if payload.Err != nil {
-			if payload.Err == io.EOF {
-				// connection closed
-				break
-			}
-			logger.Error("parse error: " + payload.Err.Error())
-			continue
+	ar := newAofReader(reader, offset, until)
+	for {
+		cmdLine, err := ar.readCommand()
+		if err == io.EOF {
+			break
 		}
-		if payload.Data == nil {
-			logger.Error("empty payload")
-			continue
+		if err == io.ErrUnexpectedEOF && last && config.Properties.AofLoadTruncated {
+			logger.Warn(fmt.Sprintf("aof file %s is truncated, loaded up to offset %d and truncating the tail",
+				filename, ar.offset))
+			return os.Truncate(filename, ar.offset)
 		}
-		args, ok := payload.Data.(*reply.MultiBulkReply)
-		if !ok {
-			logger.Error("require multi bulk reply")
-			continue
+		if err == io.ErrUnexpectedEOF {
+			return &aofLoadError{filename: filename, err: fmt.Errorf("unexpected end of file at offset %d", ar.offset)}
+		}
+		if _, ok := err.(*aofUntilError); ok {
+			return err
 		}
-		cmd := strings.ToLower(string(args.Args[0]))
+		if err != nil {
+			return &aofLoadError{filename: filename, err: err}
+		}
+		err = checkAofArity(cmdLine, ar.cmdStart)
+		if err != nil {
+			return &aofLoadError{filename: filename, err: err}
+		}
+		cmd := strings.ToLower(string(cmdLine[0]))
 		command, ok := cmdTable[cmd]
 		if ok {
-			command.executor(db, args.Args[1:])
+			command.executor(db, cmdLine[1:])
 		}
 	}
+	return nil
+}
+
+// checkAofArity returns *aofFormatError if a known command has wrong number of arguments, executor can't handle it
+func checkAofArity(cmdLine CmdLine, offset int64) error {
+	command, ok := cmdTable[strings.ToLower(string(cmdLine[0]))]
+	if ok && !validateArity(command.arity, cmdLine) {
+		return &aofFormatError{offset: offset, msg: fmt.Sprintf("wrong number of arguments for '%s' command", cmdLine[0])}
+	}
+	return nil
 }
 
-func (db *DB) startRewrite() (*os.File, int64, error) {
+// startRewrite opens a new incr file for following commands,
+// returns the manifest of files which contains the dataset to rewrite and the time of switching
+func (db *DB) startRewrite() (*aofManifest, int64, error) {
 	db.aofPause.Lock()
 	defer db.aofPause.Unlock()
 
+	if len(db.aofPending) > 0 {
+		db.writeAof(nil)
+		if err := db.aofStatus.getWriteErr(); err != nil {
+			return nil, 0, err
+		}
+	}
+
 	err := db.aofFile.Sync()
 	if err != nil {
 		logger.Warn("aof file sync failed: ", err)
 		return nil, 0, err
 	}
 
-	stat, err := db.aofFile.Stat()
+	snapshot := db.aofManifest
+	m := snapshot.copy()
+	m.currIncrSeq++
+	incr := &aofInfo{
+		fileName: incrFileName(db.aofPrefix, m.currIncrSeq),
+		seq:      m.currIncrSeq,
+		fileType: aofIncrType,
+	}
+	m.incrList = append(m.incrList, incr)
+	incrPath := filepath.Join(db.aofDir, incr.fileName)
+	f, err := os.OpenFile(incrPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
-		logger.Warn("get aof file stat failed: ", err)
+		logger.Warn("new incr aof file create failed: ", err)
 		return nil, 0, err
 	}
-	fileSize := stat.Size()
-
-	tmpFile, err := ioutil.TempFile("", "aof")
+	err = persistManifest(db.aofDir, db.aofPrefix, m)
 	if err != nil {
-		logger.Warn("tmp aof file create failed: ", err)
+		_ = f.Close()
+		_ = os.Remove(incrPath)
 		return nil, 0, err
 	}
-
-	db.aofRewriteBuffer = make(chan *reply.MultiBulkReply)
-
-	return tmpFile, fileSize, nil
+	_ = db.aofFile.Close()
+	db.aofFile = f
+	db.aofManifest = m
+	// every incr file starts with its own annotation
+	db.aofAnnotateNext = true
+	return snapshot, time.Now().UnixNano() / 1e6, nil
 }
 
+// RewriteAof rewrites aof file to the minimal commands which could rebuild current dataset.
+// Only one rewrite could run at the same time, a request arriving during rewriting will be scheduled
+// and started by aofCron after the running one finished
 func (db *DB) RewriteAof() {
-	tmpFile, fileSize, err := db.startRewrite()
+	if !db.aofRewriting.CompareAndSwap(false, true) {
+		db.aofRewriteScheduled.Set(true)
+		return
+	}
+	defer db.aofRewriting.Set(false)
+
+	err := db.rewriteAof()
+	db.aofStatus.setRewriteErr(err)
 	if err != nil {
-		logger.Warn(err)
+		logger.Warn("aof rewrite failed: ", err)
 		return
 	}
+	db.deleteHistoryAof()
+}
+
+func (db *DB) rewriteAof() error {
+	snapshot, timestamp, err := db.startRewrite()
+	if err != nil {
+		return err
+	}
 
 	tmpDB := MakeTmpDB()
-	tmpDB.aofFileName = db.aofFileName
-	tmpDB.loadAof(fileSize)
+	tmpDB.aofDir = db.aofDir
+	tmpDB.aofManifest = snapshot
+	err = tmpDB.loadAof(0)
+	if err != nil {
+		return err
+	}
 
-	tmpDB.data.ForEach(func(key string, val interface{}) bool {
+	tmpFile, err := ioutil.TempFile(db.aofDir, tempPrefix+"rewriteaof-*"+aofSuffix)
+	if err != nil {
+		logger.Warn("tmp aof file create failed: ", err)
+		return err
+	}
+	useRdb := config.Properties.AofUseRdbPreamble
+	writer := bufio.NewWriter(tmpFile)
+	if useRdb {
+		err = writeRdbSnapshot(tmpDB, writer)
+	} else {
+		err = writeSnapshot(tmpDB, writer)
+	}
+	if err == nil && config.Properties.AofTimestampEnabled {
+		// base file is annotated with the time of snapshot, which is the earliest time could be recovered
+		_, err = writer.Write(makeTimestampAnnotation(timestamp))
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return err
+	}
+
+	return db.finishRewrite(snapshot, tmpFile.Name(), useRdb)
+}
+
+// writeSnapshot writes commands which could rebuild the dataset of db
+func writeSnapshot(db *DB, w io.Writer) error {
+	var err error
+	for _, lib := range db.functions.list() {
+		cmdLine := makeAofCmd("FUNCTION", [][]byte{[]byte("LOAD"), []byte(lib.code)})
+		if _, err = w.Write(cmdLine.ToBytes()); err != nil {
+			return err
+		}
+	}
+	db.data.ForEach(func(key string, val interface{}) bool {
 		entity, _ := val.(*DataEntity)
-		cmdLine := EntityToCmd(key, entity)
-		if cmdLine != nil {
-			_, err = tmpFile.Write(cmdLine.ToBytes())
-			if err != nil {
-				logger.Warn(err)
+		for _, cmdLine := range EntityToCmds(key, entity) {
+			if _, err = w.Write(cmdLine.ToBytes()); err != nil {
+				return false
 			}
 		}
 		return true
 	})
+	if err != nil {
+		return err
+	}
 
-	tmpDB.ttlMap.ForEach(func(key string, val interface{}) bool {
+	db.ttlMap.ForEach(func(key string, val interface{}) bool {
 		expireAt, _ := val.(time.Time)
 		cmdLine := makeExpireAofCmd(key, expireAt)
 		if cmdLine != nil {
-			_, err = tmpFile.Write(cmdLine.ToBytes())
-			if err != nil {
-				logger.Warn(err)
-			}
+			_, err = w.Write(cmdLine.ToBytes())
 		}
-		return true
+		return err == nil
 	})
-
-	db.finishRewrite(tmpFile)
+	return err
 }
 
-func (db *DB) finishRewrite(tmpFile *os.File) {
+// finishRewrite installs the new base file, and marks files contained in snapshot as history.
+// Switching manifest is atomic, if the process crashes at any step, we still have a complete aof.
+func (db *DB) finishRewrite(snapshot *aofManifest, tmpName string, useRdb bool) error {
 	db.aofPause.Lock()
 	defer db.aofPause.Unlock()
 
-	func() {
-		for {
-			// 实现循环取出chan中的所有元素并在取完后结束循环的trick
-			select {
-			case cmd := <-db.aofRewriteBuffer:
-				_, err := tmpFile.Write(cmd.ToBytes())
-				if err != nil {
-					logger.Warn(err)
-				}
-			default:
-				return
-			}
+	m := db.aofManifest.copy()
+	m.currBaseSeq++
+	base := &aofInfo{
+		fileName: baseFileName(db.aofPrefix, m.currBaseSeq, useRdb),
+		seq:      m.currBaseSeq,
+		fileType: aofBaseType,
+	}
+	basePath := filepath.Join(db.aofDir, base.fileName)
+	err := os.Rename(tmpName, basePath)
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+
+	if m.base != nil {
+		m.historyList = append(m.historyList, &aofInfo{
+			fileName: m.base.fileName,
+			seq:      m.base.seq,
+			fileType: aofHistoryType,
+		})
+	}
+	incrList := make([]*aofInfo, 0, len(m.incrList))
+	for _, info := range m.incrList {
+		if info.seq <= snapshot.currIncrSeq {
+			m.historyList = append(m.historyList, &aofInfo{
+				fileName: info.fileName,
+				seq:      info.seq,
+				fileType: aofHistoryType,
+			})
+		} else {
+			incrList = append(incrList, info)
 		}
-	}()
-	close(db.aofRewriteBuffer)
-	db.aofRewriteBuffer = nil
-	_ = db.aofFile.Close()
-	_ = os.Rename(tmpFile.Name(), db.aofFileName)
+	}
+	m.incrList = incrList
+	m.base = base
+
+	err = persistManifest(db.aofDir, db.aofPrefix, m)
+	if err != nil {
+		// the old manifest is still valid
+		_ = os.Remove(basePath)
+		return err
+	}
+	db.aofManifest = m
+	size := db.aofFilesSize()
+	syncAtomic.StoreInt64(&db.aofCurrentSize, size)
+	syncAtomic.StoreInt64(&db.aofBaseSize, size)
+	return nil
+}
+
+// deleteHistoryAof removes files replaced by rewrite, and then removes them from manifest
+func (db *DB) deleteHistoryAof() {
+	db.aofPause.RLock()
+	historyList := db.aofManifest.historyList
+	db.aofPause.RUnlock()
+	if len(historyList) == 0 {
+		return
+	}
+	for _, info := range historyList {
+		err := os.Remove(filepath.Join(db.aofDir, info.fileName))
+		if err != nil && !os.IsNotExist(err) {
+			logger.Warn("delete history aof file failed: ", err)
+			return
+		}
+	}
 
-	// reopen aof file for further write
-	aofFile, err := os.OpenFile(db.aofFileName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	db.aofPause.Lock()
+	defer db.aofPause.Unlock()
+	m := db.aofManifest.copy()
+	m.historyList = nil
+	err := persistManifest(db.aofDir, db.aofPrefix, m)
 	if err != nil {
-		panic(err)
+		logger.Warn("persist aof manifest failed: ", err)
+		return
+	}
+	db.aofManifest = m
+}
+
+// shouldAutoRewrite checks whether aof file has grown enough since the last rewrite
+// according to auto-aof-rewrite-percentage and auto-aof-rewrite-min-size
+func (db *DB) shouldAutoRewrite() bool {
+	percentage := int64(config.Properties.AutoAofRewritePercentage)
+	if percentage <= 0 {
+		return false
+	}
+	current := syncAtomic.LoadInt64(&db.aofCurrentSize)
+	if current < config.Properties.AutoAofRewriteMinSize {
+		return false
+	}
+	base := syncAtomic.LoadInt64(&db.aofBaseSize)
+	if base <= 0 {
+		base = 1
+	}
+	growth := (current - base) * 100 / base
+	return growth >= percentage
+}
+
+// tryStartRewrite starts a scheduled or automatic rewrite, called by aofCron
+func (db *DB) tryStartRewrite() {
+	if db.aofRewriting.Get() {
+		return
+	}
+	if db.aofRewriteScheduled.CompareAndSwap(true, false) {
+		go db.RewriteAof()
+		return
+	}
+	if db.shouldAutoRewrite() {
+		logger.Info(fmt.Sprintf("starting automatic rewriting of AOF on %d%% growth",
+			config.Properties.AutoAofRewritePercentage))
+		go db.RewriteAof()
 	}
-	db.aofFile = aofFile
 }
@@ -0,0 +1,220 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AofCheckResult is the analysis of an aof file
+type AofCheckResult struct {
+	Filename string
+	Size     int64
+	// ValidSize is the offset after the last complete command
+	ValidSize int64
+	// Err is the first problem found in file, nil means the file is valid
+	Err error
+	// Truncated means file ends with an incomplete command
+	Truncated bool
+	// Last means no file is loaded after this one, only the last file could be fixed by truncating
+	Last bool
+	// Timestamp is the latest timestamp annotation before ValidSize
+	Timestamp int64
+	// ReachedUntil means a timestamp annotation later than the given time found at ValidSize
+	ReachedUntil bool
+}
+
+// Valid returns whether the whole file could be loaded
+func (r *AofCheckResult) Valid() bool {
+	return r.Err == nil
+}
+
+// CheckAofFile validates an aof file, the rdb preamble is validated as well
+func CheckAofFile(filename string) (*AofCheckResult, error) {
+	return scanAofFile(filename, 0)
+}
+
+// scanAofFile validates an aof file, it stops before the first timestamp annotation later than until if until is positive
+func scanAofFile(filename string, until int64) (*AofCheckResult, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	result := &AofCheckResult{
+		Filename: filename,
+		Size:     stat.Size(),
+	}
+
+	reader := bufio.NewReader(f)
+	var offset int64
+	if hasRdbPreamble(reader) {
+		// values are decoded into a throwaway db to validate the preamble
+		offset, err = MakeTmpDB().loadRdb(reader)
+		if err != nil {
+			result.Err = fmt.Errorf("bad rdb preamble: %v", err)
+			return result, nil
+		}
+		result.ValidSize = offset
+	}
+
+	ar := newAofReader(reader, offset, until)
+	for {
+		var cmdLine CmdLine
+		cmdLine, err = ar.readCommand()
+		if err == nil {
+			err = checkAofArity(cmdLine, ar.cmdStart)
+		}
+		if formatErr, ok := err.(*aofFormatError); ok {
+			result.ValidSize = formatErr.offset
+		} else {
+			result.ValidSize = ar.offset
+		}
+		result.Timestamp = ar.timestamp
+		if _, ok := err.(*aofUntilError); ok {
+			result.ReachedUntil = true
+			return result, nil
+		}
+		if err == io.EOF {
+			return result, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			result.Truncated = true
+			result.Err = fmt.Errorf("unexpected end of file at offset %d", ar.offset)
+			return result, nil
+		}
+		if err != nil {
+			result.Err = err
+			return result, nil
+		}
+	}
+}
+
+// CheckAof validates a single aof file, or all files listed in a manifest if filename ends with .manifest.
+// It stops at the first invalid file since following files could not be loaded either
+func CheckAof(filename string) ([]*AofCheckResult, error) {
+	return scanAof(filename, 0)
+}
+
+func scanAof(filename string, until int64) ([]*AofCheckResult, error) {
+	if !strings.HasSuffix(filename, manifestSuffix) {
+		result, err := scanAofFile(filename, until)
+		if err != nil {
+			return nil, err
+		}
+		result.Last = true
+		return []*AofCheckResult{result}, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseManifest(f)
+	_ = f.Close()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(filename)
+	results := make([]*AofCheckResult, 0)
+	files := m.files()
+	for i, info := range files {
+		result, err := scanAofFile(filepath.Join(dir, info.fileName), until)
+		if err != nil {
+			return nil, err
+		}
+		result.Last = i == len(files)-1
+		results = append(results, result)
+		if !result.Valid() || result.ReachedUntil {
+			break
+		}
+	}
+	return results, nil
+}
+
+// FixAofFile truncates the file at the end of the last complete command
+func FixAofFile(result *AofCheckResult) error {
+	return os.Truncate(result.Filename, result.ValidSize)
+}
+
+// TruncateAofToTimestamp removes commands executed later than the given unix time in milliseconds,
+// so that loading the aof recovers the dataset at that time.
+// For a multi-part aof, incr files after the truncated one are marked as history.
+// Returns results of scanned files, the last one is where aof was truncated.
+func TruncateAofToTimestamp(filename string, until int64) ([]*AofCheckResult, error) {
+	if until <= 0 {
+		return nil, fmt.Errorf("invalid timestamp %d", until)
+	}
+	results, err := scanAof(filename, until)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return results, nil
+	}
+	last := results[len(results)-1]
+	if !last.Valid() {
+		return results, fmt.Errorf("aof %s is not valid: %v", last.Filename, last.Err)
+	}
+	if !last.ReachedUntil {
+		// all commands executed no later than until
+		return results, nil
+	}
+
+	if !strings.HasSuffix(filename, manifestSuffix) {
+		return results, FixAofFile(last)
+	}
+	dir := filepath.Dir(filename)
+	prefix := strings.TrimSuffix(filepath.Base(filename), manifestSuffix)
+	m, err := loadManifest(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	index := len(results) - 1
+	if m.files()[index].fileType == aofBaseType {
+		return results, fmt.Errorf("cannot truncate aof to %d, the earliest recoverable time is %d", until, last.Timestamp)
+	}
+	_, err = truncateAofFiles(dir, prefix, m, index, last.ValidSize)
+	return results, err
+}
+
+// truncateAofFiles truncates the index-th file of manifest at offset and marks following incr files as history.
+// The truncated file must be an incr file
+func truncateAofFiles(dir string, prefix string, m *aofManifest, index int, offset int64) (*aofManifest, error) {
+	files := m.files()
+	err := os.Truncate(filepath.Join(dir, files[index].fileName), offset)
+	if err != nil {
+		return nil, err
+	}
+	if index == len(files)-1 {
+		return m, nil
+	}
+	truncated := m.copy()
+	truncated.incrList = truncated.incrList[:0]
+	for _, info := range files[:index+1] {
+		if info.fileType == aofIncrType {
+			truncated.incrList = append(truncated.incrList, info)
+		}
+	}
+	for _, info := range files[index+1:] {
+		truncated.historyList = append(truncated.historyList, &aofInfo{
+			fileName: info.fileName,
+			seq:      info.seq,
+			fileType: aofHistoryType,
+		})
+	}
+	err = persistManifest(dir, prefix, truncated)
+	if err != nil {
+		return nil, err
+	}
+	return truncated, nil
+}
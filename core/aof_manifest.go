@@ -0,0 +1,235 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// aof file types in manifest, the same as redis 7
+const (
+	aofBaseType    = 'b'
+	aofHistoryType = 'h'
+	aofIncrType    = 'i'
+)
+
+const (
+	defaultAofDirname  = "appendonlydir"
+	defaultAofFilename = "appendonly.aof"
+
+	manifestSuffix = ".manifest"
+	baseSuffix     = ".base"
+	incrSuffix     = ".incr"
+	aofSuffix      = ".aof"
+	rdbSuffix      = ".rdb"
+	tempPrefix     = "temp-"
+)
+
+// aofInfo describes a file recorded in manifest
+type aofInfo struct {
+	fileName string
+	seq      int64
+	fileType byte
+}
+
+// aofManifest tracks all files of a multi-part aof:
+// a base file which is the snapshot written by the latest rewrite,
+// incr files which contain commands received after the snapshot, in order,
+// and history files which has been replaced by a rewrite and waiting to be deleted
+type aofManifest struct {
+	base        *aofInfo
+	incrList    []*aofInfo
+	historyList []*aofInfo
+	currBaseSeq int64
+	currIncrSeq int64
+}
+
+func (m *aofManifest) copy() *aofManifest {
+	c := &aofManifest{
+		base:        m.base,
+		incrList:    make([]*aofInfo, len(m.incrList)),
+		historyList: make([]*aofInfo, len(m.historyList)),
+		currBaseSeq: m.currBaseSeq,
+		currIncrSeq: m.currIncrSeq,
+	}
+	copy(c.incrList, m.incrList)
+	copy(c.historyList, m.historyList)
+	return c
+}
+
+// files returns base and incr files in loading order
+func (m *aofManifest) files() []*aofInfo {
+	result := make([]*aofInfo, 0, len(m.incrList)+1)
+	if m.base != nil {
+		result = append(result, m.base)
+	}
+	result = append(result, m.incrList...)
+	return result
+}
+
+func (m *aofManifest) encode() []byte {
+	var buf bytes.Buffer
+	write := func(info *aofInfo) {
+		buf.WriteString(fmt.Sprintf("file %s seq %d type %c\n", info.fileName, info.seq, info.fileType))
+	}
+	if m.base != nil {
+		write(m.base)
+	}
+	for _, info := range m.historyList {
+		write(info)
+	}
+	for _, info := range m.incrList {
+		write(info)
+	}
+	return buf.Bytes()
+}
+
+func parseManifest(reader io.Reader) (*aofManifest, error) {
+	m := &aofManifest{}
+	scanner := bufio.NewScanner(reader)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid aof manifest line %d: %s", lineNum, line)
+		}
+		info := &aofInfo{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.fileName = fields[i+1]
+			case "seq":
+				seq, err := strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid aof manifest line %d: %s", lineNum, line)
+				}
+				info.seq = seq
+			case "type":
+				info.fileType = fields[i+1][0]
+			}
+		}
+		if info.fileName == "" || info.seq == 0 || info.fileType == 0 {
+			return nil, fmt.Errorf("invalid aof manifest line %d: %s", lineNum, line)
+		}
+		switch info.fileType {
+		case aofBaseType:
+			if m.base != nil {
+				return nil, fmt.Errorf("found duplicate base file information in aof manifest")
+			}
+			m.base = info
+			m.currBaseSeq = info.seq
+		case aofHistoryType:
+			m.historyList = append(m.historyList, info)
+		case aofIncrType:
+			if info.seq <= m.currIncrSeq {
+				return nil, fmt.Errorf("found a non-monotonic sequence number in aof manifest")
+			}
+			m.incrList = append(m.incrList, info)
+			m.currIncrSeq = info.seq
+		default:
+			return nil, fmt.Errorf("unknown aof file type in manifest line %d: %s", lineNum, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// aofDirPath returns the directory which contains all aof files.
+// appenddirname is relative to the directory of appendfilename
+func aofDirPath(appendFilename, appendDirname string) string {
+	if appendDirname == "" {
+		appendDirname = defaultAofDirname
+	}
+	if filepath.IsAbs(appendDirname) {
+		return appendDirname
+	}
+	return filepath.Join(filepath.Dir(appendFilename), appendDirname)
+}
+
+func aofPrefix(appendFilename string) string {
+	if appendFilename == "" {
+		return defaultAofFilename
+	}
+	return filepath.Base(appendFilename)
+}
+
+func manifestName(prefix string) string {
+	return prefix + manifestSuffix
+}
+
+// baseFileName returns name of base file, base file with rdb preamble has suffix .rdb
+func baseFileName(prefix string, seq int64, rdb bool) string {
+	suffix := aofSuffix
+	if rdb {
+		suffix = rdbSuffix
+	}
+	return prefix + "." + strconv.FormatInt(seq, 10) + baseSuffix + suffix
+}
+
+func incrFileName(prefix string, seq int64) string {
+	return prefix + "." + strconv.FormatInt(seq, 10) + incrSuffix + aofSuffix
+}
+
+// loadManifest reads manifest from disk, returns nil if manifest not exists
+func loadManifest(dir string, prefix string) (*aofManifest, error) {
+	f, err := os.Open(filepath.Join(dir, manifestName(prefix)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return parseManifest(f)
+}
+
+// persistManifest replaces manifest on disk atomically: write a temp file, fsync it and rename
+func persistManifest(dir string, prefix string, m *aofManifest) error {
+	tmpFile, err := ioutil.TempFile(dir, tempPrefix+manifestName(prefix))
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(m.encode())
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), filepath.Join(dir, manifestName(prefix)))
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return err
+	}
+	return fsyncDir(dir)
+}
+
+// fsyncDir makes renaming and creating in dir durable
+func fsyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	return d.Sync()
+}
@@ -0,0 +1,175 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// maxBulkLen is the max length of a single argument, the same as proto-max-bulk-len of redis
+const maxBulkLen = 512 << 20
+
+// timestampAnnotation is written before commands when aof-timestamp-enabled, followed by unix time in milliseconds
+const timestampAnnotation = "#TS:"
+
+func makeTimestampAnnotation(ms int64) []byte {
+	return []byte(timestampAnnotation + strconv.FormatInt(ms, 10) + "\r\n")
+}
+
+// aofReader reads command lines from aof file and tracks the offset after the last complete command,
+// so that a truncated tail could be located precisely
+type aofReader struct {
+	r *bufio.Reader
+	// bytes consumed
+	pos int64
+	// offset after the last complete command
+	offset int64
+	// offset where the last command read starts
+	cmdStart int64
+	// timestamp of the latest annotation
+	timestamp int64
+	// stop before the first annotation later than until, 0 means never stop
+	until int64
+}
+
+func newAofReader(r *bufio.Reader, offset int64, until int64) *aofReader {
+	return &aofReader{
+		r:      r,
+		pos:    offset,
+		offset: offset,
+		until:  until,
+	}
+}
+
+// aofFormatError means aof file contains something which is not a command line
+type aofFormatError struct {
+	offset int64
+	msg    string
+}
+
+func (e *aofFormatError) Error() string {
+	return fmt.Sprintf("bad file format at offset %d: %s", e.offset, e.msg)
+}
+
+func (r *aofReader) formatError(msg string) error {
+	return &aofFormatError{offset: r.offset, msg: msg}
+}
+
+// aofUntilError means reader reached an annotation later than until,
+// commands before offset are all executed no later than until
+type aofUntilError struct {
+	offset    int64
+	timestamp int64
+}
+
+func (e *aofUntilError) Error() string {
+	return fmt.Sprintf("reached timestamp %d at offset %d", e.timestamp, e.offset)
+}
+
+// readAnnotation consumes an annotation line, unknown annotations are ignored
+func (r *aofReader) readAnnotation() error {
+	line, err := r.readLine()
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(line, []byte(timestampAnnotation)) {
+		ts, err := strconv.ParseInt(string(line[len(timestampAnnotation):]), 10, 64)
+		if err != nil {
+			return r.formatError("invalid timestamp annotation " + string(line))
+		}
+		if r.until > 0 && ts > r.until {
+			return &aofUntilError{offset: r.offset, timestamp: ts}
+		}
+		r.timestamp = ts
+	}
+	r.offset = r.pos
+	return nil
+}
+
+// readLine reads a line ending with CRLF, returns the line without CRLF
+func (r *aofReader) readLine() ([]byte, error) {
+	line, err := r.r.ReadBytes('\n')
+	r.pos += int64(len(line))
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, r.formatError("line should end with CRLF")
+	}
+	return line[:len(line)-2], nil
+}
+
+func (r *aofReader) readNumber(prefix byte) (int64, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return 0, err
+	}
+	if len(line) == 0 || line[0] != prefix {
+		return 0, r.formatError(fmt.Sprintf("expect '%c'", prefix))
+	}
+	n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil || n < 0 {
+		return 0, r.formatError("invalid number " + string(line[1:]))
+	}
+	return n, nil
+}
+
+// readCommand returns the next command line, annotations before it are consumed.
+// It returns io.EOF at the end of file, io.ErrUnexpectedEOF if the last command is incomplete,
+// *aofUntilError if reached until and *aofFormatError if the file is corrupted.
+func (r *aofReader) readCommand() (CmdLine, error) {
+	for {
+		b, err := r.r.Peek(1)
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '#' {
+			break
+		}
+		err = r.readAnnotation()
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.cmdStart = r.offset
+	argc, err := r.readNumber('*')
+	if err != nil {
+		return nil, err
+	}
+	if argc == 0 {
+		return nil, r.formatError("empty command")
+	}
+	cmdLine := make(CmdLine, 0, argc)
+	for i := int64(0); i < argc; i++ {
+		size, err := r.readNumber('$')
+		if err != nil {
+			return nil, err
+		}
+		if size > maxBulkLen {
+			return nil, r.formatError("bulk length out of range")
+		}
+		arg := make([]byte, size+2)
+		n, err := io.ReadFull(r.r, arg)
+		r.pos += int64(n)
+		if err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, r.formatError("argument should end with CRLF")
+		}
+		cmdLine = append(cmdLine, arg[:size])
+	}
+	r.offset = r.pos
+	return cmdLine, nil
+}
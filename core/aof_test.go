@@ -4,10 +4,14 @@ import (
 	"Tiny-Godis/lib/config"
 	"Tiny-Godis/lib/utils"
 	"Tiny-Godis/redis/reply"
+	"Tiny-Godis/redis/reply/asserts"
+	"bytes"
 	"io/ioutil"
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -20,7 +24,11 @@ func TestAof(t *testing.T) {
 	}
 	aofFilename := path.Join(tmpDir, "a.aof")
 	defer func() {
-		_ = os.Remove(aofFilename)
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
 	}()
 	config.Properties = &config.ServerProperties{
 		AppendOnly:     true,
@@ -85,7 +93,11 @@ func TestRewriteAOF(t *testing.T) {
 	}
 	aofFilename := path.Join(tmpDir, "a.aof")
 	defer func() {
-		_ = os.Remove(aofFilename)
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
 	}()
 	config.Properties = &config.ServerProperties{
 		AppendOnly:     true,
@@ -168,3 +180,805 @@ func TestRewriteAOF(t *testing.T) {
 	}
 	aofReadDB.Close()
 }
+
+func TestAofFsyncAlways(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "Tiny-Godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	aofFilename := path.Join(tmpDir, "a.aof")
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: aofFilename,
+		AppendFsync:    FsyncAlways,
+	}
+	db := MakeDB()
+	key := utils.RandString(10)
+	value := utils.RandString(10)
+	db.Exec(nil, utils.ToCmdLine("SET", key, value))
+
+	// the command must be on disk once the client got its reply
+	data, err := ioutil.ReadFile(db.aofFile.Name())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := reply.MakeMultiBulkReply(utils.ToCmdLine("SET", key, value)).ToBytes()
+	if !utils.BytesEquals(data, expected) {
+		t.Errorf("expected aof %q, actual %q", expected, data)
+	}
+
+	info := db.Exec(nil, utils.ToCmdLine("INFO", "persistence"))
+	if !strings.Contains(string(info.ToBytes()), "aof_last_write_status:ok") {
+		t.Errorf("unexpected info: %s", info.ToBytes())
+	}
+	db.Close()
+}
+
+func TestAofWriteError(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "Tiny-Godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	aofFilename := path.Join(tmpDir, "a.aof")
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: aofFilename,
+		AppendFsync:    FsyncAlways,
+	}
+	db := MakeDB()
+	// make following writes fail
+	_ = db.aofFile.Close()
+	// the command failed to write is not acknowledged
+	result := db.Exec(nil, utils.ToCmdLine("SET", "a", "a"))
+	if !strings.HasPrefix(string(result.ToBytes()), "-MISCONF") {
+		t.Errorf("expected MISCONF error, actual %s", result.ToBytes())
+	}
+	result = db.Exec(nil, utils.ToCmdLine("SET", "b", "b"))
+	if !strings.HasPrefix(string(result.ToBytes()), "-MISCONF") {
+		t.Errorf("expected MISCONF error, actual %s", result.ToBytes())
+	}
+	// read commands are still allowed
+	result = db.Exec(nil, utils.ToCmdLine("GET", "a"))
+	asserts.AssertBulkReply(t, result, "a")
+	info := db.Exec(nil, utils.ToCmdLine("INFO", "persistence"))
+	if !strings.Contains(string(info.ToBytes()), "aof_last_write_status:err") {
+		t.Errorf("unexpected info: %s", info.ToBytes())
+	}
+	db.Close()
+}
+
+func TestAofWriteWhileClosing(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "Tiny-Godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: path.Join(tmpDir, "a.aof"),
+		AppendFsync:    FsyncAlways,
+	}
+	db := MakeDB()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				db.Exec(nil, utils.ToCmdLine("SET", strconv.Itoa(i), strconv.Itoa(j)))
+			}
+		}(i)
+	}
+	db.Close()
+	// commands finished after close must not panic or block
+	wg.Wait()
+}
+
+func TestAutoRewriteAof(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "Tiny-Godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	aofFilename := path.Join(tmpDir, "a.aof")
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:               true,
+		AppendFilename:           aofFilename,
+		AppendFsync:              FsyncAlways,
+		AutoAofRewritePercentage: 100,
+		AutoAofRewriteMinSize:    1024,
+	}
+	db := MakeDB()
+	key := utils.RandString(10)
+	for i := 0; i < 100; i++ {
+		db.Exec(nil, utils.ToCmdLine("SET", key, utils.RandString(10)))
+	}
+	if !db.shouldAutoRewrite() {
+		t.Error("expect auto rewrite to be triggered")
+		return
+	}
+	db.RewriteAof()
+	if db.shouldAutoRewrite() {
+		t.Error("expect auto rewrite not to be triggered after rewrite")
+	}
+	if size := db.aofFilesSize(); size >= 1024 {
+		t.Errorf("expect aof to be rewritten, actual size %d", size)
+	}
+
+	// a rewrite request during rewriting will be scheduled
+	db.aofRewriting.Set(true)
+	result := db.Exec(nil, utils.ToCmdLine("BGREWRITEAOF"))
+	asserts.AssertStatusReply(t, result, "Background append only file rewriting scheduled")
+	info := db.Exec(nil, utils.ToCmdLine("INFO", "persistence"))
+	if !strings.Contains(string(info.ToBytes()), "aof_rewrite_scheduled:1") {
+		t.Errorf("unexpected info: %s", info.ToBytes())
+	}
+	db.aofRewriting.Set(false)
+	db.Close()
+}
+
+func TestMultiPartAof(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "Tiny-Godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
+	}()
+	aofFilename := path.Join(tmpDir, "a.aof")
+	config.Properties = &config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: aofFilename,
+		AppendDirname:  "aofdir",
+		AppendFsync:    FsyncAlways,
+	}
+	// aof written by older version will be upgraded to base file
+	legacy := reply.MakeMultiBulkReply(utils.ToCmdLine("SET", "legacy", "1")).ToBytes()
+	err = ioutil.WriteFile(aofFilename, legacy, 0600)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db := MakeDB()
+	asserts.AssertBulkReply(t, db.Exec(nil, utils.ToCmdLine("GET", "legacy")), "1")
+	aofDir := path.Join(tmpDir, "aofdir")
+	if _, err := os.Stat(path.Join(aofDir, "a.aof.1.base.aof")); err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		db.Exec(nil, utils.ToCmdLine("SET", "k"+strconv.Itoa(i), strconv.Itoa(i)))
+	}
+	db.RewriteAof()
+	db.Exec(nil, utils.ToCmdLine("SET", "after", "rewrite"))
+	db.Close()
+
+	m, err := loadManifest(aofDir, "a.aof")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if m.base == nil || m.base.fileName != "a.aof.2.base.aof" {
+		t.Errorf("unexpected base file: %s", m.encode())
+	}
+	if len(m.incrList) != 1 || m.incrList[0].fileName != "a.aof.2.incr.aof" || len(m.historyList) != 0 {
+		t.Errorf("unexpected manifest: %s", m.encode())
+	}
+	files, err := ioutil.ReadDir(aofDir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(files) != 3 {
+		t.Errorf("expect history files and temp files removed, actual %d files", len(files))
+	}
+
+	db = MakeDB()
+	asserts.AssertBulkReply(t, db.Exec(nil, utils.ToCmdLine("GET", "legacy")), "1")
+	asserts.AssertBulkReply(t, db.Exec(nil, utils.ToCmdLine("GET", "k9")), "9")
+	asserts.AssertBulkReply(t, db.Exec(nil, utils.ToCmdLine("GET", "after")), "rewrite")
+	db.Close()
+}
+
+func TestRdbPreambleAof(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "Tiny-Godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:        true,
+		AppendFilename:    path.Join(tmpDir, "a.aof"),
+		AppendFsync:       FsyncAlways,
+		AofUseRdbPreamble: true,
+	}
+	aofWriteDB := MakeDB()
+	aofWriteDB.Exec(nil, utils.ToCmdLine("SET", "str", "value", "EX", "1000"))
+	aofWriteDB.Exec(nil, utils.ToCmdLine("SET", "int", "-1024"))
+	aofWriteDB.Exec(nil, utils.ToCmdLine("RPUSH", "list", "a", "b", "c"))
+	aofWriteDB.Exec(nil, utils.ToCmdLine("HSET", "hash", "f", "v"))
+	aofWriteDB.Exec(nil, utils.ToCmdLine("SADD", "set", "a", "b"))
+	aofWriteDB.RewriteAof()
+	// commands after rewrite will be appended as resp in incr file
+	aofWriteDB.Exec(nil, utils.ToCmdLine("RPUSH", "list", "d"))
+	aofWriteDB.Close()
+
+	base := aofWriteDB.aofManifest.base
+	if base == nil || base.fileName != "a.aof.1.base.rdb" {
+		t.Errorf("unexpected manifest: %s", aofWriteDB.aofManifest.encode())
+		return
+	}
+	data, err := ioutil.ReadFile(path.Join(aofWriteDB.aofDir, base.fileName))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.HasPrefix(string(data), "REDIS0009") {
+		t.Errorf("expect rdb preamble, actual %q", data)
+	}
+
+	aofReadDB := MakeDB()
+	for _, key := range []string{"str", "int", "list", "hash"} {
+		expect, _ := aofWriteDB.GetEntity(key)
+		actual, ok := aofReadDB.GetEntity(key)
+		if !ok {
+			t.Errorf("key not found: %s", key)
+			continue
+		}
+		expectData := EntityToCmd(key, expect).ToBytes()
+		actualData := EntityToCmd(key, actual).ToBytes()
+		if !utils.BytesEquals(expectData, actualData) {
+			t.Errorf("wrong value of key: %s", key)
+		}
+	}
+	asserts.AssertMultiBulkReply(t, aofReadDB.Exec(nil, utils.ToCmdLine("LRANGE", "list", "0", "-1")),
+		[]string{"a", "b", "c", "d"})
+	// members of set are not ordered
+	asserts.AssertIntReply(t, aofReadDB.Exec(nil, utils.ToCmdLine("SCARD", "set")), 2)
+	asserts.AssertIntReply(t, aofReadDB.Exec(nil, utils.ToCmdLine("SISMEMBER", "set", "a")), 1)
+	asserts.AssertIntReply(t, aofReadDB.Exec(nil, utils.ToCmdLine("SISMEMBER", "set", "b")), 1)
+	ret := aofReadDB.Exec(nil, utils.ToCmdLine("TTL", "str"))
+	intResult, ok := ret.(*reply.IntReply)
+	if !ok || intResult.Code <= 0 {
+		t.Errorf("expect a positive ttl, actual: %s", ret.ToBytes())
+	}
+	aofReadDB.Close()
+}
+
+func TestRdbCrc64(t *testing.T) {
+	// check value from redis crc64.c
+	if crc := crc64Update(0, []byte("123456789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("wrong crc64 %x", crc)
+	}
+}
+
+func TestRdbSkipUnsupportedType(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := newRdbEncoder(buf)
+	expireAt := time.Now().Add(time.Hour)
+	if err := enc.writeEntry("unknown", &DataEntity{Data: struct{}{}}, &expireAt); err != nil {
+		t.Error(err)
+	}
+	// no expire time is left to the next entry
+	if buf.Len() != 0 {
+		t.Errorf("expect nothing written for unsupported type, actual %q", buf.Bytes())
+	}
+}
+
+func TestTruncatedAof(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "Tiny-Godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
+	}()
+	aofFilename := path.Join(tmpDir, "a.aof")
+	config.Properties = &config.ServerProperties{
+		AppendOnly:       true,
+		AppendFilename:   aofFilename,
+		AofLoadTruncated: true,
+	}
+	valid := append(reply.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "1")).ToBytes(),
+		reply.MakeMultiBulkReply(utils.ToCmdLine("SET", "b", "2")).ToBytes()...)
+	truncated := reply.MakeMultiBulkReply(utils.ToCmdLine("SET", "c", "3")).ToBytes()
+	truncated = truncated[:len(truncated)-3]
+	err = ioutil.WriteFile(aofFilename, append(valid, truncated...), 0600)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	baseName := path.Join(tmpDir, "appendonlydir", "a.aof.1.base.aof")
+	result, err := CheckAofFile(aofFilename)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !result.Truncated || result.ValidSize != int64(len(valid)) {
+		t.Errorf("expect truncated at %d, actual %d", len(valid), result.ValidSize)
+	}
+
+	db := MakeDB()
+	asserts.AssertBulkReply(t, db.Exec(nil, utils.ToCmdLine("GET", "a")), "1")
+	asserts.AssertBulkReply(t, db.Exec(nil, utils.ToCmdLine("GET", "b")), "2")
+	asserts.AssertNullBulk(t, db.Exec(nil, utils.ToCmdLine("GET", "c")))
+	db.Exec(nil, utils.ToCmdLine("SET", "d", "4"))
+	db.Close()
+	stat, err := os.Stat(baseName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if stat.Size() != int64(len(valid)) {
+		t.Errorf("expect base file truncated to %d, actual %d", len(valid), stat.Size())
+	}
+
+	db = MakeDB()
+	asserts.AssertBulkReply(t, db.Exec(nil, utils.ToCmdLine("GET", "b")), "2")
+	asserts.AssertBulkReply(t, db.Exec(nil, utils.ToCmdLine("GET", "d")), "4")
+	db.Close()
+}
+
+func TestTruncatedAofNotAllowed(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "Tiny-Godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
+	}()
+	aofFilename := path.Join(tmpDir, "a.aof")
+	config.Properties = &config.ServerProperties{
+		AppendOnly:       true,
+		AppendFilename:   aofFilename,
+		AofLoadTruncated: false,
+	}
+	data := reply.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "1")).ToBytes()
+	err = ioutil.WriteFile(aofFilename, append(data, "*3\r\n$3\r\nSE"...), 0600)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	db := MakeTmpDB()
+	db.aofDir = aofDirPath(aofFilename, "")
+	db.aofPrefix = aofPrefix(aofFilename)
+	err = db.openAof()
+	if _, ok := err.(*aofLoadError); !ok {
+		t.Errorf("expect aof load error, actual %v", err)
+	}
+}
+
+func TestCorruptedAof(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "Tiny-Godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
+	}()
+	aofFilename := path.Join(tmpDir, "a.aof")
+	config.Properties = &config.ServerProperties{
+		AppendOnly:       true,
+		AppendFilename:   aofFilename,
+		AofLoadTruncated: true,
+	}
+	valid := reply.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "1")).ToBytes()
+	corrupted := []byte("*2\r\n$3\r\nGET\r\n$5\r\nab\r\n")
+	tail := reply.MakeMultiBulkReply(utils.ToCmdLine("SET", "b", "2")).ToBytes()
+	content := append(append(append([]byte{}, valid...), corrupted...), tail...)
+	err = ioutil.WriteFile(aofFilename, content, 0600)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := CheckAofFile(aofFilename)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	formatErr, ok := result.Err.(*aofFormatError)
+	if !ok || result.Truncated {
+		t.Errorf("expect format error, actual %v", result.Err)
+		return
+	}
+	if formatErr.offset != int64(len(valid)) || result.ValidSize != int64(len(valid)) {
+		t.Errorf("expect bad record at %d, actual %d", len(valid), formatErr.offset)
+	}
+	if result.Size != int64(len(content)) {
+		t.Errorf("expect size %d, actual %d", len(content), result.Size)
+	}
+
+	// corruption is not allowed even if aof-load-truncated is enabled
+	db := MakeTmpDB()
+	db.aofDir = aofDirPath(aofFilename, "")
+	db.aofPrefix = aofPrefix(aofFilename)
+	err = db.openAof()
+	if _, ok := err.(*aofLoadError); !ok {
+		t.Errorf("expect aof load error, actual %v", err)
+	}
+
+	manifest := path.Join(db.aofDir, manifestName(db.aofPrefix))
+	results, err := CheckAof(manifest)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(results) != 1 || results[0].Valid() || !results[0].Last {
+		t.Error("expect invalid base file")
+		return
+	}
+	err = FixAofFile(results[0])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	results, err = CheckAof(manifest)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(results) != 1 || !results[0].Valid() || results[0].Size != int64(len(valid)) {
+		t.Error("expect aof fixed")
+	}
+
+	db = MakeDB()
+	asserts.AssertBulkReply(t, db.Exec(nil, utils.ToCmdLine("GET", "a")), "1")
+	asserts.AssertNullBulk(t, db.Exec(nil, utils.ToCmdLine("GET", "b")))
+	db.Close()
+}
+
+func TestAofWrongArity(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "Tiny-Godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
+	}()
+	aofFilename := path.Join(tmpDir, "a.aof")
+	config.Properties = &config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: aofFilename,
+	}
+	valid := reply.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "1")).ToBytes()
+	wrong := reply.MakeMultiBulkReply(utils.ToCmdLine("SET", "k")).ToBytes()
+	content := append(append([]byte{}, valid...), wrong...)
+	err = ioutil.WriteFile(aofFilename, content, 0600)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := CheckAofFile(aofFilename)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	formatErr, ok := result.Err.(*aofFormatError)
+	if !ok || formatErr.offset != int64(len(valid)) || result.ValidSize != int64(len(valid)) {
+		t.Errorf("expect bad record at %d, actual %v", len(valid), result.Err)
+	}
+
+	db := MakeTmpDB()
+	db.aofDir = aofDirPath(aofFilename, "")
+	db.aofPrefix = aofPrefix(aofFilename)
+	err = db.openAof()
+	if _, ok := err.(*aofLoadError); !ok {
+		t.Errorf("expect aof load error, actual %v", err)
+	}
+}
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / 1e6
+}
+
+// writeTimestampedAof writes commands with distinct timestamps across a rewrite,
+// returns time before rewrite and time between SET b and SET c
+func writeTimestampedAof(tmpDir string) (int64, int64) {
+	config.Properties = &config.ServerProperties{
+		AppendOnly:          true,
+		AppendFilename:      path.Join(tmpDir, "a.aof"),
+		AppendFsync:         FsyncAlways,
+		AofUseRdbPreamble:   true,
+		AofTimestampEnabled: true,
+	}
+	db := MakeDB()
+	db.Exec(nil, utils.ToCmdLine("SET", "a", "1"))
+	time.Sleep(5 * time.Millisecond)
+	beforeRewrite := nowMs()
+	time.Sleep(5 * time.Millisecond)
+	db.RewriteAof()
+	time.Sleep(5 * time.Millisecond)
+	db.Exec(nil, utils.ToCmdLine("SET", "b", "2"))
+	db.Exec(nil, utils.ToCmdLine("SET", "a", "3"))
+	time.Sleep(5 * time.Millisecond)
+	until := nowMs()
+	time.Sleep(5 * time.Millisecond)
+	db.Exec(nil, utils.ToCmdLine("SET", "c", "4"))
+	db.Exec(nil, utils.ToCmdLine("DEL", "a"))
+	db.Close()
+	return beforeRewrite, until
+}
+
+func TestAofLoadUntil(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "Tiny-Godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
+	}()
+	beforeRewrite, until := writeTimestampedAof(tmpDir)
+
+	// time before the latest rewrite could not be recovered
+	config.Properties.AofLoadUntil = beforeRewrite
+	db := MakeTmpDB()
+	db.aofDir = aofDirPath(config.Properties.AppendFilename, "")
+	db.aofPrefix = aofPrefix(config.Properties.AppendFilename)
+	err = db.openAof()
+	if err == nil {
+		t.Error("expect error when until is earlier than base file")
+	}
+
+	aofDir := aofDirPath(config.Properties.AppendFilename, "")
+	before := readAofDir(t, aofDir)
+	config.Properties.AofLoadUntil = until
+	db = MakeDB()
+	asserts.AssertBulkReply(t, db.Exec(nil, utils.ToCmdLine("GET", "a")), "3")
+	asserts.AssertBulkReply(t, db.Exec(nil, utils.ToCmdLine("GET", "b")), "2")
+	asserts.AssertNullBulk(t, db.Exec(nil, utils.ToCmdLine("GET", "c")))
+	db.Exec(nil, utils.ToCmdLine("SET", "d", "5"))
+	db.Close()
+
+	// aof files are left unchanged, and new commands are not persisted
+	after := readAofDir(t, aofDir)
+	if len(after) != len(before) {
+		t.Errorf("expect aof files unchanged, actual %d files before and %d after", len(before), len(after))
+	}
+	for name, data := range before {
+		if after[name] != data {
+			t.Errorf("expect %s unchanged", name)
+		}
+	}
+	config.Properties.AofLoadUntil = 0
+	db = MakeDB()
+	asserts.AssertNullBulk(t, db.Exec(nil, utils.ToCmdLine("GET", "a")))
+	asserts.AssertBulkReply(t, db.Exec(nil, utils.ToCmdLine("GET", "c")), "4")
+	asserts.AssertNullBulk(t, db.Exec(nil, utils.ToCmdLine("GET", "d")))
+	db.Close()
+}
+
+func TestAofTimestampNotBackwards(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "Tiny-Godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:          true,
+		AppendFilename:      path.Join(tmpDir, "a.aof"),
+		AppendFsync:         FsyncAlways,
+		AofTimestampEnabled: true,
+	}
+	db := MakeDB()
+	// payloads stamped by concurrent commands arrive out of order
+	send := func(ts int64) {
+		p := &aofPayload{cmdLine: makeAofCmd("SET", utils.ToCmdLine("k", "v")), timestamp: ts, done: make(chan error, 1)}
+		db.aofChan <- p
+		<-p.done
+	}
+	// checkIncr checks the incr file starts with an annotation and has none older than latest
+	checkIncr := func(latest string, older ...string) {
+		files := readAofDir(t, aofDirPath(config.Properties.AppendFilename, ""))
+		for name, content := range files {
+			if !strings.Contains(name, ".incr.") {
+				continue
+			}
+			if !strings.HasPrefix(content, timestampAnnotation) || !strings.Contains(content, latest) {
+				t.Errorf("expect annotation %s at the beginning, actual %q", latest, content)
+			}
+			for _, ts := range older {
+				if strings.Contains(content, ts) {
+					t.Errorf("expect annotations never go backwards, actual %q", content)
+				}
+			}
+		}
+	}
+	send(2000)
+	send(1000)
+	send(3000)
+	checkIncr("3000", "1000")
+	db.RewriteAof()
+	send(2500)
+	checkIncr("3000", "2500")
+	db.Close()
+}
+
+// readAofDir returns content of each file in aof dir
+func readAofDir(t *testing.T, dir string) map[string]string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string, len(infos))
+	for _, info := range infos {
+		data, err := ioutil.ReadFile(path.Join(dir, info.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[info.Name()] = string(data)
+	}
+	return files
+}
+
+func TestTruncateAofToTimestamp(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "Tiny-Godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
+	}()
+	beforeRewrite, until := writeTimestampedAof(tmpDir)
+	manifest := path.Join(aofDirPath(config.Properties.AppendFilename, ""), "a.aof.manifest")
+
+	_, err = TruncateAofToTimestamp(manifest, beforeRewrite)
+	if err == nil {
+		t.Error("expect error when until is earlier than base file")
+	}
+	results, err := TruncateAofToTimestamp(manifest, until)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	last := results[len(results)-1]
+	if !last.ReachedUntil || last.Timestamp > until {
+		t.Errorf("expect truncated at %d, actual %d", until, last.Timestamp)
+	}
+	// truncating again changes nothing
+	results, err = TruncateAofToTimestamp(manifest, until)
+	if err != nil || results[len(results)-1].ReachedUntil {
+		t.Errorf("expect aof not changed, error: %v", err)
+	}
+
+	db := MakeDB()
+	asserts.AssertBulkReply(t, db.Exec(nil, utils.ToCmdLine("GET", "a")), "3")
+	asserts.AssertBulkReply(t, db.Exec(nil, utils.ToCmdLine("GET", "b")), "2")
+	asserts.AssertNullBulk(t, db.Exec(nil, utils.ToCmdLine("GET", "c")))
+	db.Close()
+}
+
+func TestAofAbsoluteExpire(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "Tiny-Godis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: path.Join(tmpDir, "a.aof"),
+	}
+	aofWriteDB := MakeDB()
+	cmdLines := [][][]byte{
+		utils.ToCmdLine("SET", "set", "v", "EX", "100"),
+		utils.ToCmdLine("SETEX", "setex", "100", "v"),
+		utils.ToCmdLine("PSETEX", "psetex", "100000", "v"),
+		utils.ToCmdLine("SET", "getex", "v"),
+		utils.ToCmdLine("GETEX", "getex", "EX", "100"),
+		utils.ToCmdLine("RPUSH", "expire", "v"),
+		utils.ToCmdLine("EXPIRE", "expire", "100"),
+		utils.ToCmdLine("SADD", "pexpire", "v"),
+		utils.ToCmdLine("PEXPIRE", "pexpire", "100000", "NX"),
+		utils.ToCmdLine("SET", "copy", "v"),
+		utils.ToCmdLine("COPY", "set", "copy", "REPLACE"),
+		utils.ToCmdLine("SET", "deleted", "v"),
+		utils.ToCmdLine("EXPIRE", "deleted", "-1"),
+	}
+	for _, cmdLine := range cmdLines {
+		asserts.AssertNotError(t, aofWriteDB.Exec(nil, cmdLine))
+	}
+	keys := []string{"set", "setex", "psetex", "getex", "expire", "pexpire", "copy"}
+	expected := make([]int, len(keys))
+	for i, key := range keys {
+		expected[i] = int(aofWriteDB.Exec(nil, utils.ToCmdLine("PEXPIRETIME", key)).(*reply.IntReply).Code)
+	}
+	aofWriteDB.Close()
+
+	// replay later must restore the same deadline rather than restarting ttl
+	time.Sleep(20 * time.Millisecond)
+	aofReadDB := MakeDB()
+	defer aofReadDB.Close()
+	for i, key := range keys {
+		asserts.AssertIntReply(t, aofReadDB.Exec(nil, utils.ToCmdLine("PEXPIRETIME", key)), expected[i])
+	}
+	asserts.AssertIntReply(t, aofReadDB.Exec(nil, utils.ToCmdLine("EXISTS", "deleted")), 0)
+}
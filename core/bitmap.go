@@ -0,0 +1,677 @@
+package core
+
+import (
+	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/reply"
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// bits are numbered from the most significant bit of the first byte like redis
+
+var bitOffsetErrReply = reply.MakeErrReply("ERR bit offset is not an integer or out of range")
+
+// parseBitOffset parses offset of bit, "#n" means the n-th field of the given width if hash is set
+func parseBitOffset(arg []byte, hash bool, width uint) (int64, reply.ErrorReply) {
+	s := string(arg)
+	multiple := false
+	if hash && strings.HasPrefix(s, "#") {
+		multiple = true
+		s = s[1:]
+	}
+	offset, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, bitOffsetErrReply
+	}
+	if multiple {
+		offset *= int64(width)
+	}
+	if offset < 0 || offset>>3 >= maxStringLen {
+		return 0, bitOffsetErrReply
+	}
+	return offset, nil
+}
+
+func getBit(val []byte, offset int64) byte {
+	index := offset >> 3
+	if index >= int64(len(val)) {
+		return 0
+	}
+	return val[index] >> (7 - uint(offset&7)) & 1
+}
+
+// growZero extends val with zero bytes to size, the backing array grows like append so SETBIT on increasing offsets is amortized
+func growZero(val []byte, size int64) []byte {
+	if size <= int64(len(val)) {
+		return val
+	}
+	return append(val, make([]byte, size-int64(len(val)))...)
+}
+
+// popcount returns number of set bits
+func popcount(buf []byte) int64 {
+	count := 0
+	i := 0
+	for ; i+8 <= len(buf); i += 8 {
+		count += bits.OnesCount64(binary.LittleEndian.Uint64(buf[i:]))
+	}
+	for ; i < len(buf); i++ {
+		count += bits.OnesCount8(buf[i])
+	}
+	return int64(count)
+}
+
+// execSetBit sets or clears the bit at offset and returns the original bit: SETBIT key offset value.
+// The value is modified in place to grow efficiently, undoSetBit restores the original bit
+func execSetBit(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	offset, errReply := parseBitOffset(args[1], false, 1)
+	if errReply != nil {
+		return errReply
+	}
+	var bit byte
+	switch string(args[2]) {
+	case "0":
+	case "1":
+		bit = 1
+	default:
+		return reply.MakeErrReply("ERR bit is not an integer or out of range")
+	}
+
+	entity, exists := db.GetEntity(key)
+	var val []byte
+	if exists {
+		switch data := entity.Data.(type) {
+		case []byte:
+			val = data
+		case int64:
+			val = strconv.AppendInt(nil, data, 10)
+		default:
+			return &reply.WrongTypeErrReply{}
+		}
+	}
+	val = growZero(val, offset>>3+1)
+	if exists {
+		entity.Data = val
+	} else {
+		db.PutEntity(key, &DataEntity{Data: val})
+	}
+
+	index, shift := offset>>3, 7-uint(offset&7)
+	original := val[index] >> shift & 1
+	val[index] = val[index]&^(1<<shift) | bit<<shift
+	db.AddAof(makeAofCmd("SETBIT", args))
+	return reply.MakeIntReply(int64(original))
+}
+
+// execGetBit returns the bit at offset: GETBIT key offset
+func execGetBit(db *DB, args [][]byte) redis.Reply {
+	offset, errReply := parseBitOffset(args[1], false, 1)
+	if errReply != nil {
+		return errReply
+	}
+	val, errReply := db.getAsString(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	return reply.MakeIntReply(int64(getBit(val, offset)))
+}
+
+// parseBitRange converts start and end indexes of BYTE or BIT unit into an inclusive range of bits of a string in size bytes
+func parseBitRange(size int64, startArg []byte, endArg []byte, unit []byte) (int64, int64, bool, redis.Reply) {
+	isBit := false
+	if unit != nil {
+		switch strings.ToUpper(string(unit)) {
+		case "BIT":
+			isBit = true
+		case "BYTE":
+		default:
+			return 0, 0, false, &reply.SyntaxErrReply{}
+		}
+	}
+	start, err := strconv.ParseInt(string(startArg), 10, 64)
+	if err != nil {
+		return 0, 0, false, reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	total := size
+	if isBit {
+		total <<= 3
+	}
+	end := total - 1
+	if endArg != nil {
+		end, err = strconv.ParseInt(string(endArg), 10, 64)
+		if err != nil {
+			return 0, 0, false, reply.MakeErrReply("ERR value is not an integer or out of range")
+		}
+	}
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= total {
+		end = total - 1
+	}
+	if start > end {
+		return 0, 0, false, nil
+	}
+	if !isBit {
+		start, end = start<<3, end<<3+7
+	}
+	return start, end, true, nil
+}
+
+// execBitCount counts set bits: BITCOUNT key [start end [BYTE|BIT]]
+func execBitCount(db *DB, args [][]byte) redis.Reply {
+	if len(args) != 1 && len(args) != 3 && len(args) != 4 {
+		return &reply.SyntaxErrReply{}
+	}
+	val, errReply := db.getAsString(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	start, end := int64(0), int64(len(val))<<3-1
+	if len(args) > 1 {
+		var unit []byte
+		if len(args) == 4 {
+			unit = args[3]
+		}
+		var ok bool
+		var errReply redis.Reply
+		start, end, ok, errReply = parseBitRange(int64(len(val)), args[1], args[2], unit)
+		if errReply != nil {
+			return errReply
+		}
+		if !ok {
+			return reply.MakeIntReply(0)
+		}
+	}
+	if start > end {
+		return reply.MakeIntReply(0)
+	}
+	first, last := start>>3, end>>3
+	count := popcount(val[first : last+1])
+	// exclude bits of the edge bytes out of range
+	count -= int64(bits.OnesCount8(val[first] & ^(byte(0xff) >> uint(start&7))))
+	count -= int64(bits.OnesCount8(val[last] & (byte(0xff) >> uint(end&7+1))))
+	return reply.MakeIntReply(count)
+}
+
+// bitPos returns the first bit equal to bit in the inclusive range, or -1
+func bitPos(val []byte, bit byte, start int64, end int64) int64 {
+	first, last := start>>3, end>>3
+	// bytes which can't contain the bit are skipped
+	var skip byte
+	if bit == 0 {
+		skip = 0xff
+	}
+	for i := first; i <= last; i++ {
+		if i != first && i != last && val[i] == skip {
+			if i+8 < last && binary.LittleEndian.Uint64(val[i:]) == uint64(skip)*0x0101010101010101 {
+				i += 7
+			}
+			continue
+		}
+		b := val[i]
+		if bit == 0 {
+			b = ^b
+		}
+		if i == first {
+			b &= 0xff >> uint(start&7)
+		}
+		if i == last {
+			b &= ^(byte(0xff) >> uint(end&7+1))
+		}
+		if b != 0 {
+			return i<<3 + int64(bits.LeadingZeros8(b))
+		}
+	}
+	return -1
+}
+
+// execBitPos returns position of the first bit set or clear: BITPOS key bit [start [end [BYTE|BIT]]]
+func execBitPos(db *DB, args [][]byte) redis.Reply {
+	if len(args) > 5 {
+		return &reply.SyntaxErrReply{}
+	}
+	var bit byte
+	switch string(args[1]) {
+	case "0":
+	case "1":
+		bit = 1
+	default:
+		return reply.MakeErrReply("ERR The bit argument must be 1 or 0.")
+	}
+	val, errReply := db.getAsString(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if val == nil {
+		// a missing key is taken as infinite zero bits
+		if bit == 1 {
+			return reply.MakeIntReply(-1)
+		}
+		return reply.MakeIntReply(0)
+	}
+	start, end := int64(0), int64(len(val))<<3-1
+	endGiven := len(args) >= 4
+	if len(args) > 2 {
+		var endArg, unit []byte
+		if len(args) >= 4 {
+			endArg = args[3]
+		}
+		if len(args) == 5 {
+			unit = args[4]
+		}
+		var ok bool
+		var errReply redis.Reply
+		start, end, ok, errReply = parseBitRange(int64(len(val)), args[2], endArg, unit)
+		if errReply != nil {
+			return errReply
+		}
+		if !ok {
+			return reply.MakeIntReply(-1)
+		}
+	}
+	if start > end {
+		return reply.MakeIntReply(-1)
+	}
+	pos := bitPos(val, bit, start, end)
+	if pos < 0 && bit == 0 && !endGiven {
+		// the string is taken as padded with zero bits on the right if the end is not given
+		pos = end + 1
+	}
+	return reply.MakeIntReply(pos)
+}
+
+// execBitOp performs bitwise operation between strings and stores the result: BITOP AND|OR|XOR|NOT destkey key [key ...]
+func execBitOp(db *DB, args [][]byte) redis.Reply {
+	op := strings.ToUpper(string(args[0]))
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(args) != 3 {
+			return reply.MakeErrReply("ERR BITOP NOT must be called with a single source key.")
+		}
+	default:
+		return &reply.SyntaxErrReply{}
+	}
+	dest := string(args[1])
+	sources := make([][]byte, len(args)-2)
+	size := 0
+	for i, arg := range args[2:] {
+		val, errReply := db.getAsString(string(arg))
+		if errReply != nil {
+			return errReply
+		}
+		sources[i] = val
+		if len(val) > size {
+			size = len(val)
+		}
+	}
+
+	result := make([]byte, size)
+	for i := range result {
+		// missing bytes of shorter strings are taken as zero
+		var b byte
+		if i < len(sources[0]) {
+			b = sources[0][i]
+		}
+		for _, src := range sources[1:] {
+			var c byte
+			if i < len(src) {
+				c = src[i]
+			}
+			switch op {
+			case "AND":
+				b &= c
+			case "OR":
+				b |= c
+			case "XOR":
+				b ^= c
+			}
+		}
+		if op == "NOT" {
+			b = ^b
+		}
+		result[i] = b
+	}
+	if size == 0 {
+		db.Remove(dest)
+	} else {
+		db.PutEntity(dest, &DataEntity{Data: result})
+	}
+	db.AddAof(makeAofCmd("BITOP", args))
+	return reply.MakeIntReply(int64(size))
+}
+
+/* ---- BITFIELD ---- */
+
+const (
+	bitfieldGet = iota
+	bitfieldSet
+	bitfieldIncrBy
+)
+
+const (
+	overflowWrap = iota
+	overflowSat
+	overflowFail
+)
+
+type bitfieldOp struct {
+	kind     int
+	signed   bool
+	width    uint
+	offset   int64
+	value    int64
+	overflow int
+}
+
+// parseBitfieldType parses types like i16 or u8, u64 is not supported since results are signed 64 bits integers
+func parseBitfieldType(arg []byte) (bool, uint, reply.ErrorReply) {
+	s := string(arg)
+	errReply := reply.MakeErrReply("ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	if len(s) < 2 || (s[0] != 'i' && s[0] != 'u') {
+		return false, 0, errReply
+	}
+	signed := s[0] == 'i'
+	width, err := strconv.ParseInt(s[1:], 10, 64)
+	if err != nil || width < 1 || (signed && width > 64) || (!signed && width > 63) {
+		return false, 0, errReply
+	}
+	return signed, uint(width), nil
+}
+
+// parseBitfield parses BITFIELD key [GET type offset] [SET type offset value] [INCRBY type offset increment] [OVERFLOW WRAP|SAT|FAIL] ...
+func parseBitfield(args [][]byte, readOnly bool) ([]*bitfieldOp, redis.Reply) {
+	var ops []*bitfieldOp
+	overflow := overflowWrap
+	for i := 1; i < len(args); i++ {
+		subCmd := strings.ToUpper(string(args[i]))
+		left := len(args) - i - 1
+		switch {
+		case subCmd == "OVERFLOW" && left >= 1:
+			switch strings.ToUpper(string(args[i+1])) {
+			case "WRAP":
+				overflow = overflowWrap
+			case "SAT":
+				overflow = overflowSat
+			case "FAIL":
+				overflow = overflowFail
+			default:
+				return nil, reply.MakeErrReply("ERR Invalid OVERFLOW type specified")
+			}
+			i++
+			continue
+		case subCmd == "GET" && left >= 2:
+		case (subCmd == "SET" || subCmd == "INCRBY") && left >= 3:
+			if readOnly {
+				return nil, reply.MakeErrReply("ERR BITFIELD_RO only supports the GET subcommand")
+			}
+		default:
+			return nil, &reply.SyntaxErrReply{}
+		}
+		op := &bitfieldOp{overflow: overflow}
+		var errReply reply.ErrorReply
+		op.signed, op.width, errReply = parseBitfieldType(args[i+1])
+		if errReply != nil {
+			return nil, errReply
+		}
+		op.offset, errReply = parseBitOffset(args[i+2], true, op.width)
+		if errReply != nil {
+			return nil, errReply
+		}
+		i += 2
+		if subCmd == "GET" {
+			op.kind = bitfieldGet
+		} else {
+			op.kind = bitfieldSet
+			if subCmd == "INCRBY" {
+				op.kind = bitfieldIncrBy
+			}
+			value, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return nil, reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			op.value = value
+			i++
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func getUnsignedBitfield(val []byte, offset int64, width uint) uint64 {
+	var result uint64
+	for i := int64(0); i < int64(width); i++ {
+		result = result<<1 | uint64(getBit(val, offset+i))
+	}
+	return result
+}
+
+func getSignedBitfield(val []byte, offset int64, width uint) int64 {
+	result := getUnsignedBitfield(val, offset, width)
+	// extend sign bit
+	if width < 64 && result&(1<<(width-1)) != 0 {
+		result |= math.MaxUint64 << width
+	}
+	return int64(result)
+}
+
+func setBitfield(val []byte, offset int64, width uint, value uint64) {
+	for i := int64(0); i < int64(width); i++ {
+		bit := byte(value >> (width - 1 - uint(i)) & 1)
+		index, shift := (offset+i)>>3, 7-uint((offset+i)&7)
+		val[index] = val[index]&^(1<<shift) | bit<<shift
+	}
+}
+
+// signedOverflow returns -1, 0 or 1 for underflow, no overflow and overflow of value+incr,
+// and the value to store according to overflow mode
+func signedOverflow(value int64, incr int64, width uint, overflow int) (int, int64) {
+	max := int64(math.MaxInt64)
+	if width < 64 {
+		max = 1<<(width-1) - 1
+	}
+	min := -max - 1
+	var result int
+	switch {
+	case value > max || (incr > 0 && value > max-incr):
+		result = 1
+	case value < min || (incr < 0 && value < min-incr):
+		result = -1
+	default:
+		return 0, value + incr
+	}
+	switch overflow {
+	case overflowSat:
+		if result > 0 {
+			return result, max
+		}
+		return result, min
+	case overflowWrap:
+		sum := uint64(value) + uint64(incr)
+		if width < 64 {
+			mask := uint64(math.MaxUint64) << width
+			if sum&(1<<(width-1)) != 0 {
+				sum |= mask
+			} else {
+				sum &^= mask
+			}
+		}
+		return result, int64(sum)
+	}
+	return result, 0
+}
+
+// unsignedOverflow is signedOverflow of unsigned fields
+func unsignedOverflow(value uint64, incr int64, width uint, overflow int) (int, uint64) {
+	max := uint64(1)<<width - 1
+	var result int
+	switch {
+	case value > max || (incr > 0 && uint64(incr) > max-value):
+		result = 1
+	case incr < 0 && uint64(-incr) > value:
+		result = -1
+	default:
+		return 0, value + uint64(incr)
+	}
+	switch overflow {
+	case overflowSat:
+		if result > 0 {
+			return result, max
+		}
+		return result, 0
+	case overflowWrap:
+		return result, (value + uint64(incr)) & max
+	}
+	return result, 0
+}
+
+func execBitfieldGeneric(db *DB, args [][]byte, readOnly bool) redis.Reply {
+	ops, errReply := parseBitfield(args, readOnly)
+	if errReply != nil {
+		return errReply
+	}
+	key := string(args[0])
+	val, errReply := db.getAsString(key)
+	if errReply != nil {
+		return errReply
+	}
+	// the string is grown to contain the highest field to write
+	size := int64(len(val))
+	for _, op := range ops {
+		if end := (op.offset + int64(op.width) - 1) >> 3; op.kind != bitfieldGet && end+1 > size {
+			size = end + 1
+		}
+	}
+	written := size > int64(len(val))
+	if written || hasBitfieldWrite(ops) {
+		// modified on a copy, since replies or undo logs may still refer to the value
+		grown := make([]byte, size)
+		copy(grown, val)
+		val = grown
+	}
+
+	replies := make([]redis.Reply, len(ops))
+	for i, op := range ops {
+		var old, stored, retVal int64
+		var overflow int
+		if op.signed {
+			old = getSignedBitfield(val, op.offset, op.width)
+			if op.kind == bitfieldIncrBy {
+				overflow, stored = signedOverflow(old, op.value, op.width, op.overflow)
+				retVal = stored
+			} else {
+				overflow, stored = signedOverflow(op.value, 0, op.width, op.overflow)
+				retVal = old
+			}
+		} else {
+			oldU := getUnsignedBitfield(val, op.offset, op.width)
+			old = int64(oldU)
+			var storedU uint64
+			if op.kind == bitfieldIncrBy {
+				overflow, storedU = unsignedOverflow(oldU, op.value, op.width, op.overflow)
+				retVal = int64(storedU)
+			} else {
+				overflow, storedU = unsignedOverflow(uint64(op.value), 0, op.width, op.overflow)
+				retVal = old
+			}
+			stored = int64(storedU)
+		}
+		if op.kind == bitfieldGet {
+			replies[i] = reply.MakeIntReply(old)
+			continue
+		}
+		if overflow != 0 && op.overflow == overflowFail {
+			replies[i] = &reply.NullBulkReply{}
+			continue
+		}
+		setBitfield(val, op.offset, op.width, uint64(stored))
+		written = true
+		replies[i] = reply.MakeIntReply(retVal)
+	}
+	if written {
+		db.PutEntity(key, &DataEntity{Data: val})
+		db.AddAof(makeAofCmd("BITFIELD", args))
+	}
+	return reply.MakeMultiRawReply(replies)
+}
+
+func hasBitfieldWrite(ops []*bitfieldOp) bool {
+	for _, op := range ops {
+		if op.kind != bitfieldGet {
+			return true
+		}
+	}
+	return false
+}
+
+// execBitfield treats string as an array of integers: BITFIELD key [GET type offset] [SET type offset value] [INCRBY type offset increment] [OVERFLOW WRAP|SAT|FAIL] ...
+func execBitfield(db *DB, args [][]byte) redis.Reply {
+	return execBitfieldGeneric(db, args, false)
+}
+
+// execBitfieldRO is BITFIELD supporting GET only: BITFIELD_RO key [GET type offset ...]
+func execBitfieldRO(db *DB, args [][]byte) redis.Reply {
+	return execBitfieldGeneric(db, args, true)
+}
+
+// prepareBitfield locks key for writing if there is any SET or INCRBY
+func prepareBitfield(args [][]byte) ([]string, []string) {
+	for _, arg := range args[1:] {
+		subCmd := strings.ToUpper(string(arg))
+		if subCmd == "SET" || subCmd == "INCRBY" {
+			return writeFirstKey(args)
+		}
+	}
+	return readFirstKey(args)
+}
+
+// undoSetBit restores the original bit, or the whole value if SETBIT creates or grows it
+func undoSetBit(db *DB, args [][]byte) []CmdLine {
+	key := string(args[0])
+	offset, errReply := parseBitOffset(args[1], false, 1)
+	if errReply != nil {
+		return nil
+	}
+	val, errReply := db.getAsString(key)
+	if errReply != nil {
+		return nil
+	}
+	if offset>>3 >= int64(len(val)) {
+		return rollbackFirstKey(db, args)
+	}
+	return []CmdLine{utils.ToCmdLine("SETBIT", key, string(args[1]), strconv.Itoa(int(getBit(val, offset))))}
+}
+
+func prepareBitOp(args [][]byte) ([]string, []string) {
+	_, sources := readAllKeys(args[2:])
+	return []string{string(args[1])}, sources
+}
+
+func undoBitOp(db *DB, args [][]byte) []CmdLine {
+	return rollbackGivenKeys(db, string(args[1]))
+}
+
+func init() {
+	RegisterCommand("SetBit", execSetBit, writeFirstKey, undoSetBit, 4)
+	RegisterCommand("GetBit", execGetBit, readFirstKey, nil, 3)
+	RegisterCommand("BitCount", execBitCount, readFirstKey, nil, -2)
+	RegisterCommand("BitPos", execBitPos, readFirstKey, nil, -3)
+	RegisterCommand("BitOp", execBitOp, prepareBitOp, undoBitOp, -4)
+	RegisterCommand("Bitfield", execBitfield, prepareBitfield, rollbackFirstKey, -2)
+	RegisterCommand("Bitfield_RO", execBitfieldRO, readFirstKey, nil, -2)
+}
@@ -0,0 +1,199 @@
+package core
+
+import (
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/reply"
+	"Tiny-Godis/redis/reply/asserts"
+	"strconv"
+	"testing"
+)
+
+func TestSetBit(t *testing.T) {
+	testDB.Flush()
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("SETBIT", "bits", "7", "1")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("SETBIT", "bits", "7", "1")), 1)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", "bits")), "\x01")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("SETBIT", "bits", "25", "1")), 0)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", "bits")), "\x01\x00\x00\x40")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("SETBIT", "bits", "7", "0")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("GETBIT", "bits", "7")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("GETBIT", "bits", "25")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("GETBIT", "bits", "1000")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("GETBIT", "none", "0")), 0)
+
+	// grown bytes are zero even if they are reused from the backing array
+	for i := 0; i < 1000; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("SETBIT", "grow", "0", "1"))
+	}
+	testDB.Exec(nil, utils.ToCmdLine("SET", "grow", "a"))
+	testDB.Exec(nil, utils.ToCmdLine("SETBIT", "grow", "23", "1"))
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", "grow")), "a\x00\x01")
+
+	// integer encoded value
+	testDB.Exec(nil, utils.ToCmdLine("SET", "int", "1"))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("SETBIT", "int", "6", "1")), 0)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", "int")), "3")
+
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("SETBIT", "bits", "-1", "1")), "ERR bit offset is not an integer or out of range")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("SETBIT", "bits", "4294967296", "1")), "ERR bit offset is not an integer or out of range")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("SETBIT", "bits", "0", "2")), "ERR bit is not an integer or out of range")
+	testDB.Exec(nil, utils.ToCmdLine("RPUSH", "list", "a"))
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("SETBIT", "list", "0", "1")), "WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestUndoSetBit(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("SET", "bits", "a"))
+	testDB.Exec(nil, utils.ToCmdLine("EXPIRE", "bits", "1000"))
+	for _, cmdLine := range [][][]byte{
+		utils.ToCmdLine("SETBIT", "bits", "0", "1"),
+		utils.ToCmdLine("SETBIT", "bits", "7", "0"),
+		utils.ToCmdLine("SETBIT", "bits", "100", "1"),
+		utils.ToCmdLine("SETBIT", "none", "1", "1"),
+	} {
+		key := string(cmdLine[1])
+		before := testDB.Exec(nil, utils.ToCmdLine("GET", key)).ToBytes()
+		undoCmdLines := testDB.GetUndoLog(cmdLine)
+		testDB.Exec(nil, cmdLine)
+		for _, undo := range undoCmdLines {
+			testDB.Exec(nil, undo)
+		}
+		asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXISTS", key)), map[bool]int{true: 1}[key == "bits"])
+		if after := testDB.Exec(nil, utils.ToCmdLine("GET", key)).ToBytes(); string(after) != string(before) {
+			t.Errorf("%s: expect %q after undo, actual %q", cmdLine, before, after)
+		}
+	}
+	if ttl := testDB.Exec(nil, utils.ToCmdLine("TTL", "bits")).(*reply.IntReply).Code; ttl <= 0 {
+		t.Error("expect ttl kept")
+	}
+}
+
+func TestBitCount(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("SET", "str", "foobar"))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITCOUNT", "str")), 26)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITCOUNT", "str", "0", "0")), 4)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITCOUNT", "str", "1", "1")), 6)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITCOUNT", "str", "1", "1", "BYTE")), 6)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITCOUNT", "str", "5", "30", "BIT")), 17)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITCOUNT", "str", "-2", "-1")), 7)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITCOUNT", "str", "-1", "-2")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITCOUNT", "str", "0", "100")), 26)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITCOUNT", "none")), 0)
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("BITCOUNT", "str", "0")), "Err syntax error")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("BITCOUNT", "str", "0", "1", "WORD")), "Err syntax error")
+
+	// compare with counting bit by bit
+	long := make([]byte, 1000)
+	for i := range long {
+		long[i] = byte(i * 7)
+	}
+	testDB.Exec(nil, [][]byte{[]byte("SET"), []byte("long"), long})
+	for _, r := range [][2]int{{0, 7999}, {3, 5000}, {13, 13}, {100, 107}, {8, 7}} {
+		expected := 0
+		for i := r[0]; i <= r[1]; i++ {
+			expected += int(getBit(long, int64(i)))
+		}
+		asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITCOUNT", "long", strconv.Itoa(r[0]), strconv.Itoa(r[1]), "BIT")), expected)
+	}
+}
+
+func TestBitPos(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, [][]byte{[]byte("SET"), []byte("str"), {0xff, 0xf0, 0x00}})
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITPOS", "str", "0")), 12)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITPOS", "str", "1")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITPOS", "str", "1", "2")), -1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITPOS", "str", "1", "1")), 8)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITPOS", "str", "1", "2", "-1", "BYTE")), -1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITPOS", "str", "1", "7", "15", "BIT")), 7)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITPOS", "str", "0", "7", "15", "BIT")), 12)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITPOS", "str", "1", "12", "-1", "BIT")), -1)
+
+	testDB.Exec(nil, [][]byte{[]byte("SET"), []byte("ones"), {0xff, 0xff, 0xff}})
+	// zero bits are padded on the right unless the end is given
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITPOS", "ones", "0")), 24)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITPOS", "ones", "0", "1")), 24)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITPOS", "ones", "0", "0", "-1")), -1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITPOS", "none", "0")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITPOS", "none", "1")), -1)
+
+	// long strings are scanned by words
+	long := make([]byte, 100)
+	long[90] = 0x10
+	testDB.Exec(nil, [][]byte{[]byte("SET"), []byte("long"), long})
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITPOS", "long", "1")), 90*8+3)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITPOS", "long", "1", "1", "89")), -1)
+
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("BITPOS", "str", "2")), "ERR The bit argument must be 1 or 0.")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("BITPOS", "str", "1", "0", "1", "BIT", "x")), "Err syntax error")
+}
+
+func TestBitOp(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("SET", "a", "foobar"))
+	testDB.Exec(nil, utils.ToCmdLine("SET", "b", "abc"))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITOP", "AND", "dst", "a", "b")), 6)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", "dst")), "`bc\x00\x00\x00")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITOP", "OR", "dst", "a", "b", "none")), 6)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", "dst")), "goobar")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITOP", "XOR", "dst", "a", "b")), 6)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", "dst")), "\x07\x0d\x0cbar")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITOP", "NOT", "dst", "b")), 3)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", "dst")), "\x9e\x9d\x9c")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("BITOP", "AND", "dst", "none")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXISTS", "dst")), 0)
+
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("BITOP", "NOT", "dst", "a", "b")), "ERR BITOP NOT must be called with a single source key.")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("BITOP", "NAND", "dst", "a")), "Err syntax error")
+}
+
+func TestBitfield(t *testing.T) {
+	testDB.Flush()
+	result := testDB.Exec(nil, utils.ToCmdLine("BITFIELD", "bf", "INCRBY", "i5", "100", "1", "GET", "u4", "0"))
+	assertRawReply(t, result, "*2\r\n:1\r\n:0\r\n")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("STRLEN", "bf")), 14)
+
+	testDB.Flush()
+	result = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", "bf", "SET", "u8", "#1", "255", "GET", "u8", "8", "GET", "i8", "8", "SET", "i16", "#0", "-2"))
+	assertRawReply(t, result, "*4\r\n:0\r\n:255\r\n:-1\r\n:255\r\n")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", "bf")), "\xff\xfe")
+
+	// overflow
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("BITFIELD", "bf", "SET", "u2", "0", "3"))
+	result = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", "bf",
+		"INCRBY", "u2", "0", "1", "OVERFLOW", "SAT", "INCRBY", "u2", "0", "5", "OVERFLOW", "FAIL", "INCRBY", "u2", "0", "1", "GET", "u2", "0"))
+	assertRawReply(t, result, "*4\r\n:0\r\n:3\r\n$-1\r\n:3\r\n")
+	result = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", "bf",
+		"SET", "i8", "8", "127", "INCRBY", "i8", "8", "1", "OVERFLOW", "SAT", "INCRBY", "i8", "8", "-200", "INCRBY", "i8", "8", "300",
+		"OVERFLOW", "FAIL", "SET", "i8", "8", "128", "SET", "u8", "8", "-1", "OVERFLOW", "WRAP", "SET", "u8", "8", "256"))
+	assertRawReply(t, result, "*7\r\n:0\r\n:-128\r\n:-128\r\n:127\r\n$-1\r\n$-1\r\n:127\r\n")
+	result = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", "big",
+		"SET", "i64", "0", "9223372036854775807", "INCRBY", "i64", "0", "1", "OVERFLOW", "SAT", "INCRBY", "i64", "0", "-1", "INCRBY", "i64", "0", "-9223372036854775807",
+		"SET", "u63", "0", "-1", "OVERFLOW", "WRAP", "INCRBY", "u63", "0", "1"))
+	assertRawReply(t, result, "*6\r\n:0\r\n:-9223372036854775808\r\n:-9223372036854775808\r\n:-9223372036854775808\r\n:4611686018427387904\r\n:0\r\n")
+
+	// a missing key is not created by GET
+	result = testDB.Exec(nil, utils.ToCmdLine("BITFIELD_RO", "none", "GET", "u8", "0"))
+	assertRawReply(t, result, "*1\r\n:0\r\n")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXISTS", "none")), 0)
+
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("BITFIELD_RO", "bf", "SET", "u8", "0", "1")), "ERR BITFIELD_RO only supports the GET subcommand")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("BITFIELD", "bf", "GET", "u64", "0")), "ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("BITFIELD", "bf", "GET", "i8", "-1")), "ERR bit offset is not an integer or out of range")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("BITFIELD", "bf", "OVERFLOW", "NONE")), "ERR Invalid OVERFLOW type specified")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("BITFIELD", "bf", "SET", "i8", "0", "x")), "ERR value is not an integer or out of range")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("BITFIELD", "bf", "GET", "i8")), "Err syntax error")
+}
+
+func TestBitfieldPrepare(t *testing.T) {
+	writeKeys, readKeys := prepareBitfield(utils.ToCmdLine("bf", "GET", "u8", "0", "incrby", "u8", "0", "1"))
+	if len(writeKeys) != 1 || len(readKeys) != 0 {
+		t.Error("expect key locked for writing")
+	}
+	writeKeys, readKeys = prepareBitfield(utils.ToCmdLine("bf", "GET", "u8", "0"))
+	if len(writeKeys) != 0 || len(readKeys) != 1 {
+		t.Error("expect key locked for reading")
+	}
+}
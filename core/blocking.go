@@ -0,0 +1,337 @@
+package core
+
+import (
+	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/redis/reply"
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blockedClient is a client waiting for elements of list keys
+type blockedClient struct {
+	id   int64
+	keys []string
+	// elements of the client in waiting queues, in the same order as keys
+	elements []*list.Element
+	// wakeup receives a signal when one of keys may have elements
+	wakeup chan struct{}
+	// unblocked is closed by CLIENT UNBLOCK or closing connection
+	unblocked chan struct{}
+	// unblockErr means the client should receive an error rather than a null reply
+	unblockErr bool
+}
+
+// blockingKeys is the registry of clients blocked by BLPOP and so on.
+// Clients waiting for the same key are woken in FIFO order
+type blockingKeys struct {
+	mu      sync.Mutex
+	queues  map[string]*list.List
+	clients map[int64]*blockedClient
+}
+
+func makeBlockingKeys() *blockingKeys {
+	return &blockingKeys{
+		queues:  make(map[string]*list.List),
+		clients: make(map[int64]*blockedClient),
+	}
+}
+
+// block appends the client to the waiting queues of keys, returns nil if the connection has been closed
+func (bk *blockingKeys) block(conn redis.Connection, keys []string) *blockedClient {
+	client := &blockedClient{
+		id:        conn.ID(),
+		wakeup:    make(chan struct{}, 1),
+		unblocked: make(chan struct{}),
+	}
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+	if conn.IsClosed() {
+		// closeClient has already tried to unblock it, nobody would remove the client later
+		return nil
+	}
+	for _, key := range keys {
+		queue, ok := bk.queues[key]
+		if !ok {
+			queue = list.New()
+			bk.queues[key] = queue
+		}
+		client.keys = append(client.keys, key)
+		client.elements = append(client.elements, queue.PushBack(client))
+	}
+	bk.clients[client.id] = client
+	return client
+}
+
+// remove deletes the client from waiting queues, then the next client of each key is woken
+// since the key may still have elements the removed client did not consume
+func (bk *blockingKeys) remove(client *blockedClient) {
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+	for i, key := range client.keys {
+		queue := bk.queues[key]
+		queue.Remove(client.elements[i])
+		if queue.Len() == 0 {
+			delete(bk.queues, key)
+			continue
+		}
+		bk.notify(queue)
+	}
+	if bk.clients[client.id] == client {
+		delete(bk.clients, client.id)
+	}
+}
+
+// signal wakes the earliest client blocked by key
+func (bk *blockingKeys) signal(key string) {
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+	queue, ok := bk.queues[key]
+	if !ok {
+		return
+	}
+	bk.notify(queue)
+}
+
+func (bk *blockingKeys) notify(queue *list.List) {
+	client := queue.Front().Value.(*blockedClient)
+	select {
+	case client.wakeup <- struct{}{}:
+	default:
+		// client has a pending signal
+	}
+}
+
+// unblock stops waiting of the client with given id, returns false if the client is not blocked
+func (bk *blockingKeys) unblock(id int64, withErr bool) bool {
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+	return bk.unblockLocked(id, withErr)
+}
+
+// unblockClosed marks the connection closed and stops its waiting,
+// both under mu so that block could not register it afterwards
+func (bk *blockingKeys) unblockClosed(conn redis.Connection) {
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+	conn.MarkClosed()
+	bk.unblockLocked(conn.ID(), false)
+}
+
+func (bk *blockingKeys) unblockLocked(id int64, withErr bool) bool {
+	client, ok := bk.clients[id]
+	if !ok {
+		return false
+	}
+	delete(bk.clients, id)
+	client.unblockErr = withErr
+	close(client.unblocked)
+	return true
+}
+
+// signalBlocked is called after elements pushed into key
+func (db *DB) signalBlocked(key string) {
+	if db.blocking == nil {
+		return
+	}
+	db.blocking.signal(key)
+}
+
+var blockingCmds = map[string]struct{}{
+	"blpop":      {},
+	"brpop":      {},
+	"blmove":     {},
+	"brpoplpush": {},
+	"xread":      {},
+	"xreadgroup": {},
+}
+
+func isBlockingCmd(cmdName string) bool {
+	_, ok := blockingCmds[cmdName]
+	return ok
+}
+
+// parseBlockingTimeout parses timeout in seconds, 0 means blocking forever
+func parseBlockingTimeout(arg []byte) (time.Duration, redis.Reply) {
+	seconds, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil {
+		return 0, reply.MakeErrReply("ERR timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return 0, reply.MakeErrReply("ERR timeout is negative")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// blockingKeysOf returns keys to wait for of a blocking command, only source keys are waited
+func blockingKeysOf(cmdName string, args [][]byte) []string {
+	if cmdName == "blmove" || cmdName == "brpoplpush" {
+		return []string{string(args[0])}
+	}
+	keys := make([]string, 0, len(args)-1)
+	seen := make(map[string]struct{})
+	for _, arg := range args[:len(args)-1] {
+		key := string(arg)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func isNullReply(r redis.Reply) bool {
+	switch r.(type) {
+	case *reply.NullBulkReply, *reply.NullMultiBulkReply:
+		return true
+	}
+	return false
+}
+
+// execBlockingCmd executes the command repeatedly until it gets an element, timed out or unblocked.
+// Executors of blocking commands never block, so they behave as non-blocking inside MULTI
+func (db *DB) execBlockingCmd(conn redis.Connection, cmdLine CmdLine) redis.Reply {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	cmd := cmdTable[cmdName]
+	if !validateArity(cmd.arity, cmdLine) {
+		return reply.MakeArgNumErrReply(cmdName)
+	}
+	var keys []string
+	var timeout time.Duration
+	if cmdName == "xread" || cmdName == "xreadgroup" {
+		var block bool
+		var errReply redis.Reply
+		cmdLine, keys, timeout, block, errReply = db.prepareStreamBlocking(cmdLine)
+		if errReply != nil {
+			return errReply
+		}
+		if !block {
+			return db.execNormalCmd(cmdLine)
+		}
+	} else {
+		var errReply redis.Reply
+		timeout, errReply = parseBlockingTimeout(cmdLine[len(cmdLine)-1])
+		if errReply != nil {
+			return errReply
+		}
+		keys = blockingKeysOf(cmdName, cmdLine[1:])
+	}
+
+	// register before the first try, so that no push could be missed
+	client := db.blocking.block(conn, keys)
+	if client == nil {
+		return reply.MakeNullMultiBulkReply()
+	}
+	defer db.blocking.remove(client)
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for {
+		result := db.execNormalCmd(cmdLine)
+		if !isNullReply(result) {
+			return result
+		}
+		select {
+		case <-client.wakeup:
+		case <-deadline:
+			return result
+		case <-client.unblocked:
+			if client.unblockErr {
+				return reply.MakeErrReply("UNBLOCKED client unblocked via CLIENT UNBLOCK")
+			}
+			return result
+		}
+	}
+}
+
+// execBPop pops from the first non-empty list of keys, returns null if all lists are empty
+func execBPop(db *DB, args [][]byte, left bool) redis.Reply {
+	if _, errReply := parseBlockingTimeout(args[len(args)-1]); errReply != nil {
+		return errReply
+	}
+	for _, arg := range args[:len(args)-1] {
+		key := string(arg)
+		ll, errReply := db.getAsList(key)
+		if errReply != nil {
+			return errReply
+		}
+		if ll == nil {
+			continue
+		}
+		result := execPop(db, [][]byte{arg}, left)
+		if bulk, ok := result.(*reply.BulkReply); ok {
+			return reply.MakeMultiBulkReply([][]byte{arg, bulk.Arg})
+		}
+		return result
+	}
+	return reply.MakeNullMultiBulkReply()
+}
+
+func execBLPop(db *DB, args [][]byte) redis.Reply {
+	return execBPop(db, args, true)
+}
+
+func execBRPop(db *DB, args [][]byte) redis.Reply {
+	return execBPop(db, args, false)
+}
+
+func execBLMove(db *DB, args [][]byte) redis.Reply {
+	if _, errReply := parseBlockingTimeout(args[4]); errReply != nil {
+		return errReply
+	}
+	return execLMove(db, args[:4])
+}
+
+func execBRPopLPush(db *DB, args [][]byte) redis.Reply {
+	if _, errReply := parseBlockingTimeout(args[2]); errReply != nil {
+		return errReply
+	}
+	return execRPopLPush(db, args[:2])
+}
+
+func prepareBPop(args [][]byte) ([]string, []string) {
+	return writeAllKeys(args[:len(args)-1])
+}
+
+// undoBPop restores the list which would be popped
+func undoBPop(db *DB, args [][]byte, left bool) []CmdLine {
+	for _, arg := range args[:len(args)-1] {
+		ll, errReply := db.getAsList(string(arg))
+		if errReply != nil {
+			return nil
+		}
+		if ll != nil {
+			return undoPop(db, [][]byte{arg}, left)
+		}
+	}
+	return nil
+}
+
+func undoBLPop(db *DB, args [][]byte) []CmdLine {
+	return undoBPop(db, args, true)
+}
+
+func undoBRPop(db *DB, args [][]byte) []CmdLine {
+	return undoBPop(db, args, false)
+}
+
+func undoBLMove(db *DB, args [][]byte) []CmdLine {
+	return undoLMove(db, args[:4])
+}
+
+func undoBRPopLPush(db *DB, args [][]byte) []CmdLine {
+	return undoRPopLPush(db, args[:2])
+}
+
+func init() {
+	RegisterCommand("BLPop", execBLPop, prepareBPop, undoBLPop, -3)
+	RegisterCommand("BRPop", execBRPop, prepareBPop, undoBRPop, -3)
+	RegisterCommand("BLMove", execBLMove, prepareRPopLPush, undoBLMove, 6)
+	RegisterCommand("BRPopLPush", execBRPopLPush, prepareRPopLPush, undoBRPopLPush, 4)
+}
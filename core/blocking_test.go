@@ -0,0 +1,185 @@
+package core
+
+import (
+	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/connection"
+	"Tiny-Godis/redis/reply"
+	"Tiny-Godis/redis/reply/asserts"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// execAsync executes command in another goroutine and waits until the client is blocked
+func execAsync(t *testing.T, db *DB, conn redis.Connection, cmdLine CmdLine) <-chan redis.Reply {
+	ch := make(chan redis.Reply, 1)
+	go func() {
+		ch <- db.Exec(conn, cmdLine)
+	}()
+	for i := 0; i < 100; i++ {
+		db.blocking.mu.Lock()
+		_, blocked := db.blocking.clients[conn.ID()]
+		db.blocking.mu.Unlock()
+		if blocked {
+			return ch
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("client is not blocked by %s", string(cmdLine[0]))
+	return nil
+}
+
+func waitReply(t *testing.T, ch <-chan redis.Reply) redis.Reply {
+	select {
+	case result := <-ch:
+		return result
+	case <-time.After(time.Second):
+		t.Fatal("blocking command is not woken")
+		return nil
+	}
+}
+
+func TestBLPop(t *testing.T) {
+	db := makeTestDB()
+	conn := connection.MakeConn(nil)
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	db.Exec(nil, utils.ToCmdLine("rpush", key2, "a", "b"))
+	result := db.Exec(conn, utils.ToCmdLine("blpop", key1, key2, "0"))
+	asserts.AssertMultiBulkReply(t, result, []string{key2, "a"})
+	result = db.Exec(conn, utils.ToCmdLine("brpop", key1, key2, "0"))
+	asserts.AssertMultiBulkReply(t, result, []string{key2, "b"})
+
+	ch := execAsync(t, db, conn, utils.ToCmdLine("blpop", key1, key2, "0"))
+	db.Exec(nil, utils.ToCmdLine("lpush", key1, "c"))
+	asserts.AssertMultiBulkReply(t, waitReply(t, ch), []string{key1, "c"})
+	asserts.AssertIntReply(t, db.Exec(nil, utils.ToCmdLine("exists", key1)), 0)
+
+	result = db.Exec(conn, utils.ToCmdLine("blpop", key1, "-1"))
+	asserts.AssertErrReply(t, result, "ERR timeout is negative")
+	result = db.Exec(conn, utils.ToCmdLine("blpop", key1, "a"))
+	asserts.AssertErrReply(t, result, "ERR timeout is not a float or out of range")
+}
+
+func TestBLPopTimeout(t *testing.T) {
+	db := makeTestDB()
+	conn := connection.MakeConn(nil)
+	key := utils.RandString(10)
+	start := time.Now()
+	result := db.Exec(conn, utils.ToCmdLine("blpop", key, "0.1"))
+	if !utils.BytesEquals(result.ToBytes(), reply.MakeNullMultiBulkReply().ToBytes()) {
+		t.Errorf("expected null multi bulk, actually %s", string(result.ToBytes()))
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("blpop returned after %v", elapsed)
+	}
+	result = db.Exec(conn, utils.ToCmdLine("blmove", key, key, "left", "right", "0.1"))
+	asserts.AssertNullBulk(t, result)
+}
+
+func TestBlockingFIFO(t *testing.T) {
+	db := makeTestDB()
+	key := utils.RandString(10)
+	chs := make([]<-chan redis.Reply, 3)
+	for i := range chs {
+		chs[i] = execAsync(t, db, connection.MakeConn(nil), utils.ToCmdLine("brpop", key, "0"))
+	}
+	db.Exec(nil, utils.ToCmdLine("rpush", key, "0", "1", "2"))
+	for i := range chs {
+		asserts.AssertMultiBulkReply(t, waitReply(t, chs[i]), []string{key, strconv.Itoa(2 - i)})
+	}
+}
+
+func TestBLMove(t *testing.T) {
+	db := makeTestDB()
+	conn := connection.MakeConn(nil)
+	src := utils.RandString(10)
+	dest := utils.RandString(10)
+	ch := execAsync(t, db, conn, utils.ToCmdLine("blmove", src, dest, "right", "left", "0"))
+	db.Exec(nil, utils.ToCmdLine("rpush", src, "a", "b"))
+	asserts.AssertBulkReply(t, waitReply(t, ch), "b")
+
+	ch = execAsync(t, db, conn, utils.ToCmdLine("brpoplpush", dest+"x", src, "0"))
+	db.Exec(nil, utils.ToCmdLine("rpoplpush", dest, dest+"x"))
+	asserts.AssertBulkReply(t, waitReply(t, ch), "b")
+	result := db.Exec(nil, utils.ToCmdLine("lrange", src, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "a"})
+}
+
+func TestClientUnblock(t *testing.T) {
+	db := makeTestDB()
+	conn := connection.MakeConn(nil)
+	other := connection.MakeConn(nil)
+	key := utils.RandString(10)
+	id := strconv.FormatInt(conn.ID(), 10)
+	asserts.AssertIntReply(t, db.Exec(conn, utils.ToCmdLine("client", "id")), int(conn.ID()))
+
+	ch := execAsync(t, db, conn, utils.ToCmdLine("blpop", key, "0"))
+	asserts.AssertIntReply(t, db.Exec(other, utils.ToCmdLine("client", "unblock", id)), 1)
+	result := waitReply(t, ch)
+	if !utils.BytesEquals(result.ToBytes(), reply.MakeNullMultiBulkReply().ToBytes()) {
+		t.Errorf("expected null multi bulk, actually %s", string(result.ToBytes()))
+	}
+
+	ch = execAsync(t, db, conn, utils.ToCmdLine("blpop", key, "0"))
+	asserts.AssertIntReply(t, db.Exec(other, utils.ToCmdLine("client", "unblock", id, "error")), 1)
+	asserts.AssertErrReply(t, waitReply(t, ch), "UNBLOCKED client unblocked via CLIENT UNBLOCK")
+	asserts.AssertIntReply(t, db.Exec(other, utils.ToCmdLine("client", "unblock", id)), 0)
+}
+
+func TestBlockedClientClose(t *testing.T) {
+	db := makeTestDB()
+	conn := connection.MakeConn(nil)
+	key := utils.RandString(10)
+	ch := execAsync(t, db, conn, utils.ToCmdLine("blpop", key, "0"))
+	db.AfterClientClose(conn)
+	waitReply(t, ch)
+
+	// element must not be consumed by the closed client
+	db.Exec(nil, utils.ToCmdLine("rpush", key, "a"))
+	asserts.AssertIntReply(t, db.Exec(nil, utils.ToCmdLine("llen", key)), 1)
+	if len(db.blocking.queues) != 0 || len(db.blocking.clients) != 0 {
+		t.Error("blocked client is not removed")
+	}
+}
+
+func TestBlockAfterClientClose(t *testing.T) {
+	db := makeTestDB()
+	conn := connection.MakeConn(nil)
+	key := utils.RandString(10)
+	// the connection is closed after the command is received but before the client is registered
+	db.AfterClientClose(conn)
+	result := db.Exec(conn, utils.ToCmdLine("blpop", key, "0"))
+	if !utils.BytesEquals(result.ToBytes(), reply.MakeNullMultiBulkReply().ToBytes()) {
+		t.Errorf("expected null multi bulk, actually %s", string(result.ToBytes()))
+	}
+	if len(db.blocking.queues) != 0 || len(db.blocking.clients) != 0 {
+		t.Error("closed client is registered")
+	}
+
+	// pushed element is left for other clients
+	other := connection.MakeConn(nil)
+	ch := execAsync(t, db, other, utils.ToCmdLine("blpop", key, "0"))
+	db.Exec(nil, utils.ToCmdLine("rpush", key, "a"))
+	result = waitReply(t, ch)
+	expected := reply.MakeMultiBulkReply([][]byte{[]byte(key), []byte("a")}).ToBytes()
+	if !utils.BytesEquals(result.ToBytes(), expected) {
+		t.Errorf("expected %q, actually %q", string(expected), string(result.ToBytes()))
+	}
+}
+
+func TestBLPopInMulti(t *testing.T) {
+	db := makeTestDB()
+	conn := connection.MakeConn(nil)
+	key := utils.RandString(10)
+	db.Exec(conn, utils.ToCmdLine("multi"))
+	db.Exec(conn, utils.ToCmdLine("BLPOP", key, "0"))
+	db.Exec(conn, utils.ToCmdLine("rpush", key, "a"))
+	db.Exec(conn, utils.ToCmdLine("blpop", key, "0"))
+	result := db.Exec(conn, utils.ToCmdLine("exec"))
+	expected := "*3\r\n*-1\r\n:1\r\n*2\r\n$" + strconv.Itoa(len(key)) + "\r\n" + key + "\r\n$1\r\na\r\n"
+	if string(result.ToBytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, string(result.ToBytes()))
+	}
+}
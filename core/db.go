@@ -6,11 +6,14 @@ import (
 	"Tiny-Godis/interface/redis"
 	"Tiny-Godis/lib/config"
 	"Tiny-Godis/lib/logger"
+	"Tiny-Godis/lib/sync/atomic"
 	"Tiny-Godis/lib/timewheel"
 	"Tiny-Godis/pubsub"
-	"Tiny-Godis/redis/reply"
+	"fmt"
+	"math/rand"
 	"os"
 	"sync"
+	stdatomic "sync/atomic"
 	"time"
 )
 
@@ -27,23 +30,58 @@ type DB struct {
 	versionMap dict.Dict
 
 	locker *lock.Locks
+	// held shared by commands locking their keys, and exclusively by commands whose keys can't be known in advance
+	globalLock sync.RWMutex
 
 	stopWait sync.WaitGroup
 
-	aofChan     chan *reply.MultiBulkReply
+	aofChan chan *aofPayload
+	// held shared while sending to aofChan and exclusively while closing it
+	aofChanLock sync.RWMutex
+	aofClosed   bool
+	// aofFile is the latest incr file of multi-part aof
 	aofFile     *os.File
-	aofFileName string
+	aofDir      string
+	aofPrefix   string
+	aofManifest *aofManifest
+	aofFsync    string
+	// data failed to write into aof file, will be retried by next write or aofCron
+	aofPending []byte
+	aofStatus  aofStatus
+	// timestamp of the latest annotation, never goes backwards
+	aofLastTimestamp int64
+	// set when a new incr file is opened, which starts with its own annotation
+	aofAnnotateNext bool
+	// closed to stop aofCron
+	aofCronStop chan struct{}
 	// aof goroutine will send msg to main goroutine through this channel when aof tasks finished and ready to shutdown
-	aofFinished chan struct{}
-	// buffer commands received during aof rewrite progress
-	aofRewriteBuffer chan *reply.MultiBulkReply
-	aofPause         sync.RWMutex
+	aofFinished         chan struct{}
+	aofPause            sync.RWMutex
+	aofRewriting        atomic.Boolean
+	aofRewriteScheduled atomic.Boolean
+	// aof file size after the latest rewrite or startup, used by auto rewrite
+	aofBaseSize    int64
+	aofCurrentSize int64
 
 	subs *pubsub.SubPool
+	// clients blocked by BLPOP and so on
+	blocking *blockingKeys
+	// increased by FLUSHDB, so versions of all keys change at once
+	flushEpoch uint32
+	// scripts cached by EVAL and SCRIPT LOAD
+	scripts *scriptCache
+	// libraries loaded by FUNCTION LOAD
+	functions *functionLibs
 }
 
 type DataEntity struct {
 	Data interface{}
+	// unix time in milliseconds of the latest access, reported by OBJECT IDLETIME
+	accessTime int64
+	// logarithmic access counter like LFU of redis, reported by OBJECT FREQ
+	freq uint32
+	// raw marks a string built in place like redis does for PFADD, reported as raw encoding regardless of length
+	raw bool
 }
 
 // ExecFunc is interface for command executor
@@ -69,22 +107,38 @@ func MakeDB() *DB {
 		versionMap: dict.MakeConcurrent(lockerSize),
 		locker:     lock.Make(lockerSize),
 		subs:       pubsub.MakeSubPool(),
+		blocking:   makeBlockingKeys(),
+		scripts:    makeScriptCache(),
+		functions:  makeFunctionLibs(),
 	}
 
 	if config.Properties.AppendOnly {
-		db.aofFileName = config.Properties.AppendFilename
-		db.loadAof(0)
-		f, err := os.OpenFile(db.aofFileName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+		db.aofDir = aofDirPath(config.Properties.AppendFilename, config.Properties.AppendDirname)
+		db.aofPrefix = aofPrefix(config.Properties.AppendFilename)
+		db.aofFsync = parseFsyncPolicy(config.Properties.AppendFsync)
+		err := db.openAof()
+		if _, ok := err.(*aofLoadError); ok || (err != nil && config.Properties.AofLoadUntil > 0) {
+			// refuse to start with a corrupted dataset or a dataset other than the one to recover
+			logger.Fatal(err)
+		}
 		if err != nil {
 			logger.Warn(err)
+		} else if config.Properties.AofLoadUntil > 0 {
+			logger.Warn(fmt.Sprintf("dataset is recovered until %d in memory only, aof files are left unchanged "+
+				"and new writes are not persisted, use godis-truncate-aof to truncate aof files", config.Properties.AofLoadUntil))
 		} else {
-			db.aofFile = f
-			db.aofChan = make(chan *reply.MultiBulkReply, aofQueueSize)
+			db.aofChan = make(chan *aofPayload, aofQueueSize)
 		}
 		db.aofFinished = make(chan struct{})
-		go func() {
-			db.handleAof()
-		}()
+		db.aofCronStop = make(chan struct{})
+		if db.aofChan != nil {
+			go func() {
+				db.handleAof()
+			}()
+			go func() {
+				db.aofCron()
+			}()
+		}
 	}
 
 	return &db
@@ -92,9 +146,10 @@ func MakeDB() *DB {
 
 func MakeTmpDB() *DB {
 	db := DB{
-		data:   dict.MakeSimpleDict(),
-		ttlMap: dict.MakeSimpleDict(),
-		locker: lock.Make(lockerSize),
+		data:      dict.MakeSimpleDict(),
+		ttlMap:    dict.MakeSimpleDict(),
+		locker:    lock.Make(lockerSize),
+		functions: makeFunctionLibs(),
 	}
 
 	return &db
@@ -102,7 +157,17 @@ func MakeTmpDB() *DB {
 
 /* ---- Main Function ----- */
 
+// GetEntity returns the entity of key and records the access
 func (db *DB) GetEntity(key string) (*DataEntity, bool) {
+	entity, ok := db.peekEntity(key)
+	if ok {
+		entity.touch()
+	}
+	return entity, ok
+}
+
+// peekEntity returns the entity of key without changing its access time and frequency
+func (db *DB) peekEntity(key string) (*DataEntity, bool) {
 	db.stopWait.Wait()
 
 	raw, ok := db.data.Get(key)
@@ -118,16 +183,19 @@ func (db *DB) GetEntity(key string) (*DataEntity, bool) {
 
 func (db *DB) PutEntity(key string, value *DataEntity) int {
 	db.stopWait.Wait()
+	value.init()
 	return db.data.Put(key, value)
 }
 
 func (db *DB) PutIfExists(key string, value *DataEntity) int {
 	db.stopWait.Wait()
+	value.init()
 	return db.data.PutIfExists(key, value)
 }
 
 func (db *DB) PutIfAbsent(key string, value *DataEntity) int {
 	db.stopWait.Wait()
+	value.init()
 	return db.data.PutIfAbsent(key, value)
 }
 
@@ -150,26 +218,107 @@ func (db *DB) Removes(keys ...string) (deleted int) {
 	return deleted
 }
 
+/* ---- Access Function ----- */
+
+const (
+	// initial frequency of new keys, so they are not evicted before having a chance to be accessed
+	lfuInitVal = 5
+	lfuMaxVal  = 255
+	// the larger the factor is, the more accesses are needed to grow the frequency
+	lfuLogFactor = 10
+	// frequency decreases by 1 every lfuDecayTime without access
+	lfuDecayTime = time.Minute
+)
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// init sets access time and frequency of a new entity
+func (entity *DataEntity) init() {
+	if stdatomic.LoadInt64(&entity.accessTime) == 0 {
+		stdatomic.StoreInt64(&entity.accessTime, nowMillis())
+		stdatomic.StoreUint32(&entity.freq, lfuInitVal)
+	}
+}
+
+// idleTime returns the time since the latest access
+func (entity *DataEntity) idleTime() time.Duration {
+	return time.Duration(nowMillis()-stdatomic.LoadInt64(&entity.accessTime)) * time.Millisecond
+}
+
+// frequency returns the access counter decayed by the idle time
+func (entity *DataEntity) frequency() uint32 {
+	counter := stdatomic.LoadUint32(&entity.freq)
+	decay := uint32(entity.idleTime() / lfuDecayTime)
+	if decay >= counter {
+		return 0
+	}
+	return counter - decay
+}
+
+// touch records an access, the counter grows logarithmically with the number of accesses
+func (entity *DataEntity) touch() {
+	counter := entity.frequency()
+	if counter < lfuMaxVal {
+		base := 0.0
+		if counter > lfuInitVal {
+			base = float64(counter - lfuInitVal)
+		}
+		if rand.Float64() < 1.0/(base*lfuLogFactor+1) {
+			counter++
+		}
+	}
+	// concurrent readers may lose some increments, the counter is approximate anyway
+	stdatomic.StoreUint32(&entity.freq, counter)
+	stdatomic.StoreInt64(&entity.accessTime, nowMillis())
+}
+
 /* ---- Lock Function ----- */
 
+// lockAllKeys is returned as a read key by PreFunc if the command accesses keys which can't be known before execution,
+// such command runs under a database-wide lock. A user key with the same name just takes the lock unnecessarily
+const lockAllKeys = "\x00*"
+
+func needLockAll(readKeys []string) bool {
+	for _, key := range readKeys {
+		if key == lockAllKeys {
+			return true
+		}
+	}
+	return false
+}
+
 // Lock lock key for writing
 func (db *DB) Lock(key string) {
+	db.globalLock.RLock()
 	db.locker.Lock(key)
 }
 
 // UnLock releases key for writing
 func (db *DB) UnLock(key string) {
 	db.locker.UnLock(key)
+	db.globalLock.RUnlock()
 }
 
 // RWLocks lock keys for writing and reading
 func (db *DB) RWLocks(writeKeys []string, readKeys []string) {
+	if needLockAll(readKeys) {
+		db.globalLock.Lock()
+	} else {
+		db.globalLock.RLock()
+	}
 	db.locker.RWLocks(writeKeys, readKeys)
 }
 
 // RWUnLocks unlock keys for writing and reading
 func (db *DB) RWUnLocks(writeKeys []string, readKeys []string) {
 	db.locker.RWUnLocks(writeKeys, readKeys)
+	if needLockAll(readKeys) {
+		db.globalLock.Unlock()
+	} else {
+		db.globalLock.RUnlock()
+	}
 }
 
 /* ---- TTL Function ----- */
@@ -231,12 +380,13 @@ func (db *DB) Flush() {
 /* ---- Version Function ----- */
 func (db *DB) addVersion(keys ...string) {
 	for _, key := range keys {
-		version := db.getVersion(key)
+		version := db.keyVersion(key)
 		db.versionMap.Put(key, version+1)
 	}
 }
 
-func (db *DB) getVersion(key string) uint32 {
+// keyVersion returns the number of writes of key
+func (db *DB) keyVersion(key string) uint32 {
 	v, ok := db.versionMap.Get(key)
 	if ok {
 		return v.(uint32)
@@ -244,6 +394,10 @@ func (db *DB) getVersion(key string) uint32 {
 	return 0
 }
 
+func (db *DB) getVersion(key string) uint32 {
+	return db.keyVersion(key) + stdatomic.LoadUint32(&db.flushEpoch)
+}
+
 /* ---- Util Function ----- */
 
 func validateArity(arity int, cmdArgs [][]byte) bool {
@@ -256,10 +410,34 @@ func validateArity(arity int, cmdArgs [][]byte) bool {
 
 /* ---- Clean Function ----- */
 
+// Close waits for pending aof commands and flushes aof file to disk
 func (db *DB) Close() {
-
+	if db.aofCronStop != nil {
+		close(db.aofCronStop)
+	}
+	db.aofChanLock.Lock()
+	if db.aofChan == nil || db.aofClosed {
+		db.aofChanLock.Unlock()
+		return
+	}
+	// commands finished after this point are not written into aof
+	db.aofClosed = true
+	close(db.aofChan)
+	db.aofChanLock.Unlock()
+	<-db.aofFinished
+
+	db.aofPause.Lock()
+	defer db.aofPause.Unlock()
+	if len(db.aofPending) > 0 {
+		db.writeAof(nil)
+	}
+	db.fsyncAof()
+	_ = db.aofFile.Close()
 }
 
+// AfterClientClose releases resources of the closed client
 func (db *DB) AfterClientClose(c redis.Connection) {
-
+	if db.blocking != nil {
+		db.blocking.unblockClosed(c)
+	}
 }
@@ -0,0 +1,359 @@
+package core
+
+import (
+	"Tiny-Godis/data_struct/list"
+	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/client"
+	"Tiny-Godis/redis/reply"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// payload of DUMP is the same as redis: object type, object in rdb format, 2 bytes rdb version and 8 bytes crc64
+const dumpFooterSize = 10
+
+var errBadDumpPayload = errors.New("bad data format")
+
+// dumpEntity serializes value of entity
+func dumpEntity(entity *DataEntity) ([]byte, error) {
+	objType, ok := rdbObjectType(entity)
+	if !ok {
+		return nil, errors.New("unsupported type")
+	}
+	buf := &bytes.Buffer{}
+	enc := newRdbEncoder(buf)
+	err := enc.writeByte(objType)
+	if err != nil {
+		return nil, err
+	}
+	err = enc.writeObject(entity)
+	if err != nil {
+		return nil, err
+	}
+	return writeDumpFooter(enc, buf)
+}
+
+// writeDumpFooter appends rdb version and checksum to buf written by enc, returns the whole payload
+func writeDumpFooter(enc *rdbEncoder, buf *bytes.Buffer) ([]byte, error) {
+	footer := make([]byte, dumpFooterSize)
+	binary.LittleEndian.PutUint16(footer, rdbVersion)
+	err := enc.write(footer[:2])
+	if err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint64(footer[2:], enc.crc)
+	buf.Write(footer[2:])
+	return buf.Bytes(), nil
+}
+
+// verifyDumpPayload checks rdb version and checksum of payload
+func verifyDumpPayload(payload []byte) bool {
+	if len(payload) < dumpFooterSize {
+		return false
+	}
+	footer := payload[len(payload)-dumpFooterSize:]
+	if binary.LittleEndian.Uint16(footer) > rdbVersion {
+		return false
+	}
+	crc := crc64Update(0, payload[:len(payload)-8])
+	return crc == binary.LittleEndian.Uint64(footer[2:])
+}
+
+// restoreEntity deserializes a verified payload
+func restoreEntity(payload []byte) (*DataEntity, error) {
+	size := len(payload) - dumpFooterSize
+	dec := newRdbDecoder(bytes.NewReader(payload[:size]))
+	dec.maxLength = uint64(size)
+	objType, err := dec.readByte()
+	if err != nil {
+		return nil, errBadDumpPayload
+	}
+	entity, err := dec.readObject(objType)
+	if err != nil || dec.offset != int64(size) {
+		return nil, errBadDumpPayload
+	}
+	return entity, nil
+}
+
+// execDump serializes value of key: DUMP key
+func execDump(db *DB, args [][]byte) redis.Reply {
+	entity, exists := db.GetEntity(string(args[0]))
+	if !exists {
+		return &reply.NullBulkReply{}
+	}
+	payload, err := dumpEntity(entity)
+	if err != nil {
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	return reply.MakeBulkReply(payload)
+}
+
+// execRestore creates key from payload of DUMP: RESTORE key ttl payload [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+func execRestore(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return reply.MakeErrReply("ERR Invalid TTL value, must be >= 0")
+	}
+	payload := args[2]
+	replace, absTTL := false, false
+	idleTime, freq := int64(-1), int64(-1)
+	for i := 3; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i]))
+		additional := i+1 < len(args)
+		switch {
+		case option == "REPLACE":
+			replace = true
+		case option == "ABSTTL":
+			absTTL = true
+		case option == "IDLETIME" && additional && freq == -1:
+			idleTime, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if idleTime < 0 {
+				return reply.MakeErrReply("ERR Invalid IDLETIME value, must be >= 0")
+			}
+			i++
+		case option == "FREQ" && additional && idleTime == -1:
+			freq, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if freq < 0 || freq > lfuMaxVal {
+				return reply.MakeErrReply("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+			i++
+		default:
+			return &reply.SyntaxErrReply{}
+		}
+	}
+
+	if _, exists := db.GetEntity(key); exists && !replace {
+		return reply.MakeErrReply("BUSYKEY Target key name already exists.")
+	}
+	if !verifyDumpPayload(payload) {
+		return reply.MakeErrReply("ERR DUMP payload version or checksum are wrong")
+	}
+	entity, err := restoreEntity(payload)
+	if err != nil {
+		return reply.MakeErrReply("ERR Bad data format")
+	}
+
+	var expireAt time.Time
+	if ttl > 0 {
+		if absTTL {
+			expireAt = time.Unix(0, ttl*int64(time.Millisecond))
+		} else {
+			expireAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+		if !expireAt.After(time.Now()) {
+			// key expired already is not created
+			if db.Remove(key) > 0 {
+				db.AddAof(reply.MakeMultiBulkReply(utils.ToCmdLine("DEL", key)))
+			}
+			return reply.MakeOkReply()
+		}
+	}
+
+	db.Remove(key)
+	db.PutEntity(key, entity)
+	if idleTime >= 0 {
+		entity.accessTime -= idleTime * 1000
+	}
+	if freq >= 0 {
+		entity.freq = uint32(freq)
+	}
+	db.AddAof(reply.MakeMultiBulkReply([][]byte{[]byte("RESTORE"), args[0], []byte("0"), payload, []byte("REPLACE")}))
+	if !expireAt.IsZero() {
+		db.setExpire(key, expireAt)
+	}
+	if _, ok := entity.Data.(list.List); ok {
+		db.signalBlocked(key)
+	}
+	return reply.MakeOkReply()
+}
+
+// migrateArgs is the parsed arguments of MIGRATE
+type migrateArgs struct {
+	addr    string
+	db      int64
+	timeout time.Duration
+	keys    []string
+	copy    bool
+	replace bool
+	// auth is the arguments of AUTH command sent before migrating
+	auth []string
+}
+
+// parseMigrate parses MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key ...]
+func parseMigrate(args [][]byte) (*migrateArgs, reply.ErrorReply) {
+	result := &migrateArgs{
+		addr: net.JoinHostPort(string(args[0]), string(args[1])),
+	}
+	var err error
+	result.db, err = strconv.ParseInt(string(args[3]), 10, 64)
+	if err != nil {
+		return nil, reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	timeout, err := strconv.ParseInt(string(args[4]), 10, 64)
+	if err != nil {
+		return nil, reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+	result.timeout = time.Duration(timeout) * time.Millisecond
+	keysStart := 0
+	for i := 5; i < len(args) && keysStart == 0; i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "COPY":
+			result.copy = true
+		case "REPLACE":
+			result.replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return nil, &reply.SyntaxErrReply{}
+			}
+			result.auth = []string{string(args[i+1])}
+			i++
+		case "AUTH2":
+			if i+2 >= len(args) {
+				return nil, &reply.SyntaxErrReply{}
+			}
+			result.auth = []string{string(args[i+1]), string(args[i+2])}
+			i += 2
+		case "KEYS":
+			if len(args[2]) != 0 {
+				return nil, reply.MakeErrReply("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			keysStart = i + 1
+		default:
+			return nil, &reply.SyntaxErrReply{}
+		}
+	}
+	if keysStart > 0 {
+		for _, key := range args[keysStart:] {
+			result.keys = append(result.keys, string(key))
+		}
+	} else {
+		result.keys = []string{string(args[2])}
+	}
+	return result, nil
+}
+
+// execMigrate transfers keys to another instance by DUMP and RESTORE.
+// Keys are locked during migration, they are deleted from this instance after restored unless COPY is given
+func execMigrate(db *DB, args [][]byte) redis.Reply {
+	ma, errReply := parseMigrate(args)
+	if errReply != nil {
+		return errReply
+	}
+	type dumped struct {
+		key     string
+		ttl     int64
+		payload []byte
+	}
+	var entries []dumped
+	for _, key := range ma.keys {
+		entity, exists := db.GetEntity(key)
+		if !exists {
+			continue
+		}
+		payload, err := dumpEntity(entity)
+		if err != nil {
+			return reply.MakeErrReply("ERR " + err.Error())
+		}
+		ttl := int64(0)
+		if raw, ok := db.ttlMap.Get(key); ok {
+			ttl = int64(time.Until(raw.(time.Time)) / time.Millisecond)
+			if ttl < 1 {
+				ttl = 1
+			}
+		}
+		entries = append(entries, dumped{key: key, ttl: ttl, payload: payload})
+	}
+	if len(entries) == 0 {
+		return reply.MakeStatusReply("NOKEY")
+	}
+
+	c, err := client.MakeClientWithTimeout(ma.addr, ma.timeout)
+	if err != nil {
+		return reply.MakeErrReply("IOERR error or timeout connecting to the client")
+	}
+	c.Start()
+	defer c.Close()
+
+	var cmdLines [][][]byte
+	if len(ma.auth) > 0 {
+		cmdLines = append(cmdLines, utils.ToCmdLine2("AUTH", ma.auth...))
+	}
+	if ma.db != 0 {
+		cmdLines = append(cmdLines, utils.ToCmdLine("SELECT", strconv.FormatInt(ma.db, 10)))
+	}
+	for _, cmdLine := range cmdLines {
+		if errReply, ok := c.Send(cmdLine).(reply.ErrorReply); ok {
+			return reply.MakeErrReply("ERR Target instance replied with error: " + strings.TrimPrefix(errReply.Error(), "ERR "))
+		}
+	}
+
+	migrated := make([][]byte, 0, len(entries))
+	var failure redis.Reply
+	for _, entry := range entries {
+		cmdLine := [][]byte{[]byte("RESTORE"), []byte(entry.key), []byte(strconv.FormatInt(entry.ttl, 10)), entry.payload}
+		if ma.replace {
+			cmdLine = append(cmdLine, []byte("REPLACE"))
+		}
+		result := c.Send(cmdLine)
+		if result == nil || result == client.TimeoutErrReply {
+			failure = reply.MakeErrReply("IOERR error or timeout reading to target instance")
+			break
+		}
+		if errReply, ok := result.(reply.ErrorReply); ok {
+			failure = reply.MakeErrReply("ERR Target instance replied with error: " + strings.TrimPrefix(errReply.Error(), "ERR "))
+			break
+		}
+		migrated = append(migrated, []byte(entry.key))
+	}
+
+	if !ma.copy && len(migrated) > 0 {
+		for _, key := range migrated {
+			db.Remove(string(key))
+		}
+		db.AddAof(makeAofCmd("DEL", migrated))
+	}
+	if failure != nil {
+		return failure
+	}
+	return reply.MakeOkReply()
+}
+
+// prepareMigrate returns keys to migrate, they are locked for writing since they are deleted after migration
+func prepareMigrate(args [][]byte) ([]string, []string) {
+	for i := 5; i < len(args); i++ {
+		if strings.ToUpper(string(args[i])) == "KEYS" {
+			return writeAllKeys(args[i+1:])
+		}
+	}
+	return []string{string(args[2])}, nil
+}
+
+func undoMigrate(db *DB, args [][]byte) []CmdLine {
+	keys, _ := prepareMigrate(args)
+	return rollbackGivenKeys(db, keys...)
+}
+
+func init() {
+	RegisterCommand("Dump", execDump, readFirstKey, nil, 2)
+	RegisterCommand("Restore", execRestore, writeFirstKey, rollbackFirstKey, -4)
+	RegisterCommand("Migrate", execMigrate, prepareMigrate, undoMigrate, -6)
+}
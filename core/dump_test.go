@@ -0,0 +1,105 @@
+package core
+
+import (
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/reply"
+	"Tiny-Godis/redis/reply/asserts"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func dump(t *testing.T, db *DB, key string) []byte {
+	result, ok := db.Exec(nil, utils.ToCmdLine("DUMP", key)).(*reply.BulkReply)
+	if !ok {
+		t.Fatalf("expect bulk reply of DUMP %s", key)
+	}
+	return result.Arg
+}
+
+func TestDumpRestore(t *testing.T) {
+	testDB.Flush()
+	asserts.AssertNullBulk(t, testDB.Exec(nil, utils.ToCmdLine("DUMP", "none")))
+	testDB.Exec(nil, utils.ToCmdLine("SET", "str", "hello"))
+	testDB.Exec(nil, utils.ToCmdLine("SET", "int", "12345"))
+	testDB.Exec(nil, utils.ToCmdLine("RPUSH", "list", "a", "b", "c"))
+	testDB.Exec(nil, utils.ToCmdLine("SADD", "set", "1", "2", "a"))
+	testDB.Exec(nil, utils.ToCmdLine("HSET", "hash", "f1", "v1"))
+	testDB.Exec(nil, utils.ToCmdLine("HSET", "hash", "f2", "v2"))
+	for _, key := range []string{"str", "int", "list", "set", "hash"} {
+		payload := dump(t, testDB, key)
+		expected := EntityToCmd(key, mustGetEntity(t, testDB, key)).ToBytes()
+		asserts.AssertErrReply(t, testDB.Exec(nil, [][]byte{[]byte("RESTORE"), []byte(key), []byte("0"), payload}),
+			"BUSYKEY Target key name already exists.")
+		asserts.AssertStatusReply(t, testDB.Exec(nil, [][]byte{[]byte("RESTORE"), []byte(key + "2"), []byte("0"), payload}), "OK")
+		actual := EntityToCmd(key, mustGetEntity(t, testDB, key+"2")).ToBytes()
+		if string(expected) != string(actual) {
+			t.Errorf("restored %s is different, expected %q, actual %q", key, expected, actual)
+		}
+		asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("TTL", key+"2")), -1)
+	}
+
+	// replace with ttl
+	payload := dump(t, testDB, "list")
+	asserts.AssertStatusReply(t, testDB.Exec(nil, [][]byte{[]byte("RESTORE"), []byte("str"), []byte("100000"), payload, []byte("REPLACE")}), "OK")
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("LRANGE", "str", "0", "-1")), []string{"a", "b", "c"})
+	ttl := testDB.Exec(nil, utils.ToCmdLine("PTTL", "str")).(*reply.IntReply)
+	if ttl.Code <= 0 || ttl.Code > 100000 {
+		t.Errorf("expect ttl in (0, 100000], actual %d", ttl.Code)
+	}
+	expireAt := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	asserts.AssertStatusReply(t, testDB.Exec(nil, [][]byte{[]byte("RESTORE"), []byte("abs"), []byte(strconv.FormatInt(expireAt, 10)), payload, []byte("ABSTTL")}), "OK")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PEXPIRETIME", "abs")), int(expireAt))
+	// expired already
+	asserts.AssertStatusReply(t, testDB.Exec(nil, [][]byte{[]byte("RESTORE"), []byte("abs"), []byte("1"), payload, []byte("ABSTTL"), []byte("REPLACE")}), "OK")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXISTS", "abs")), 0)
+
+	// idle time and frequency
+	asserts.AssertStatusReply(t, testDB.Exec(nil, [][]byte{[]byte("RESTORE"), []byte("idle"), []byte("0"), payload, []byte("IDLETIME"), []byte("1000")}), "OK")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "IDLETIME", "idle")), 1000)
+	asserts.AssertStatusReply(t, testDB.Exec(nil, [][]byte{[]byte("RESTORE"), []byte("freq"), []byte("0"), payload, []byte("FREQ"), []byte("100")}), "OK")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "FREQ", "freq")), 100)
+}
+
+func TestRestoreErrors(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("SET", "k", "v"))
+	payload := dump(t, testDB, "k")
+	restore := func(args ...[]byte) []byte {
+		return testDB.Exec(nil, append([][]byte{[]byte("RESTORE"), []byte("k2")}, args...)).ToBytes()
+	}
+	cases := []struct {
+		args     [][]byte
+		expected string
+	}{
+		{[][]byte{[]byte("-1"), payload}, "-ERR Invalid TTL value, must be >= 0\r\n"},
+		{[][]byte{[]byte("0"), payload, []byte("IDLETIME"), []byte("1"), []byte("FREQ"), []byte("1")}, "-Err syntax error\r\n"},
+		{[][]byte{[]byte("0"), payload, []byte("FREQ"), []byte("256")}, "-ERR Invalid FREQ value, must be >= 0 and <= 255\r\n"},
+		{[][]byte{[]byte("0"), payload, []byte("IDLETIME"), []byte("-1")}, "-ERR Invalid IDLETIME value, must be >= 0\r\n"},
+		{[][]byte{[]byte("0"), payload, []byte("KEEPTTL")}, "-Err syntax error\r\n"},
+		{[][]byte{[]byte("0"), []byte("short")}, "-ERR DUMP payload version or checksum are wrong\r\n"},
+	}
+	for _, c := range cases {
+		if actual := string(restore(c.args...)); actual != c.expected {
+			t.Errorf("expected %q, actual %q", c.expected, actual)
+		}
+	}
+
+	// every modified byte is detected
+	for i := range payload {
+		corrupted := append([]byte{}, payload...)
+		corrupted[i] ^= 0x20
+		if actual := string(restore([]byte("0"), corrupted)); actual != "-ERR DUMP payload version or checksum are wrong\r\n" {
+			t.Errorf("expect corruption at %d detected, actual %q", i, actual)
+		}
+	}
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXISTS", "k2")), 0)
+}
+
+func mustGetEntity(t *testing.T, db *DB, key string) *DataEntity {
+	entity, ok := db.GetEntity(key)
+	if !ok {
+		t.Fatalf("key %s not found", key)
+	}
+	return entity
+}
@@ -35,6 +35,10 @@ func (db *DB) Exec(conn redis.Connection, cmdLine CmdLine) (result redis.Reply)
 		return EnqueueCmd(conn, cmdLine)
 	}
 
+	if conn != nil && isBlockingCmd(cmdName) {
+		return db.execBlockingCmd(conn, cmdLine)
+	}
+
 	return db.execNormalCmd(cmdLine)
 }
 
@@ -54,6 +58,12 @@ func (db *DB) execSpecialCmd(conn redis.Connection, cmdLine CmdLine) (result red
 	case "bgrewriteaof":
 		// aof.go imports cmd.go, cmd.go cannot import BGRewriteAOF from aof.go
 		return BGRewriteAOF(db, cmdLine[1:]), true
+	case "script":
+		// SCRIPT KILL must not wait for locks held by the running script
+		if !validateArity(-2, cmdLine) {
+			return reply.MakeArgNumErrReply(cmdName), true
+		}
+		return Script(db, cmdLine[1:]), true
 	case "multi":
 		if len(cmdLine) != 1 {
 			return reply.MakeArgNumErrReply(cmdName), true
@@ -74,6 +84,11 @@ func (db *DB) execSpecialCmd(conn redis.Connection, cmdLine CmdLine) (result red
 			return reply.MakeArgNumErrReply(cmdName), true
 		}
 		return Watch(db, conn, cmdLine[1:]), true
+	case "client":
+		if !validateArity(-2, cmdLine) {
+			return reply.MakeArgNumErrReply(cmdName), true
+		}
+		return Client(db, conn, cmdLine[1:]), true
 	default:
 		return nil, false
 	}
@@ -91,11 +106,22 @@ func (db *DB) execNormalCmd(cmdLine CmdLine) (result redis.Reply) {
 	}
 
 	wk, rk := cmd.prepare(cmdLine[1:])
+	if len(wk) > 0 {
+		if errReply := db.checkAofWritable(); errReply != nil {
+			return errReply
+		}
+	}
 	db.addVersion(wk...)
 	db.RWLocks(wk, rk)
 	defer db.RWUnLocks(wk, rk)
 
-	return cmd.executor(db, cmdLine[1:])
+	result = cmd.executor(db, cmdLine[1:])
+	if len(wk) > 0 {
+		if errReply := db.checkAofSynced(); errReply != nil {
+			return errReply
+		}
+	}
+	return result
 }
 
 func (db *DB) ExecWithLock(cmdLine CmdLine) (result redis.Reply) {
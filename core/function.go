@@ -0,0 +1,590 @@
+package core
+
+import (
+	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/lua"
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/reply"
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	functionChunkName = "user_function"
+	// library code should do nothing but registering functions, so loading it must be quick
+	functionLoadTimeout = 500 * time.Millisecond
+)
+
+var functionFlags = map[string]struct{}{
+	"no-writes":             {},
+	"allow-oom":             {},
+	"allow-stale":           {},
+	"no-cluster":            {},
+	"allow-cross-slot-keys": {},
+}
+
+// luaFunction is a function registered by redis.register_function
+type luaFunction struct {
+	name        string
+	description string
+	flags       []string
+}
+
+func (f *luaFunction) hasFlag(flag string) bool {
+	for _, name := range f.flags {
+		if name == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// luaLibrary is loaded by FUNCTION LOAD, its code is run again in every FCALL to get the callbacks
+type luaLibrary struct {
+	name      string
+	code      string
+	proto     *lua.FunctionProto
+	functions map[string]*luaFunction
+}
+
+// functionLibs keeps libraries, which are persisted in aof and rdb
+type functionLibs struct {
+	mu        sync.RWMutex
+	libraries map[string]*luaLibrary
+	// function name -> library registering it
+	functions map[string]*luaLibrary
+}
+
+func makeFunctionLibs() *functionLibs {
+	return &functionLibs{
+		libraries: make(map[string]*luaLibrary),
+		functions: make(map[string]*luaLibrary),
+	}
+}
+
+// install adds libs atomically, existing libraries are removed before if flush is true,
+// and libraries with the same name are replaced if replace is true
+func (fl *functionLibs) install(libs []*luaLibrary, replace bool, flush bool) reply.ErrorReply {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	libraries := make(map[string]*luaLibrary)
+	functions := make(map[string]*luaLibrary)
+	if !flush {
+		for name, lib := range fl.libraries {
+			libraries[name] = lib
+		}
+		for name, lib := range fl.functions {
+			functions[name] = lib
+		}
+	}
+	for _, lib := range libs {
+		if old, ok := libraries[lib.name]; ok {
+			if !replace {
+				return reply.MakeErrReply("ERR Library '" + lib.name + "' already exists")
+			}
+			delete(libraries, old.name)
+			for name := range old.functions {
+				delete(functions, name)
+			}
+		}
+		for name := range lib.functions {
+			if _, ok := functions[name]; ok {
+				return reply.MakeErrReply("ERR Function " + name + " already exists")
+			}
+			functions[name] = lib
+		}
+		libraries[lib.name] = lib
+	}
+	fl.libraries = libraries
+	fl.functions = functions
+	return nil
+}
+
+func (fl *functionLibs) delete(name string) bool {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	lib, ok := fl.libraries[name]
+	if !ok {
+		return false
+	}
+	delete(fl.libraries, name)
+	for fn := range lib.functions {
+		delete(fl.functions, fn)
+	}
+	return true
+}
+
+func (fl *functionLibs) flush() {
+	fl.mu.Lock()
+	fl.libraries = make(map[string]*luaLibrary)
+	fl.functions = make(map[string]*luaLibrary)
+	fl.mu.Unlock()
+}
+
+func (fl *functionLibs) get(name string) (*luaLibrary, *luaFunction) {
+	fl.mu.RLock()
+	defer fl.mu.RUnlock()
+	lib, ok := fl.functions[name]
+	if !ok {
+		return nil, nil
+	}
+	return lib, lib.functions[name]
+}
+
+// list returns libraries sorted by name
+func (fl *functionLibs) list() []*luaLibrary {
+	fl.mu.RLock()
+	libs := make([]*luaLibrary, 0, len(fl.libraries))
+	for _, lib := range fl.libraries {
+		libs = append(libs, lib)
+	}
+	fl.mu.RUnlock()
+	sort.Slice(libs, func(i, j int) bool {
+		return libs[i].name < libs[j].name
+	})
+	return libs
+}
+
+func isValidFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLibraryMetadata parses the shebang like `#!lua name=mylib`,
+// returns name of library and code with the shebang line blanked, so line numbers in errors are kept
+func parseLibraryMetadata(code string) (string, string, reply.ErrorReply) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", "", reply.MakeErrReply("ERR Missing library metadata")
+	}
+	end := strings.IndexByte(code, '\n')
+	if end < 0 {
+		end = len(code)
+	}
+	fields := strings.Fields(code[2:end])
+	engine := ""
+	if len(fields) > 0 {
+		engine = fields[0]
+	}
+	if !strings.EqualFold(engine, "lua") {
+		return "", "", reply.MakeErrReply("ERR Engine '" + engine + "' not found")
+	}
+	name := ""
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "name=") {
+			return "", "", reply.MakeErrReply("ERR Invalid metadata value given: " + field)
+		}
+		name = field[len("name="):]
+	}
+	if name == "" {
+		return "", "", reply.MakeErrReply("ERR Library name was not given")
+	}
+	if !isValidFunctionName(name) {
+		return "", "", reply.MakeErrReply("ERR Library names can only contain letters, numbers, or underscores(_) " +
+			"and must be at least one character long")
+	}
+	return name, code[end:], nil
+}
+
+// compileLibrary compiles code and runs it once to collect the registered functions
+func compileLibrary(code string) (*luaLibrary, reply.ErrorReply) {
+	name, body, errReply := parseLibraryMetadata(code)
+	if errReply != nil {
+		return nil, errReply
+	}
+	proto, err := compileLua(body, functionChunkName)
+	if err != nil {
+		return nil, reply.MakeErrReply("ERR Error compiling function: " + err.Error())
+	}
+	lib := &luaLibrary{name: name, code: code, proto: proto}
+
+	L := newScriptState()
+	defer L.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), functionLoadTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	L.SetGlobal("redis", makeRedisLib(L, nil))
+	protectGlobals(L)
+	functions, _, err := loadLibraryFunctions(L, lib)
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, reply.MakeErrReply("ERR FUNCTION LOAD timeout")
+	}
+	if err != nil {
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			if msg, ok := luaErrMessage(apiErr.Object); ok {
+				return nil, reply.MakeErrReply(msg)
+			}
+			return nil, reply.MakeErrReply("ERR Error registering functions: " + apiErr.Object.String())
+		}
+		return nil, reply.MakeErrReply("ERR Error registering functions: " + err.Error())
+	}
+	if len(functions) == 0 {
+		return nil, reply.MakeErrReply("ERR No functions registered")
+	}
+	lib.functions = functions
+	return lib, nil
+}
+
+// loadLibraryFunctions runs code of lib in L, which registers functions by redis.register_function.
+// Commands can't be called while loading
+func loadLibraryFunctions(L *lua.LState, lib *luaLibrary) (map[string]*luaFunction, map[string]*lua.LFunction, error) {
+	redisLib, _ := L.GetGlobal("redis").(*lua.LTable)
+	call, pcall := redisLib.RawGetString("call"), redisLib.RawGetString("pcall")
+	redisLib.RawSetString("call", lua.LNil)
+	redisLib.RawSetString("pcall", lua.LNil)
+	functions := make(map[string]*luaFunction)
+	callbacks := make(map[string]*lua.LFunction)
+	redisLib.RawSetString("register_function", L.NewFunction(func(L *lua.LState) int {
+		fn, callback, errMsg := parseRegisterFunction(L)
+		if errMsg == "" {
+			if _, ok := functions[fn.name]; ok {
+				errMsg = "ERR Function already exists in the library"
+			}
+		}
+		if errMsg != "" {
+			L.Error(makeLuaStatusTable(L, "err", errMsg), 1)
+			return 0
+		}
+		functions[fn.name] = fn
+		callbacks[fn.name] = callback
+		return 0
+	}))
+
+	L.Push(L.NewFunctionFromProto(lib.proto))
+	err := L.PCall(0, 0, nil)
+	redisLib.RawSetString("register_function", lua.LNil)
+	redisLib.RawSetString("call", call)
+	redisLib.RawSetString("pcall", pcall)
+	return functions, callbacks, err
+}
+
+// parseRegisterFunction parses arguments of redis.register_function, which could be
+// `name, callback` or a table like {function_name=..., callback=..., flags={...}, description=...}
+func parseRegisterFunction(L *lua.LState) (*luaFunction, *lua.LFunction, string) {
+	fn := &luaFunction{}
+	var name, callback lua.LValue
+	errMsg := ""
+	switch L.GetTop() {
+	case 1:
+		tb, ok := L.Get(1).(*lua.LTable)
+		if !ok {
+			return nil, nil, "ERR calling redis.register_function with a single argument is only applicable to Lua table"
+		}
+		tb.ForEach(func(k lua.LValue, v lua.LValue) {
+			switch k.String() {
+			case "function_name":
+				name = v
+			case "callback":
+				callback = v
+			case "description":
+				if desc, ok := v.(lua.LString); ok {
+					fn.description = string(desc)
+				} else {
+					errMsg = "ERR description argument given to redis.register_function must be a string"
+				}
+			case "flags":
+				flags, ok := v.(*lua.LTable)
+				if !ok {
+					errMsg = "ERR flags argument to redis.register_function must be a table representing function flags"
+					return
+				}
+				flags.ForEach(func(_ lua.LValue, flag lua.LValue) {
+					if _, ok := functionFlags[flag.String()]; !ok || flag.Type() != lua.LTString {
+						errMsg = "ERR unknown flag given"
+						return
+					}
+					fn.flags = append(fn.flags, flag.String())
+				})
+			default:
+				errMsg = "ERR unknown argument given to redis.register_function"
+			}
+		})
+	case 2:
+		name, callback = L.Get(1), L.Get(2)
+	default:
+		return nil, nil, "ERR wrong number of arguments to redis.register_function"
+	}
+	if errMsg != "" {
+		return nil, nil, errMsg
+	}
+	nameStr, ok := name.(lua.LString)
+	if !ok {
+		return nil, nil, "ERR function_name argument given to redis.register_function must be a string"
+	}
+	callbackFn, ok := callback.(*lua.LFunction)
+	if !ok {
+		return nil, nil, "ERR callback argument given to redis.register_function must be a function"
+	}
+	if !isValidFunctionName(string(nameStr)) {
+		return nil, nil, "ERR Function names can only contain letters, numbers, or underscores(_) " +
+			"and must be at least one character long"
+	}
+	fn.name = string(nameStr)
+	return fn, callbackFn, ""
+}
+
+// loadLibrary installs a library saved in rdb
+func (db *DB) loadLibrary(code string) error {
+	lib, errReply := compileLibrary(code)
+	if errReply == nil {
+		errReply = db.functions.install([]*luaLibrary{lib}, false, false)
+	}
+	if errReply != nil {
+		return errReply
+	}
+	return nil
+}
+
+// dumpLibraries serializes libraries like FUNCTION DUMP of redis: function opcode and code of each library,
+// followed by the footer of DUMP
+func dumpLibraries(libs []*luaLibrary) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := newRdbEncoder(buf)
+	for _, lib := range libs {
+		err := enc.writeFunction(lib.code)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return writeDumpFooter(enc, buf)
+}
+
+// restoreLibraries deserializes a verified payload of FUNCTION DUMP
+func restoreLibraries(payload []byte) ([]*luaLibrary, reply.ErrorReply) {
+	size := len(payload) - dumpFooterSize
+	dec := newRdbDecoder(bytes.NewReader(payload[:size]))
+	dec.maxLength = uint64(size)
+	var libs []*luaLibrary
+	for dec.offset < int64(size) {
+		opcode, err := dec.readByte()
+		if err != nil {
+			return nil, reply.MakeErrReply("ERR Bad data format")
+		}
+		if opcode != rdbOpcodeFunction2 {
+			return nil, reply.MakeErrReply("ERR given type is not a function")
+		}
+		code, err := dec.readString()
+		if err != nil {
+			return nil, reply.MakeErrReply("ERR Bad data format")
+		}
+		lib, errReply := compileLibrary(string(code))
+		if errReply != nil {
+			return nil, errReply
+		}
+		libs = append(libs, lib)
+	}
+	return libs, nil
+}
+
+// execFunction implements FUNCTION LOAD, LIST, DELETE, FLUSH, DUMP and RESTORE
+func execFunction(db *DB, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "load":
+		return execFunctionLoad(db, args)
+	case "list":
+		return execFunctionList(db, args[1:])
+	case "delete":
+		if len(args) != 2 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'function|delete' command")
+		}
+		if !db.functions.delete(string(args[1])) {
+			return reply.MakeErrReply("ERR Library not found")
+		}
+		db.AddAof(makeAofCmd("function", args))
+		return reply.MakeOkReply()
+	case "flush":
+		if len(args) > 2 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'function|flush' command")
+		}
+		if len(args) == 2 {
+			mode := strings.ToLower(string(args[1]))
+			if mode != "sync" && mode != "async" {
+				return reply.MakeErrReply("ERR FUNCTION FLUSH only supports SYNC|ASYNC option")
+			}
+		}
+		db.functions.flush()
+		db.AddAof(makeAofCmd("function", args))
+		return reply.MakeOkReply()
+	case "dump":
+		if len(args) != 1 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'function|dump' command")
+		}
+		payload, err := dumpLibraries(db.functions.list())
+		if err != nil {
+			return reply.MakeErrReply("ERR " + err.Error())
+		}
+		return reply.MakeBulkReply(payload)
+	case "restore":
+		return execFunctionRestore(db, args)
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try FUNCTION HELP.")
+}
+
+// execFunctionLoad loads a library: FUNCTION LOAD [REPLACE] code
+func execFunctionLoad(db *DB, args [][]byte) redis.Reply {
+	if len(args) != 2 && len(args) != 3 {
+		return reply.MakeErrReply("ERR wrong number of arguments for 'function|load' command")
+	}
+	replace := false
+	if len(args) == 3 {
+		if strings.ToUpper(string(args[1])) != "REPLACE" {
+			return reply.MakeErrReply("ERR Unknown option given: " + string(args[1]))
+		}
+		replace = true
+	}
+	lib, errReply := compileLibrary(string(args[len(args)-1]))
+	if errReply != nil {
+		return errReply
+	}
+	errReply = db.functions.install([]*luaLibrary{lib}, replace, false)
+	if errReply != nil {
+		return errReply
+	}
+	db.AddAof(makeAofCmd("function", args))
+	return reply.MakeBulkReply([]byte(lib.name))
+}
+
+// execFunctionList lists libraries: FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE]
+func execFunctionList(db *DB, args [][]byte) redis.Reply {
+	pattern, withCode := "", false
+	for i := 0; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i]))
+		switch {
+		case option == "WITHCODE" && !withCode:
+			withCode = true
+		case option == "LIBRARYNAME" && i+1 < len(args) && pattern == "":
+			pattern = string(args[i+1])
+			i++
+		default:
+			return &reply.SyntaxErrReply{}
+		}
+	}
+	var result []redis.Reply
+	for _, lib := range db.functions.list() {
+		if pattern != "" {
+			if ok, _ := path.Match(pattern, lib.name); !ok {
+				continue
+			}
+		}
+		names := make([]string, 0, len(lib.functions))
+		for name := range lib.functions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		functions := make([]redis.Reply, len(names))
+		for i, name := range names {
+			fn := lib.functions[name]
+			var description redis.Reply = reply.MakeNullBulkReply()
+			if fn.description != "" {
+				description = reply.MakeBulkReply([]byte(fn.description))
+			}
+			functions[i] = reply.MakeMultiRawReply([]redis.Reply{
+				reply.MakeBulkReply([]byte("name")), reply.MakeBulkReply([]byte(fn.name)),
+				reply.MakeBulkReply([]byte("description")), description,
+				reply.MakeBulkReply([]byte("flags")), reply.MakeMultiBulkReply(utils.ToCmdLine(fn.flags...)),
+			})
+		}
+		item := []redis.Reply{
+			reply.MakeBulkReply([]byte("library_name")), reply.MakeBulkReply([]byte(lib.name)),
+			reply.MakeBulkReply([]byte("engine")), reply.MakeBulkReply([]byte("LUA")),
+			reply.MakeBulkReply([]byte("functions")), reply.MakeMultiRawReply(functions),
+		}
+		if withCode {
+			item = append(item, reply.MakeBulkReply([]byte("library_code")), reply.MakeBulkReply([]byte(lib.code)))
+		}
+		result = append(result, reply.MakeMultiRawReply(item))
+	}
+	return reply.MakeMultiRawReply(result)
+}
+
+// execFunctionRestore restores libraries from payload of FUNCTION DUMP: FUNCTION RESTORE payload [FLUSH|APPEND|REPLACE]
+func execFunctionRestore(db *DB, args [][]byte) redis.Reply {
+	if len(args) != 2 && len(args) != 3 {
+		return reply.MakeErrReply("ERR wrong number of arguments for 'function|restore' command")
+	}
+	flush, replace := false, false
+	if len(args) == 3 {
+		switch strings.ToUpper(string(args[2])) {
+		case "FLUSH":
+			flush = true
+		case "REPLACE":
+			replace = true
+		case "APPEND":
+		default:
+			return reply.MakeErrReply("ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+		}
+	}
+	if !verifyDumpPayload(args[1]) {
+		return reply.MakeErrReply("ERR payload version or checksum are wrong")
+	}
+	libs, errReply := restoreLibraries(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	errReply = db.functions.install(libs, replace, flush)
+	if errReply != nil {
+		return errReply
+	}
+	db.AddAof(makeAofCmd("function", args))
+	return reply.MakeOkReply()
+}
+
+// execFCall calls a function: FCALL function numkeys [key ...] [arg ...]
+func execFCall(db *DB, args [][]byte) redis.Reply {
+	return db.fcall(args, false)
+}
+
+// execFCallRO calls a function which must not write: FCALL_RO function numkeys [key ...] [arg ...]
+func execFCallRO(db *DB, args [][]byte) redis.Reply {
+	return db.fcall(args, true)
+}
+
+func (db *DB) fcall(args [][]byte, readOnly bool) redis.Reply {
+	keys, argv, errReply := parseScriptKeys(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	lib, fn := db.functions.get(string(args[0]))
+	if fn == nil {
+		return reply.MakeErrReply("ERR Function not found")
+	}
+	readOnly = readOnly || fn.hasFlag("no-writes")
+	return db.runLua(keys, readOnly, fn.name, func(L *lua.LState) (*lua.LFunction, []lua.LValue, error) {
+		protectGlobals(L)
+		_, callbacks, err := loadLibraryFunctions(L, lib)
+		if err != nil {
+			return nil, nil, err
+		}
+		callback, ok := callbacks[fn.name]
+		if !ok {
+			return nil, nil, fmt.Errorf("function %s is not registered by library %s", fn.name, lib.name)
+		}
+		keyTable := makeLuaArray(L, utils.ToCmdLine(keys...))
+		return callback, []lua.LValue{keyTable, makeLuaArray(L, argv)}, nil
+	})
+}
+
+// prepareFCallRO locks declared keys for reading, since nothing would be written
+func prepareFCallRO(args [][]byte) ([]string, []string) {
+	keys, _ := prepareEval(args)
+	return nil, keys
+}
+
+func init() {
+	RegisterCommand("Function", execFunction, noPrepare, nil, -2)
+	RegisterCommand("FCall", execFCall, prepareEval, undoEval, -3)
+	RegisterCommand("FCall_RO", execFCallRO, prepareFCallRO, nil, -3)
+}
@@ -0,0 +1,202 @@
+package core
+
+import (
+	"Tiny-Godis/lib/config"
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/reply"
+	"Tiny-Godis/redis/reply/asserts"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const testLibrary = `#!lua name=mylib
+local function set(keys, args)
+  return redis.call('SET', keys[1], args[1])
+end
+redis.register_function('myset', set)
+redis.register_function('myget', function(keys, args) return redis.call('GET', keys[1]) end)
+redis.register_function{
+  function_name = 'myget_ro',
+  callback = function(keys, args) return redis.call('GET', keys[1]) end,
+  flags = {'no-writes'},
+  description = 'get a key',
+}
+redis.register_function{
+  function_name = 'myset_ro',
+  callback = set,
+  flags = {'no-writes'},
+}
+`
+
+func TestFunctionLoad(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "FLUSH"))
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LOAD", testLibrary)), "mylib")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LOAD", testLibrary)), "ERR Library 'mylib' already exists")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LOAD", "REPLACE", testLibrary)), "mylib")
+
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("FCALL", "myset", "1", "key", "value")), "OK")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("FCALL", "myget", "1", "key")), "value")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FCALL", "none", "0")), "ERR Function not found")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FCALL", "myget", "0")),
+		"ERR Lua redis lib command arguments must be strings or integers")
+
+	other := "#!lua name=other\nredis.register_function('myget', function() return 1 end)"
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LOAD", other)), "ERR Function myget already exists")
+	other = "#!lua name=other\nredis.register_function('other', function() return 1 end)"
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LOAD", other)), "other")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("FCALL", "other", "0")), 1)
+	// functions removed by REPLACE are gone
+	other = "#!lua name=other\nredis.register_function('other2', function() return 2 end)"
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LOAD", "REPLACE", other)), "other")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FCALL", "other", "0")), "ERR Function not found")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("FCALL", "other2", "0")), 2)
+
+	errCases := map[string]string{
+		"redis.register_function('f', function() end)": "ERR Missing library metadata",
+		"#!js name=lib\n":             "ERR Engine 'js' not found",
+		"#!lua\n":                     "ERR Library name was not given",
+		"#!lua name=lib foo=bar\n":    "ERR Invalid metadata value given: foo=bar",
+		"#!lua name=a-b\n":            "ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long",
+		"#!lua name=lib\nlocal a = 1": "ERR No functions registered",
+		"#!lua name=lib\nredis.register_function('f', function() end)\nredis.register_function('f', function() end)": "ERR Function already exists in the library",
+		"#!lua name=lib\nredis.register_function('f-1', function() end)":                                             "ERR Function names can only contain letters, numbers, or underscores(_) and must be at least one character long",
+		"#!lua name=lib\nredis.register_function('f', 1)":                                                            "ERR callback argument given to redis.register_function must be a function",
+		"#!lua name=lib\nredis.register_function{function_name='f', callback=function() end, flags={'foo'}}":         "ERR unknown flag given",
+	}
+	for code, expected := range errCases {
+		asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LOAD", code)), expected)
+	}
+	for _, code := range []string{
+		"#!lua name=lib\nredis.register_function('f', function() end",
+		"#!lua name=lib\nredis.call('SET', 'k', 'v')",
+		"#!lua name=lib\nx = 1",
+	} {
+		result := testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LOAD", code))
+		if !reply.IsErrorReply(result) {
+			t.Errorf("expected error of loading, actually %q", result.ToBytes())
+		}
+	}
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LOAD", "KEEP", testLibrary)), "ERR Unknown option given: KEEP")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "FOO")), "ERR unknown subcommand 'FOO'. Try FUNCTION HELP.")
+}
+
+func TestFCallRO(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "FLUSH"))
+	testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LOAD", testLibrary))
+	testDB.Exec(nil, utils.ToCmdLine("SET", "key", "value"))
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("FCALL_RO", "myget", "1", "key")), "value")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("FCALL_RO", "myget_ro", "1", "key")), "value")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FCALL_RO", "myset", "1", "key", "v2")),
+		"ERR Write commands are not allowed from read-only scripts.")
+	// functions with no-writes flag are read-only even called by FCALL
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FCALL", "myset_ro", "1", "key", "v2")),
+		"ERR Write commands are not allowed from read-only scripts.")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", "key")), "value")
+}
+
+func TestFunctionList(t *testing.T) {
+	testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "FLUSH"))
+	assertArrayLen(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LIST")), 0)
+	testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LOAD", testLibrary))
+	other := "#!lua name=other\nredis.register_function('f', function() return 1 end)"
+	testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LOAD", other))
+
+	result := testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LIST", "LIBRARYNAME", "oth*", "WITHCODE"))
+	expected := arrayRESP(arrayRESP(
+		bulkRESP("library_name"), bulkRESP("other"),
+		bulkRESP("engine"), bulkRESP("LUA"),
+		bulkRESP("functions"), arrayRESP(arrayRESP(
+			bulkRESP("name"), bulkRESP("f"),
+			bulkRESP("description"), "$-1\r\n",
+			bulkRESP("flags"), arrayRESP(),
+		)),
+		bulkRESP("library_code"), bulkRESP(other),
+	))
+	if string(result.ToBytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, result.ToBytes())
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LIST"))
+	assertArrayLen(t, result, 2)
+	for _, s := range []string{bulkRESP("get a key"), arrayRESP(bulkRESP("no-writes"))} {
+		if !strings.Contains(string(result.ToBytes()), s) {
+			t.Errorf("%q not found in %q", s, result.ToBytes())
+		}
+	}
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LIST", "FOO")), "Err syntax error")
+
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "DELETE", "other")), "OK")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "DELETE", "other")), "ERR Library not found")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FCALL", "f", "0")), "ERR Function not found")
+	assertArrayLen(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LIST")), 1)
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "FLUSH", "SYNC")), "OK")
+	assertArrayLen(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LIST")), 0)
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "FLUSH", "NOW")), "ERR FUNCTION FLUSH only supports SYNC|ASYNC option")
+}
+
+func TestFunctionDumpRestore(t *testing.T) {
+	testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "FLUSH"))
+	testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LOAD", testLibrary))
+	result := testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "DUMP"))
+	payload, ok := result.(*reply.BulkReply)
+	if !ok {
+		t.Fatalf("expected bulk reply, actually %q", result.ToBytes())
+	}
+
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "RESTORE", string(payload.Arg))), "ERR Library 'mylib' already exists")
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "RESTORE", string(payload.Arg), "REPLACE")), "OK")
+	other := "#!lua name=other\nredis.register_function('f', function() return 1 end)"
+	testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LOAD", other))
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "RESTORE", string(payload.Arg), "FLUSH")), "OK")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FCALL", "f", "0")), "ERR Function not found")
+	testDB.Exec(nil, utils.ToCmdLine("SET", "key", "value"))
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("FCALL", "myget", "1", "key")), "value")
+
+	testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "FLUSH"))
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "RESTORE", string(payload.Arg), "APPEND")), "OK")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("FCALL", "myget", "1", "key")), "value")
+
+	corrupted := []byte(string(payload.Arg))
+	corrupted[3]++
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "RESTORE", string(corrupted))), "ERR payload version or checksum are wrong")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "RESTORE", string(payload.Arg), "KEEP")),
+		"ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+	dump, _ := dumpEntity(&DataEntity{Data: []byte("str")})
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("FUNCTION", "RESTORE", string(dump))), "ERR given type is not a function")
+}
+
+func TestFunctionAof(t *testing.T) {
+	for _, useRdb := range []bool{false, true} {
+		tmpDir, err := ioutil.TempDir("", "Tiny-Godis")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		props := config.Properties
+		config.Properties = &config.ServerProperties{
+			AppendOnly:        true,
+			AppendFilename:    path.Join(tmpDir, "a.aof"),
+			AofUseRdbPreamble: useRdb,
+		}
+		aofWriteDB := MakeDB()
+		aofWriteDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LOAD", testLibrary))
+		other := "#!lua name=other\nredis.register_function('f', function() return 1 end)"
+		aofWriteDB.Exec(nil, utils.ToCmdLine("FUNCTION", "LOAD", other))
+		aofWriteDB.Exec(nil, utils.ToCmdLine("FCALL", "myset", "1", "key", "value"))
+		aofWriteDB.RewriteAof()
+		// commands after rewrite are in incr file
+		aofWriteDB.Exec(nil, utils.ToCmdLine("FUNCTION", "DELETE", "other"))
+		aofWriteDB.Close()
+
+		aofReadDB := MakeDB()
+		asserts.AssertBulkReply(t, aofReadDB.Exec(nil, utils.ToCmdLine("FCALL", "myget", "1", "key")), "value")
+		asserts.AssertErrReply(t, aofReadDB.Exec(nil, utils.ToCmdLine("FCALL", "f", "0")), "ERR Function not found")
+		aofReadDB.Close()
+		config.Properties = props
+		_ = os.RemoveAll(tmpDir)
+	}
+}
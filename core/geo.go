@@ -0,0 +1,598 @@
+package core
+
+import (
+	"Tiny-Godis/data_struct/sortedset"
+	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/geohash"
+	"Tiny-Godis/redis/reply"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// geo sets are sorted sets whose scores are 52 bits geohash of members
+
+// parseLongLat parses longitude and latitude, they must be in the range of geohash
+func parseLongLat(longArg []byte, latArg []byte) (float64, float64, reply.ErrorReply) {
+	longitude, err1 := strconv.ParseFloat(string(longArg), 64)
+	latitude, err2 := strconv.ParseFloat(string(latArg), 64)
+	if err1 != nil || err2 != nil {
+		return 0, 0, reply.MakeErrReply("ERR value is not a valid float")
+	}
+	if longitude < geohash.LongMin || longitude > geohash.LongMax || latitude < geohash.LatMin || latitude > geohash.LatMax {
+		return 0, 0, reply.MakeErrReply(fmt.Sprintf("ERR invalid longitude,latitude pair %f,%f", longitude, latitude))
+	}
+	return longitude, latitude, nil
+}
+
+// parseGeoUnit returns meters of the unit
+func parseGeoUnit(arg []byte) (float64, reply.ErrorReply) {
+	switch strings.ToLower(string(arg)) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	}
+	return 0, reply.MakeErrReply("ERR unsupported unit provided. please use M, KM, FT, MI")
+}
+
+// parseGeoRadius parses radius with unit, returns the radius and meters of the unit
+func parseGeoRadius(distArg []byte, unitArg []byte) (float64, float64, reply.ErrorReply) {
+	distance, err := strconv.ParseFloat(string(distArg), 64)
+	if err != nil {
+		return 0, 0, reply.MakeErrReply("ERR need numeric radius")
+	}
+	if distance < 0 {
+		return 0, 0, reply.MakeErrReply("ERR radius cannot be negative")
+	}
+	conversion, errReply := parseGeoUnit(unitArg)
+	if errReply != nil {
+		return 0, 0, errReply
+	}
+	return distance, conversion, nil
+}
+
+// parseGeoBox parses width and height with unit, returns the width, height and meters of the unit
+func parseGeoBox(widthArg []byte, heightArg []byte, unitArg []byte) (float64, float64, float64, reply.ErrorReply) {
+	width, err := strconv.ParseFloat(string(widthArg), 64)
+	if err != nil {
+		return 0, 0, 0, reply.MakeErrReply("ERR need numeric width")
+	}
+	height, err := strconv.ParseFloat(string(heightArg), 64)
+	if err != nil {
+		return 0, 0, 0, reply.MakeErrReply("ERR need numeric height")
+	}
+	if width < 0 || height < 0 {
+		return 0, 0, 0, reply.MakeErrReply("ERR height or width cannot be negative")
+	}
+	conversion, errReply := parseGeoUnit(unitArg)
+	if errReply != nil {
+		return 0, 0, 0, errReply
+	}
+	return width, height, conversion, nil
+}
+
+// geoMemberPos returns longitude and latitude of member
+func geoMemberPos(zset *sortedset.SortedSet, member string) (float64, float64, bool) {
+	score, ok := zset.Get(member)
+	if !ok {
+		return 0, 0, false
+	}
+	longitude, latitude := geohash.DecodeScore(uint64(score))
+	return longitude, latitude, true
+}
+
+// formatGeoDistance formats distance with 4 decimal places
+func formatGeoDistance(distance float64) []byte {
+	return []byte(strconv.FormatFloat(distance, 'f', 4, 64))
+}
+
+// formatCoordinate formats coordinate with 17 decimal places without trailing zeros like redis
+func formatCoordinate(coordinate float64) []byte {
+	s := strconv.FormatFloat(coordinate, 'f', 17, 64)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimSuffix(s, ".")
+	return []byte(s)
+}
+
+// execGeoAdd adds members with their coordinates: GEOADD key [NX|XX] [CH] longitude latitude member [longitude latitude member ...]
+// It is executed as ZADD of geohash scores
+func execGeoAdd(db *DB, args [][]byte) redis.Reply {
+	var nx, xx bool
+	index := 1
+options:
+	for ; index < len(args); index++ {
+		switch strings.ToUpper(string(args[index])) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+		default:
+			break options
+		}
+	}
+	triples := args[index:]
+	if len(triples) == 0 || len(triples)%3 != 0 || (nx && xx) {
+		return &reply.SyntaxErrReply{}
+	}
+	zaddArgs := make([][]byte, 0, index+len(triples)/3*2)
+	zaddArgs = append(zaddArgs, args[:index]...)
+	for i := 0; i < len(triples); i += 3 {
+		longitude, latitude, errReply := parseLongLat(triples[i], triples[i+1])
+		if errReply != nil {
+			return errReply
+		}
+		score, _ := geohash.EncodeScore(longitude, latitude)
+		zaddArgs = append(zaddArgs, []byte(strconv.FormatUint(score, 10)), triples[i+2])
+	}
+	return execZAdd(db, zaddArgs)
+}
+
+// execGeoPos returns coordinates of members: GEOPOS key [member ...]
+func execGeoPos(db *DB, args [][]byte) redis.Reply {
+	zset, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	replies := make([]redis.Reply, len(args)-1)
+	for i, member := range args[1:] {
+		if zset == nil {
+			replies[i] = reply.MakeNullMultiBulkReply()
+			continue
+		}
+		longitude, latitude, ok := geoMemberPos(zset, string(member))
+		if !ok {
+			replies[i] = reply.MakeNullMultiBulkReply()
+			continue
+		}
+		replies[i] = reply.MakeMultiBulkReply([][]byte{formatCoordinate(longitude), formatCoordinate(latitude)})
+	}
+	return reply.MakeMultiRawReply(replies)
+}
+
+// execGeoDist returns distance between members: GEODIST key member1 member2 [M|KM|FT|MI]
+func execGeoDist(db *DB, args [][]byte) redis.Reply {
+	conversion := 1.0
+	if len(args) == 4 {
+		var errReply reply.ErrorReply
+		conversion, errReply = parseGeoUnit(args[3])
+		if errReply != nil {
+			return errReply
+		}
+	} else if len(args) > 4 {
+		return &reply.SyntaxErrReply{}
+	}
+	zset, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if zset == nil {
+		return &reply.NullBulkReply{}
+	}
+	long1, lat1, ok1 := geoMemberPos(zset, string(args[1]))
+	long2, lat2, ok2 := geoMemberPos(zset, string(args[2]))
+	if !ok1 || !ok2 {
+		return &reply.NullBulkReply{}
+	}
+	return reply.MakeBulkReply(formatGeoDistance(geohash.Distance(long1, lat1, long2, lat2) / conversion))
+}
+
+// execGeoHash returns standard geohash strings of members: GEOHASH key [member ...]
+func execGeoHash(db *DB, args [][]byte) redis.Reply {
+	zset, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	result := make([][]byte, len(args)-1)
+	for i, member := range args[1:] {
+		if zset == nil {
+			continue
+		}
+		if score, ok := zset.Get(string(member)); ok {
+			result[i] = []byte(geohash.ToString(uint64(score)))
+		}
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+/* ---- GEOSEARCH and GEORADIUS ---- */
+
+const (
+	geoRadiusCoords = 1 << iota
+	geoRadiusMember
+	geoSearch
+	geoSearchStore
+	geoNoStore
+)
+
+const (
+	geoSortNone = iota
+	geoSortAsc
+	geoSortDesc
+)
+
+type geoSearchArgs struct {
+	shape geohash.Shape
+	// meters of the unit of distances in reply
+	conversion float64
+	withDist   bool
+	withHash   bool
+	withCoord  bool
+	sort       int
+	// 0 means no limit
+	count     int64
+	any       bool
+	store     string
+	storeDist bool
+}
+
+type geoPoint struct {
+	member    string
+	score     float64
+	longitude float64
+	latitude  float64
+	dist      float64
+}
+
+// parseGeoSearch parses options after base arguments, zset is needed by FROMMEMBER
+func parseGeoSearch(zset *sortedset.SortedSet, args [][]byte, base int, flags int, cmdName string) (*geoSearchArgs, reply.ErrorReply) {
+	ga := &geoSearchArgs{}
+	var errReply reply.ErrorReply
+	var radius, width, height float64
+	switch {
+	case flags&geoRadiusCoords > 0:
+		ga.shape.Longitude, ga.shape.Latitude, errReply = parseLongLat(args[1], args[2])
+		if errReply != nil {
+			return nil, errReply
+		}
+		radius, ga.conversion, errReply = parseGeoRadius(args[3], args[4])
+		if errReply != nil {
+			return nil, errReply
+		}
+	case flags&geoRadiusMember > 0 && zset != nil:
+		var ok bool
+		ga.shape.Longitude, ga.shape.Latitude, ok = geoMemberPos(zset, string(args[1]))
+		if !ok {
+			return nil, reply.MakeErrReply("ERR could not decode requested zset member")
+		}
+		radius, ga.conversion, errReply = parseGeoRadius(args[2], args[3])
+		if errReply != nil {
+			return nil, errReply
+		}
+	}
+
+	var fromMember, fromLonLat, byRadius, byBox bool
+	for i := base; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i]))
+		left := len(args) - i - 1
+		switch {
+		case option == "WITHDIST":
+			ga.withDist = true
+		case option == "WITHHASH":
+			ga.withHash = true
+		case option == "WITHCOORD":
+			ga.withCoord = true
+		case option == "ANY":
+			ga.any = true
+		case option == "ASC":
+			ga.sort = geoSortAsc
+		case option == "DESC":
+			ga.sort = geoSortDesc
+		case option == "COUNT" && left >= 1:
+			count, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return nil, reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if count <= 0 {
+				return nil, reply.MakeErrReply("ERR COUNT must be > 0")
+			}
+			ga.count = count
+			i++
+		case (option == "STORE" || option == "STOREDIST") && left >= 1 && flags&(geoNoStore|geoSearch) == 0:
+			ga.store = string(args[i+1])
+			ga.storeDist = option == "STOREDIST"
+			i++
+		case option == "STOREDIST" && flags&geoSearchStore > 0:
+			ga.storeDist = true
+		case option == "FROMMEMBER" && left >= 1 && flags&geoSearch > 0 && !fromLonLat:
+			// the error of missing key is returned after parsing
+			if zset != nil {
+				var ok bool
+				ga.shape.Longitude, ga.shape.Latitude, ok = geoMemberPos(zset, string(args[i+1]))
+				if !ok {
+					return nil, reply.MakeErrReply("ERR could not decode requested zset member")
+				}
+			}
+			fromMember = true
+			i++
+		case option == "FROMLONLAT" && left >= 2 && flags&geoSearch > 0 && !fromMember:
+			ga.shape.Longitude, ga.shape.Latitude, errReply = parseLongLat(args[i+1], args[i+2])
+			if errReply != nil {
+				return nil, errReply
+			}
+			fromLonLat = true
+			i += 2
+		case option == "BYRADIUS" && left >= 2 && flags&geoSearch > 0 && !byBox:
+			radius, ga.conversion, errReply = parseGeoRadius(args[i+1], args[i+2])
+			if errReply != nil {
+				return nil, errReply
+			}
+			byRadius = true
+			i += 2
+		case option == "BYBOX" && left >= 3 && flags&geoSearch > 0 && !byRadius:
+			width, height, ga.conversion, errReply = parseGeoBox(args[i+1], args[i+2], args[i+3])
+			if errReply != nil {
+				return nil, errReply
+			}
+			byBox = true
+			i += 3
+		default:
+			return nil, &reply.SyntaxErrReply{}
+		}
+	}
+
+	if (ga.store != "" || flags&geoSearchStore > 0) && (ga.withDist || ga.withHash || ga.withCoord) {
+		name := "STORE option in GEORADIUS"
+		if flags&geoSearchStore > 0 {
+			name = "GEOSEARCHSTORE"
+		}
+		return nil, reply.MakeErrReply("ERR " + name + " is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+	}
+	if flags&geoSearch > 0 && !fromMember && !fromLonLat {
+		return nil, reply.MakeErrReply("ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for " + cmdName)
+	}
+	if flags&geoSearch > 0 && !byRadius && !byBox {
+		return nil, reply.MakeErrReply("ERR exactly one of BYRADIUS and BYBOX can be specified for " + cmdName)
+	}
+	if ga.any && ga.count == 0 {
+		return nil, reply.MakeErrReply("ERR the ANY argument requires COUNT argument")
+	}
+	// COUNT returns the nearest members
+	if ga.count > 0 && ga.sort == geoSortNone && !ga.any {
+		ga.sort = geoSortAsc
+	}
+	if byBox {
+		ga.shape.IsBox = true
+		ga.shape.Width = width * ga.conversion
+		ga.shape.Height = height * ga.conversion
+	} else {
+		ga.shape.Radius = radius * ga.conversion
+	}
+	return ga, nil
+}
+
+// geoMembersInShape searches the area of center and its neighbors, stops when limit members are found if limit is not 0
+func geoMembersInShape(zset *sortedset.SortedSet, shape *geohash.Shape, limit int64) []*geoPoint {
+	radius := geohash.AreasByShape(shape)
+	n := radius.Neighbors
+	areas := []geohash.Bits{radius.Hash, n.North, n.South, n.East, n.West, n.NorthEast, n.NorthWest, n.SouthEast, n.SouthWest}
+	var points []*geoPoint
+	lastProcessed := 0
+	for i, hash := range areas {
+		if hash.IsZero() {
+			continue
+		}
+		// neighbors of a huge radius may be the same area
+		if lastProcessed != 0 && hash == areas[lastProcessed] {
+			continue
+		}
+		if limit > 0 && int64(len(points)) >= limit {
+			break
+		}
+		min, max := geohash.ScoreRange(hash)
+		zset.ForEachByScore(float64(min), float64(max), func(member string, score float64) bool {
+			longitude, latitude := geohash.DecodeScore(uint64(score))
+			dist, ok := shape.Contains(longitude, latitude)
+			if !ok {
+				return true
+			}
+			points = append(points, &geoPoint{
+				member:    member,
+				score:     score,
+				longitude: longitude,
+				latitude:  latitude,
+				dist:      dist,
+			})
+			return limit == 0 || int64(len(points)) < limit
+		})
+		lastProcessed = i
+	}
+	return points
+}
+
+func execGeoSearchGeneric(db *DB, args [][]byte, flags int, cmdName string) redis.Reply {
+	srcIndex, base := 0, 1
+	switch {
+	case flags&geoRadiusCoords > 0:
+		base = 5
+	case flags&geoRadiusMember > 0:
+		base = 4
+	case flags&geoSearchStore > 0:
+		srcIndex, base = 1, 2
+	}
+	zset, errReply := db.getAsSortedSet(string(args[srcIndex]))
+	if errReply != nil {
+		return errReply
+	}
+	ga, errReply := parseGeoSearch(zset, args, base, flags, cmdName)
+	if errReply != nil {
+		return errReply
+	}
+	if flags&geoSearchStore > 0 {
+		ga.store = string(args[0])
+	}
+
+	var points []*geoPoint
+	if zset != nil {
+		limit := int64(0)
+		if ga.any {
+			limit = ga.count
+		}
+		points = geoMembersInShape(zset, &ga.shape, limit)
+	}
+	switch ga.sort {
+	case geoSortAsc:
+		sort.SliceStable(points, func(i, j int) bool {
+			return points[i].dist < points[j].dist
+		})
+	case geoSortDesc:
+		sort.SliceStable(points, func(i, j int) bool {
+			return points[i].dist > points[j].dist
+		})
+	}
+	if ga.count > 0 && int64(len(points)) > ga.count {
+		points = points[:ga.count]
+	}
+	for _, point := range points {
+		point.dist /= ga.conversion
+	}
+
+	if ga.store != "" {
+		return db.storeGeoPoints(ga.store, points, ga.storeDist)
+	}
+	if len(points) == 0 {
+		return reply.MakeEmptyMultiBulkReply()
+	}
+	if !ga.withDist && !ga.withHash && !ga.withCoord {
+		members := make([][]byte, len(points))
+		for i, point := range points {
+			members[i] = []byte(point.member)
+		}
+		return reply.MakeMultiBulkReply(members)
+	}
+	replies := make([]redis.Reply, len(points))
+	for i, point := range points {
+		item := []redis.Reply{reply.MakeBulkReply([]byte(point.member))}
+		if ga.withDist {
+			item = append(item, reply.MakeBulkReply(formatGeoDistance(point.dist)))
+		}
+		if ga.withHash {
+			item = append(item, reply.MakeIntReply(int64(point.score)))
+		}
+		if ga.withCoord {
+			item = append(item, reply.MakeMultiBulkReply([][]byte{formatCoordinate(point.longitude), formatCoordinate(point.latitude)}))
+		}
+		replies[i] = reply.MakeMultiRawReply(item)
+	}
+	return reply.MakeMultiRawReply(replies)
+}
+
+// storeGeoPoints stores points into a sorted set by their geohash or distance, destination is removed if there is no point
+func (db *DB) storeGeoPoints(dest string, points []*geoPoint, storeDist bool) redis.Reply {
+	db.Remove(dest)
+	db.AddAof(makeAofCmd("DEL", [][]byte{[]byte(dest)}))
+	if len(points) == 0 {
+		return reply.MakeIntReply(0)
+	}
+	zset := sortedset.Make()
+	for _, point := range points {
+		score := point.score
+		if storeDist {
+			score = point.dist
+		}
+		zset.Add(point.member, score)
+	}
+	db.PutEntity(dest, &DataEntity{Data: zset})
+	db.AddAof(EntityToCmd(dest, &DataEntity{Data: zset}))
+	return reply.MakeIntReply(int64(len(points)))
+}
+
+// execGeoSearch returns members in a circle or box: GEOSEARCH key FROMMEMBER member|FROMLONLAT longitude latitude
+// BYRADIUS radius M|KM|FT|MI|BYBOX width height M|KM|FT|MI [ASC|DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]
+func execGeoSearch(db *DB, args [][]byte) redis.Reply {
+	return execGeoSearchGeneric(db, args, geoSearch, "geosearch")
+}
+
+// execGeoSearchStore stores result of GEOSEARCH: GEOSEARCHSTORE destination source ... [STOREDIST]
+func execGeoSearchStore(db *DB, args [][]byte) redis.Reply {
+	return execGeoSearchGeneric(db, args, geoSearch|geoSearchStore, "geosearchstore")
+}
+
+// execGeoRadius returns members in a circle: GEORADIUS key longitude latitude radius M|KM|FT|MI
+// [WITHCOORD] [WITHDIST] [WITHHASH] [COUNT count [ANY]] [ASC|DESC] [STORE key|STOREDIST key]
+func execGeoRadius(db *DB, args [][]byte) redis.Reply {
+	return execGeoSearchGeneric(db, args, geoRadiusCoords, "georadius")
+}
+
+func execGeoRadiusRO(db *DB, args [][]byte) redis.Reply {
+	return execGeoSearchGeneric(db, args, geoRadiusCoords|geoNoStore, "georadius_ro")
+}
+
+// execGeoRadiusByMember is GEORADIUS around a member: GEORADIUSBYMEMBER key member radius M|KM|FT|MI ...
+func execGeoRadiusByMember(db *DB, args [][]byte) redis.Reply {
+	return execGeoSearchGeneric(db, args, geoRadiusMember, "georadiusbymember")
+}
+
+func execGeoRadiusByMemberRO(db *DB, args [][]byte) redis.Reply {
+	return execGeoSearchGeneric(db, args, geoRadiusMember|geoNoStore, "georadiusbymember_ro")
+}
+
+// geoRadiusStoreKey returns destination of STORE or STOREDIST options
+func geoRadiusStoreKey(args [][]byte, base int) string {
+	for i := base; i+1 < len(args); i++ {
+		option := strings.ToUpper(string(args[i]))
+		if option == "STORE" || option == "STOREDIST" {
+			return string(args[i+1])
+		}
+	}
+	return ""
+}
+
+func prepareGeoRadius(args [][]byte) ([]string, []string) {
+	if store := geoRadiusStoreKey(args, 5); store != "" {
+		return []string{store}, []string{string(args[0])}
+	}
+	return readFirstKey(args)
+}
+
+func prepareGeoRadiusByMember(args [][]byte) ([]string, []string) {
+	if store := geoRadiusStoreKey(args, 4); store != "" {
+		return []string{store}, []string{string(args[0])}
+	}
+	return readFirstKey(args)
+}
+
+func undoGeoRadius(db *DB, args [][]byte) []CmdLine {
+	if store := geoRadiusStoreKey(args, 4); store != "" {
+		return rollbackGivenKeys(db, store)
+	}
+	return nil
+}
+
+func prepareGeoSearchStore(args [][]byte) ([]string, []string) {
+	return []string{string(args[0])}, []string{string(args[1])}
+}
+
+func undoGeoAdd(db *DB, args [][]byte) []CmdLine {
+	index := 1
+	for ; index < len(args); index++ {
+		option := strings.ToUpper(string(args[index]))
+		if option != "NX" && option != "XX" && option != "CH" {
+			break
+		}
+	}
+	var members []string
+	for i := index + 2; i < len(args); i += 3 {
+		members = append(members, string(args[i]))
+	}
+	return rollbackZSetMembers(db, string(args[0]), members...)
+}
+
+func init() {
+	RegisterCommand("GeoAdd", execGeoAdd, writeFirstKey, undoGeoAdd, -5)
+	RegisterCommand("GeoPos", execGeoPos, readFirstKey, nil, -2)
+	RegisterCommand("GeoDist", execGeoDist, readFirstKey, nil, -4)
+	RegisterCommand("GeoHash", execGeoHash, readFirstKey, nil, -2)
+	RegisterCommand("GeoSearch", execGeoSearch, readFirstKey, nil, -7)
+	RegisterCommand("GeoSearchStore", execGeoSearchStore, prepareGeoSearchStore, rollbackFirstKey, -8)
+	RegisterCommand("GeoRadius", execGeoRadius, prepareGeoRadius, undoGeoRadius, -6)
+	RegisterCommand("GeoRadius_RO", execGeoRadiusRO, readFirstKey, nil, -6)
+	RegisterCommand("GeoRadiusByMember", execGeoRadiusByMember, prepareGeoRadiusByMember, undoGeoRadius, -5)
+	RegisterCommand("GeoRadiusByMember_RO", execGeoRadiusByMemberRO, readFirstKey, nil, -5)
+}
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/reply/asserts"
+	"testing"
+)
+
+// reference replies are taken from redis with the same dataset
+
+func addSicily() {
+	testDB.Exec(nil, utils.ToCmdLine("GEOADD", "Sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania"))
+}
+
+func TestGeoAdd(t *testing.T) {
+	testDB.Flush()
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOADD", "Sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania")), 2)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("ZSCORE", "Sicily", "Palermo")), "3479099956230698")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("ZSCORE", "Sicily", "Catania")), "3479447370796909")
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("TYPE", "Sicily")), "zset")
+
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOADD", "Sicily", "NX", "13", "38", "Palermo")), 0)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("ZSCORE", "Sicily", "Palermo")), "3479099956230698")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOADD", "Sicily", "XX", "CH", "13", "38", "Palermo", "13", "38", "Rome")), 1)
+	asserts.AssertNullBulk(t, testDB.Exec(nil, utils.ToCmdLine("ZSCORE", "Sicily", "Rome")))
+
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOADD", "Sicily", "200", "100", "Nowhere")), "ERR invalid longitude,latitude pair 200.000000,100.000000")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOADD", "Sicily", "x", "38", "Nowhere")), "ERR value is not a valid float")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOADD", "Sicily", "NX", "XX", "13", "38", "Palermo")), "Err syntax error")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOADD", "Sicily", "13", "38", "Palermo", "13")), "Err syntax error")
+}
+
+func TestGeoPosDistHash(t *testing.T) {
+	testDB.Flush()
+	addSicily()
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOPOS", "Sicily", "Palermo", "NonExisting")),
+		"*2\r\n*2\r\n$20\r\n13.36138933897018433\r\n$20\r\n38.11555639549629859\r\n*-1\r\n")
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOPOS", "none", "Palermo")), "*1\r\n*-1\r\n")
+
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GEODIST", "Sicily", "Palermo", "Catania")), "166274.1516")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GEODIST", "Sicily", "Palermo", "Catania", "km")), "166.2742")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GEODIST", "Sicily", "Palermo", "Catania", "MI")), "103.3182")
+	asserts.AssertNullBulk(t, testDB.Exec(nil, utils.ToCmdLine("GEODIST", "Sicily", "Foo", "Bar")))
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("GEODIST", "Sicily", "Palermo", "Catania", "yd")), "ERR unsupported unit provided. please use M, KM, FT, MI")
+
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOHASH", "Sicily", "Palermo", "Catania", "none")),
+		"*3\r\n$11\r\nsqc8b49rny0\r\n$11\r\nsqdtr74hyu0\r\n$-1\r\n")
+}
+
+func TestGeoSearch(t *testing.T) {
+	testDB.Flush()
+	addSicily()
+	testDB.Exec(nil, utils.ToCmdLine("GEOADD", "Sicily", "12.758489", "38.788135", "edge1", "17.241510", "38.788135", "edge2"))
+
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC")),
+		[]string{"Catania", "Palermo"})
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC", "WITHCOORD", "WITHDIST")),
+		"*4\r\n"+
+			"*3\r\n$7\r\nCatania\r\n$7\r\n56.4413\r\n*2\r\n$20\r\n15.08726745843887329\r\n$20\r\n37.50266842333162032\r\n"+
+			"*3\r\n$7\r\nPalermo\r\n$8\r\n190.4424\r\n*2\r\n$20\r\n13.36138933897018433\r\n$20\r\n38.11555639549629859\r\n"+
+			"*3\r\n$5\r\nedge2\r\n$8\r\n279.7403\r\n*2\r\n$20\r\n17.24151045083999634\r\n$20\r\n38.78813451624225195\r\n"+
+			"*3\r\n$5\r\nedge1\r\n$8\r\n279.7405\r\n*2\r\n$19\r\n12.7584877610206604\r\n$20\r\n38.78813451624225195\r\n")
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOSEARCH", "Sicily", "FROMMEMBER", "Palermo", "BYRADIUS", "200", "km", "DESC", "WITHHASH", "COUNT", "1")),
+		"*1\r\n*2\r\n$7\r\nCatania\r\n:3479447370796909\r\n")
+	asserts.AssertMultiBulkReplySize(t, testDB.Exec(nil, utils.ToCmdLine("GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "COUNT", "2", "ANY")), 2)
+	asserts.AssertMultiBulkReplySize(t, testDB.Exec(nil, utils.ToCmdLine("GEOSEARCH", "none", "FROMMEMBER", "Palermo", "BYRADIUS", "200", "km")), 0)
+
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOSEARCH", "Sicily", "BYRADIUS", "200", "km", "ASC", "WITHDIST")),
+		"ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for geosearch")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "ASC", "WITHDIST")),
+		"ERR exactly one of BYRADIUS and BYBOX can be specified for geosearch")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "FROMMEMBER", "Palermo", "BYRADIUS", "200", "km")),
+		"Err syntax error")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOSEARCH", "Sicily", "FROMMEMBER", "Rome", "BYRADIUS", "200", "km")),
+		"ERR could not decode requested zset member")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ANY")),
+		"ERR the ANY argument requires COUNT argument")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYBOX", "-1", "1", "km")),
+		"ERR height or width cannot be negative")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "COUNT", "0")),
+		"ERR COUNT must be > 0")
+}
+
+func TestGeoSearchStore(t *testing.T) {
+	testDB.Flush()
+	addSicily()
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOSEARCHSTORE", "dst", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km")), 2)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("ZSCORE", "dst", "Palermo")), "3479099956230698")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOSEARCHSTORE", "dst", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "100", "km", "STOREDIST")), 1)
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("ZRANGE", "dst", "0", "-1", "WITHSCORES")), []string{"Catania", "56.4412578701582"})
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOSEARCHSTORE", "dst", "Sicily", "FROMLONLAT", "0", "0", "BYRADIUS", "1", "km")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXISTS", "dst")), 0)
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("GEOSEARCHSTORE", "dst", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "WITHDIST")),
+		"ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+}
+
+func TestGeoRadius(t *testing.T) {
+	testDB.Flush()
+	addSicily()
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GEORADIUS", "Sicily", "15", "37", "100", "km")), []string{"Catania"})
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("GEORADIUS", "Sicily", "15", "37", "200", "km", "WITHDIST")),
+		"*2\r\n*2\r\n$7\r\nPalermo\r\n$8\r\n190.4424\r\n*2\r\n$7\r\nCatania\r\n$7\r\n56.4413\r\n")
+	testDB.Exec(nil, utils.ToCmdLine("GEOADD", "Sicily", "13.583333", "37.316667", "Agrigento"))
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GEORADIUSBYMEMBER", "Sicily", "Agrigento", "100", "km")), []string{"Agrigento", "Palermo"})
+
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("GEORADIUS", "Sicily", "15", "37", "200", "km", "STORE", "dst")), 3)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("ZCARD", "dst")), 3)
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("GEORADIUS_RO", "Sicily", "15", "37", "200", "km", "STORE", "dst")), "Err syntax error")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("GEORADIUS", "Sicily", "15", "37", "200", "km", "STORE", "dst", "WITHCOORD")),
+		"ERR STORE option in GEORADIUS is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+
+	writeKeys, readKeys := prepareGeoRadius(utils.ToCmdLine("Sicily", "15", "37", "200", "km", "STOREDIST", "dst"))
+	if len(writeKeys) != 1 || writeKeys[0] != "dst" || len(readKeys) != 1 || readKeys[0] != "Sicily" {
+		t.Errorf("unexpected keys of GEORADIUS STOREDIST: %v %v", writeKeys, readKeys)
+	}
+}
@@ -3,7 +3,11 @@ package core
 import (
 	"Tiny-Godis/data_struct/dict"
 	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/config"
 	"Tiny-Godis/redis/reply"
+	"math"
+	"strconv"
+	"strings"
 )
 
 func (db *DB) getAsDict(key string) (dict.Dict, reply.ErrorReply) {
@@ -18,13 +22,18 @@ func (db *DB) getAsDict(key string) (dict.Dict, reply.ErrorReply) {
 	return value, nil
 }
 
+// makeHash creates an empty hash, which is encoded as listpack until it exceeds limits in config
+func makeHash() dict.Dict {
+	return dict.MakeCompactDict(config.Properties.HashMaxListpackEntries, config.Properties.HashMaxListpackValue)
+}
+
 func (db *DB) getOrInitDict(key string) (dict.Dict, reply.ErrorReply) {
 	d, result := db.getAsDict(key)
 	if result != nil {
 		return nil, result
 	}
 	if d == nil {
-		nd := dict.MakeSimpleDict()
+		nd := makeHash()
 		entity := DataEntity{Data: nd}
 		db.PutEntity(key, &entity)
 		return nd, nil
@@ -88,7 +97,7 @@ func execHMSet(db *DB, args [][]byte) redis.Reply {
 func undoHMSet(db *DB, args [][]byte) []CmdLine {
 	key := args[0]
 	fields := make([]string, len(args)/2)
-	for i := 0; i < len(args); i++ {
+	for i := 0; i < len(fields); i++ {
 		fields[i] = string(args[2*i+1])
 	}
 	return rollbackHashFields(db, string(key), fields...)
@@ -185,6 +194,226 @@ func execHGet(db *DB, args [][]byte) redis.Reply {
 	return reply.MakeBulkReply(value)
 }
 
+func execHGetAll(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	d, err := db.getAsDict(key)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return &reply.EmptyMultiBulkReply{}
+	}
+
+	result := make([][]byte, 0, d.Len()*2)
+	d.ForEach(func(field string, val interface{}) bool {
+		value, _ := val.([]byte)
+		result = append(result, []byte(field), value)
+		return true
+	})
+	return reply.MakeMultiBulkReply(result)
+}
+
+func execHKeys(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	d, err := db.getAsDict(key)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return &reply.EmptyMultiBulkReply{}
+	}
+
+	fields := make([][]byte, 0, d.Len())
+	d.ForEach(func(field string, val interface{}) bool {
+		fields = append(fields, []byte(field))
+		return true
+	})
+	return reply.MakeMultiBulkReply(fields)
+}
+
+func execHVals(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	d, err := db.getAsDict(key)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return &reply.EmptyMultiBulkReply{}
+	}
+
+	values := make([][]byte, 0, d.Len())
+	d.ForEach(func(field string, val interface{}) bool {
+		value, _ := val.([]byte)
+		values = append(values, value)
+		return true
+	})
+	return reply.MakeMultiBulkReply(values)
+}
+
+func execHMGet(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	d, err := db.getAsDict(key)
+	if err != nil {
+		return err
+	}
+
+	result := make([][]byte, len(args)-1)
+	if d == nil {
+		return reply.MakeMultiBulkReply(result)
+	}
+	for i, field := range args[1:] {
+		raw, ok := d.Get(string(field))
+		if ok {
+			result[i], _ = raw.([]byte)
+		}
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+func execHStrLen(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	field := string(args[1])
+	d, err := db.getAsDict(key)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return reply.MakeIntReply(0)
+	}
+
+	raw, ok := d.Get(field)
+	if !ok {
+		return reply.MakeIntReply(0)
+	}
+	value, _ := raw.([]byte)
+	return reply.MakeIntReply(int64(len(value)))
+}
+
+func execHIncrBy(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	field := string(args[1])
+	delta, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+
+	d, errReply := db.getOrInitDict(key)
+	if errReply != nil {
+		return errReply
+	}
+	var num int64
+	if raw, ok := d.Get(field); ok {
+		value, _ := raw.([]byte)
+		num, err = strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return reply.MakeErrReply("ERR hash value is not an integer")
+		}
+	}
+	if (delta > 0 && num > math.MaxInt64-delta) || (delta < 0 && num < math.MinInt64-delta) {
+		return reply.MakeErrReply("ERR increment or decrement would overflow")
+	}
+	num += delta
+	d.Put(field, []byte(strconv.FormatInt(num, 10)))
+	db.AddAof(makeAofCmd("HINCRBY", args))
+	return reply.MakeIntReply(num)
+}
+
+// execHIncrByFloat adds a float delta to field, it is written into aof as HSET of the result
+func execHIncrByFloat(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	field := string(args[1])
+	delta, err := strconv.ParseFloat(string(args[2]), 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return reply.MakeErrReply("ERR value is not a valid float")
+	}
+
+	d, errReply := db.getOrInitDict(key)
+	if errReply != nil {
+		return errReply
+	}
+	var num float64
+	if raw, ok := d.Get(field); ok {
+		value, _ := raw.([]byte)
+		num, err = strconv.ParseFloat(string(value), 64)
+		if err != nil {
+			return reply.MakeErrReply("ERR hash value is not a float")
+		}
+	}
+	num += delta
+	if math.IsNaN(num) || math.IsInf(num, 0) {
+		return reply.MakeErrReply("ERR increment would produce NaN or Infinity")
+	}
+	result := []byte(strconv.FormatFloat(num, 'f', -1, 64))
+	d.Put(field, result)
+	db.AddAof(makeAofCmd("HSET", [][]byte{args[0], args[1], result}))
+	return reply.MakeBulkReply(result)
+}
+
+// execHRandField returns random fields: HRANDFIELD key [count [WITHVALUES]]
+// a positive count returns distinct fields, a negative count allows the same field multiple times
+func execHRandField(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	count := int64(1)
+	withCount := false
+	withValues := false
+	if len(args) > 1 {
+		var err error
+		count, err = strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return reply.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		withCount = true
+	}
+	if len(args) == 3 {
+		if strings.ToUpper(string(args[2])) != "WITHVALUES" {
+			return &reply.SyntaxErrReply{}
+		}
+		withValues = true
+	} else if len(args) > 3 {
+		return &reply.SyntaxErrReply{}
+	}
+	// a negative count is negated, and doubled if WITHVALUES is given
+	if count == math.MinInt64 || (withValues && count < -math.MaxInt64/2) {
+		return reply.MakeErrReply("ERR value is out of range")
+	}
+
+	d, err := db.getAsDict(key)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		if withCount {
+			return &reply.EmptyMultiBulkReply{}
+		}
+		return &reply.NullBulkReply{}
+	}
+
+	if !withCount {
+		fields := d.RandomKeys(1)
+		return reply.MakeBulkReply([]byte(fields[0]))
+	}
+	var fields []string
+	if count >= 0 {
+		fields = d.RandomDistinctKeys(int(count))
+	} else {
+		fields = d.RandomKeys(int(-count))
+	}
+	if !withValues {
+		result := make([][]byte, len(fields))
+		for i, field := range fields {
+			result[i] = []byte(field)
+		}
+		return reply.MakeMultiBulkReply(result)
+	}
+	result := make([][]byte, 0, len(fields)*2)
+	for _, field := range fields {
+		raw, _ := d.Get(field)
+		value, _ := raw.([]byte)
+		result = append(result, []byte(field), value)
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
 func init() {
 	RegisterCommand("HSet", execHSet, writeFirstKey, undoHSet, 4)
 	RegisterCommand("HSetNX", execHSetNX, writeFirstKey, undoHSet, 4)
@@ -193,4 +422,12 @@ func init() {
 	RegisterCommand("HDel", execHDel, writeFirstKey, undoHDel, -3)
 	RegisterCommand("HLen", execHLen, readFirstKey, nil, 2)
 	RegisterCommand("HMSet", execHMSet, writeFirstKey, undoHMSet, -4)
+	RegisterCommand("HMGet", execHMGet, readFirstKey, nil, -3)
+	RegisterCommand("HGetAll", execHGetAll, readFirstKey, nil, 2)
+	RegisterCommand("HKeys", execHKeys, readFirstKey, nil, 2)
+	RegisterCommand("HVals", execHVals, readFirstKey, nil, 2)
+	RegisterCommand("HStrLen", execHStrLen, readFirstKey, nil, 3)
+	RegisterCommand("HIncrBy", execHIncrBy, writeFirstKey, undoHSet, 4)
+	RegisterCommand("HIncrByFloat", execHIncrByFloat, writeFirstKey, undoHSet, 4)
+	RegisterCommand("HRandField", execHRandField, readFirstKey, nil, -2)
 }
@@ -0,0 +1,173 @@
+package core
+
+import (
+	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/config"
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/reply"
+	"Tiny-Godis/redis/reply/asserts"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestHGetAll(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	size := 50
+	fields := make([]string, size)
+	values := make([]string, size)
+	for i := 0; i < size; i++ {
+		fields[i] = "f" + strconv.Itoa(i)
+		values[i] = "v" + strconv.Itoa(i)
+		testDB.Exec(nil, utils.ToCmdLine("HSET", key, fields[i], values[i]))
+	}
+
+	result := testDB.Exec(nil, utils.ToCmdLine("HGETALL", key))
+	multiBulk, ok := result.(*reply.MultiBulkReply)
+	if !ok || len(multiBulk.Args) != size*2 {
+		t.Errorf("expect %d fields and values, actual %s", size, result.ToBytes())
+		return
+	}
+	for i := 0; i < len(multiBulk.Args); i += 2 {
+		field := string(multiBulk.Args[i])
+		if "v"+field[1:] != string(multiBulk.Args[i+1]) {
+			t.Errorf("wrong value of field %s", field)
+		}
+	}
+
+	result = testDB.Exec(nil, utils.ToCmdLine("HKEYS", key))
+	assertSameMembers(t, result, fields)
+	result = testDB.Exec(nil, utils.ToCmdLine("HVALS", key))
+	assertSameMembers(t, result, values)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("HMGET", key, "f1", "none", "f2"))
+	multiBulk, _ = result.(*reply.MultiBulkReply)
+	if multiBulk == nil || string(multiBulk.Args[0]) != "v1" || multiBulk.Args[1] != nil || string(multiBulk.Args[2]) != "v2" {
+		t.Errorf("wrong hmget result %s", result.ToBytes())
+	}
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("HSTRLEN", key, "f10")), 3)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("HSTRLEN", key, "none")), 0)
+
+	asserts.AssertMultiBulkReplySize(t, testDB.Exec(nil, utils.ToCmdLine("HGETALL", key+"none")), 0)
+	asserts.AssertMultiBulkReplySize(t, testDB.Exec(nil, utils.ToCmdLine("HMGET", key+"none", "a", "b")), 2)
+}
+
+func assertSameMembers(t *testing.T, actual redis.Reply, expected []string) {
+	multiBulk, ok := actual.(*reply.MultiBulkReply)
+	if !ok || len(multiBulk.Args) != len(expected) {
+		t.Errorf("expect %d members, actual %s", len(expected), actual.ToBytes())
+		return
+	}
+	members := make([]string, len(multiBulk.Args))
+	for i, arg := range multiBulk.Args {
+		members[i] = string(arg)
+	}
+	sort.Strings(members)
+	sorted := append([]string{}, expected...)
+	sort.Strings(sorted)
+	for i := range members {
+		if members[i] != sorted[i] {
+			t.Errorf("expect %v, actual %v", sorted, members)
+			return
+		}
+	}
+}
+
+func TestHIncrBy(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("HINCRBY", key, "f", "5")), 5)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("HINCRBY", key, "f", "-7")), -2)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("HGET", key, "f")), "-2")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("HINCRBYFLOAT", key, "f", "0.5")), "-1.5")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("HINCRBY", key, "f", "1")), "ERR hash value is not an integer")
+
+	undoLogs := testDB.GetUndoLog(utils.ToCmdLine("HINCRBY", key, "g", "1"))
+	testDB.Exec(nil, utils.ToCmdLine("HINCRBY", key, "g", "1"))
+	for _, cmdLine := range undoLogs {
+		testDB.Exec(nil, cmdLine)
+	}
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("HEXISTS", key, "g")), 0)
+}
+
+func TestHRandField(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	size := 10
+	for i := 0; i < size; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("HSET", key, "f"+strconv.Itoa(i), "v"+strconv.Itoa(i)))
+	}
+
+	result := testDB.Exec(nil, utils.ToCmdLine("HRANDFIELD", key))
+	if _, ok := result.(*reply.BulkReply); !ok {
+		t.Errorf("expect bulk reply, actual %s", result.ToBytes())
+	}
+	asserts.AssertMultiBulkReplySize(t, testDB.Exec(nil, utils.ToCmdLine("HRANDFIELD", key, "5")), 5)
+	asserts.AssertMultiBulkReplySize(t, testDB.Exec(nil, utils.ToCmdLine("HRANDFIELD", key, "20")), size)
+	asserts.AssertMultiBulkReplySize(t, testDB.Exec(nil, utils.ToCmdLine("HRANDFIELD", key, "-20")), 20)
+	asserts.AssertMultiBulkReplySize(t, testDB.Exec(nil, utils.ToCmdLine("HRANDFIELD", key, "0")), 0)
+
+	// distinct fields
+	result = testDB.Exec(nil, utils.ToCmdLine("HRANDFIELD", key, "8", "WITHVALUES"))
+	multiBulk := result.(*reply.MultiBulkReply)
+	seen := make(map[string]bool)
+	for i := 0; i < len(multiBulk.Args); i += 2 {
+		field := string(multiBulk.Args[i])
+		if seen[field] {
+			t.Errorf("duplicated field %s", field)
+		}
+		seen[field] = true
+		if "v"+field[1:] != string(multiBulk.Args[i+1]) {
+			t.Errorf("wrong value of field %s", field)
+		}
+	}
+	if len(seen) != 8 {
+		t.Errorf("expect 8 fields, actual %d", len(seen))
+	}
+
+	asserts.AssertNullBulk(t, testDB.Exec(nil, utils.ToCmdLine("HRANDFIELD", key+"none")))
+	asserts.AssertMultiBulkReplySize(t, testDB.Exec(nil, utils.ToCmdLine("HRANDFIELD", key+"none", "3")), 0)
+
+	// negative counts which could not be negated
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("HRANDFIELD", key, "-9223372036854775808")),
+		"ERR value is out of range")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("HRANDFIELD", key, "-4611686018427387904", "WITHVALUES")),
+		"ERR value is out of range")
+}
+
+func TestHashEncoding(t *testing.T) {
+	testDB.Flush()
+	props := *config.Properties
+	defer func() {
+		*config.Properties = props
+	}()
+	config.Properties.HashMaxListpackEntries = 4
+	config.Properties.HashMaxListpackValue = 8
+
+	key := utils.RandString(10)
+	for i := 0; i < 4; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("HSET", key, "f"+strconv.Itoa(i), "v"+strconv.Itoa(i)))
+	}
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "ENCODING", key)), "listpack")
+	testDB.Exec(nil, utils.ToCmdLine("HSET", key, "f1", "v"))
+	testDB.Exec(nil, utils.ToCmdLine("HDEL", key, "f2"))
+	testDB.Exec(nil, utils.ToCmdLine("HINCRBY", key, "n", "3"))
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "ENCODING", key)), "listpack")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("HGET", key, "f1")), "v")
+	asserts.AssertNullBulk(t, testDB.Exec(nil, utils.ToCmdLine("HGET", key, "f2")))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("HLEN", key)), 4)
+
+	// too many fields
+	testDB.Exec(nil, utils.ToCmdLine("HSET", key, "f4", "v4"))
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "ENCODING", key)), "hashtable")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("HLEN", key)), 5)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("HGET", key, "n")), "3")
+
+	// too long value
+	key = utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("HSET", key, "f", "v"))
+	testDB.Exec(nil, utils.ToCmdLine("HSET", key, "f", "abcdefghijk"))
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "ENCODING", key)), "hashtable")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("HGET", key, "f")), "abcdefghijk")
+}
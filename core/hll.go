@@ -0,0 +1,213 @@
+package core
+
+import (
+	"Tiny-Godis/data_struct/hll"
+	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/config"
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/reply"
+	"strings"
+)
+
+var (
+	invalidHllErrReply   = reply.MakeErrReply("WRONGTYPE Key is not a valid HyperLogLog string value.")
+	corruptedHllErrReply = reply.MakeErrReply("INVALIDOBJ Corrupted HLL object detected")
+)
+
+// getAsHll returns HyperLogLog stored as string, nil if key does not exist
+func (db *DB) getAsHll(key string) ([]byte, reply.ErrorReply) {
+	entity, ok := db.GetEntity(key)
+	if !ok {
+		return nil, nil
+	}
+	val, ok := stringValue(entity.Data)
+	if !ok || !hll.IsValid(val) {
+		return nil, invalidHllErrReply
+	}
+	return val, nil
+}
+
+// execPFAdd adds elements into HyperLogLog: PFADD key [element ...]
+func execPFAdd(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	buf, errReply := db.getAsHll(key)
+	if errReply != nil {
+		return errReply
+	}
+	created := buf == nil
+	if created {
+		buf = hll.Make()
+	}
+	// registers are modified on a copy, since replies of GET may still refer to the value
+	result, updated, err := hll.Add(buf, args[1:], config.Properties.HllSparseMaxBytes)
+	if err != nil {
+		return corruptedHllErrReply
+	}
+	if !created && !updated {
+		return reply.MakeIntReply(0)
+	}
+	db.PutEntity(key, makeRawStringEntity(result))
+	db.AddAof(makeAofCmd("PFADD", args))
+	return reply.MakeIntReply(1)
+}
+
+// execPFCount returns approximated cardinality of the union of HyperLogLogs: PFCOUNT key [key ...]
+func execPFCount(db *DB, args [][]byte) redis.Reply {
+	if len(args) > 1 {
+		max := make([]uint8, hll.Registers)
+		for _, arg := range args {
+			buf, errReply := db.getAsHll(string(arg))
+			if errReply != nil {
+				return errReply
+			}
+			if buf == nil {
+				continue
+			}
+			if err := hll.Merge(max, buf); err != nil {
+				return corruptedHllErrReply
+			}
+		}
+		return reply.MakeIntReply(int64(hll.CountRegisters(max)))
+	}
+
+	key := string(args[0])
+	buf, errReply := db.getAsHll(key)
+	if errReply != nil {
+		return errReply
+	}
+	if buf == nil {
+		return reply.MakeIntReply(0)
+	}
+	if card, ok := hll.CachedCount(buf); ok {
+		return reply.MakeIntReply(int64(card))
+	}
+	card, err := hll.Count(buf)
+	if err != nil {
+		return corruptedHllErrReply
+	}
+	// the cache is not written into aof, it is recomputed after loading
+	result := make([]byte, len(buf))
+	copy(result, buf)
+	hll.SetCachedCount(result, card)
+	db.PutEntity(key, makeRawStringEntity(result))
+	return reply.MakeIntReply(int64(card))
+}
+
+// execPFMerge merges HyperLogLogs into destination: PFMERGE destkey [sourcekey ...]
+func execPFMerge(db *DB, args [][]byte) redis.Reply {
+	max := make([]uint8, hll.Registers)
+	dense := false
+	// destination is merged as well
+	for _, arg := range args {
+		buf, errReply := db.getAsHll(string(arg))
+		if errReply != nil {
+			return errReply
+		}
+		if buf == nil {
+			continue
+		}
+		if hll.Encoding(buf) == "dense" {
+			dense = true
+		}
+		if err := hll.Merge(max, buf); err != nil {
+			return corruptedHllErrReply
+		}
+	}
+	dest := string(args[0])
+	buf, _ := db.getAsHll(dest)
+	if buf == nil {
+		buf = hll.Make()
+	}
+	result, err := hll.SetRegisters(buf, max, dense, config.Properties.HllSparseMaxBytes)
+	if err != nil {
+		return corruptedHllErrReply
+	}
+	db.PutEntity(dest, makeRawStringEntity(result))
+	db.AddAof(makeAofCmd("PFMERGE", args))
+	return reply.MakeOkReply()
+}
+
+// execPFDebug inspects HyperLogLog: PFDEBUG GETREG|DECODE|ENCODING|TODENSE key
+func execPFDebug(db *DB, args [][]byte) redis.Reply {
+	if len(args) != 2 {
+		return reply.MakeArgNumErrReply("pfdebug")
+	}
+	subCmd := strings.ToLower(string(args[0]))
+	key := string(args[1])
+	buf, errReply := db.getAsHll(key)
+	if errReply != nil {
+		return errReply
+	}
+	if buf == nil {
+		return reply.MakeErrReply("ERR The specified key does not exist")
+	}
+
+	switch subCmd {
+	case "getreg", "todense":
+		converted := hll.Encoding(buf) == "sparse"
+		if converted {
+			dense, err := hll.ToDense(buf)
+			if err != nil {
+				return corruptedHllErrReply
+			}
+			buf = dense
+			db.PutEntity(key, makeRawStringEntity(buf))
+			db.AddAof(makeAofCmd("PFDEBUG", utils.ToCmdLine("TODENSE", key)))
+		}
+		if subCmd == "todense" {
+			if converted {
+				return reply.MakeIntReply(1)
+			}
+			return reply.MakeIntReply(0)
+		}
+		registers := hll.GetRegisters(buf)
+		replies := make([]redis.Reply, len(registers))
+		for i, val := range registers {
+			replies[i] = reply.MakeIntReply(int64(val))
+		}
+		return reply.MakeMultiRawReply(replies)
+	case "decode":
+		if hll.Encoding(buf) != "sparse" {
+			return reply.MakeErrReply("ERR HLL encoding is not sparse")
+		}
+		decoded, err := hll.Decode(buf)
+		if err != nil {
+			return corruptedHllErrReply
+		}
+		return reply.MakeStatusReply(decoded)
+	case "encoding":
+		return reply.MakeStatusReply(hll.Encoding(buf))
+	}
+	return reply.MakeErrReply("ERR Unknown PFDEBUG subcommand '" + string(args[0]) + "'")
+}
+
+// preparePFCount returns the only key as write key, since its cached cardinality may be updated
+func preparePFCount(args [][]byte) ([]string, []string) {
+	if len(args) == 1 {
+		return writeFirstKey(args)
+	}
+	return readAllKeys(args)
+}
+
+func preparePFMerge(args [][]byte) ([]string, []string) {
+	_, sources := readAllKeys(args[1:])
+	return []string{string(args[0])}, sources
+}
+
+func preparePFDebug(args [][]byte) ([]string, []string) {
+	if len(args) < 2 {
+		return nil, nil
+	}
+	return writeFirstKey(args[1:])
+}
+
+func undoPFDebug(db *DB, args [][]byte) []CmdLine {
+	return rollbackGivenKeys(db, string(args[1]))
+}
+
+func init() {
+	RegisterCommand("PFAdd", execPFAdd, writeFirstKey, rollbackFirstKey, -2)
+	RegisterCommand("PFCount", execPFCount, preparePFCount, nil, -2)
+	RegisterCommand("PFMerge", execPFMerge, preparePFMerge, rollbackFirstKey, -2)
+	RegisterCommand("PFDebug", execPFDebug, preparePFDebug, undoPFDebug, -3)
+}
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/reply"
+	"Tiny-Godis/redis/reply/asserts"
+	"strconv"
+	"testing"
+)
+
+func TestPFAdd(t *testing.T) {
+	testDB.Flush()
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFADD", "hll")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFADD", "hll")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFCOUNT", "hll")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFADD", "hll", "1", "2", "3", "4", "5")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFADD", "hll", "1", "2")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFCOUNT", "hll")), 5)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFADD", "hll", "6", "7", "8", "8", "9", "10")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFCOUNT", "hll")), 10)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFCOUNT", "none")), 0)
+	// hyperloglog is a raw string like redis even if it is short
+	testDB.Exec(nil, utils.ToCmdLine("PFADD", "empty"))
+	if size := testDB.Exec(nil, utils.ToCmdLine("STRLEN", "empty")).(*reply.IntReply).Code; size > embstrSizeLimit {
+		t.Errorf("expect a short hyperloglog, actual %d bytes", size)
+	}
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "ENCODING", "empty")), "raw")
+
+	testDB.Exec(nil, utils.ToCmdLine("SET", "str", "HYLLxxx"))
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("PFADD", "str", "a")), "WRONGTYPE Key is not a valid HyperLogLog string value.")
+	testDB.Exec(nil, utils.ToCmdLine("RPUSH", "list", "a"))
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("PFCOUNT", "list")), "WRONGTYPE Key is not a valid HyperLogLog string value.")
+}
+
+func TestPFCountCache(t *testing.T) {
+	testDB.Flush()
+	cacheFlag := func() byte {
+		val, _ := testDB.getAsString("hll")
+		return val[15]
+	}
+	testDB.Exec(nil, utils.ToCmdLine("PFADD", "hll", "a", "b", "c"))
+	testDB.Exec(nil, utils.ToCmdLine("PFCOUNT", "hll"))
+	if cacheFlag() != 0 {
+		t.Error("expect cardinality cached")
+	}
+	testDB.Exec(nil, utils.ToCmdLine("PFADD", "hll", "a", "b", "c"))
+	if cacheFlag() != 0 {
+		t.Error("expect cache kept")
+	}
+	testDB.Exec(nil, utils.ToCmdLine("PFADD", "hll", "1", "2", "3"))
+	if cacheFlag() != 0x80 {
+		t.Error("expect cache invalidated")
+	}
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFCOUNT", "hll")), 6)
+}
+
+func TestPFMerge(t *testing.T) {
+	testDB.Flush()
+	for i := 0; i < 1000; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("PFADD", "hll1", strconv.Itoa(i)))
+		testDB.Exec(nil, utils.ToCmdLine("PFADD", "hll2", strconv.Itoa(i+500)))
+	}
+	count := testDB.Exec(nil, utils.ToCmdLine("PFCOUNT", "hll1", "hll2", "none")).(*reply.IntReply).Code
+	if count < 1425 || count > 1575 {
+		t.Errorf("expect union of about 1500 elements, actual %d", count)
+	}
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("PFMERGE", "dst", "hll1", "hll2")), "OK")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFCOUNT", "dst")), int(count))
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("PFDEBUG", "ENCODING", "dst")), "sparse")
+	// destination is dense if any input is dense
+	testDB.Exec(nil, utils.ToCmdLine("PFDEBUG", "TODENSE", "hll2"))
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("PFMERGE", "dst2", "hll1", "hll2")), "OK")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFCOUNT", "dst2")), int(count))
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("PFDEBUG", "ENCODING", "dst2")), "dense")
+
+	// destination is merged as well
+	testDB.Exec(nil, utils.ToCmdLine("PFADD", "small", "a", "b"))
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("PFMERGE", "small", "none")), "OK")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFCOUNT", "small")), 2)
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("PFDEBUG", "ENCODING", "small")), "sparse")
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("PFMERGE", "empty")), "OK")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFCOUNT", "empty")), 0)
+}
+
+func TestPFDebug(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("PFADD", "hll", "a"))
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("PFDEBUG", "ENCODING", "hll")), "sparse")
+	decoded := testDB.Exec(nil, utils.ToCmdLine("PFDEBUG", "DECODE", "hll")).(*reply.StatusReply).Status
+	if decoded == "" {
+		t.Error("expect opcodes of sparse encoding")
+	}
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFDEBUG", "TODENSE", "hll")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFDEBUG", "TODENSE", "hll")), 0)
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("PFDEBUG", "DECODE", "hll")), "ERR HLL encoding is not sparse")
+	registers := testDB.Exec(nil, utils.ToCmdLine("PFDEBUG", "GETREG", "hll")).(*reply.MultiRawReply)
+	if len(registers.Replies) != 16384 {
+		t.Errorf("expect 16384 registers, actual %d", len(registers.Replies))
+	}
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFCOUNT", "hll")), 1)
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("PFDEBUG", "GETREG", "none")), "ERR The specified key does not exist")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("PFDEBUG", "FOO", "hll")), "ERR Unknown PFDEBUG subcommand 'FOO'")
+}
+
+func TestHllAsString(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("PFADD", "hll", "a", "b", "c"))
+	val := testDB.Exec(nil, utils.ToCmdLine("GET", "hll")).(*reply.BulkReply).Arg
+	testDB.Exec(nil, [][]byte{[]byte("SET"), []byte("copy"), val})
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PFCOUNT", "copy")), 3)
+	// a corrupted value is detected
+	corrupted := append([]byte{}, val...)
+	corrupted = append(corrupted, 0x7f, 0xff)
+	testDB.Exec(nil, [][]byte{[]byte("SET"), []byte("corrupted"), corrupted})
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("PFCOUNT", "corrupted", "copy")), "INVALIDOBJ Corrupted HLL object detected")
+}
@@ -1,9 +1,17 @@
 package core
 
 import (
+	"Tiny-Godis/data_struct/dict"
+	"Tiny-Godis/data_struct/list"
+	"Tiny-Godis/data_struct/set"
+	"Tiny-Godis/data_struct/sortedset"
+	"Tiny-Godis/data_struct/stream"
 	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/utils"
 	"Tiny-Godis/redis/reply"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -39,73 +47,152 @@ func execExists(db *DB, args [][]byte) redis.Reply {
 	return reply.MakeIntReply(int64(result))
 }
 
-func execExpire(db *DB, args [][]byte) redis.Reply {
-	key := string(args[0])
-	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
-	if err != nil {
-		return &reply.SyntaxErrReply{}
+// expire flags of Redis 7, only one of them could be given except GT and LT are both absent
+const (
+	expireNX = "NX"
+	expireXX = "XX"
+	expireGT = "GT"
+	expireLT = "LT"
+)
+
+// parseExpireFlag parses the options after the expire time: NX | XX | GT | LT
+func parseExpireFlag(args [][]byte) (string, reply.ErrorReply) {
+	nx, xx, gt, lt := false, false, false, false
+	for _, arg := range args {
+		switch option := strings.ToUpper(string(arg)); option {
+		case expireNX:
+			nx = true
+		case expireXX:
+			xx = true
+		case expireGT:
+			gt = true
+		case expireLT:
+			lt = true
+		default:
+			return "", reply.MakeErrReply("ERR Unsupported option " + string(arg))
+		}
 	}
-	expireTime := time.Duration(ttl) * time.Second
-	_, exist := db.GetEntity(key)
-	if !exist {
-		return reply.MakeIntReply(0)
+	if nx && (xx || gt || lt) {
+		return "", reply.MakeErrReply("ERR NX and XX, GT or LT options at the same time are not compatible")
 	}
-	expireAt := time.Now().Add(expireTime)
-	db.Expire(key, expireAt)
-	db.AddAof(makeExpireAofCmd(key, expireAt))
-	return reply.MakeIntReply(1)
+	if gt && lt {
+		return "", reply.MakeErrReply("ERR GT and LT options at the same time are not compatible")
+	}
+	switch {
+	case nx:
+		return expireNX, nil
+	case gt:
+		// XX is implied by GT since a persistent key has infinite ttl
+		return expireGT, nil
+	case lt && xx:
+		return expireXX + expireLT, nil
+	case lt:
+		return expireLT, nil
+	case xx:
+		return expireXX, nil
+	}
+	return "", nil
 }
 
-func execExpireAt(db *DB, args [][]byte) redis.Reply {
-	key := string(args[0])
-	raw, err := strconv.ParseInt(string(args[1]), 10, 64)
-	if err != nil {
-		return &reply.SyntaxErrReply{}
+// canExpire checks the flag against the current ttl of key
+func (db *DB) canExpire(key string, expireAt time.Time, flag string) bool {
+	raw, hasTTL := db.ttlMap.Get(key)
+	switch flag {
+	case expireNX:
+		return !hasTTL
+	case expireXX:
+		return hasTTL
+	case expireGT:
+		return hasTTL && expireAt.After(raw.(time.Time))
+	case expireLT:
+		return !hasTTL || expireAt.Before(raw.(time.Time))
+	case expireXX + expireLT:
+		return hasTTL && expireAt.Before(raw.(time.Time))
 	}
-	expireAt := time.Unix(raw, 0)
-	_, exist := db.GetEntity(key)
-	if !exist {
-		return reply.MakeIntReply(0)
+	return true
+}
+
+// setExpire sets ttl of an existing key and writes it into aof as an absolute PEXPIREAT,
+// so replaying aof never extends the lifetime of key. A key expiring in the past is deleted at once
+func (db *DB) setExpire(key string, expireAt time.Time) {
+	if !expireAt.After(time.Now()) {
+		db.Remove(key)
+		db.AddAof(reply.MakeMultiBulkReply(utils.ToCmdLine("DEL", key)))
+		return
 	}
 	db.Expire(key, expireAt)
 	db.AddAof(makeExpireAofCmd(key, expireAt))
-	return reply.MakeIntReply(1)
 }
 
-func execPExpire(db *DB, args [][]byte) redis.Reply {
+// execExpireGeneric implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT: key time [NX | XX | GT | LT].
+// unit is the unit of time, absolute means time is a unix timestamp rather than ttl
+func execExpireGeneric(db *DB, args [][]byte, cmdName string, unit time.Duration, absolute bool) redis.Reply {
 	key := string(args[0])
-	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	raw, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
 		return &reply.SyntaxErrReply{}
 	}
-	expireTime := time.Duration(ttl) * time.Millisecond
+	flag, errReply := parseExpireFlag(args[2:])
+	if errReply != nil {
+		return errReply
+	}
+	// expire time in unix nanoseconds must fit in int64
+	if raw > math.MaxInt64/int64(unit) || raw < math.MinInt64/int64(unit) {
+		return reply.MakeErrReply("ERR invalid expire time in '" + cmdName + "' command")
+	}
+	at := raw * int64(unit)
+	if !absolute {
+		now := time.Now().UnixNano()
+		if at > 0 && now > math.MaxInt64-at {
+			return reply.MakeErrReply("ERR invalid expire time in '" + cmdName + "' command")
+		}
+		at += now
+	}
+	expireAt := time.Unix(0, at)
 	_, exist := db.GetEntity(key)
 	if !exist {
 		return reply.MakeIntReply(0)
 	}
-	expireAt := time.Now().Add(expireTime)
-	db.Expire(key, expireAt)
-	db.AddAof(makeExpireAofCmd(key, expireAt))
+	if !db.canExpire(key, expireAt, flag) {
+		return reply.MakeIntReply(0)
+	}
+	db.setExpire(key, expireAt)
 	return reply.MakeIntReply(1)
 }
 
+func execExpire(db *DB, args [][]byte) redis.Reply {
+	return execExpireGeneric(db, args, "expire", time.Second, false)
+}
+
+func execExpireAt(db *DB, args [][]byte) redis.Reply {
+	return execExpireGeneric(db, args, "expireat", time.Second, true)
+}
+
+func execPExpire(db *DB, args [][]byte) redis.Reply {
+	return execExpireGeneric(db, args, "pexpire", time.Millisecond, false)
+}
+
 func execPExpireAt(db *DB, args [][]byte) redis.Reply {
+	return execExpireGeneric(db, args, "pexpireat", time.Millisecond, true)
+}
+
+func execTTL(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
-	raw, err := strconv.ParseInt(string(args[1]), 10, 64)
-	if err != nil {
-		return &reply.SyntaxErrReply{}
-	}
-	expireAt := time.Unix(0, raw*int64(time.Millisecond))
 	_, exist := db.GetEntity(key)
 	if !exist {
-		return reply.MakeIntReply(0)
+		return reply.MakeIntReply(-2)
 	}
-	db.Expire(key, expireAt)
-	db.AddAof(makeExpireAofCmd(key, expireAt))
-	return reply.MakeIntReply(1)
+	raw, exist := db.ttlMap.Get(key)
+	if !exist {
+		return reply.MakeIntReply(-1)
+	}
+
+	expireTime, _ := raw.(time.Time)
+	ttl := expireTime.Sub(time.Now())
+	return reply.MakeIntReply(int64(ttl / time.Second))
 }
 
-func execTTL(db *DB, args [][]byte) redis.Reply {
+func execPTTL(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	_, exist := db.GetEntity(key)
 	if !exist {
@@ -118,7 +205,7 @@ func execTTL(db *DB, args [][]byte) redis.Reply {
 
 	expireTime, _ := raw.(time.Time)
 	ttl := expireTime.Sub(time.Now())
-	return reply.MakeIntReply(int64(ttl / time.Second))
+	return reply.MakeIntReply(int64(ttl / time.Millisecond))
 }
 
 func execPersist(db *DB, args [][]byte) redis.Reply {
@@ -136,8 +223,279 @@ func execPersist(db *DB, args [][]byte) redis.Reply {
 	return reply.MakeIntReply(1)
 }
 
+// typeName returns the type of value reported by TYPE
+func typeName(entity *DataEntity) string {
+	switch entity.Data.(type) {
+	case []byte, int64:
+		return "string"
+	case list.List:
+		return "list"
+	case *set.Set:
+		return "set"
+	case dict.Dict:
+		return "hash"
+	case *sortedset.SortedSet:
+		return "zset"
+	case *stream.Stream:
+		return "stream"
+	}
+	return "none"
+}
+
+func execType(db *DB, args [][]byte) redis.Reply {
+	entity, exists := db.GetEntity(string(args[0]))
+	if !exists {
+		return reply.MakeStatusReply("none")
+	}
+	return reply.MakeStatusReply(typeName(entity))
+}
+
+// moveKey puts the value and ttl of src into dst, dst is overwritten
+func (db *DB) moveKey(src string, dst string, entity *DataEntity) {
+	rawExpireTime, hasTTL := db.ttlMap.Get(src)
+	db.Removes(src, dst)
+	db.PutEntity(dst, entity)
+	if hasTTL {
+		db.Expire(dst, rawExpireTime.(time.Time))
+	}
+	if _, ok := entity.Data.(list.List); ok {
+		db.signalBlocked(dst)
+	}
+}
+
+// execRename renames key: RENAME key newkey
+func execRename(db *DB, args [][]byte) redis.Reply {
+	src := string(args[0])
+	dst := string(args[1])
+	entity, exists := db.GetEntity(src)
+	if !exists {
+		return reply.MakeErrReply("ERR no such key")
+	}
+	if src != dst {
+		db.moveKey(src, dst, entity)
+	}
+	db.AddAof(makeAofCmd("RENAME", args))
+	return reply.MakeOkReply()
+}
+
+// execRenameNX renames key only if newkey does not exist: RENAMENX key newkey
+func execRenameNX(db *DB, args [][]byte) redis.Reply {
+	src := string(args[0])
+	dst := string(args[1])
+	entity, exists := db.GetEntity(src)
+	if !exists {
+		return reply.MakeErrReply("ERR no such key")
+	}
+	if _, exists = db.GetEntity(dst); exists {
+		return reply.MakeIntReply(0)
+	}
+	db.moveKey(src, dst, entity)
+	db.AddAof(makeAofCmd("RENAMENX", args))
+	return reply.MakeIntReply(1)
+}
+
+func undoRename(db *DB, args [][]byte) []CmdLine {
+	return rollbackGivenKeys(db, string(args[0]), string(args[1]))
+}
+
+// copyData returns a deep copy of value, compact encodings are kept as long as the copy fits in them
+func copyData(data interface{}) interface{} {
+	switch val := data.(type) {
+	case []byte:
+		return append([]byte{}, val...)
+	case list.List:
+		l := makeList()
+		val.ForEach(func(v interface{}) bool {
+			l.RPush(append([]byte{}, v.([]byte)...))
+			return true
+		})
+		return l
+	case *set.Set:
+		s := makeSet()
+		val.ForEach(func(member string, _ interface{}) bool {
+			s.Add(member)
+			return true
+		})
+		return s
+	case dict.Dict:
+		d := makeHash()
+		val.ForEach(func(field string, v interface{}) bool {
+			d.Put(field, append([]byte{}, v.([]byte)...))
+			return true
+		})
+		return d
+	case *sortedset.SortedSet:
+		zset := sortedset.Make()
+		val.ForEach(func(member string, score float64) bool {
+			zset.Add(member, score)
+			return true
+		})
+		return zset
+	case *stream.Stream:
+		return val.Copy()
+	}
+	return data
+}
+
+// execCopy copies value of source to destination: COPY source destination [REPLACE]
+func execCopy(db *DB, args [][]byte) redis.Reply {
+	src := string(args[0])
+	dst := string(args[1])
+	replace := false
+	for _, arg := range args[2:] {
+		if strings.ToUpper(string(arg)) != "REPLACE" {
+			return &reply.SyntaxErrReply{}
+		}
+		replace = true
+	}
+	if src == dst {
+		return reply.MakeErrReply("ERR source and destination objects are the same")
+	}
+	entity, exists := db.GetEntity(src)
+	if !exists {
+		return reply.MakeIntReply(0)
+	}
+	if _, exists = db.GetEntity(dst); exists {
+		if !replace {
+			return reply.MakeIntReply(0)
+		}
+		db.Remove(dst)
+	}
+	db.PutEntity(dst, &DataEntity{Data: copyData(entity.Data)})
+	if rawExpireTime, ok := db.ttlMap.Get(src); ok {
+		db.Expire(dst, rawExpireTime.(time.Time))
+	}
+	if _, ok := entity.Data.(list.List); ok {
+		db.signalBlocked(dst)
+	}
+	db.AddAof(makeAofCmd("COPY", args))
+	return reply.MakeIntReply(1)
+}
+
+func prepareCopy(args [][]byte) ([]string, []string) {
+	return []string{string(args[1])}, []string{string(args[0])}
+}
+
+func undoCopy(db *DB, args [][]byte) []CmdLine {
+	return rollbackGivenKeys(db, string(args[1]))
+}
+
+// randomKeyTries limits sampling of RANDOMKEY when most keys are expired
+const randomKeyTries = 100
+
+func execRandomKey(db *DB, args [][]byte) redis.Reply {
+	for i := 0; i < randomKeyTries; i++ {
+		keys := db.data.RandomKeys(1)
+		if len(keys) == 0 {
+			break
+		}
+		if _, exists := db.peekEntity(keys[0]); exists {
+			return reply.MakeBulkReply([]byte(keys[0]))
+		}
+	}
+	return &reply.NullBulkReply{}
+}
+
+// execDBSize returns the number of keys. Like redis, it is approximate since expired keys
+// not removed yet are counted: DBSIZE
+func execDBSize(db *DB, args [][]byte) redis.Reply {
+	return reply.MakeIntReply(int64(db.data.Len()))
+}
+
+// execTouch updates access time of keys and returns the number of existing keys
+func execTouch(db *DB, args [][]byte) redis.Reply {
+	return execExists(db, args)
+}
+
+// expireTime returns the unix time in milliseconds at which key expires, or -1 for persistent key and -2 for absent key
+func (db *DB) expireTime(key string) int64 {
+	if _, exists := db.GetEntity(key); !exists {
+		return -2
+	}
+	raw, exists := db.ttlMap.Get(key)
+	if !exists {
+		return -1
+	}
+	return raw.(time.Time).UnixNano() / int64(time.Millisecond)
+}
+
+func execExpireTime(db *DB, args [][]byte) redis.Reply {
+	result := db.expireTime(string(args[0]))
+	if result > 0 {
+		result /= 1000
+	}
+	return reply.MakeIntReply(result)
+}
+
+func execPExpireTime(db *DB, args [][]byte) redis.Reply {
+	return reply.MakeIntReply(db.expireTime(string(args[0])))
+}
+
+// objectEncoding returns the internal representation of value
+func objectEncoding(entity *DataEntity) string {
+	switch v := entity.Data.(type) {
+	case []byte, int64:
+		return stringEncoding(entity)
+	case *list.QuickList:
+		return "quicklist"
+	case list.List:
+		return "linkedlist"
+	case *set.Set:
+		return v.Encoding()
+	case *dict.CompactDict:
+		return v.Encoding()
+	case dict.Dict:
+		return "hashtable"
+	case *sortedset.SortedSet:
+		return "skiplist"
+	case *stream.Stream:
+		return "stream"
+	}
+	return "unknown"
+}
+
+// execObject inspects the internal of value: OBJECT ENCODING|IDLETIME|FREQ|REFCOUNT key
+func execObject(db *DB, args [][]byte) redis.Reply {
+	subCmd := strings.ToUpper(string(args[0]))
+	if len(args) != 2 {
+		return reply.MakeErrReply("ERR Unknown subcommand or wrong number of arguments for '" + string(args[0]) + "'")
+	}
+	switch subCmd {
+	case "ENCODING", "IDLETIME", "FREQ", "REFCOUNT":
+	default:
+		return reply.MakeErrReply("ERR Unknown subcommand or wrong number of arguments for '" + string(args[0]) + "'")
+	}
+	// inspecting a key is not an access of it
+	entity, exists := db.peekEntity(string(args[1]))
+	if !exists {
+		return &reply.NullBulkReply{}
+	}
+	switch subCmd {
+	case "ENCODING":
+		return reply.MakeBulkReply([]byte(objectEncoding(entity)))
+	case "IDLETIME":
+		return reply.MakeIntReply(int64(entity.idleTime() / time.Second))
+	case "FREQ":
+		return reply.MakeIntReply(int64(entity.frequency()))
+	}
+	// values are never shared between keys
+	return reply.MakeIntReply(1)
+}
+
+// prepareObject returns the key of OBJECT subcommand
+func prepareObject(args [][]byte) ([]string, []string) {
+	if len(args) < 2 {
+		return nil, nil
+	}
+	return nil, []string{string(args[1])}
+}
+
 // BGRewriteAOF asynchronously rewrites Append-Only-File
 func BGRewriteAOF(db *DB, args [][]byte) redis.Reply {
+	if db.aofRewriting.Get() {
+		db.aofRewriteScheduled.Set(true)
+		return reply.MakeStatusReply("Background append only file rewriting scheduled")
+	}
 	go db.RewriteAof()
 	return reply.MakeStatusReply("Background append only file rewriting started")
 }
@@ -145,10 +503,21 @@ func BGRewriteAOF(db *DB, args [][]byte) redis.Reply {
 func init() {
 	RegisterCommand("Del", execDel, writeAllKeys, undoDel, -2)
 	RegisterCommand("Exists", execExists, readAllKeys, nil, -2)
-	RegisterCommand("Expire", execExpire, writeFirstKey, nil, 3)
-	RegisterCommand("ExpireAt", execExpireAt, writeFirstKey, nil, 3)
-	RegisterCommand("PExpire", execPExpire, writeFirstKey, nil, 3)
-	RegisterCommand("PExpireAt", execPExpireAt, writeFirstKey, nil, 3)
+	RegisterCommand("Expire", execExpire, writeFirstKey, rollbackFirstKey, -3)
+	RegisterCommand("ExpireAt", execExpireAt, writeFirstKey, rollbackFirstKey, -3)
+	RegisterCommand("PExpire", execPExpire, writeFirstKey, rollbackFirstKey, -3)
+	RegisterCommand("PExpireAt", execPExpireAt, writeFirstKey, rollbackFirstKey, -3)
 	RegisterCommand("TTL", execTTL, readFirstKey, nil, 2)
+	RegisterCommand("PTTL", execPTTL, readFirstKey, nil, 2)
 	RegisterCommand("Persist", execPersist, writeFirstKey, nil, 2)
+	RegisterCommand("Object", execObject, prepareObject, nil, -2)
+	RegisterCommand("Type", execType, readFirstKey, nil, 2)
+	RegisterCommand("Rename", execRename, writeAllKeys, undoRename, 3)
+	RegisterCommand("RenameNX", execRenameNX, writeAllKeys, undoRename, 3)
+	RegisterCommand("Copy", execCopy, prepareCopy, undoCopy, -3)
+	RegisterCommand("RandomKey", execRandomKey, noPrepare, nil, 1)
+	RegisterCommand("DBSize", execDBSize, noPrepare, nil, 1)
+	RegisterCommand("Touch", execTouch, readAllKeys, nil, -2)
+	RegisterCommand("ExpireTime", execExpireTime, readFirstKey, nil, 2)
+	RegisterCommand("PExpireTime", execPExpireTime, readFirstKey, nil, 2)
 }
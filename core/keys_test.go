@@ -0,0 +1,235 @@
+package core
+
+import (
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/reply"
+	"Tiny-Godis/redis/reply/asserts"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestType(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("TYPE", key)), "none")
+	testDB.Exec(nil, utils.ToCmdLine("SET", key, "v"))
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("TYPE", key)), "string")
+	testDB.Exec(nil, utils.ToCmdLine("DEL", key))
+	testDB.Exec(nil, utils.ToCmdLine("RPUSH", key, "v"))
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("TYPE", key)), "list")
+	testDB.Exec(nil, utils.ToCmdLine("DEL", key))
+	testDB.Exec(nil, utils.ToCmdLine("SADD", key, "v"))
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("TYPE", key)), "set")
+	testDB.Exec(nil, utils.ToCmdLine("DEL", key))
+	testDB.Exec(nil, utils.ToCmdLine("HSET", key, "f", "v"))
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("TYPE", key)), "hash")
+}
+
+func TestRename(t *testing.T) {
+	testDB.Flush()
+	src := utils.RandString(10)
+	dst := utils.RandString(10)
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("RENAME", src, dst)), "ERR no such key")
+
+	testDB.Exec(nil, utils.ToCmdLine("SET", src, "v", "EX", "1000"))
+	testDB.Exec(nil, utils.ToCmdLine("SET", dst, "old"))
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("RENAME", src, dst)), "OK")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXISTS", src)), 0)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", dst)), "v")
+	ttl := testDB.Exec(nil, utils.ToCmdLine("TTL", dst)).(*reply.IntReply)
+	if ttl.Code <= 0 || ttl.Code > 1000 {
+		t.Errorf("expect ttl in (0, 1000], actual %d", ttl.Code)
+	}
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("RENAME", dst, dst)), "OK")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", dst)), "v")
+
+	// ttl of the overwritten key is not kept
+	testDB.Exec(nil, utils.ToCmdLine("SET", src, "v2"))
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("RENAME", src, dst)), "OK")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("TTL", dst)), -1)
+
+	testDB.Exec(nil, utils.ToCmdLine("SET", src, "v3"))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("RENAMENX", src, dst)), 0)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", dst)), "v2")
+	testDB.Exec(nil, utils.ToCmdLine("DEL", dst))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("RENAMENX", src, dst)), 1)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", dst)), "v3")
+}
+
+func TestCopy(t *testing.T) {
+	testDB.Flush()
+	src := utils.RandString(10)
+	dst := utils.RandString(10)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("COPY", src, dst)), 0)
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("COPY", src, src)), "ERR source and destination objects are the same")
+
+	testDB.Exec(nil, utils.ToCmdLine("RPUSH", src, "a", "b", "c"))
+	testDB.Exec(nil, utils.ToCmdLine("PEXPIRE", src, "100000"))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("COPY", src, dst)), 1)
+	testDB.Exec(nil, utils.ToCmdLine("RPUSH", dst, "d"))
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("LRANGE", src, "0", "-1")), []string{"a", "b", "c"})
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("LRANGE", dst, "0", "-1")), []string{"a", "b", "c", "d"})
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PEXPIRETIME", dst)),
+		int(testDB.Exec(nil, utils.ToCmdLine("PEXPIRETIME", src)).(*reply.IntReply).Code))
+
+	testDB.Exec(nil, utils.ToCmdLine("HSET", src+"h", "f", "v"))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("COPY", src+"h", dst)), 0)
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("COPY", src+"h", dst, "FORCE")), "Err syntax error")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("COPY", src+"h", dst, "REPLACE")), 1)
+	testDB.Exec(nil, utils.ToCmdLine("HSET", dst, "f", "v2"))
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("HGET", src+"h", "f")), "v")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("HGET", dst, "f")), "v2")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("TTL", dst)), -1)
+
+	testDB.Exec(nil, utils.ToCmdLine("SADD", src+"s", "1", "a"))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("COPY", src+"s", dst, "REPLACE")), 1)
+	testDB.Exec(nil, utils.ToCmdLine("SREM", src+"s", "a"))
+	assertSameMembers(t, testDB.Exec(nil, utils.ToCmdLine("SMEMBERS", dst)), []string{"1", "a"})
+}
+
+func TestUndoRenameAndCopy(t *testing.T) {
+	testDB.Flush()
+	src := utils.RandString(10)
+	dst := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("SET", src, "v", "EX", "1000"))
+	testDB.Exec(nil, utils.ToCmdLine("SET", dst, "old"))
+	for _, cmdLine := range [][][]byte{
+		utils.ToCmdLine("RENAME", src, dst),
+		utils.ToCmdLine("COPY", src, dst, "REPLACE"),
+	} {
+		undoCmdLines := testDB.GetUndoLog(cmdLine)
+		testDB.Exec(nil, cmdLine)
+		for _, undoCmdLine := range undoCmdLines {
+			testDB.Exec(nil, undoCmdLine)
+		}
+		asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", src)), "v")
+		asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", dst)), "old")
+		asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("TTL", dst)), -1)
+		ttl := testDB.Exec(nil, utils.ToCmdLine("TTL", src)).(*reply.IntReply)
+		if ttl.Code <= 0 {
+			t.Errorf("expect ttl of %s kept, actual %d", src, ttl.Code)
+		}
+	}
+}
+
+func TestRandomKeyAndDBSize(t *testing.T) {
+	// a private db, keys expiring in other tests are not counted
+	db := makeTestDB()
+	asserts.AssertNullBulk(t, db.Exec(nil, utils.ToCmdLine("RANDOMKEY")))
+	asserts.AssertIntReply(t, db.Exec(nil, utils.ToCmdLine("DBSIZE")), 0)
+	keys := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		key := "k" + strconv.Itoa(i)
+		keys[key] = true
+		db.Exec(nil, utils.ToCmdLine("SET", key, "v"))
+	}
+	asserts.AssertIntReply(t, db.Exec(nil, utils.ToCmdLine("DBSIZE")), 10)
+	for i := 0; i < 20; i++ {
+		result, ok := db.Exec(nil, utils.ToCmdLine("RANDOMKEY")).(*reply.BulkReply)
+		if !ok || !keys[string(result.Arg)] {
+			t.Fatalf("expect an existing key, actual %s", result.ToBytes())
+		}
+	}
+}
+
+func TestExpireTime(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIRETIME", key)), -2)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PEXPIRETIME", key)), -2)
+	testDB.Exec(nil, utils.ToCmdLine("SET", key, "v"))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIRETIME", key)), -1)
+	expireAt := time.Now().Add(time.Hour).Unix()
+	testDB.Exec(nil, utils.ToCmdLine("EXPIREAT", key, strconv.FormatInt(expireAt, 10)))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIRETIME", key)), int(expireAt))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PEXPIRETIME", key)), int(expireAt*1000))
+}
+
+func TestObjectAndTouch(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	asserts.AssertNullBulk(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "IDLETIME", key)))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("TOUCH", key)), 0)
+	testDB.Exec(nil, utils.ToCmdLine("SET", key, "v"))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "REFCOUNT", key)), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "FREQ", key)), lfuInitVal)
+
+	entity, _ := testDB.peekEntity(key)
+	entity.accessTime -= int64(10 * time.Minute / time.Millisecond)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "IDLETIME", key)), 600)
+	// frequency decays without access
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "FREQ", key)), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("TOUCH", key, key+"1")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "IDLETIME", key)), 0)
+
+	for i := 0; i < 1000; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("GET", key))
+	}
+	freq := testDB.Exec(nil, utils.ToCmdLine("OBJECT", "FREQ", key)).(*reply.IntReply)
+	if freq.Code <= lfuInitVal || freq.Code >= 1000 {
+		t.Errorf("expect frequency grows logarithmically, actual %d", freq.Code)
+	}
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "HELLO", key)),
+		"ERR Unknown subcommand or wrong number of arguments for 'HELLO'")
+}
+
+func TestExpireFlags(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("SET", key, "v"))
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIRE", key, "100", "NX", "XX")),
+		"ERR NX and XX, GT or LT options at the same time are not compatible")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIRE", key, "100", "GT", "LT")),
+		"ERR GT and LT options at the same time are not compatible")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIRE", key, "100", "YY")), "ERR Unsupported option YY")
+
+	// persistent key has infinite ttl
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIRE", key, "100", "XX")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIRE", key, "100", "GT")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIRE", key, "100", "LT")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PERSIST", key)), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIRE", key, "100", "NX")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIRE", key, "200", "NX")), 0)
+	if ttl := testDB.Exec(nil, utils.ToCmdLine("TTL", key)).(*reply.IntReply); ttl.Code > 100 {
+		t.Errorf("expect ttl not changed by NX, actual %d", ttl.Code)
+	}
+
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIRE", key, "50", "GT")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PEXPIRE", key, "200000", "gt")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIRE", key, "300", "LT")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIRE", key, "150", "XX", "LT")), 1)
+	expireAt := time.Now().Add(time.Hour).Unix()
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIREAT", key, strconv.FormatInt(expireAt, 10), "XX")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIRETIME", key)), int(expireAt))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("PEXPIREAT", key, "1", "LT")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXISTS", key)), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIRE", key, "100")), 0)
+
+	// negative ttl deletes key
+	testDB.Exec(nil, utils.ToCmdLine("SET", key, "v"))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXPIRE", key, "-1")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXISTS", key)), 0)
+}
+
+func TestExpireOverflow(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("SET", key, "v"))
+	maxInt := strconv.FormatInt(math.MaxInt64, 10)
+	for _, cmdLine := range [][]string{
+		{"EXPIRE", key, maxInt},
+		{"EXPIRE", key, "-" + maxInt},
+		{"PEXPIRE", key, maxInt},
+		{"EXPIREAT", key, maxInt},
+		{"PEXPIREAT", key, maxInt},
+		// does not overflow when multiplied but overflows when added to now
+		{"PEXPIRE", key, strconv.FormatInt(math.MaxInt64/int64(time.Millisecond), 10)},
+	} {
+		expected := "ERR invalid expire time in '" + strings.ToLower(cmdLine[0]) + "' command"
+		asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine(cmdLine...)), expected)
+	}
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("TTL", key)), -1)
+}
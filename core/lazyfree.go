@@ -0,0 +1,75 @@
+package core
+
+import (
+	"Tiny-Godis/data_struct/dict"
+	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/redis/reply"
+	"strings"
+	"sync/atomic"
+)
+
+// Unlink removes key from db. Detaching the entity is O(1) whatever its size, the garbage collector
+// reclaims the value on its own goroutines later, so there is nothing left to release in background.
+// Readers which got the entity before detaching keep a consistent view of it
+func (db *DB) Unlink(key string) int {
+	return db.Remove(key)
+}
+
+// Unlinks removes keys like Unlink
+func (db *DB) Unlinks(keys ...string) (deleted int) {
+	for _, key := range keys {
+		deleted += db.Unlink(key)
+	}
+	return deleted
+}
+
+// flush swaps in empty dicts under the exclusive lock of db, keys are invalidated for WATCH by flushEpoch.
+// The old dicts are reclaimed by the garbage collector, so ASYNC and SYNC flush work the same
+func (db *DB) flush() {
+	db.data = dict.MakeConcurrent(dataDictSize)
+	db.ttlMap = dict.MakeConcurrent(ttlDictSize)
+	atomic.AddUint32(&db.flushEpoch, 1)
+	// timers of old keys find nothing in the new ttlMap, so they are not cancelled
+}
+
+// prepareFlush locks the whole db, so no command works on the old dicts while they are swapped
+func prepareFlush(args [][]byte) ([]string, []string) {
+	return nil, []string{lockAllKeys}
+}
+
+// execFlushDB removes all keys: FLUSHDB [ASYNC | SYNC]
+func execFlushDB(db *DB, args [][]byte) redis.Reply {
+	if len(args) > 1 {
+		return &reply.SyntaxErrReply{}
+	}
+	if len(args) == 1 {
+		switch strings.ToUpper(string(args[0])) {
+		case "ASYNC", "SYNC":
+		default:
+			return &reply.SyntaxErrReply{}
+		}
+	}
+	db.flush()
+	db.AddAof(makeAofCmd("FLUSHDB", nil))
+	return reply.MakeOkReply()
+}
+
+// execUnlink removes keys like DEL: UNLINK key [key ...]
+func execUnlink(db *DB, args [][]byte) redis.Reply {
+	keys := make([]string, len(args))
+	for i, k := range args {
+		keys[i] = string(k)
+	}
+	deleted := db.Unlinks(keys...)
+	if deleted > 0 {
+		db.AddAof(makeAofCmd("UNLINK", args))
+	}
+	return reply.MakeIntReply(int64(deleted))
+}
+
+func init() {
+	RegisterCommand("Unlink", execUnlink, writeAllKeys, undoDel, -2)
+	RegisterCommand("FlushDB", execFlushDB, prepareFlush, nil, -1)
+	// there is only one db
+	RegisterCommand("FlushAll", execFlushDB, prepareFlush, nil, -1)
+}
@@ -0,0 +1,153 @@
+package core
+
+import (
+	"Tiny-Godis/data_struct/dict"
+	"Tiny-Godis/lib/config"
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/connection"
+	"Tiny-Godis/redis/reply"
+	"Tiny-Godis/redis/reply/asserts"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// walkCountingDict counts calls which visit all entries of a dict
+type walkCountingDict struct {
+	dict.Dict
+	walks int32
+}
+
+func (d *walkCountingDict) ForEach(recall dict.RecallFunc) {
+	atomic.AddInt32(&d.walks, 1)
+	d.Dict.ForEach(recall)
+}
+
+func (d *walkCountingDict) Keys() []string {
+	atomic.AddInt32(&d.walks, 1)
+	return d.Dict.Keys()
+}
+
+func (d *walkCountingDict) Remove(key string) int {
+	atomic.AddInt32(&d.walks, 1)
+	return d.Dict.Remove(key)
+}
+
+// bigHashSize is large enough that freeing the hash field by field would be noticed
+const bigHashSize = 1000
+
+// putBigHash puts a hash which counts walks through its fields
+func putBigHash(db *DB, key string) *walkCountingDict {
+	d := &walkCountingDict{Dict: dict.MakeSimpleDict()}
+	for i := 0; i < bigHashSize; i++ {
+		d.Dict.Put("f"+strconv.Itoa(i), []byte("v"))
+	}
+	db.PutEntity(key, &DataEntity{Data: d})
+	return d
+}
+
+// assertDetached checks that key is removed without walking through its value
+func assertDetached(t *testing.T, db *DB, key string, d *walkCountingDict) {
+	t.Helper()
+	asserts.AssertIntReply(t, db.Exec(nil, utils.ToCmdLine("EXISTS", key)), 0)
+	if walks := atomic.LoadInt32(&d.walks); walks != 0 {
+		t.Errorf("expect value detached in O(1), actual %d walks", walks)
+	}
+	if d.Len() != bigHashSize {
+		t.Errorf("expect value kept intact, actual %d fields", d.Len())
+	}
+}
+
+func TestUnlink(t *testing.T) {
+	db := makeTestDB()
+	key := utils.RandString(10)
+	small := utils.RandString(10)
+	d := putBigHash(db, key)
+	db.Exec(nil, utils.ToCmdLine("SET", small, "v"))
+	asserts.AssertIntReply(t, db.Exec(nil, utils.ToCmdLine("UNLINK", key, small, key+"none")), 2)
+	asserts.AssertIntReply(t, db.Exec(nil, utils.ToCmdLine("EXISTS", small)), 0)
+	assertDetached(t, db, key, d)
+}
+
+func TestUnlinkKeepsReaderView(t *testing.T) {
+	db := makeTestDB()
+	key := utils.RandString(10)
+	d := putBigHash(db, key)
+	// a reader got the entity before it is unlinked
+	db.RWLocks(nil, []string{key})
+	entity, _ := db.GetEntity(key)
+	db.Unlink(key)
+	if entity.Data.(dict.Dict).Len() != bigHashSize {
+		t.Error("expect hash kept while being read")
+	}
+	db.RWUnLocks(nil, []string{key})
+	assertDetached(t, db, key, d)
+}
+
+func TestRemoveWithoutWalk(t *testing.T) {
+	db := makeTestDB()
+	props := *config.Properties
+	defer func() {
+		*config.Properties = props
+	}()
+	key := utils.RandString(10)
+
+	for _, lazy := range []bool{false, true} {
+		config.Properties.LazyfreeLazyUserDel = lazy
+		config.Properties.LazyfreeLazyExpire = lazy
+		d := putBigHash(db, key)
+		asserts.AssertIntReply(t, db.Exec(nil, utils.ToCmdLine("DEL", key)), 1)
+		assertDetached(t, db, key, d)
+
+		d = putBigHash(db, key)
+		db.Exec(nil, utils.ToCmdLine("PEXPIRE", key, "10"))
+		time.Sleep(20 * time.Millisecond)
+		assertDetached(t, db, key, d)
+	}
+
+	for _, flush := range [][]string{{"FLUSHDB"}, {"FLUSHDB", "ASYNC"}, {"FLUSHALL", "SYNC"}} {
+		d := putBigHash(db, key)
+		asserts.AssertStatusReply(t, db.Exec(nil, utils.ToCmdLine(flush...)), "OK")
+		assertDetached(t, db, key, d)
+	}
+}
+
+func TestFlushDB(t *testing.T) {
+	db := makeTestDB()
+	db.Exec(nil, utils.ToCmdLine("SET", "k", "v", "EX", "100"))
+	asserts.AssertErrReply(t, db.Exec(nil, utils.ToCmdLine("FLUSHDB", "LATER")), "Err syntax error")
+	asserts.AssertStatusReply(t, db.Exec(nil, utils.ToCmdLine("FLUSHDB")), "OK")
+	asserts.AssertIntReply(t, db.Exec(nil, utils.ToCmdLine("DBSIZE")), 0)
+	asserts.AssertIntReply(t, db.Exec(nil, utils.ToCmdLine("TTL", "k")), -2)
+
+	// flush waits for running commands
+	db.Exec(nil, utils.ToCmdLine("SET", "k", "v"))
+	db.RWLocks([]string{"k"}, nil)
+	done := make(chan struct{})
+	go func() {
+		db.Exec(nil, utils.ToCmdLine("FLUSHDB", "ASYNC"))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Error("expect flush blocked by running command")
+	case <-time.After(20 * time.Millisecond):
+	}
+	db.RWUnLocks([]string{"k"}, nil)
+	<-done
+	asserts.AssertIntReply(t, db.Exec(nil, utils.ToCmdLine("EXISTS", "k")), 0)
+
+	// flushed keys are modified for WATCH
+	conn := connection.MakeConn(nil)
+	db.Exec(nil, utils.ToCmdLine("SET", "k", "v"))
+	asserts.AssertStatusReply(t, db.Exec(conn, utils.ToCmdLine("WATCH", "k")), "OK")
+	db.Exec(nil, utils.ToCmdLine("FLUSHDB", "ASYNC"))
+	db.Exec(conn, utils.ToCmdLine("MULTI"))
+	db.Exec(conn, utils.ToCmdLine("SET", "k", "v2"))
+	result := db.Exec(conn, utils.ToCmdLine("EXEC"))
+	if _, ok := result.(*reply.MultiBulkReply); ok {
+		t.Errorf("expect transaction aborted, actual %s", result.ToBytes())
+	}
+	asserts.AssertIntReply(t, db.Exec(nil, utils.ToCmdLine("EXISTS", "k")), 0)
+}
@@ -3,10 +3,11 @@ package core
 import (
 	"Tiny-Godis/data_struct/list"
 	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/config"
 	"Tiny-Godis/lib/utils"
 	"Tiny-Godis/redis/reply"
-	"fmt"
 	"strconv"
+	"strings"
 )
 
 func (db *DB) getAsList(key string) (list.List, reply.ErrorReply) {
@@ -21,13 +22,18 @@ func (db *DB) getAsList(key string) (list.List, reply.ErrorReply) {
 	return value, nil
 }
 
+// makeList creates an empty list of the default encoding
+func makeList() list.List {
+	return list.MakeQuickList(config.Properties.ListCompressDepth)
+}
+
 func (db *DB) getOrInitList(key string) (list.List, reply.ErrorReply) {
 	ll, errReply := db.getAsList(key)
 	if errReply != nil {
 		return nil, errReply
 	}
 	if ll == nil {
-		ll = list.MakeLinkedList()
+		ll = makeList()
 		e := DataEntity{Data: ll}
 		db.PutEntity(key, &e)
 		return ll, nil
@@ -46,6 +52,7 @@ func execLPush(db *DB, args [][]byte) redis.Reply {
 		ll.LPush(v)
 	}
 	db.AddAof(makeAofCmd("LPUSH", args))
+	db.signalBlocked(key)
 	return reply.MakeIntReply(int64(ll.Len()))
 }
 
@@ -63,6 +70,7 @@ func execLPushX(db *DB, args [][]byte) redis.Reply {
 		ll.LPush(v)
 	}
 	db.AddAof(makeAofCmd("LPUSHX", args))
+	db.signalBlocked(key)
 	return reply.MakeIntReply(int64(ll.Len()))
 }
 
@@ -77,6 +85,7 @@ func execRPush(db *DB, args [][]byte) redis.Reply {
 		ll.RPush(v)
 	}
 	db.AddAof(makeAofCmd("RPUSH", args))
+	db.signalBlocked(key)
 	return reply.MakeIntReply(int64(ll.Len()))
 }
 
@@ -94,65 +103,158 @@ func execRPushX(db *DB, args [][]byte) redis.Reply {
 		ll.RPush(v)
 	}
 	db.AddAof(makeAofCmd("RPUSHX", args))
+	db.signalBlocked(key)
 	return reply.MakeIntReply(int64(ll.Len()))
 }
 
-func execLPop(db *DB, args [][]byte) redis.Reply {
+// parsePopCount parses the optional count argument of LPOP/RPOP, returns -1 if it's absent
+func parsePopCount(args [][]byte) (int, redis.Reply) {
+	if len(args) < 2 {
+		return -1, nil
+	}
+	if len(args) > 2 {
+		return 0, &reply.SyntaxErrReply{}
+	}
+	count, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil || count < 0 {
+		return 0, reply.MakeErrReply("ERR value is out of range, must be positive")
+	}
+	return int(count), nil
+}
+
+func execPop(db *DB, args [][]byte, left bool) redis.Reply {
 	key := string(args[0])
+	count, errReply := parsePopCount(args)
+	if errReply != nil {
+		return errReply
+	}
 	ll, errReply := db.getAsList(key)
 	if errReply != nil {
 		return errReply
 	}
 	if ll == nil {
-		return reply.MakeNullBulkReply()
+		if count < 0 {
+			return reply.MakeNullBulkReply()
+		}
+		return reply.MakeNullMultiBulkReply()
+	}
+	n := count
+	if count < 0 {
+		n = 1
+	}
+	if n > ll.Len() {
+		n = ll.Len()
+	}
+	popped := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		var raw interface{}
+		if left {
+			raw = ll.LPop()
+		} else {
+			raw = ll.RPop()
+		}
+		popped[i], _ = raw.([]byte)
 	}
-	raw := ll.LPop()
-	v, _ := raw.([]byte)
 	if ll.Len() == 0 {
 		db.Remove(key)
 	}
-	db.AddAof(makeAofCmd("LPOP", args))
-	return reply.MakeBulkReply(v)
+	if n > 0 {
+		if left {
+			db.AddAof(makeAofCmd("LPOP", args))
+		} else {
+			db.AddAof(makeAofCmd("RPOP", args))
+		}
+	}
+	if count < 0 {
+		return reply.MakeBulkReply(popped[0])
+	}
+	return reply.MakeMultiBulkReply(popped)
+}
+
+func execLPop(db *DB, args [][]byte) redis.Reply {
+	return execPop(db, args, true)
 }
 
 func execRPop(db *DB, args [][]byte) redis.Reply {
-	key := string(args[0])
-	ll, errReply := db.getAsList(key)
+	return execPop(db, args, false)
+}
+
+// parseListDirection parses LEFT or RIGHT, returns true for LEFT
+func parseListDirection(arg []byte) (bool, bool) {
+	switch strings.ToUpper(string(arg)) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
+	}
+	return false, false
+}
+
+// moveElement pops an element from source and pushes it into destination.
+// Returns nil if source does not exist, destination will not be created in this case
+func (db *DB) moveElement(sourceKey string, desKey string, fromLeft bool, toLeft bool) ([]byte, reply.ErrorReply) {
+	sll, errReply := db.getAsList(sourceKey)
 	if errReply != nil {
-		return errReply
+		return nil, errReply
 	}
-	if ll == nil {
-		return reply.MakeNullBulkReply()
+	if _, errReply = db.getAsList(desKey); errReply != nil {
+		return nil, errReply
+	}
+	if sll == nil {
+		return nil, nil
+	}
+	var raw interface{}
+	if fromLeft {
+		raw = sll.LPop()
+	} else {
+		raw = sll.RPop()
 	}
-	raw := ll.RPop()
 	v, _ := raw.([]byte)
-	if ll.Len() == 0 {
-		db.Remove(key)
+	if sll.Len() == 0 {
+		db.Remove(sourceKey)
 	}
-	db.AddAof(makeAofCmd("RPOP", args))
-	return reply.MakeBulkReply(v)
+	dll, errReply := db.getOrInitList(desKey)
+	if errReply != nil {
+		return nil, errReply
+	}
+	if toLeft {
+		dll.LPush(v)
+	} else {
+		dll.RPush(v)
+	}
+	db.signalBlocked(desKey)
+	return v, nil
 }
 
 func execRPopLPush(db *DB, args [][]byte) redis.Reply {
-	sourceKey := string(args[0])
-	desKey := string(args[1])
-	sll, errReply := db.getAsList(sourceKey)
+	v, errReply := db.moveElement(string(args[0]), string(args[1]), false, true)
 	if errReply != nil {
 		return errReply
 	}
-	dll, errReply := db.getOrInitList(desKey)
+	if v == nil {
+		return reply.MakeNullBulkReply()
+	}
+	db.AddAof(makeAofCmd("RPopLPush", args))
+	return reply.MakeBulkReply(v)
+}
+
+func execLMove(db *DB, args [][]byte) redis.Reply {
+	fromLeft, ok := parseListDirection(args[2])
+	if !ok {
+		return &reply.SyntaxErrReply{}
+	}
+	toLeft, ok := parseListDirection(args[3])
+	if !ok {
+		return &reply.SyntaxErrReply{}
+	}
+	v, errReply := db.moveElement(string(args[0]), string(args[1]), fromLeft, toLeft)
 	if errReply != nil {
 		return errReply
 	}
-	if sll == nil {
+	if v == nil {
 		return reply.MakeNullBulkReply()
 	}
-	v := sll.RPop().([]byte)
-	dll.LPush(v)
-	if sll.Len() == 0 {
-		db.Remove(sourceKey)
-	}
-	db.AddAof(makeAofCmd("RPopLPush", args))
+	db.AddAof(makeAofCmd("LMOVE", args))
 	return reply.MakeBulkReply(v)
 }
 
@@ -206,7 +308,7 @@ func execLIndex(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	index64, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
-		return &reply.SyntaxErrReply{}
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
 	}
 	index := int(index64)
 	ll, errReply := db.getAsList(key)
@@ -218,7 +320,7 @@ func execLIndex(db *DB, args [][]byte) redis.Reply {
 	}
 
 	if index >= ll.Len() || index < -ll.Len() {
-		return reply.MakeErrReply(fmt.Sprintf("ERR index '%d' out of range '%d'", index, ll.Len()))
+		return reply.MakeNullBulkReply()
 	} else if index < 0 && index >= -ll.Len() {
 		index = index + ll.Len()
 	}
@@ -231,7 +333,7 @@ func execLSet(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	index64, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
-		return &reply.SyntaxErrReply{}
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
 	}
 	index := int(index64)
 	value := args[2]
@@ -244,7 +346,7 @@ func execLSet(db *DB, args [][]byte) redis.Reply {
 	}
 
 	if index >= ll.Len() || index < -ll.Len() {
-		return reply.MakeErrReply(fmt.Sprintf("ERR index '%d' out of range '%d'", index, ll.Len()))
+		return reply.MakeErrReply("ERR index out of range")
 	} else if index < 0 && index >= -ll.Len() {
 		index = index + ll.Len()
 	}
@@ -258,11 +360,11 @@ func execLRange(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	start64, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
-		return &reply.SyntaxErrReply{}
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
 	}
 	stop64, err := strconv.ParseInt(string(args[2]), 10, 64)
 	if err != nil {
-		return &reply.SyntaxErrReply{}
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
 	}
 	start := int(start64)
 	stop := int(stop64)
@@ -271,7 +373,7 @@ func execLRange(db *DB, args [][]byte) redis.Reply {
 		return errReply
 	}
 	if ll == nil {
-		return reply.MakeErrReply("ERR no such key")
+		return &reply.EmptyMultiBulkReply{}
 	}
 
 	// compute index
@@ -305,12 +407,200 @@ func execLRange(db *DB, args [][]byte) redis.Reply {
 	return reply.MakeMultiBulkReply(result)
 }
 
+func execLTrim(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	start64, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	stop64, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	ll, errReply := db.getAsList(key)
+	if errReply != nil {
+		return errReply
+	}
+	if ll == nil {
+		return &reply.OkReply{}
+	}
+
+	// compute index, elements in [start, stop] are kept
+	size := int64(ll.Len())
+	start, stop := start64, stop64
+	if start < 0 {
+		start = size + start
+		if start < 0 {
+			start = 0
+		}
+	}
+	if stop < 0 {
+		stop = size + stop
+	}
+	if stop >= size {
+		stop = size - 1
+	}
+	if start > stop || start >= size {
+		ll.Trim(0, 0)
+	} else {
+		ll.Trim(int(start), int(stop)+1)
+	}
+	if ll.Len() == 0 {
+		db.Remove(key)
+	}
+	db.AddAof(makeAofCmd("LTRIM", args))
+	return &reply.OkReply{}
+}
+
+func execLInsert(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	var after bool
+	switch strings.ToUpper(string(args[1])) {
+	case "BEFORE":
+		after = false
+	case "AFTER":
+		after = true
+	default:
+		return &reply.SyntaxErrReply{}
+	}
+	pivot := args[2]
+	value := args[3]
+	ll, errReply := db.getAsList(key)
+	if errReply != nil {
+		return errReply
+	}
+	if ll == nil {
+		return reply.MakeIntReply(0)
+	}
+
+	index := -1
+	i := 0
+	ll.ForEach(func(val interface{}) bool {
+		if utils.Equals(val, pivot) {
+			index = i
+			return false
+		}
+		i++
+		return true
+	})
+	if index < 0 {
+		return reply.MakeIntReply(-1)
+	}
+	if after {
+		index++
+	}
+	ll.Insert(index, value)
+	db.AddAof(makeAofCmd("LINSERT", args))
+	return reply.MakeIntReply(int64(ll.Len()))
+}
+
+// execLPos implements LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+func execLPos(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	element := args[1]
+	rank := int64(1)
+	count := int64(-1) // -1 means COUNT is not given
+	maxLen := int64(0)
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return &reply.SyntaxErrReply{}
+		}
+		v, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+		if err != nil {
+			return reply.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "RANK":
+			if v == 0 {
+				return reply.MakeErrReply("ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+			}
+			rank = v
+		case "COUNT":
+			if v < 0 {
+				return reply.MakeErrReply("ERR COUNT can't be negative")
+			}
+			count = v
+		case "MAXLEN":
+			if v < 0 {
+				return reply.MakeErrReply("ERR MAXLEN can't be negative")
+			}
+			maxLen = v
+		default:
+			return &reply.SyntaxErrReply{}
+		}
+	}
+
+	ll, errReply := db.getAsList(key)
+	if errReply != nil {
+		return errReply
+	}
+	if ll == nil {
+		if count < 0 {
+			return reply.MakeNullBulkReply()
+		}
+		return &reply.EmptyMultiBulkReply{}
+	}
+
+	// skip the first |rank|-1 matches, then collect matches until count reached
+	size := ll.Len()
+	skip := rank - 1
+	if rank < 0 {
+		skip = -rank - 1
+	}
+	limit := count
+	if limit < 0 {
+		limit = 1
+	}
+	var positions []int64
+	scanned := int64(0)
+	visit := func(index int) func(val interface{}) bool {
+		return func(val interface{}) bool {
+			if maxLen > 0 && scanned >= maxLen {
+				return false
+			}
+			scanned++
+			pos := int64(index)
+			if rank > 0 {
+				index++
+			} else {
+				index--
+			}
+			if !utils.Equals(val, element) {
+				return true
+			}
+			if skip > 0 {
+				skip--
+				return true
+			}
+			positions = append(positions, pos)
+			return limit == 0 || int64(len(positions)) < limit
+		}
+	}
+	if rank > 0 {
+		ll.ForEach(visit(0))
+	} else {
+		ll.ReverseForEach(visit(size - 1))
+	}
+
+	if count < 0 {
+		if len(positions) == 0 {
+			return reply.MakeNullBulkReply()
+		}
+		return reply.MakeIntReply(positions[0])
+	}
+	result := make([]redis.Reply, len(positions))
+	for i, pos := range positions {
+		result[i] = reply.MakeIntReply(pos)
+	}
+	return reply.MakeMultiRawReply(result)
+}
+
 func undoRPush(db *DB, args [][]byte) []CmdLine {
 	key := string(args[0])
 	count := len(args) - 1
 	cmdLines := make([]CmdLine, count)
 	for i := 0; i < count; i++ {
-		cmdLines = append(cmdLines, utils.ToCmdLine("RPOP", key))
+		cmdLines[i] = utils.ToCmdLine("RPOP", key)
 	}
 	return cmdLines
 }
@@ -325,34 +615,53 @@ func undoLPush(db *DB, args [][]byte) []CmdLine {
 	return cmdLines
 }
 
-func undoLPop(db *DB, args [][]byte) []CmdLine {
+// undoPop pushes popped elements back, the whole list is restored if pop removes the key
+func undoPop(db *DB, args [][]byte, left bool) []CmdLine {
 	key := string(args[0])
-	ll, errReply := db.getAsList(key)
+	count, errReply := parsePopCount(args)
 	if errReply != nil {
 		return nil
 	}
-	if ll == nil {
-		return nil
+	if count < 0 {
+		count = 1
 	}
-	v, _ := ll.Get(0).([]byte)
-	cmdLines := make([]CmdLine, 1)
-	cmdLines[0] = utils.ToCmdLine("LPUSH", key, string(v))
-	return cmdLines
-}
-
-func undoRPop(db *DB, args [][]byte) []CmdLine {
-	key := string(args[0])
 	ll, errReply := db.getAsList(key)
 	if errReply != nil {
 		return nil
 	}
-	if ll == nil {
+	if ll == nil || count == 0 {
 		return nil
 	}
-	v, _ := ll.Get(0).([]byte)
-	cmdLines := make([]CmdLine, 1)
-	cmdLines[0] = utils.ToCmdLine("RPUSH", key, string(v))
-	return cmdLines
+	if count >= ll.Len() {
+		return rollbackFirstKey(db, args)
+	}
+	var elements []interface{}
+	var cmdLine CmdLine
+	if left {
+		// LPUSH puts the last argument at head
+		elements = ll.Range(0, count)
+		cmdLine = utils.ToCmdLine("LPUSH", key)
+		for i := len(elements) - 1; i >= 0; i-- {
+			v, _ := elements[i].([]byte)
+			cmdLine = append(cmdLine, v)
+		}
+	} else {
+		elements = ll.Range(ll.Len()-count, ll.Len())
+		cmdLine = utils.ToCmdLine("RPUSH", key)
+		for _, e := range elements {
+			v, _ := e.([]byte)
+			cmdLine = append(cmdLine, v)
+		}
+	}
+	return []CmdLine{cmdLine}
+}
+
+func undoLPop(db *DB, args [][]byte) []CmdLine {
+	return undoPop(db, args, true)
+}
+
+func undoRPop(db *DB, args [][]byte) []CmdLine {
+	return undoPop(db, args, false)
 }
 
 var rPushCmd = []byte("RPUSH")
@@ -413,6 +722,41 @@ func undoLSet(db *DB, args [][]byte) []CmdLine {
 	}
 }
 
+func undoLMove(db *DB, args [][]byte) []CmdLine {
+	fromLeft, ok := parseListDirection(args[2])
+	if !ok {
+		return nil
+	}
+	toLeft, ok := parseListDirection(args[3])
+	if !ok {
+		return nil
+	}
+	ll, errReply := db.getAsList(string(args[0]))
+	if errReply != nil {
+		return nil
+	}
+	if ll == nil || ll.Len() == 0 {
+		return nil
+	}
+	var element []byte
+	pushCmd := "RPUSH"
+	if fromLeft {
+		element, _ = ll.Get(0).([]byte)
+		pushCmd = "LPUSH"
+	} else {
+		element, _ = ll.Get(ll.Len() - 1).([]byte)
+	}
+	popCmd := "RPOP"
+	if toLeft {
+		popCmd = "LPOP"
+	}
+	// pop from destination first, source and destination may be the same list
+	return []CmdLine{
+		utils.ToCmdLine(popCmd, string(args[1])),
+		{[]byte(pushCmd), args[0], element},
+	}
+}
+
 func prepareRPopLPush(args [][]byte) ([]string, []string) {
 	return []string{
 		string(args[0]),
@@ -425,12 +769,16 @@ func init() {
 	RegisterCommand("LPushX", execLPushX, writeFirstKey, undoLPush, -3)
 	RegisterCommand("RPush", execRPush, writeFirstKey, undoRPush, -3)
 	RegisterCommand("RPushX", execRPushX, writeFirstKey, undoRPush, -3)
-	RegisterCommand("LPop", execLPop, writeFirstKey, undoLPop, 2)
-	RegisterCommand("RPop", execRPop, writeFirstKey, undoRPop, 2)
+	RegisterCommand("LPop", execLPop, writeFirstKey, undoLPop, -2)
+	RegisterCommand("RPop", execRPop, writeFirstKey, undoRPop, -2)
 	RegisterCommand("RPopLPush", execRPopLPush, prepareRPopLPush, undoRPopLPush, 3)
+	RegisterCommand("LMove", execLMove, prepareRPopLPush, undoLMove, 5)
 	RegisterCommand("LRem", execLRem, writeFirstKey, rollbackFirstKey, 4)
 	RegisterCommand("LLen", execLLen, readFirstKey, nil, 2)
 	RegisterCommand("LIndex", execLIndex, readFirstKey, nil, 3)
 	RegisterCommand("LSet", execLSet, writeFirstKey, undoLSet, 4)
 	RegisterCommand("LRange", execLRange, readFirstKey, nil, 4)
+	RegisterCommand("LTrim", execLTrim, writeFirstKey, rollbackFirstKey, 4)
+	RegisterCommand("LInsert", execLInsert, writeFirstKey, rollbackFirstKey, 5)
+	RegisterCommand("LPos", execLPos, readFirstKey, nil, -3)
 }
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/config"
 	"Tiny-Godis/lib/utils"
 	"Tiny-Godis/redis/reply"
 	"Tiny-Godis/redis/reply/asserts"
@@ -465,3 +467,182 @@ func TestUndoRPopLPush(t *testing.T) {
 	result = testDB.Exec(nil, utils.ToCmdLine("llen", key2))
 	asserts.AssertIntReply(t, result, 0)
 }
+
+func TestLPopCount(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "a", "b", "c", "d", "e"))
+	result := testDB.Exec(nil, utils.ToCmdLine("lpop", key, "2"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "b"})
+	result = testDB.Exec(nil, utils.ToCmdLine("rpop", key, "2"))
+	asserts.AssertMultiBulkReply(t, result, []string{"e", "d"})
+	result = testDB.Exec(nil, utils.ToCmdLine("lpop", key, "0"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("rpop", key, "10"))
+	asserts.AssertMultiBulkReply(t, result, []string{"c"})
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpop", key, "1"))
+	if !utils.BytesEquals(result.ToBytes(), reply.MakeNullMultiBulkReply().ToBytes()) {
+		t.Errorf("expected null multi bulk, actually %s", string(result.ToBytes()))
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("lpop", key, "-1"))
+	asserts.AssertErrReply(t, result, "ERR value is out of range, must be positive")
+}
+
+func TestLTrim(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "a", "b", "c", "d", "e"))
+	result := testDB.Exec(nil, utils.ToCmdLine("ltrim", key, "1", "-2"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", key, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "c", "d"})
+	result = testDB.Exec(nil, utils.ToCmdLine("ltrim", key, "-100", "100"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", key, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "c", "d"})
+	result = testDB.Exec(nil, utils.ToCmdLine("ltrim", key, "2", "1"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key))
+	asserts.AssertIntReply(t, result, 0)
+}
+
+func TestLInsert(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	result := testDB.Exec(nil, utils.ToCmdLine("linsert", key, "before", "a", "x"))
+	asserts.AssertIntReply(t, result, 0)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "a", "b", "c"))
+	result = testDB.Exec(nil, utils.ToCmdLine("linsert", key, "before", "b", "x"))
+	asserts.AssertIntReply(t, result, 4)
+	result = testDB.Exec(nil, utils.ToCmdLine("linsert", key, "after", "c", "y"))
+	asserts.AssertIntReply(t, result, 5)
+	result = testDB.Exec(nil, utils.ToCmdLine("linsert", key, "after", "z", "y"))
+	asserts.AssertIntReply(t, result, -1)
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", key, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "x", "b", "c", "y"})
+	result = testDB.Exec(nil, utils.ToCmdLine("linsert", key, "middle", "a", "y"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+}
+
+func TestLPos(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "a", "b", "c", "1", "2", "3", "c", "c"))
+	result := testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c"))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "rank", "2"))
+	asserts.AssertIntReply(t, result, 6)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "rank", "-1"))
+	asserts.AssertIntReply(t, result, 7)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "count", "2"))
+	assertRawReply(t, result, "*2\r\n:2\r\n:6\r\n")
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "count", "0", "rank", "-2"))
+	assertRawReply(t, result, "*2\r\n:6\r\n:2\r\n")
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "count", "0", "maxlen", "3"))
+	assertRawReply(t, result, "*1\r\n:2\r\n")
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "x"))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "rank", "0"))
+	asserts.AssertErrReply(t, result, "ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+}
+
+func TestLMove(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key1, "a", "b", "c"))
+	result := testDB.Exec(nil, utils.ToCmdLine("lmove", key1, key2, "left", "right"))
+	asserts.AssertBulkReply(t, result, "a")
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key1, key2, "right", "left"))
+	asserts.AssertBulkReply(t, result, "c")
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", key2, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"c", "a"})
+	// rotate
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key2, key2, "left", "right"))
+	asserts.AssertBulkReply(t, result, "c")
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", key2, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "c"})
+
+	key3 := utils.RandString(10)
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key3, key1, "left", "right"))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key3, key3, "left", "right"))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key3))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key1, key2, "up", "right"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+}
+
+func TestUndoListCommands(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	cmdLines := [][][]byte{
+		utils.ToCmdLine("ltrim", key1, "1", "2"),
+		utils.ToCmdLine("ltrim", key1, "5", "1"),
+		utils.ToCmdLine("linsert", key1, "after", "c", "x"),
+		utils.ToCmdLine("lpop", key1, "2"),
+		utils.ToCmdLine("rpop", key1, "3"),
+		utils.ToCmdLine("rpop", key1, "10"),
+		utils.ToCmdLine("lmove", key1, key2, "left", "right"),
+		utils.ToCmdLine("lmove", key1, key1, "right", "left"),
+		utils.ToCmdLine("rpush", key1, "x", "y"),
+	}
+	for _, cmdLine := range cmdLines {
+		testDB.Remove(key1)
+		testDB.Remove(key2)
+		testDB.Exec(nil, utils.ToCmdLine("rpush", key1, "a", "b", "c", "d", "e"))
+		testDB.Exec(nil, utils.ToCmdLine("rpush", key2, "1", "2"))
+		testDB.Exec(nil, utils.ToCmdLine("expire", key1, "1000"))
+		undoCmdLines := testDB.GetUndoLog(cmdLine)
+		testDB.Exec(nil, cmdLine)
+		for _, undoCmdLine := range undoCmdLines {
+			testDB.Exec(nil, undoCmdLine)
+		}
+		name := string(cmdLine[0])
+		result := testDB.Exec(nil, utils.ToCmdLine("lrange", key1, "0", "-1"))
+		if !utils.BytesEquals(result.ToBytes(), reply.MakeMultiBulkReply(utils.ToCmdLine("a", "b", "c", "d", "e")).ToBytes()) {
+			t.Errorf("%s: bad undo, got %s", name, string(result.ToBytes()))
+		}
+		result = testDB.Exec(nil, utils.ToCmdLine("lrange", key2, "0", "-1"))
+		if !utils.BytesEquals(result.ToBytes(), reply.MakeMultiBulkReply(utils.ToCmdLine("1", "2")).ToBytes()) {
+			t.Errorf("%s: bad undo of destination, got %s", name, string(result.ToBytes()))
+		}
+		result = testDB.Exec(nil, utils.ToCmdLine("ttl", key1))
+		if intResult, _ := result.(*reply.IntReply); intResult == nil || intResult.Code <= 0 {
+			t.Errorf("%s: ttl lost after undo", name)
+		}
+	}
+}
+
+func assertRawReply(t *testing.T, actual redis.Reply, expected string) {
+	if string(actual.ToBytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, string(actual.ToBytes()))
+	}
+}
+
+func TestCompressedList(t *testing.T) {
+	testDB.Flush()
+	depth := config.Properties.ListCompressDepth
+	config.Properties.ListCompressDepth = 1
+	defer func() {
+		config.Properties.ListCompressDepth = depth
+	}()
+	key := utils.RandString(10)
+	values := make([]string, 1000)
+	for i := range values {
+		values[i] = "value:" + strconv.Itoa(i)
+		testDB.Exec(nil, utils.ToCmdLine("rpush", key, values[i]))
+	}
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("object", "encoding", key)), "quicklist")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("lindex", key, "500")), values[500])
+	result := testDB.Exec(nil, utils.ToCmdLine("lrange", key, "300", "699"))
+	asserts.AssertMultiBulkReply(t, result, values[300:700])
+	testDB.Exec(nil, utils.ToCmdLine("lset", key, "400", "x"))
+	testDB.Exec(nil, utils.ToCmdLine("linsert", key, "before", "x", "y"))
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", key, "399", "402"))
+	asserts.AssertMultiBulkReply(t, result, []string{values[399], "y", "x", values[401]})
+}
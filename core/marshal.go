@@ -4,6 +4,8 @@ import (
 	"Tiny-Godis/data_struct/dict"
 	"Tiny-Godis/data_struct/list"
 	"Tiny-Godis/data_struct/set"
+	"Tiny-Godis/data_struct/sortedset"
+	"Tiny-Godis/data_struct/stream"
 	"Tiny-Godis/lib/utils"
 	"Tiny-Godis/redis/reply"
 	"strconv"
@@ -19,16 +21,36 @@ func EntityToCmd(key string, entity *DataEntity) *reply.MultiBulkReply {
 	case []byte:
 		cmd = stringToCmd(key, val)
 		return cmd
+	case int64:
+		cmd = stringToCmd(key, strconv.AppendInt(nil, val, 10))
 	case list.List:
 		cmd = listToCmd(key, val)
 	case dict.Dict:
 		cmd = hashToCmd(key, val)
 	case *set.Set:
 		cmd = setToCmd(key, val)
+	case *sortedset.SortedSet:
+		cmd = zsetToCmd(key, val)
 	}
 	return cmd
 }
 
+// EntityToCmds returns commands which rebuild entity, a stream needs more than one command
+// to restore its consumer groups while other types need exactly one
+func EntityToCmds(key string, entity *DataEntity) []*reply.MultiBulkReply {
+	if entity == nil {
+		return nil
+	}
+	if s, ok := entity.Data.(*stream.Stream); ok {
+		return streamToCmds(key, s)
+	}
+	cmd := EntityToCmd(key, entity)
+	if cmd == nil {
+		return nil
+	}
+	return []*reply.MultiBulkReply{cmd}
+}
+
 var setCmd = []byte("SET")
 
 func stringToCmd(key string, data []byte) *reply.MultiBulkReply {
@@ -87,6 +109,58 @@ func setToCmd(key string, s *set.Set) *reply.MultiBulkReply {
 	return reply.MakeMultiBulkReply(args)
 }
 
+var zaddCmd = []byte("ZADD")
+
+func zsetToCmd(key string, zset *sortedset.SortedSet) *reply.MultiBulkReply {
+	args := make([][]byte, 2+2*zset.Len())
+	args[0] = zaddCmd
+	args[1] = []byte(key)
+	index := 2
+	zset.ForEach(func(member string, score float64) bool {
+		args[index] = []byte(formatScore(score))
+		args[index+1] = []byte(member)
+		index += 2
+		return true
+	})
+	return reply.MakeMultiBulkReply(args)
+}
+
+var xaddCmd = []byte("XADD")
+
+// streamToCmds rebuilds entries by XADD, then metadata by XSETID, groups by XGROUP CREATE
+// and pending entries by XCLAIM. Consumers without pending entries are created by XGROUP CREATECONSUMER
+func streamToCmds(key string, s *stream.Stream) []*reply.MultiBulkReply {
+	var cmds []*reply.MultiBulkReply
+	if s.Len() == 0 {
+		// creates an empty stream by adding an entry and trimming it at once
+		cmds = append(cmds, reply.MakeMultiBulkReply(utils.ToCmdLine("XADD", key, "MAXLEN", "0", "0-1", "x", "y")))
+	}
+	s.ForEach(func(entry *stream.Entry) bool {
+		args := make([][]byte, 0, 3+len(entry.Fields))
+		args = append(args, xaddCmd, []byte(key), []byte(entry.ID.String()))
+		args = append(args, entry.Fields...)
+		cmds = append(cmds, reply.MakeMultiBulkReply(args))
+		return true
+	})
+	cmds = append(cmds, reply.MakeMultiBulkReply(utils.ToCmdLine("XSETID", key, s.LastID.String(),
+		"ENTRIESADDED", strconv.FormatUint(s.EntriesAdded, 10),
+		"MAXDELETEDID", s.MaxDeletedID.String())))
+	for _, g := range s.Groups() {
+		cmds = append(cmds, reply.MakeMultiBulkReply(utils.ToCmdLine("XGROUP", "CREATE", key, g.Name,
+			g.LastID.String(), "ENTRIESREAD", strconv.FormatInt(g.EntriesRead, 10))))
+		g.RangePending(stream.ID{}, stream.MaxID, func(pe *stream.PendingEntry) bool {
+			cmds = append(cmds, makeStreamClaimCmd(key, g, pe))
+			return true
+		})
+		for _, c := range g.Consumers() {
+			if c.PendingLen() == 0 {
+				cmds = append(cmds, makeStreamCreateConsumerCmd(key, g, c.Name))
+			}
+		}
+	}
+	return cmds
+}
+
 // toTTLCmd serialize ttl config
 func toTTLCmd(db *DB, key string) *reply.MultiBulkReply {
 	raw, exists := db.ttlMap.Get(key)
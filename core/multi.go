@@ -4,6 +4,7 @@ import (
 	"Tiny-Godis/data_struct/set"
 	"Tiny-Godis/interface/redis"
 	"Tiny-Godis/redis/reply"
+	"strings"
 )
 
 var forbiddenCmdInMulti = set.MakeSet("flushdb", "flushall")
@@ -44,7 +45,7 @@ func StartMulti(conn redis.Connection) redis.Reply {
 }
 
 func EnqueueCmd(conn redis.Connection, line CmdLine) redis.Reply {
-	cmdName := string(line[0])
+	cmdName := strings.ToLower(string(line[0]))
 	cmd, ok := cmdTable[cmdName]
 	if !ok {
 		return reply.MakeErrReply("ERR unknown command '" + cmdName + "'")
@@ -75,7 +76,7 @@ func execMulti(db *DB, watching map[string]uint32, cmdLines []CmdLine) redis.Rep
 	writeKeys := make([]string, 0)
 	readKeys := make([]string, 0)
 	for _, cmdline := range cmdLines {
-		cmdName := string(cmdline[0])
+		cmdName := strings.ToLower(string(cmdline[0]))
 		cmd, _ := cmdTable[cmdName]
 		wk, rk := cmd.prepare(cmdline[1:])
 		writeKeys = append(writeKeys, wk...)
@@ -91,6 +92,12 @@ func execMulti(db *DB, watching map[string]uint32, cmdLines []CmdLine) redis.Rep
 
 	readKeys = append(readKeys, watchingKeys...)
 
+	if len(writeKeys) > 0 {
+		if errReply := db.checkAofWritable(); errReply != nil {
+			return errReply
+		}
+	}
+
 	db.RWLocks(writeKeys, readKeys)
 	defer db.RWUnLocks(writeKeys, readKeys)
 
@@ -113,6 +120,11 @@ func execMulti(db *DB, watching map[string]uint32, cmdLines []CmdLine) redis.Rep
 	}
 	if !aborted {
 		db.addVersion(writeKeys...)
+		if len(writeKeys) > 0 {
+			if errReply := db.checkAofSynced(); errReply != nil {
+				return errReply
+			}
+		}
 		return reply.MakeMultiRawReply(results)
 	}
 
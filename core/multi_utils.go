@@ -41,10 +41,11 @@ func rollbackGivenKeys(db *DB, keys ...string) []CmdLine {
 		if entity, ok := db.GetEntity(key); !ok {
 			undoCmdLines = append(undoCmdLines, utils.ToCmdLine("DEL", key))
 		} else {
-			undoCmdLines = append(undoCmdLines,
-				utils.ToCmdLine("DEL", key),
-				EntityToCmd(key, entity).Args,
-				toTTLCmd(db, key).Args)
+			undoCmdLines = append(undoCmdLines, utils.ToCmdLine("DEL", key))
+			for _, cmd := range EntityToCmds(key, entity) {
+				undoCmdLines = append(undoCmdLines, cmd.Args)
+			}
+			undoCmdLines = append(undoCmdLines, toTTLCmd(db, key).Args)
 		}
 	}
 	return undoCmdLines
@@ -95,3 +96,23 @@ func rollbackSetMembers(db *DB, key string, members ...string) []CmdLine {
 	}
 	return undoCmdLines
 }
+
+func rollbackZSetMembers(db *DB, key string, members ...string) []CmdLine {
+	var undoCmdLines []CmdLine
+	zset, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return nil
+	}
+	if zset == nil {
+		undoCmdLines = append(undoCmdLines, utils.ToCmdLine("DEL", key))
+		return undoCmdLines
+	}
+	for _, member := range members {
+		if score, ok := zset.Get(member); ok {
+			undoCmdLines = append(undoCmdLines, utils.ToCmdLine("ZADD", key, formatScore(score), member))
+		} else {
+			undoCmdLines = append(undoCmdLines, utils.ToCmdLine("ZREM", key, member))
+		}
+	}
+	return undoCmdLines
+}
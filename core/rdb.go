@@ -0,0 +1,633 @@
+package core
+
+import (
+	"Tiny-Godis/data_struct/dict"
+	"Tiny-Godis/data_struct/list"
+	"Tiny-Godis/data_struct/set"
+	"Tiny-Godis/data_struct/sortedset"
+	"Tiny-Godis/data_struct/stream"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// rdb format is compatible with redis rdb version 9, only the encodings used by Tiny-Godis are supported
+const (
+	rdbVersion = 9
+	rdbMagic   = "REDIS"
+
+	// library of functions, which is introduced by rdb version 10 and written only if there are libraries
+	rdbOpcodeFunction2    = 245
+	rdbOpcodeAux          = 250
+	rdbOpcodeResizeDB     = 251
+	rdbOpcodeExpireTimeMs = 252
+	rdbOpcodeExpireTime   = 253
+	rdbOpcodeSelectDB     = 254
+	rdbOpcodeEOF          = 255
+
+	rdbTypeString = 0
+	rdbTypeList   = 1
+	rdbTypeSet    = 2
+	rdbTypeHash   = 4
+	rdbTypeZSet2  = 5
+
+	rdbTypeStreamListpacks = 15
+
+	rdb6BitLen  = 0
+	rdb14BitLen = 1
+	rdb32BitLen = 0x80
+	rdb64BitLen = 0x81
+	rdbEncVal   = 3
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+)
+
+// crc64Table is the table of crc-64-jones used by redis
+var crc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// crc64Update continues redis crc64 checksum with p.
+// hash/crc64 inverts crc before and after updating while redis doesn't
+func crc64Update(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crc64Table, p)
+}
+
+/* ---- Encoder ----- */
+
+type rdbEncoder struct {
+	w   io.Writer
+	crc uint64
+	buf []byte
+}
+
+func newRdbEncoder(w io.Writer) *rdbEncoder {
+	return &rdbEncoder{
+		w:   w,
+		buf: make([]byte, 9),
+	}
+}
+
+func (enc *rdbEncoder) write(p []byte) error {
+	enc.crc = crc64Update(enc.crc, p)
+	_, err := enc.w.Write(p)
+	return err
+}
+
+func (enc *rdbEncoder) writeByte(b byte) error {
+	enc.buf[0] = b
+	return enc.write(enc.buf[:1])
+}
+
+func (enc *rdbEncoder) writeLength(n uint64) error {
+	buf := enc.buf
+	switch {
+	case n < 1<<6:
+		buf[0] = byte(n) | rdb6BitLen<<6
+		return enc.write(buf[:1])
+	case n < 1<<14:
+		buf[0] = byte(n>>8) | rdb14BitLen<<6
+		buf[1] = byte(n)
+		return enc.write(buf[:2])
+	case n <= 1<<32-1:
+		buf[0] = rdb32BitLen
+		binary.BigEndian.PutUint32(buf[1:], uint32(n))
+		return enc.write(buf[:5])
+	default:
+		buf[0] = rdb64BitLen
+		binary.BigEndian.PutUint64(buf[1:], n)
+		return enc.write(buf[:9])
+	}
+}
+
+func (enc *rdbEncoder) writeString(s []byte) error {
+	err := enc.writeLength(uint64(len(s)))
+	if err != nil {
+		return err
+	}
+	return enc.write(s)
+}
+
+// writeInt writes an integer as int encoded string if it fits in 32 bits
+func (enc *rdbEncoder) writeInt(n int64) error {
+	buf := enc.buf
+	switch {
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		buf[0] = rdbEncVal<<6 | rdbEncInt8
+		buf[1] = byte(int8(n))
+		return enc.write(buf[:2])
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		buf[0] = rdbEncVal<<6 | rdbEncInt16
+		binary.LittleEndian.PutUint16(buf[1:], uint16(int16(n)))
+		return enc.write(buf[:3])
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		buf[0] = rdbEncVal<<6 | rdbEncInt32
+		binary.LittleEndian.PutUint32(buf[1:], uint32(int32(n)))
+		return enc.write(buf[:5])
+	}
+	return enc.writeString(strconv.AppendInt(nil, n, 10))
+}
+
+// writeDouble writes a score of sorted set in binary form
+func (enc *rdbEncoder) writeDouble(f float64) error {
+	binary.LittleEndian.PutUint64(enc.buf, math.Float64bits(f))
+	return enc.write(enc.buf[:8])
+}
+
+func (enc *rdbEncoder) writeHeader() error {
+	return enc.write([]byte(fmt.Sprintf("%s%04d", rdbMagic, rdbVersion)))
+}
+
+func (enc *rdbEncoder) writeAux(key string, value string) error {
+	err := enc.writeByte(rdbOpcodeAux)
+	if err != nil {
+		return err
+	}
+	err = enc.writeString([]byte(key))
+	if err != nil {
+		return err
+	}
+	return enc.writeString([]byte(value))
+}
+
+func (enc *rdbEncoder) writeFunction(code string) error {
+	err := enc.writeByte(rdbOpcodeFunction2)
+	if err != nil {
+		return err
+	}
+	return enc.writeString([]byte(code))
+}
+
+func (enc *rdbEncoder) writeSelectDB(index int) error {
+	err := enc.writeByte(rdbOpcodeSelectDB)
+	if err != nil {
+		return err
+	}
+	return enc.writeLength(uint64(index))
+}
+
+// writeEntry writes a key-value pair with its expire time, expireAt is nil if the key has no ttl
+func (enc *rdbEncoder) writeEntry(key string, entity *DataEntity, expireAt *time.Time) error {
+	objType, ok := rdbObjectType(entity)
+	if !ok {
+		// unsupported type will be skipped, together with its expire time
+		return nil
+	}
+	if expireAt != nil {
+		err := enc.writeByte(rdbOpcodeExpireTimeMs)
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(enc.buf, uint64(expireAt.UnixNano()/1e6))
+		err = enc.write(enc.buf[:8])
+		if err != nil {
+			return err
+		}
+	}
+	err := enc.writeByte(objType)
+	if err != nil {
+		return err
+	}
+	err = enc.writeString([]byte(key))
+	if err != nil {
+		return err
+	}
+	return enc.writeObject(entity)
+}
+
+// writeEOF writes end of rdb and checksum
+func (enc *rdbEncoder) writeEOF() error {
+	err := enc.writeByte(rdbOpcodeEOF)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(enc.buf, enc.crc)
+	_, err = enc.w.Write(enc.buf[:8])
+	return err
+}
+
+func rdbObjectType(entity *DataEntity) (byte, bool) {
+	switch entity.Data.(type) {
+	case []byte, int64:
+		return rdbTypeString, true
+	case list.List:
+		return rdbTypeList, true
+	case *set.Set:
+		return rdbTypeSet, true
+	case dict.Dict:
+		return rdbTypeHash, true
+	case *sortedset.SortedSet:
+		return rdbTypeZSet2, true
+	case *stream.Stream:
+		return rdbTypeStreamListpacks, true
+	}
+	return 0, false
+}
+
+// writeObject writes value of entity without type byte
+func (enc *rdbEncoder) writeObject(entity *DataEntity) error {
+	var err error
+	switch val := entity.Data.(type) {
+	case []byte:
+		return enc.writeString(val)
+	case int64:
+		return enc.writeInt(val)
+	case list.List:
+		err = enc.writeLength(uint64(val.Len()))
+		if err != nil {
+			return err
+		}
+		val.ForEach(func(v interface{}) bool {
+			bytes, _ := v.([]byte)
+			err = enc.writeString(bytes)
+			return err == nil
+		})
+	case *set.Set:
+		err = enc.writeLength(uint64(val.Len()))
+		if err != nil {
+			return err
+		}
+		val.ForEach(func(member string, _ interface{}) bool {
+			err = enc.writeString([]byte(member))
+			return err == nil
+		})
+	case dict.Dict:
+		err = enc.writeLength(uint64(val.Len()))
+		if err != nil {
+			return err
+		}
+		val.ForEach(func(field string, v interface{}) bool {
+			err = enc.writeString([]byte(field))
+			if err != nil {
+				return false
+			}
+			bytes, _ := v.([]byte)
+			err = enc.writeString(bytes)
+			return err == nil
+		})
+	case *sortedset.SortedSet:
+		err = enc.writeLength(uint64(val.Len()))
+		if err != nil {
+			return err
+		}
+		val.ForEach(func(member string, score float64) bool {
+			err = enc.writeString([]byte(member))
+			if err != nil {
+				return false
+			}
+			err = enc.writeDouble(score)
+			return err == nil
+		})
+	case *stream.Stream:
+		return enc.writeStream(val)
+	default:
+		return fmt.Errorf("unsupported type %T", entity.Data)
+	}
+	return err
+}
+
+// writeRdbSnapshot writes the whole dataset of db in rdb format
+func writeRdbSnapshot(db *DB, w io.Writer) error {
+	enc := newRdbEncoder(w)
+	err := enc.writeHeader()
+	if err != nil {
+		return err
+	}
+	err = enc.writeAux("aof-preamble", "1")
+	if err != nil {
+		return err
+	}
+	for _, lib := range db.functions.list() {
+		err = enc.writeFunction(lib.code)
+		if err != nil {
+			return err
+		}
+	}
+	err = enc.writeSelectDB(0)
+	if err != nil {
+		return err
+	}
+	db.data.ForEach(func(key string, val interface{}) bool {
+		entity, _ := val.(*DataEntity)
+		var expireAt *time.Time
+		if raw, ok := db.ttlMap.Get(key); ok {
+			t, _ := raw.(time.Time)
+			expireAt = &t
+		}
+		err = enc.writeEntry(key, entity, expireAt)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return enc.writeEOF()
+}
+
+/* ---- Decoder ----- */
+
+var errRdbChecksum = errors.New("wrong rdb checksum")
+
+type rdbDecoder struct {
+	r   io.Reader
+	crc uint64
+	buf []byte
+	// bytes consumed
+	offset int64
+	// max length of a string, 0 means unlimited
+	maxLength uint64
+}
+
+func newRdbDecoder(r io.Reader) *rdbDecoder {
+	return &rdbDecoder{
+		r:   r,
+		buf: make([]byte, 9),
+	}
+}
+
+func (dec *rdbDecoder) readFull(p []byte) error {
+	n, err := io.ReadFull(dec.r, p)
+	dec.offset += int64(n)
+	if err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	dec.crc = crc64Update(dec.crc, p)
+	return nil
+}
+
+func (dec *rdbDecoder) readByte() (byte, error) {
+	err := dec.readFull(dec.buf[:1])
+	return dec.buf[0], err
+}
+
+// readLength returns length or special encoding type if encoded is true
+func (dec *rdbDecoder) readLength() (length uint64, encoded bool, err error) {
+	first, err := dec.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch first >> 6 {
+	case rdb6BitLen:
+		return uint64(first & 0x3f), false, nil
+	case rdb14BitLen:
+		next, err := dec.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(first&0x3f)<<8 | uint64(next), false, nil
+	case rdbEncVal:
+		return uint64(first & 0x3f), true, nil
+	}
+	switch first {
+	case rdb32BitLen:
+		err = dec.readFull(dec.buf[:4])
+		return uint64(binary.BigEndian.Uint32(dec.buf)), false, err
+	case rdb64BitLen:
+		err = dec.readFull(dec.buf[:8])
+		return binary.BigEndian.Uint64(dec.buf), false, err
+	}
+	return 0, false, fmt.Errorf("unknown length encoding %d", first)
+}
+
+func (dec *rdbDecoder) readString() ([]byte, error) {
+	length, encoded, err := dec.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		if dec.maxLength > 0 && length > dec.maxLength {
+			return nil, fmt.Errorf("string length %d exceeds limit", length)
+		}
+		s := make([]byte, length)
+		err = dec.readFull(s)
+		return s, err
+	}
+	var val int64
+	switch length {
+	case rdbEncInt8:
+		b, err := dec.readByte()
+		if err != nil {
+			return nil, err
+		}
+		val = int64(int8(b))
+	case rdbEncInt16:
+		err = dec.readFull(dec.buf[:2])
+		val = int64(int16(binary.LittleEndian.Uint16(dec.buf)))
+	case rdbEncInt32:
+		err = dec.readFull(dec.buf[:4])
+		val = int64(int32(binary.LittleEndian.Uint32(dec.buf)))
+	default:
+		return nil, fmt.Errorf("unsupported string encoding %d", length)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strconv.FormatInt(val, 10)), nil
+}
+
+func (dec *rdbDecoder) readDouble() (float64, error) {
+	err := dec.readFull(dec.buf[:8])
+	return math.Float64frombits(binary.LittleEndian.Uint64(dec.buf)), err
+}
+
+func (dec *rdbDecoder) readObject(objType byte) (*DataEntity, error) {
+	switch objType {
+	case rdbTypeString:
+		val, err := dec.readString()
+		if err != nil {
+			return nil, err
+		}
+		return makeStringEntity(val), nil
+	case rdbTypeList:
+		size, _, err := dec.readLength()
+		if err != nil {
+			return nil, err
+		}
+		l := makeList()
+		for i := uint64(0); i < size; i++ {
+			val, err := dec.readString()
+			if err != nil {
+				return nil, err
+			}
+			l.RPush(val)
+		}
+		return &DataEntity{Data: l}, nil
+	case rdbTypeSet:
+		size, _, err := dec.readLength()
+		if err != nil {
+			return nil, err
+		}
+		s := makeSet()
+		for i := uint64(0); i < size; i++ {
+			member, err := dec.readString()
+			if err != nil {
+				return nil, err
+			}
+			s.Add(string(member))
+		}
+		return &DataEntity{Data: s}, nil
+	case rdbTypeHash:
+		size, _, err := dec.readLength()
+		if err != nil {
+			return nil, err
+		}
+		d := makeHash()
+		for i := uint64(0); i < size; i++ {
+			field, err := dec.readString()
+			if err != nil {
+				return nil, err
+			}
+			val, err := dec.readString()
+			if err != nil {
+				return nil, err
+			}
+			d.Put(string(field), val)
+		}
+		return &DataEntity{Data: d}, nil
+	case rdbTypeZSet2:
+		size, _, err := dec.readLength()
+		if err != nil {
+			return nil, err
+		}
+		zset := sortedset.Make()
+		for i := uint64(0); i < size; i++ {
+			member, err := dec.readString()
+			if err != nil {
+				return nil, err
+			}
+			score, err := dec.readDouble()
+			if err != nil {
+				return nil, err
+			}
+			if math.IsNaN(score) {
+				return nil, fmt.Errorf("score of %s is not a number", member)
+			}
+			zset.Add(string(member), score)
+		}
+		return &DataEntity{Data: zset}, nil
+	case rdbTypeStreamListpacks:
+		s, err := dec.readStream()
+		if err != nil {
+			return nil, err
+		}
+		return &DataEntity{Data: s}, nil
+	}
+	return nil, fmt.Errorf("unsupported rdb object type %d", objType)
+}
+
+// loadRdb reads a rdb from r into db, r is left at the end of rdb.
+// returns the length of rdb
+func (db *DB) loadRdb(r io.Reader) (int64, error) {
+	dec := newRdbDecoder(r)
+	err := dec.load(db)
+	return dec.offset, err
+}
+
+func (dec *rdbDecoder) load(db *DB) error {
+	header := make([]byte, 9)
+	err := dec.readFull(header)
+	if err != nil {
+		return err
+	}
+	if string(header[:5]) != rdbMagic {
+		return fmt.Errorf("wrong signature trying to load rdb")
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > rdbVersion {
+		return fmt.Errorf("can't handle rdb format version %s", header[5:])
+	}
+
+	var expireAt *time.Time
+	for {
+		opcode, err := dec.readByte()
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case rdbOpcodeExpireTimeMs:
+			err = dec.readFull(dec.buf[:8])
+			if err != nil {
+				return err
+			}
+			t := time.Unix(0, int64(binary.LittleEndian.Uint64(dec.buf))*int64(time.Millisecond))
+			expireAt = &t
+			continue
+		case rdbOpcodeExpireTime:
+			err = dec.readFull(dec.buf[:4])
+			if err != nil {
+				return err
+			}
+			t := time.Unix(int64(binary.LittleEndian.Uint32(dec.buf)), 0)
+			expireAt = &t
+			continue
+		case rdbOpcodeSelectDB:
+			_, _, err = dec.readLength()
+		case rdbOpcodeResizeDB:
+			_, _, err = dec.readLength()
+			if err == nil {
+				_, _, err = dec.readLength()
+			}
+		case rdbOpcodeFunction2:
+			var code []byte
+			code, err = dec.readString()
+			if err == nil {
+				err = db.loadLibrary(string(code))
+			}
+		case rdbOpcodeAux:
+			_, err = dec.readString()
+			if err == nil {
+				_, err = dec.readString()
+			}
+		case rdbOpcodeEOF:
+			expected := dec.crc
+			err = dec.readFull(dec.buf[:8])
+			if err != nil {
+				return err
+			}
+			checksum := binary.LittleEndian.Uint64(dec.buf)
+			// checksum 0 means checksum is disabled
+			if version >= 5 && checksum != 0 && checksum != expected {
+				return errRdbChecksum
+			}
+			return nil
+		default:
+			var key []byte
+			key, err = dec.readString()
+			if err != nil {
+				return err
+			}
+			var entity *DataEntity
+			entity, err = dec.readObject(opcode)
+			if err != nil {
+				return err
+			}
+			if expireAt != nil && expireAt.Before(time.Now()) {
+				// expired keys won't be loaded
+				expireAt = nil
+				continue
+			}
+			db.PutEntity(string(key), entity)
+			if expireAt != nil {
+				db.Expire(string(key), *expireAt)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		expireAt = nil
+	}
+}
+
+// hasRdbPreamble checks whether the aof file starts with a rdb
+func hasRdbPreamble(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(rdbMagic))
+	return err == nil && string(magic) == rdbMagic
+}
@@ -0,0 +1,580 @@
+package core
+
+import (
+	"Tiny-Godis/data_struct/stream"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// streams are saved as RDB_TYPE_STREAM_LISTPACKS of redis rdb version 9,
+// which has no entries-added, max-deleted-entry-id and entries-read, they are estimated on loading
+
+const (
+	// streamNodeMaxEntries is the number of entries in a saved node
+	streamNodeMaxEntries = 100
+
+	streamItemFlagDeleted    = 1
+	streamItemFlagSameFields = 2
+)
+
+var errStreamCorrupted = errors.New("corrupted stream")
+
+// listpackIntWidths are the number of bytes following encodings of 32 bits string and integers
+var listpackIntWidths = map[byte]int{0xf0: 4, 0xf1: 2, 0xf2: 3, 0xf3: 4, 0xf4: 8}
+
+/* ---- redis listpack ----- */
+
+// rdbListpack builds a listpack of redis, which differs from listpack of Tiny-Godis
+type rdbListpack struct {
+	buf   []byte
+	count int
+}
+
+// listpackBacklen encodes length of an element, so that the listpack could be traversed backward
+func listpackBacklen(l int) []byte {
+	switch {
+	case l <= 127:
+		return []byte{byte(l)}
+	case l < 16383:
+		return []byte{byte(l >> 7), byte(l&127) | 128}
+	case l < 2097151:
+		return []byte{byte(l >> 14), byte((l>>7)&127) | 128, byte(l&127) | 128}
+	case l < 268435455:
+		return []byte{byte(l >> 21), byte((l>>14)&127) | 128, byte((l>>7)&127) | 128, byte(l&127) | 128}
+	}
+	return []byte{byte(l >> 28), byte((l>>21)&127) | 128, byte((l>>14)&127) | 128, byte((l>>7)&127) | 128, byte(l&127) | 128}
+}
+
+func (lp *rdbListpack) appendElement(ele []byte) {
+	lp.buf = append(lp.buf, ele...)
+	lp.buf = append(lp.buf, listpackBacklen(len(ele))...)
+	lp.count++
+}
+
+func (lp *rdbListpack) appendInt(v int64) {
+	var ele []byte
+	switch {
+	case v >= 0 && v <= 127:
+		ele = []byte{byte(v)}
+	case v >= -4096 && v <= 4095:
+		u := uint64(v) & 0x1fff
+		ele = []byte{byte(u>>8) | 0xc0, byte(u)}
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		ele = []byte{0xf1, 0, 0}
+		binary.LittleEndian.PutUint16(ele[1:], uint16(v))
+	case v >= -1<<23 && v <= 1<<23-1:
+		ele = []byte{0xf2, byte(v), byte(v >> 8), byte(v >> 16)}
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		ele = []byte{0xf3, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(ele[1:], uint32(v))
+	default:
+		ele = make([]byte, 9)
+		ele[0] = 0xf4
+		binary.LittleEndian.PutUint64(ele[1:], uint64(v))
+	}
+	lp.appendElement(ele)
+}
+
+// appendString appends s, a string representing an integer is encoded as integer like redis does
+func (lp *rdbListpack) appendString(s []byte) {
+	if len(s) > 0 && len(s) <= 20 {
+		if v, err := strconv.ParseInt(string(s), 10, 64); err == nil && strconv.FormatInt(v, 10) == string(s) {
+			lp.appendInt(v)
+			return
+		}
+	}
+	var ele []byte
+	switch l := len(s); {
+	case l < 64:
+		ele = append([]byte{0x80 | byte(l)}, s...)
+	case l < 4096:
+		ele = append([]byte{0xe0 | byte(l>>8), byte(l)}, s...)
+	default:
+		ele = make([]byte, 5, 5+l)
+		ele[0] = 0xf0
+		binary.LittleEndian.PutUint32(ele[1:], uint32(l))
+		ele = append(ele, s...)
+	}
+	lp.appendElement(ele)
+}
+
+func (lp *rdbListpack) bytes() []byte {
+	buf := make([]byte, 6, 6+len(lp.buf)+1)
+	binary.LittleEndian.PutUint32(buf, uint32(6+len(lp.buf)+1))
+	count := lp.count
+	if count > math.MaxUint16 {
+		// too many elements to be counted in header
+		count = math.MaxUint16
+	}
+	binary.LittleEndian.PutUint16(buf[4:], uint16(count))
+	buf = append(buf, lp.buf...)
+	return append(buf, 0xff)
+}
+
+// decodeRdbListpack returns elements of a redis listpack, integers are formatted as strings
+func decodeRdbListpack(buf []byte) ([][]byte, error) {
+	if len(buf) < 7 || int(binary.LittleEndian.Uint32(buf)) != len(buf) {
+		return nil, errStreamCorrupted
+	}
+	var elements [][]byte
+	for pos := 6; ; {
+		if pos >= len(buf) {
+			return nil, errStreamCorrupted
+		}
+		b := buf[pos]
+		if b == 0xff {
+			if pos != len(buf)-1 {
+				return nil, errStreamCorrupted
+			}
+			return elements, nil
+		}
+		var header, size int
+		var val int64
+		isInt := true
+		switch {
+		case b&0x80 == 0:
+			header, val = 1, int64(b)
+		case b&0xc0 == 0x80:
+			header, size, isInt = 1, int(b&0x3f), false
+		case b&0xe0 == 0xc0:
+			if pos+2 > len(buf) {
+				return nil, errStreamCorrupted
+			}
+			u := int64(b&0x1f)<<8 | int64(buf[pos+1])
+			if u >= 1<<12 {
+				u -= 1 << 13
+			}
+			header, val = 2, u
+		case b&0xf0 == 0xe0:
+			if pos+2 > len(buf) {
+				return nil, errStreamCorrupted
+			}
+			header, size, isInt = 2, int(b&0x0f)<<8|int(buf[pos+1]), false
+		default:
+			width, ok := listpackIntWidths[b]
+			if !ok || pos+1+width > len(buf) {
+				return nil, errStreamCorrupted
+			}
+			raw := make([]byte, 8)
+			copy(raw, buf[pos+1:pos+1+width])
+			u := binary.LittleEndian.Uint64(raw)
+			header = 1 + width
+			if b == 0xf0 {
+				size, isInt = int(u), false
+			} else {
+				// sign extends the integer of width bytes
+				shift := uint(64 - 8*width)
+				val = int64(u<<shift) >> shift
+			}
+		}
+		if size < 0 || pos+header+size > len(buf) {
+			return nil, errStreamCorrupted
+		}
+		if isInt {
+			elements = append(elements, []byte(strconv.FormatInt(val, 10)))
+		} else {
+			str := make([]byte, size)
+			copy(str, buf[pos+header:pos+header+size])
+			elements = append(elements, str)
+		}
+		pos += header + size
+		pos += len(listpackBacklen(header + size))
+	}
+}
+
+/* ---- stream ----- */
+
+// streamNodeListpack encodes entries of a node like redis:
+// a master entry [count, deleted, master-fields-count, master-fields..., 0] followed by entries
+// [flags, ms-diff, seq-diff, [fields-count, field, value ... | value ...], lp-count].
+// The master ID is the ID of the first entry, and fields of the first entry are master fields
+func streamNodeListpack(entries []*stream.Entry) []byte {
+	lp := &rdbListpack{}
+	master := entries[0]
+	masterFields := make([][]byte, 0, len(master.Fields)/2)
+	for i := 0; i < len(master.Fields); i += 2 {
+		masterFields = append(masterFields, master.Fields[i])
+	}
+	lp.appendInt(int64(len(entries)))
+	lp.appendInt(0)
+	lp.appendInt(int64(len(masterFields)))
+	for _, field := range masterFields {
+		lp.appendString(field)
+	}
+	lp.appendInt(0)
+	for _, entry := range entries {
+		n := len(entry.Fields) / 2
+		sameFields := n == len(masterFields)
+		for i := 0; sameFields && i < n; i++ {
+			sameFields = string(entry.Fields[2*i]) == string(masterFields[i])
+		}
+		if sameFields {
+			lp.appendInt(streamItemFlagSameFields)
+		} else {
+			lp.appendInt(0)
+		}
+		lp.appendInt(int64(entry.ID.Ms - master.ID.Ms))
+		lp.appendInt(int64(entry.ID.Seq - master.ID.Seq))
+		if sameFields {
+			for i := 1; i < len(entry.Fields); i += 2 {
+				lp.appendString(entry.Fields[i])
+			}
+			lp.appendInt(int64(n + 3))
+		} else {
+			lp.appendInt(int64(n))
+			for _, field := range entry.Fields {
+				lp.appendString(field)
+			}
+			lp.appendInt(int64(2*n + 4))
+		}
+	}
+	return lp.bytes()
+}
+
+func (enc *rdbEncoder) writeMillis(ms int64) error {
+	binary.LittleEndian.PutUint64(enc.buf, uint64(ms))
+	return enc.write(enc.buf[:8])
+}
+
+func (enc *rdbEncoder) writeStreamID(id stream.ID) error {
+	err := enc.writeLength(id.Ms)
+	if err != nil {
+		return err
+	}
+	return enc.writeLength(id.Seq)
+}
+
+func (enc *rdbEncoder) writeStream(s *stream.Stream) error {
+	var nodes [][]*stream.Entry
+	s.ForEach(func(entry *stream.Entry) bool {
+		if len(nodes) == 0 || len(nodes[len(nodes)-1]) == streamNodeMaxEntries {
+			nodes = append(nodes, make([]*stream.Entry, 0, streamNodeMaxEntries))
+		}
+		nodes[len(nodes)-1] = append(nodes[len(nodes)-1], entry)
+		return true
+	})
+	err := enc.writeLength(uint64(len(nodes)))
+	if err != nil {
+		return err
+	}
+	for _, entries := range nodes {
+		err = enc.writeString(entries[0].ID.Bytes())
+		if err != nil {
+			return err
+		}
+		err = enc.writeString(streamNodeListpack(entries))
+		if err != nil {
+			return err
+		}
+	}
+	err = enc.writeLength(uint64(s.Len()))
+	if err != nil {
+		return err
+	}
+	err = enc.writeStreamID(s.LastID)
+	if err != nil {
+		return err
+	}
+
+	groups := s.Groups()
+	err = enc.writeLength(uint64(len(groups)))
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		err = enc.writeString([]byte(g.Name))
+		if err != nil {
+			return err
+		}
+		err = enc.writeStreamID(g.LastID)
+		if err != nil {
+			return err
+		}
+		err = enc.writeLength(uint64(g.PendingLen()))
+		if err != nil {
+			return err
+		}
+		g.RangePending(stream.ID{}, stream.MaxID, func(pe *stream.PendingEntry) bool {
+			if err = enc.write(pe.ID.Bytes()); err != nil {
+				return false
+			}
+			if err = enc.writeMillis(pe.DeliveryTime); err != nil {
+				return false
+			}
+			err = enc.writeLength(uint64(pe.DeliveryCount))
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+		consumers := g.Consumers()
+		err = enc.writeLength(uint64(len(consumers)))
+		if err != nil {
+			return err
+		}
+		for _, c := range consumers {
+			err = enc.writeString([]byte(c.Name))
+			if err != nil {
+				return err
+			}
+			err = enc.writeMillis(c.SeenTime)
+			if err != nil {
+				return err
+			}
+			err = enc.writeLength(uint64(c.PendingLen()))
+			if err != nil {
+				return err
+			}
+			c.RangePending(stream.ID{}, stream.MaxID, func(pe *stream.PendingEntry) bool {
+				err = enc.write(pe.ID.Bytes())
+				return err == nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (dec *rdbDecoder) readMillis() (int64, error) {
+	err := dec.readFull(dec.buf[:8])
+	return int64(binary.LittleEndian.Uint64(dec.buf)), err
+}
+
+func (dec *rdbDecoder) readStreamID() (stream.ID, error) {
+	ms, _, err := dec.readLength()
+	if err != nil {
+		return stream.ID{}, err
+	}
+	seq, _, err := dec.readLength()
+	return stream.ID{Ms: ms, Seq: seq}, err
+}
+
+func (dec *rdbDecoder) readRawStreamID() (stream.ID, error) {
+	buf := make([]byte, 16)
+	err := dec.readFull(buf)
+	return stream.IDFromBytes(buf), err
+}
+
+// loadStreamNode appends entries of a node not deleted to s
+func loadStreamNode(s *stream.Stream, masterID stream.ID, elements [][]byte) error {
+	pos := 0
+	next := func() ([]byte, error) {
+		if pos >= len(elements) {
+			return nil, errStreamCorrupted
+		}
+		pos++
+		return elements[pos-1], nil
+	}
+	nextInt := func() (int64, error) {
+		ele, err := next()
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseInt(string(ele), 10, 64)
+	}
+	// skips count and deleted of master entry
+	if _, err := nextInt(); err != nil {
+		return err
+	}
+	if _, err := nextInt(); err != nil {
+		return err
+	}
+	masterCount, err := nextInt()
+	if err != nil || masterCount < 0 || masterCount > int64(len(elements)) {
+		return errStreamCorrupted
+	}
+	masterFields := make([][]byte, masterCount)
+	for i := range masterFields {
+		if masterFields[i], err = next(); err != nil {
+			return err
+		}
+	}
+	if _, err = nextInt(); err != nil {
+		return err
+	}
+
+	for pos < len(elements) {
+		flags, err := nextInt()
+		if err != nil {
+			return err
+		}
+		msDiff, err := nextInt()
+		if err != nil {
+			return err
+		}
+		seqDiff, err := nextInt()
+		if err != nil {
+			return err
+		}
+		id := stream.ID{Ms: masterID.Ms + uint64(msDiff), Seq: masterID.Seq + uint64(seqDiff)}
+		var fields [][]byte
+		if flags&streamItemFlagSameFields != 0 {
+			for _, field := range masterFields {
+				value, err := next()
+				if err != nil {
+					return err
+				}
+				fields = append(fields, field, value)
+			}
+		} else {
+			n, err := nextInt()
+			if err != nil || n < 0 || n > int64(len(elements)) {
+				return errStreamCorrupted
+			}
+			fields = make([][]byte, 2*n)
+			for i := range fields {
+				if fields[i], err = next(); err != nil {
+					return err
+				}
+			}
+		}
+		// skips lp-count
+		if _, err = nextInt(); err != nil {
+			return err
+		}
+		if flags&streamItemFlagDeleted != 0 {
+			continue
+		}
+		if s.Len() > 0 && !s.LastID.Less(id) {
+			return errStreamCorrupted
+		}
+		s.Append(id, fields)
+	}
+	return nil
+}
+
+func (dec *rdbDecoder) readStream() (*stream.Stream, error) {
+	s := stream.Make()
+	nodeCount, _, err := dec.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < nodeCount; i++ {
+		key, err := dec.readString()
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 16 {
+			return nil, errStreamCorrupted
+		}
+		buf, err := dec.readString()
+		if err != nil {
+			return nil, err
+		}
+		elements, err := decodeRdbListpack(buf)
+		if err != nil {
+			return nil, err
+		}
+		err = loadStreamNode(s, stream.IDFromBytes(key), elements)
+		if err != nil {
+			return nil, err
+		}
+	}
+	length, _, err := dec.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if length != uint64(s.Len()) {
+		return nil, fmt.Errorf("stream length %d doesn't match %d entries", length, s.Len())
+	}
+	lastID, err := dec.readStreamID()
+	if err != nil {
+		return nil, err
+	}
+	if lastID.Less(s.LastID) {
+		return nil, errStreamCorrupted
+	}
+	s.LastID = lastID
+	s.EntriesAdded = length
+
+	groupCount, _, err := dec.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < groupCount; i++ {
+		name, err := dec.readString()
+		if err != nil {
+			return nil, err
+		}
+		groupLastID, err := dec.readStreamID()
+		if err != nil {
+			return nil, err
+		}
+		g, ok := s.CreateGroup(string(name), groupLastID, s.EstimateEntriesRead(groupLastID))
+		if !ok {
+			return nil, fmt.Errorf("duplicated consumer group %s", name)
+		}
+		pendingCount, _, err := dec.readLength()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < pendingCount; j++ {
+			id, err := dec.readRawStreamID()
+			if err != nil {
+				return nil, err
+			}
+			deliveryTime, err := dec.readMillis()
+			if err != nil {
+				return nil, err
+			}
+			deliveryCount, _, err := dec.readLength()
+			if err != nil {
+				return nil, err
+			}
+			if g.Pending(id) != nil {
+				return nil, errStreamCorrupted
+			}
+			pe := g.AddPending(id, deliveryTime)
+			pe.DeliveryCount = int64(deliveryCount)
+		}
+		consumerCount, _, err := dec.readLength()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < consumerCount; j++ {
+			consumerName, err := dec.readString()
+			if err != nil {
+				return nil, err
+			}
+			seenTime, err := dec.readMillis()
+			if err != nil {
+				return nil, err
+			}
+			c, ok := g.CreateConsumer(string(consumerName), seenTime)
+			if !ok {
+				return nil, fmt.Errorf("duplicated consumer %s", consumerName)
+			}
+			c.ActiveTime = seenTime
+			ownedCount, _, err := dec.readLength()
+			if err != nil {
+				return nil, err
+			}
+			for k := uint64(0); k < ownedCount; k++ {
+				id, err := dec.readRawStreamID()
+				if err != nil {
+					return nil, err
+				}
+				pe := g.Pending(id)
+				if pe == nil || pe.Consumer != nil {
+					return nil, errStreamCorrupted
+				}
+				g.Transfer(pe, c)
+			}
+		}
+		g.RangePending(stream.ID{}, stream.MaxID, func(pe *stream.PendingEntry) bool {
+			if pe.Consumer == nil {
+				err = errStreamCorrupted
+			}
+			return err == nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,606 @@
+package core
+
+import (
+	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/config"
+	"Tiny-Godis/lib/logger"
+	"Tiny-Godis/lib/lua"
+	"Tiny-Godis/lib/lua/parse"
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/reply"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const scriptChunkName = "user_script"
+
+// commands which make no sense or would deadlock inside a script
+var noScriptCmds = map[string]struct{}{
+	"eval":        {},
+	"evalsha":     {},
+	"script":      {},
+	"multi":       {},
+	"exec":        {},
+	"discard":     {},
+	"watch":       {},
+	"subscribe":   {},
+	"unsubscribe": {},
+	"client":      {},
+	"fcall":       {},
+	"fcall_ro":    {},
+	"function":    {},
+}
+
+// keylessScriptCmds touch no data, other commands called by scripts must work on declared keys only
+var keylessScriptCmds = map[string]struct{}{
+	"ping": {},
+	"info": {},
+}
+
+// luaScript is a compiled script, the proto can be shared by many lua states
+type luaScript struct {
+	sha   string
+	proto *lua.FunctionProto
+}
+
+// scriptRun is a script being executed
+type scriptRun struct {
+	start  time.Time
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// a script which has called write commands can't be killed, or the dataset would be left half modified
+	wrote  bool
+	killed bool
+}
+
+// scriptCache keeps scripts loaded by EVAL and SCRIPT LOAD, and tracks running scripts for SCRIPT KILL
+type scriptCache struct {
+	mu      sync.RWMutex
+	scripts map[string]*luaScript
+
+	runMu   sync.Mutex
+	running map[*scriptRun]struct{}
+}
+
+func makeScriptCache() *scriptCache {
+	return &scriptCache{
+		scripts: make(map[string]*luaScript),
+		running: make(map[*scriptRun]struct{}),
+	}
+}
+
+func sha1hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func compileLua(body string, chunkName string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(body), chunkName)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, chunkName)
+}
+
+// load compiles and caches the script, compiled scripts are reused
+func (c *scriptCache) load(body string) (*luaScript, redis.Reply) {
+	sha := sha1hex(body)
+	if script := c.get(sha); script != nil {
+		return script, nil
+	}
+	proto, err := compileLua(body, scriptChunkName)
+	if err != nil {
+		return nil, reply.MakeErrReply("ERR Error compiling script (new function): " + err.Error())
+	}
+	script := &luaScript{sha: sha, proto: proto}
+	c.mu.Lock()
+	c.scripts[sha] = script
+	c.mu.Unlock()
+	return script, nil
+}
+
+func (c *scriptCache) get(sha string) *luaScript {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.scripts[strings.ToLower(sha)]
+}
+
+func (c *scriptCache) flush() {
+	c.mu.Lock()
+	c.scripts = make(map[string]*luaScript)
+	c.mu.Unlock()
+}
+
+func (c *scriptCache) addRun(run *scriptRun) {
+	c.runMu.Lock()
+	c.running[run] = struct{}{}
+	c.runMu.Unlock()
+}
+
+func (c *scriptCache) removeRun(run *scriptRun) {
+	c.runMu.Lock()
+	delete(c.running, run)
+	c.runMu.Unlock()
+}
+
+// kill interrupts scripts running longer than limit which haven't written anything
+func (c *scriptCache) kill(limit time.Duration) redis.Reply {
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+	killed, unkillable := false, false
+	for run := range c.running {
+		if limit <= 0 || time.Since(run.start) < limit {
+			continue
+		}
+		run.mu.Lock()
+		if run.wrote {
+			unkillable = true
+		} else if !run.killed {
+			run.killed = true
+			run.cancel()
+			killed = true
+		}
+		run.mu.Unlock()
+	}
+	if killed {
+		return reply.MakeOkReply()
+	}
+	if unkillable {
+		return reply.MakeErrReply("UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+			"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.")
+	}
+	return reply.MakeErrReply("NOTBUSY No scripts in execution right now.")
+}
+
+// scriptContext is the state shared by redis.call during one run of a script
+type scriptContext struct {
+	db   *DB
+	keys map[string]struct{}
+	run  *scriptRun
+	// rejects commands with write keys, used by FCALL_RO and functions with no-writes flag
+	readOnly bool
+}
+
+// parseScriptKeys splits `numkeys key [key ...] arg [arg ...]`
+func parseScriptKeys(args [][]byte) ([]string, [][]byte, redis.Reply) {
+	numKeys, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return nil, nil, reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if numKeys < 0 {
+		return nil, nil, reply.MakeErrReply("ERR Number of keys can't be negative")
+	}
+	if numKeys > int64(len(args)-1) {
+		return nil, nil, reply.MakeErrReply("ERR Number of keys can't be greater than number of args")
+	}
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = string(args[i+1])
+	}
+	return keys, args[numKeys+1:], nil
+}
+
+// execEval runs EVAL script numkeys [key ...] [arg ...]
+func execEval(db *DB, args [][]byte) redis.Reply {
+	keys, argv, errReply := parseScriptKeys(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	script, errReply := db.scripts.load(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	return db.runScript(script, keys, argv)
+}
+
+// execEvalSha runs EVALSHA sha1 numkeys [key ...] [arg ...]
+func execEvalSha(db *DB, args [][]byte) redis.Reply {
+	keys, argv, errReply := parseScriptKeys(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	script := db.scripts.get(string(args[0]))
+	if script == nil {
+		return reply.MakeErrReply("NOSCRIPT No matching script. Please use EVAL.")
+	}
+	return db.runScript(script, keys, argv)
+}
+
+// prepareEval locks all declared keys for writing, a script may access nothing else
+func prepareEval(args [][]byte) ([]string, []string) {
+	keys, _, errReply := parseScriptKeys(args[1:])
+	if errReply != nil {
+		return nil, nil
+	}
+	return keys, nil
+}
+
+func undoEval(db *DB, args [][]byte) []CmdLine {
+	keys, _, errReply := parseScriptKeys(args[1:])
+	if errReply != nil {
+		return nil
+	}
+	return rollbackGivenKeys(db, keys...)
+}
+
+// Script implements SCRIPT LOAD, EXISTS, FLUSH and KILL.
+// It doesn't lock anything, so that SCRIPT KILL can run while scripts hold their keys
+func Script(db *DB, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "load":
+		if len(args) != 2 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'script|load' command")
+		}
+		script, errReply := db.scripts.load(string(args[1]))
+		if errReply != nil {
+			return errReply
+		}
+		return reply.MakeBulkReply([]byte(script.sha))
+	case "exists":
+		if len(args) < 2 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'script|exists' command")
+		}
+		result := make([]redis.Reply, len(args)-1)
+		for i, sha := range args[1:] {
+			if db.scripts.get(string(sha)) != nil {
+				result[i] = reply.MakeIntReply(1)
+			} else {
+				result[i] = reply.MakeIntReply(0)
+			}
+		}
+		return reply.MakeMultiRawReply(result)
+	case "flush":
+		if len(args) > 2 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'script|flush' command")
+		}
+		if len(args) == 2 {
+			mode := strings.ToLower(string(args[1]))
+			if mode != "sync" && mode != "async" {
+				return reply.MakeErrReply("ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+			}
+		}
+		db.scripts.flush()
+		return reply.MakeOkReply()
+	case "kill":
+		if len(args) != 1 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'script|kill' command")
+		}
+		limit := time.Duration(config.Properties.LuaTimeLimit) * time.Millisecond
+		return db.scripts.kill(limit)
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try SCRIPT HELP.")
+}
+
+// runScript executes the script in a new lua state, with KEYS and ARGV set.
+// The caller holds locks of keys
+func (db *DB) runScript(script *luaScript, keys []string, argv [][]byte) redis.Reply {
+	return db.runLua(keys, false, "f_"+script.sha, func(L *lua.LState) (*lua.LFunction, []lua.LValue, error) {
+		L.SetGlobal("KEYS", makeLuaArray(L, utils.ToCmdLine(keys...)))
+		L.SetGlobal("ARGV", makeLuaArray(L, argv))
+		protectGlobals(L)
+		return L.NewFunctionFromProto(script.proto), nil, nil
+	})
+}
+
+// runLua calls the function returned by load in a new lua state, whose redis.call can access only keys
+func (db *DB) runLua(keys []string, readOnly bool, name string,
+	load func(L *lua.LState) (*lua.LFunction, []lua.LValue, error)) redis.Reply {
+	L := newScriptState()
+	defer L.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	L.SetContext(ctx)
+
+	run := &scriptRun{start: time.Now(), cancel: cancel}
+	db.scripts.addRun(run)
+	defer db.scripts.removeRun(run)
+
+	sc := &scriptContext{db: db, keys: make(map[string]struct{}, len(keys)), run: run, readOnly: readOnly}
+	for _, key := range keys {
+		sc.keys[key] = struct{}{}
+	}
+	L.SetGlobal("redis", makeRedisLib(L, sc))
+
+	fn, args, err := load(L)
+	if err == nil {
+		L.Push(fn)
+		for _, arg := range args {
+			L.Push(arg)
+		}
+		err = L.PCall(len(args), 1, nil)
+	}
+	if err != nil {
+		return scriptErrReply(run, name, err)
+	}
+	return luaToReply(L.Get(-1))
+}
+
+func makeLuaArray(L *lua.LState, items [][]byte) *lua.LTable {
+	tb := L.CreateTable(len(items), 0)
+	for _, item := range items {
+		tb.Append(lua.LString(item))
+	}
+	return tb
+}
+
+func scriptErrReply(run *scriptRun, name string, err error) redis.Reply {
+	run.mu.Lock()
+	killed := run.killed
+	run.mu.Unlock()
+	if killed {
+		return reply.MakeErrReply("ERR Script killed by user with SCRIPT KILL...")
+	}
+	apiErr, ok := err.(*lua.ApiError)
+	if !ok {
+		return reply.MakeErrReply("ERR Error running script (call to " + name + "): " + err.Error())
+	}
+	// error raised by redis.call or returned by redis.error_reply is passed to client as is
+	if msg, ok := luaErrMessage(apiErr.Object); ok {
+		return reply.MakeErrReply(msg)
+	}
+	return reply.MakeErrReply("ERR Error running script (call to " + name + "): " + apiErr.Object.String())
+}
+
+// luaErrMessage returns the message of an error table like {err=...}
+func luaErrMessage(lv lua.LValue) (string, bool) {
+	if tb, ok := lv.(*lua.LTable); ok {
+		if msg, ok := tb.RawGetString("err").(lua.LString); ok {
+			return string(msg), true
+		}
+	}
+	return "", false
+}
+
+// newScriptState creates a lua state with only libraries that can't touch the host
+func newScriptState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	libs := []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	}
+	for _, lib := range libs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	return L
+}
+
+// protectGlobals forbids scripts from creating global variables or reading undefined ones,
+// which are usually typos of local variables
+func protectGlobals(L *lua.LState) {
+	mt := L.NewTable()
+	mt.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("Attempt to modify a readonly table")
+		return 0
+	}))
+	mt.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("Script attempted to access nonexistent global variable '%s'", L.Get(2).String())
+		return 0
+	}))
+	L.SetMetatable(L.G.Global, mt)
+}
+
+// makeRedisLib returns the redis table of scripts, redis.call and redis.pcall are available only if sc is given
+func makeRedisLib(L *lua.LState, sc *scriptContext) *lua.LTable {
+	lib := L.NewTable()
+	if sc != nil {
+		L.SetFuncs(lib, map[string]lua.LGFunction{
+			"call": func(L *lua.LState) int {
+				return sc.call(L, true)
+			},
+			"pcall": func(L *lua.LState) int {
+				return sc.call(L, false)
+			},
+		})
+	}
+	L.SetFuncs(lib, map[string]lua.LGFunction{
+		"error_reply": func(L *lua.LState) int {
+			L.Push(makeLuaStatusTable(L, "err", L.CheckString(1)))
+			return 1
+		},
+		"status_reply": func(L *lua.LState) int {
+			L.Push(makeLuaStatusTable(L, "ok", L.CheckString(1)))
+			return 1
+		},
+		"sha1hex": func(L *lua.LState) int {
+			L.Push(lua.LString(sha1hex(L.CheckString(1))))
+			return 1
+		},
+		"log": scriptLog,
+	})
+	lib.RawSetString("LOG_DEBUG", lua.LNumber(0))
+	lib.RawSetString("LOG_VERBOSE", lua.LNumber(1))
+	lib.RawSetString("LOG_NOTICE", lua.LNumber(2))
+	lib.RawSetString("LOG_WARNING", lua.LNumber(3))
+	return lib
+}
+
+func scriptLog(L *lua.LState) int {
+	level := L.CheckInt(1)
+	parts := make([]string, 0, L.GetTop()-1)
+	for i := 2; i <= L.GetTop(); i++ {
+		parts = append(parts, L.Get(i).String())
+	}
+	msg := strings.Join(parts, " ")
+	switch level {
+	case 0, 1:
+		logger.Debug(msg)
+	case 2:
+		logger.Info(msg)
+	default:
+		logger.Warn(msg)
+	}
+	return 0
+}
+
+// call executes a command for redis.call and redis.pcall,
+// errors are raised as lua errors by redis.call and returned as tables by redis.pcall
+func (sc *scriptContext) call(L *lua.LState, raise bool) int {
+	result := sc.exec(L)
+	lv := replyToLua(L, result)
+	if raise && reply.IsErrorReply(result) {
+		L.Error(lv, 1)
+		return 0
+	}
+	L.Push(lv)
+	return 1
+}
+
+func (sc *scriptContext) exec(L *lua.LState) redis.Reply {
+	if L.GetTop() == 0 {
+		return reply.MakeErrReply("ERR Please specify at least one argument for this redis lib call")
+	}
+	cmdLine := make(CmdLine, L.GetTop())
+	for i := range cmdLine {
+		switch arg := L.Get(i + 1).(type) {
+		case lua.LString:
+			cmdLine[i] = []byte(arg)
+		case lua.LNumber:
+			cmdLine[i] = []byte(arg.String())
+		default:
+			return reply.MakeErrReply("ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	if _, ok := noScriptCmds[cmdName]; ok {
+		return reply.MakeErrReply("ERR This Redis command is not allowed from script")
+	}
+	cmd, ok := cmdTable[cmdName]
+	if !ok {
+		return reply.MakeErrReply("ERR Unknown Redis command called from script")
+	}
+	if !validateArity(cmd.arity, cmdLine) {
+		return reply.MakeErrReply("ERR Wrong number of args calling Redis command from script")
+	}
+	wk, rk := cmd.prepare(cmdLine[1:])
+	if (len(wk) == 0 && len(rk) == 0) || needLockAll(rk) {
+		// keys of the command can't be declared, so they are not locked by the script
+		if _, ok := keylessScriptCmds[cmdName]; !ok {
+			return reply.MakeErrReply("ERR This Redis command is not allowed from script")
+		}
+	}
+	if len(wk) > 0 && sc.readOnly {
+		return reply.MakeErrReply("ERR Write commands are not allowed from read-only scripts.")
+	}
+	for _, keys := range [][]string{wk, rk} {
+		for _, key := range keys {
+			// only declared keys are locked by the script
+			if _, ok := sc.keys[key]; !ok {
+				return reply.MakeErrReply("ERR Script attempted to access a key not declared in KEYS")
+			}
+		}
+	}
+	sc.run.mu.Lock()
+	if sc.run.killed {
+		sc.run.mu.Unlock()
+		// the state has been canceled, stop before touching the dataset
+		L.RaiseError("Script killed by user with SCRIPT KILL...")
+	}
+	if len(wk) > 0 {
+		sc.run.wrote = true
+	}
+	sc.run.mu.Unlock()
+	// effects are appended to aof by the executor, so scripts are propagated as the commands they called
+	return cmd.executor(sc.db, cmdLine[1:])
+}
+
+func makeLuaStatusTable(L *lua.LState, field string, msg string) *lua.LTable {
+	tb := L.NewTable()
+	tb.RawSetString(field, lua.LString(msg))
+	return tb
+}
+
+// replyToLua converts a redis reply into lua value by the rules of redis:
+// integer to number, bulk to string, array to table, status to {ok=...}, error to {err=...}, nil to false
+func replyToLua(L *lua.LState, r redis.Reply) lua.LValue {
+	switch r := r.(type) {
+	case *reply.IntReply:
+		return lua.LNumber(r.Code)
+	case *reply.BulkReply:
+		return lua.LString(r.Arg)
+	case *reply.NullBulkReply, *reply.NullMultiBulkReply:
+		return lua.LFalse
+	case *reply.StatusReply:
+		return makeLuaStatusTable(L, "ok", r.Status)
+	case *reply.OkReply:
+		return makeLuaStatusTable(L, "ok", "OK")
+	case *reply.PongReply:
+		return makeLuaStatusTable(L, "ok", "PONG")
+	case *reply.EmptyMultiBulkReply:
+		return L.NewTable()
+	case *reply.MultiBulkReply:
+		tb := L.CreateTable(len(r.Args), 0)
+		for _, arg := range r.Args {
+			if arg == nil {
+				tb.Append(lua.LFalse)
+			} else {
+				tb.Append(lua.LString(arg))
+			}
+		}
+		return tb
+	case *reply.MultiRawReply:
+		tb := L.CreateTable(len(r.Replies), 0)
+		for _, item := range r.Replies {
+			tb.Append(replyToLua(L, item))
+		}
+		return tb
+	case reply.ErrorReply:
+		return makeLuaStatusTable(L, "err", r.Error())
+	}
+	return lua.LFalse
+}
+
+// luaToReply converts the value returned by script into redis reply,
+// number to integer, string to bulk, true to 1, false and nil to nil, table to array or status or error
+func luaToReply(lv lua.LValue) redis.Reply {
+	switch v := lv.(type) {
+	case lua.LNumber:
+		return reply.MakeIntReply(int64(v))
+	case lua.LString:
+		return reply.MakeBulkReply([]byte(v))
+	case lua.LBool:
+		if v {
+			return reply.MakeIntReply(1)
+		}
+		return reply.MakeNullBulkReply()
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			return reply.MakeErrReply(string(msg))
+		}
+		if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+			return reply.MakeStatusReply(string(msg))
+		}
+		var replies []redis.Reply
+		// like redis, the array ends at the first nil
+		for i := 1; ; i++ {
+			item := v.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			replies = append(replies, luaToReply(item))
+		}
+		return reply.MakeMultiRawReply(replies)
+	}
+	return reply.MakeNullBulkReply()
+}
+
+func init() {
+	RegisterCommand("Eval", execEval, prepareEval, undoEval, -3)
+	RegisterCommand("EvalSha", execEvalSha, prepareEval, undoEval, -3)
+}
@@ -0,0 +1,243 @@
+package core
+
+import (
+	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/config"
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/connection"
+	"Tiny-Godis/redis/reply/asserts"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEval(t *testing.T) {
+	testDB.Flush()
+	result := testDB.Exec(nil, utils.ToCmdLine("EVAL", "return {KEYS[1], KEYS[2], ARGV[1], ARGV[2]}", "2", "k1", "k2", "a1", "a2"))
+	if string(result.ToBytes()) != arrayRESP(bulkRESP("k1"), bulkRESP("k2"), bulkRESP("a1"), bulkRESP("a2")) {
+		t.Errorf("wrong KEYS and ARGV: %q", result.ToBytes())
+	}
+
+	script := "redis.call('SET', KEYS[1], ARGV[1]); return redis.call('GET', KEYS[1])"
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", script, "1", "key", "value")), "value")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", "key")), "value")
+	script = "local n = redis.call('INCRBY', KEYS[1], ARGV[1]); return n * 2"
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", script, "1", "counter", "5")), 10)
+
+	// conversion between lua values and replies
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return 3.99", "0")), 3)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return true", "0")), 1)
+	asserts.AssertNullBulk(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return false", "0")))
+	asserts.AssertNullBulk(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return nil", "0")))
+	asserts.AssertNullBulk(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return redis.call('GET', KEYS[1])", "1", "none")))
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return redis.call('SET', KEYS[1], 'v')", "1", "key")), "OK")
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return redis.status_reply('FINE')", "0")), "FINE")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return redis.error_reply('MY error')", "0")), "MY error")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return {err='MY error'}", "0")), "MY error")
+	result = testDB.Exec(nil, utils.ToCmdLine("EVAL", "return {1, 'a', {2, 'b'}, nil, 3}", "0"))
+	expected := arrayRESP(":1\r\n", bulkRESP("a"), arrayRESP(":2\r\n", bulkRESP("b")))
+	if string(result.ToBytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, result.ToBytes())
+	}
+	testDB.Exec(nil, utils.ToCmdLine("RPUSH", "list", "a", "b"))
+	script = "local items = redis.call('LRANGE', KEYS[1], 0, -1); return #items .. items[1]"
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", script, "1", "list")), "2a")
+	script = "return type(redis.call('SET', KEYS[1], 'v').ok)"
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", script, "1", "key")), "string")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return redis.sha1hex('')", "0")),
+		"da39a3ee5e6b4b0d3255bfef95601890afd80709")
+
+	// numbers are passed to commands as strings
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return redis.call('SET', KEYS[1], 42)", "1", "key")), "OK")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", "key")), "42")
+}
+
+func TestEvalErrors(t *testing.T) {
+	testDB.Flush()
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return 1", "x")), "ERR value is not an integer or out of range")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return 1", "-1")), "ERR Number of keys can't be negative")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return 1", "2", "k")),
+		"ERR Number of keys can't be greater than number of args")
+	result := testDB.Exec(nil, utils.ToCmdLine("EVAL", "return +", "0"))
+	if !strings.HasPrefix(string(result.ToBytes()), "-ERR Error compiling script") {
+		t.Errorf("expected compiling error, actually %q", result.ToBytes())
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("EVAL", "return nil + 1", "0"))
+	if !strings.HasPrefix(string(result.ToBytes()), "-ERR Error running script") {
+		t.Errorf("expected running error, actually %q", result.ToBytes())
+	}
+
+	testDB.Exec(nil, utils.ToCmdLine("RPUSH", "list", "a"))
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return redis.call('GET', KEYS[1])", "1", "list")),
+		"WRONGTYPE Operation against a key holding the wrong kind of value")
+	// redis.pcall returns the error as a table
+	script := "local r = redis.pcall('GET', KEYS[1]); return r.err"
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", script, "1", "list")),
+		"WRONGTYPE Operation against a key holding the wrong kind of value")
+	// only nil becomes false, an empty string stays a string
+	testDB.Exec(nil, utils.ToCmdLine("SET", "empty", ""))
+	script = "return {type(redis.call('GET', KEYS[1])), type(redis.call('GET', KEYS[2]))}"
+	result = testDB.Exec(nil, utils.ToCmdLine("EVAL", script, "2", "empty", "none"))
+	if string(result.ToBytes()) != arrayRESP(bulkRESP("string"), bulkRESP("boolean")) {
+		t.Errorf("expected empty string kept, actually %q", result.ToBytes())
+	}
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return redis.call('GET', 'undeclared')", "0")),
+		"ERR Script attempted to access a key not declared in KEYS")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return redis.call('EVAL', 'return 1', 0)", "0")),
+		"ERR This Redis command is not allowed from script")
+	// commands whose keys can't be declared are rejected
+	for _, script := range []string{"return redis.call('FLUSHDB')", "return redis.call('FLUSHALL', 'ASYNC')",
+		"return redis.call('RANDOMKEY')", "return redis.call('DBSIZE')",
+		"return redis.call('SORT', KEYS[1], 'BY', 'w_*')"} {
+		asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", script, "1", "list")),
+			"ERR This Redis command is not allowed from script")
+	}
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXISTS", "list")), 1)
+	script = "return redis.call('PING').ok"
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", script, "0")), "PONG")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return redis.call('NOPE')", "0")),
+		"ERR Unknown Redis command called from script")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return redis.call('GET')", "0")),
+		"ERR Wrong number of args calling Redis command from script")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return redis.call()", "0")),
+		"ERR Please specify at least one argument for this redis lib call")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EVAL", "return redis.call('GET', {})", "0")),
+		"ERR Lua redis lib command arguments must be strings or integers")
+
+	// scripts run in a sandbox
+	for _, script := range []string{"x = 1", "return y", "return os.time()", "return io.read()", "return dofile('/etc/passwd')"} {
+		result = testDB.Exec(nil, utils.ToCmdLine("EVAL", script, "0"))
+		if !strings.HasPrefix(string(result.ToBytes()), "-ERR Error running script") {
+			t.Errorf("%s: expected running error, actually %q", script, result.ToBytes())
+		}
+	}
+}
+
+func TestEvalSha(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("SCRIPT", "FLUSH"))
+	script := "return ARGV[1]"
+	sha := sha1hex(script)
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EVALSHA", sha, "0", "a")), "NOSCRIPT No matching script. Please use EVAL.")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("SCRIPT", "LOAD", script)), sha)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("EVALSHA", sha, "0", "a")), "a")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("EVALSHA", strings.ToUpper(sha), "0", "b")), "b")
+
+	// EVAL caches the script as well
+	other := "return 2"
+	testDB.Exec(nil, utils.ToCmdLine("EVAL", other, "0"))
+	result := testDB.Exec(nil, utils.ToCmdLine("SCRIPT", "EXISTS", sha, sha1hex(other), sha1hex("none")))
+	if string(result.ToBytes()) != arrayRESP(":1\r\n", ":1\r\n", ":0\r\n") {
+		t.Errorf("wrong result of SCRIPT EXISTS: %q", result.ToBytes())
+	}
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("SCRIPT", "FLUSH", "ASYNC")), "OK")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("EVALSHA", sha, "0")), "NOSCRIPT No matching script. Please use EVAL.")
+
+	result = testDB.Exec(nil, utils.ToCmdLine("SCRIPT", "LOAD", "return +"))
+	if !strings.HasPrefix(string(result.ToBytes()), "-ERR Error compiling script") {
+		t.Errorf("expected compiling error, actually %q", result.ToBytes())
+	}
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("SCRIPT", "FLUSH", "LATER")), "ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("SCRIPT", "FOO")), "ERR unknown subcommand 'FOO'. Try SCRIPT HELP.")
+}
+
+func TestScriptKill(t *testing.T) {
+	testDB.Flush()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
+	}()
+	config.Properties = &config.ServerProperties{LuaTimeLimit: 100}
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("SCRIPT", "KILL")), "NOTBUSY No scripts in execution right now.")
+
+	done := make(chan redis.Reply)
+	go func() {
+		done <- testDB.Exec(nil, utils.ToCmdLine("EVAL", "while true do end", "1", "key"))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	// not busy until the time limit exceeded
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("SCRIPT", "KILL")), "NOTBUSY No scripts in execution right now.")
+	time.Sleep(100 * time.Millisecond)
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("SCRIPT", "KILL")), "OK")
+	select {
+	case result := <-done:
+		asserts.AssertErrReply(t, result, "ERR Script killed by user with SCRIPT KILL...")
+	case <-time.After(time.Second):
+		t.Fatal("script is not killed")
+	}
+	// locks of the killed script are released
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("SET", "key", "v")), "OK")
+
+	// a script which has written can't be killed
+	go func() {
+		script := "redis.call('SET', KEYS[1], 'w'); local deadline = redis.call('INCR', KEYS[2]) + 3e6; " +
+			"for i = 1, deadline do end; return 1"
+		done <- testDB.Exec(nil, utils.ToCmdLine("EVAL", script, "2", "key", "counter"))
+	}()
+	time.Sleep(120 * time.Millisecond)
+	result := testDB.Exec(nil, utils.ToCmdLine("SCRIPT", "KILL"))
+	select {
+	case r := <-done:
+		// the script may finish before the time limit on a fast machine
+		asserts.AssertIntReply(t, r, 1)
+		return
+	default:
+	}
+	if !strings.HasPrefix(string(result.ToBytes()), "-UNKILLABLE") {
+		t.Errorf("expected UNKILLABLE, actually %q", result.ToBytes())
+	}
+	asserts.AssertIntReply(t, <-done, 1)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", "key")), "w")
+}
+
+func TestEvalInMulti(t *testing.T) {
+	testDB.Flush()
+	conn := connection.MakeConn(nil)
+	testDB.Exec(conn, utils.ToCmdLine("MULTI"))
+	testDB.Exec(conn, utils.ToCmdLine("EVAL", "return redis.call('INCR', KEYS[1])", "1", "counter"))
+	testDB.Exec(conn, utils.ToCmdLine("EVAL", "return redis.call('INCR', KEYS[1])", "1", "counter"))
+	result := testDB.Exec(conn, utils.ToCmdLine("EXEC"))
+	if string(result.ToBytes()) != arrayRESP(":1\r\n", ":2\r\n") {
+		t.Errorf("wrong result of EXEC: %q", result.ToBytes())
+	}
+}
+
+func TestScriptAof(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "Tiny-Godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: path.Join(tmpDir, "a.aof"),
+	}
+	aofWriteDB := MakeDB()
+	script := "redis.call('SET', KEYS[1], ARGV[1]); redis.call('RPUSH', KEYS[2], ARGV[1], ARGV[2]); return 1"
+	aofWriteDB.Exec(nil, utils.ToCmdLine("EVAL", script, "2", "str", "list", "a", "b"))
+	aofWriteDB.Close()
+
+	// the aof contains effects of the script instead of the script itself
+	content, err := ioutil.ReadFile(path.Join(aofWriteDB.aofDir, aofWriteDB.aofManifest.incrList[0].fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strings.ToLower(string(content)), "eval") {
+		t.Errorf("script should be propagated as its effects: %q", content)
+	}
+
+	aofReadDB := MakeDB()
+	defer aofReadDB.Close()
+	asserts.AssertBulkReply(t, aofReadDB.Exec(nil, utils.ToCmdLine("GET", "str")), "a")
+	asserts.AssertMultiBulkReply(t, aofReadDB.Exec(nil, utils.ToCmdLine("LRANGE", "list", "0", "-1")), []string{"a", "b"})
+}
@@ -2,7 +2,13 @@ package core
 
 import (
 	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/config"
 	"Tiny-Godis/redis/reply"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
 )
 
 // todo: 等待config模块完成
@@ -34,6 +40,93 @@ func Auth(conn redis.Connection, args [][]byte) redis.Reply {
 	}
 }
 
+// Client implements CLIENT ID and CLIENT UNBLOCK
+func Client(db *DB, conn redis.Connection, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "id":
+		if len(args) != 1 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'client|id' command")
+		}
+		return reply.MakeIntReply(conn.ID())
+	case "unblock":
+		if len(args) != 2 && len(args) != 3 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'client|unblock' command")
+		}
+		id, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return reply.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		withErr := false
+		if len(args) == 3 {
+			switch strings.ToUpper(string(args[2])) {
+			case "TIMEOUT":
+			case "ERROR":
+				withErr = true
+			default:
+				return reply.MakeErrReply("ERR CLIENT UNBLOCK reason should be TIMEOUT or ERROR")
+			}
+		}
+		if db.blocking != nil && db.blocking.unblock(id, withErr) {
+			return reply.MakeIntReply(1)
+		}
+		return reply.MakeIntReply(0)
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try CLIENT HELP.")
+}
+
+// Info returns information and statistics about the server, only persistence section is supported now
+func Info(db *DB, args [][]byte) redis.Reply {
+	section := "default"
+	if len(args) == 1 {
+		section = strings.ToLower(string(args[0]))
+	} else if len(args) > 1 {
+		return &reply.SyntaxErrReply{}
+	}
+
+	var buf bytes.Buffer
+	switch section {
+	case "default", "all", "everything", "persistence":
+		buf.WriteString(db.persistenceInfo())
+	}
+	return reply.MakeBulkReply(buf.Bytes())
+}
+
+func (db *DB) persistenceInfo() string {
+	aofEnabled := 0
+	if config.Properties.AppendOnly {
+		aofEnabled = 1
+	}
+	rewriting := 0
+	if db.aofRewriting.Get() {
+		rewriting = 1
+	}
+	scheduled := 0
+	if db.aofRewriteScheduled.Get() {
+		scheduled = 1
+	}
+	fsyncInFlight := 0
+	if db.aofStatus.fsyncInFlight.Get() {
+		fsyncInFlight = 1
+	}
+	lines := []string{
+		"# Persistence",
+		fmt.Sprintf("aof_enabled:%d", aofEnabled),
+		fmt.Sprintf("aof_fsync_policy:%s", db.aofFsync),
+		fmt.Sprintf("aof_rewrite_in_progress:%d", rewriting),
+		fmt.Sprintf("aof_rewrite_scheduled:%d", scheduled),
+		fmt.Sprintf("aof_last_bgrewrite_status:%s", statusString(db.aofStatus.getRewriteErr())),
+		fmt.Sprintf("aof_last_write_status:%s", statusString(db.aofStatus.getWriteErr())),
+		fmt.Sprintf("aof_last_fsync_status:%s", statusString(db.aofStatus.getFsyncErr())),
+		fmt.Sprintf("aof_pending_bio_fsync:%d", fsyncInFlight),
+		fmt.Sprintf("aof_delayed_fsync:%d", atomic.LoadInt64(&db.aofStatus.delayedFsync)),
+		fmt.Sprintf("aof_current_size:%d", atomic.LoadInt64(&db.aofCurrentSize)),
+		fmt.Sprintf("aof_base_size:%d", atomic.LoadInt64(&db.aofBaseSize)),
+	}
+	return strings.Join(lines, reply.CRLF) + reply.CRLF
+}
+
 func init() {
 	RegisterCommand("ping", Ping, noPrepare, nil, -1)
+	RegisterCommand("info", Info, noPrepare, nil, -1)
 }
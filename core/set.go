@@ -3,7 +3,11 @@ package core
 import (
 	"Tiny-Godis/data_struct/set"
 	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/config"
 	"Tiny-Godis/redis/reply"
+	"math"
+	"strconv"
+	"strings"
 )
 
 func (db *DB) getAsSet(key string) (*set.Set, reply.ErrorReply) {
@@ -18,13 +22,22 @@ func (db *DB) getAsSet(key string) (*set.Set, reply.ErrorReply) {
 	return value, nil
 }
 
+// makeSet creates an empty set, which is encoded compactly until it exceeds limits in config
+func makeSet() *set.Set {
+	return set.MakeCompactSet(set.Limits{
+		MaxIntsetEntries:   config.Properties.SetMaxIntsetEntries,
+		MaxListpackEntries: config.Properties.SetMaxListpackEntries,
+		MaxListpackValue:   config.Properties.SetMaxListpackValue,
+	})
+}
+
 func (db *DB) getOrInitSet(key string) (*set.Set, reply.ErrorReply) {
 	s, errReply := db.getAsSet(key)
 	if errReply != nil {
 		return nil, errReply
 	}
 	if s == nil {
-		s = set.MakeSet()
+		s = makeSet()
 		e := DataEntity{Data: s}
 		db.PutEntity(key, &e)
 	}
@@ -317,6 +330,243 @@ func execSDiffStore(db *DB, args [][]byte) redis.Reply {
 	return reply.MakeIntReply(int64(diff.Len()))
 }
 
+// parseSetCount parses the optional count argument of SPOP and SRANDMEMBER
+func parseSetCount(args [][]byte) (count int64, withCount bool, errReply redis.Reply) {
+	if len(args) < 2 {
+		return 0, false, nil
+	}
+	if len(args) > 2 {
+		return 0, false, &reply.SyntaxErrReply{}
+	}
+	count, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return 0, false, reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	return count, true, nil
+}
+
+func membersToBytes(members []string) [][]byte {
+	result := make([][]byte, len(members))
+	for i, m := range members {
+		result[i] = []byte(m)
+	}
+	return result
+}
+
+func execSPop(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	count, withCount, errReply := parseSetCount(args)
+	if errReply != nil {
+		return errReply
+	}
+	if withCount && count < 0 {
+		return reply.MakeErrReply("ERR value is out of range, must be positive")
+	}
+	s, errReply := db.getAsSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		if withCount {
+			return &reply.EmptyMultiBulkReply{}
+		}
+		return reply.MakeNullBulkReply()
+	}
+	if !withCount {
+		count = 1
+	}
+	members := s.RandomDistinctMembers(int(count))
+	for _, m := range members {
+		s.Remove(m)
+	}
+	if s.Len() == 0 {
+		db.Remove(key)
+	}
+	if len(members) > 0 {
+		// members are chosen randomly, write SREM into aof so that replay is deterministic
+		db.AddAof(makeAofCmd("SRem", append([][]byte{args[0]}, membersToBytes(members)...)))
+	}
+	if !withCount {
+		return reply.MakeBulkReply([]byte(members[0]))
+	}
+	return reply.MakeMultiBulkReply(membersToBytes(members))
+}
+
+// execSRandMember returns distinct members if count is positive, members may be duplicated if count is negative
+func execSRandMember(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	count, withCount, errReply := parseSetCount(args)
+	if errReply != nil {
+		return errReply
+	}
+	if count == math.MinInt64 {
+		// a negative count is negated
+		return reply.MakeErrReply("ERR value is out of range")
+	}
+	s, errReply := db.getAsSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		if withCount {
+			return &reply.EmptyMultiBulkReply{}
+		}
+		return reply.MakeNullBulkReply()
+	}
+	if !withCount {
+		members := s.RandomMembers(1)
+		return reply.MakeBulkReply([]byte(members[0]))
+	}
+	var members []string
+	if count >= 0 {
+		members = s.RandomDistinctMembers(int(count))
+	} else {
+		members = s.RandomMembers(int(-count))
+	}
+	return reply.MakeMultiBulkReply(membersToBytes(members))
+}
+
+func execSMove(db *DB, args [][]byte) redis.Reply {
+	src := string(args[0])
+	dest := string(args[1])
+	member := string(args[2])
+	srcSet, errReply := db.getAsSet(src)
+	if errReply != nil {
+		return errReply
+	}
+	if _, errReply = db.getAsSet(dest); errReply != nil {
+		return errReply
+	}
+	if srcSet == nil || !srcSet.Has(member) {
+		return reply.MakeIntReply(0)
+	}
+	if src == dest {
+		return reply.MakeIntReply(1)
+	}
+	srcSet.Remove(member)
+	if srcSet.Len() == 0 {
+		db.Remove(src)
+	}
+	destSet, _ := db.getOrInitSet(dest)
+	destSet.Add(member)
+	db.AddAof(makeAofCmd("SMove", args))
+	return reply.MakeIntReply(1)
+}
+
+func execSMIsMember(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	s, errReply := db.getAsSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	result := make([]redis.Reply, len(args)-1)
+	for i, member := range args[1:] {
+		if s != nil && s.Has(string(member)) {
+			result[i] = reply.MakeIntReply(1)
+		} else {
+			result[i] = reply.MakeIntReply(0)
+		}
+	}
+	return reply.MakeMultiRawReply(result)
+}
+
+// parseSInterCard parses SINTERCARD numkeys key [key ...] [LIMIT limit]
+func parseSInterCard(args [][]byte) (keys []string, limit int64, errReply redis.Reply) {
+	numKeys, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return nil, 0, reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if numKeys <= 0 {
+		return nil, 0, reply.MakeErrReply("ERR numkeys should be greater than 0")
+	}
+	if numKeys > int64(len(args)-1) {
+		return nil, 0, reply.MakeErrReply("ERR Number of keys can't be greater than number of args")
+	}
+	for _, arg := range args[1 : numKeys+1] {
+		keys = append(keys, string(arg))
+	}
+	rest := args[numKeys+1:]
+	if len(rest) == 0 {
+		return keys, 0, nil
+	}
+	if len(rest) != 2 || strings.ToUpper(string(rest[0])) != "LIMIT" {
+		return nil, 0, &reply.SyntaxErrReply{}
+	}
+	limit, err = strconv.ParseInt(string(rest[1]), 10, 64)
+	if err != nil {
+		return nil, 0, reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if limit < 0 {
+		return nil, 0, reply.MakeErrReply("ERR LIMIT can't be negative")
+	}
+	return keys, limit, nil
+}
+
+// execSInterCard counts the intersection without building it, 0 limit means no limit
+func execSInterCard(db *DB, args [][]byte) redis.Reply {
+	keys, limit, errReply := parseSInterCard(args)
+	if errReply != nil {
+		return errReply
+	}
+	sets := make([]*set.Set, len(keys))
+	for i, key := range keys {
+		s, errReply := db.getAsSet(key)
+		if errReply != nil {
+			return errReply
+		}
+		if s == nil {
+			return reply.MakeIntReply(0)
+		}
+		sets[i] = s
+	}
+	// walk the smallest set
+	smallest := 0
+	for i, s := range sets {
+		if s.Len() < sets[smallest].Len() {
+			smallest = i
+		}
+	}
+	count := int64(0)
+	sets[smallest].ForEach(func(member string, val interface{}) bool {
+		for i, s := range sets {
+			if i != smallest && !s.Has(member) {
+				return true
+			}
+		}
+		count++
+		return limit == 0 || count < limit
+	})
+	return reply.MakeIntReply(count)
+}
+
+func prepareSInterCard(args [][]byte) ([]string, []string) {
+	keys, _, errReply := parseSInterCard(args)
+	if errReply != nil {
+		return nil, nil
+	}
+	return nil, keys
+}
+
+func prepareSMove(args [][]byte) ([]string, []string) {
+	return []string{
+		string(args[0]),
+		string(args[1]),
+	}, nil
+}
+
+func undoSMove(db *DB, args [][]byte) []CmdLine {
+	src := string(args[0])
+	dest := string(args[1])
+	member := string(args[2])
+	undoCmdLines := rollbackSetMembers(db, dest, member)
+	s, errReply := db.getAsSet(src)
+	if errReply == nil && s != nil && s.Len() == 1 {
+		// src will be removed, restore its ttl as well
+		return append(undoCmdLines, rollbackGivenKeys(db, src)...)
+	}
+	return append(undoCmdLines, rollbackSetMembers(db, src, member)...)
+}
+
 // undoSetChange rollbacks SADD and SREM command
 func undoSetChange(db *DB, args [][]byte) []CmdLine {
 	key := args[0]
@@ -359,4 +609,9 @@ func init() {
 	RegisterCommand("SUnionStore", execSUnionStore, prepareSetCalculateStore, rollbackFirstKey, -3)
 	RegisterCommand("SDiff", execSDiff, prepareSetCalculate, nil, -2)
 	RegisterCommand("SDiffStore", execSDiffStore, prepareSetCalculateStore, rollbackFirstKey, -3)
+	RegisterCommand("SPop", execSPop, writeFirstKey, rollbackFirstKey, -2)
+	RegisterCommand("SRandMember", execSRandMember, readFirstKey, nil, -2)
+	RegisterCommand("SMove", execSMove, prepareSMove, undoSMove, 4)
+	RegisterCommand("SMIsMember", execSMIsMember, readFirstKey, nil, -3)
+	RegisterCommand("SInterCard", execSInterCard, prepareSInterCard, nil, -3)
 }
@@ -1,10 +1,14 @@
 package core
 
 import (
+	"Tiny-Godis/lib/config"
 	"Tiny-Godis/lib/utils"
 	"Tiny-Godis/redis/reply"
 	"Tiny-Godis/redis/reply/asserts"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
 
 	"strconv"
 	"testing"
@@ -214,4 +218,217 @@ func TestSRandMember(t *testing.T) {
 
 	result = testDB.Exec(nil, utils.ToCmdLine("SRandMember", key, "-110"))
 	asserts.AssertMultiBulkReplySize(t, result, 110)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("SRandMember", key, "-9223372036854775808"))
+	asserts.AssertErrReply(t, result, "ERR value is out of range")
+
+	// compact set
+	small := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("SADD", small, "a", "b"))
+	result = testDB.Exec(nil, utils.ToCmdLine("SRandMember", small, "-5"))
+	asserts.AssertMultiBulkReplySize(t, result, 5)
+}
+
+func TestSPop(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	members := make([]string, 100)
+	for i := range members {
+		members[i] = strconv.Itoa(i)
+	}
+	testDB.Exec(nil, utils.ToCmdLine2("sadd", append([]string{key}, members...)...))
+
+	popped := make(map[string]struct{})
+	result := testDB.Exec(nil, utils.ToCmdLine("spop", key))
+	br, ok := result.(*reply.BulkReply)
+	if !ok {
+		t.Fatalf("expected bulk reply, actually %s", result.ToBytes())
+	}
+	popped[string(br.Arg)] = struct{}{}
+	result = testDB.Exec(nil, utils.ToCmdLine("spop", key, "40"))
+	asserts.AssertMultiBulkReplySize(t, result, 40)
+	for _, arg := range result.(*reply.MultiBulkReply).Args {
+		popped[string(arg)] = struct{}{}
+	}
+	if len(popped) != 41 {
+		t.Errorf("expected 41 distinct members, actually %d", len(popped))
+	}
+	for member := range popped {
+		asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("sismember", key, member)), 0)
+	}
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("scard", key)), 59)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("spop", key, "100"))
+	asserts.AssertMultiBulkReplySize(t, result, 59)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("exists", key)), 0)
+	asserts.AssertNullBulk(t, testDB.Exec(nil, utils.ToCmdLine("spop", key)))
+	asserts.AssertMultiBulkReplySize(t, testDB.Exec(nil, utils.ToCmdLine("spop", key, "1")), 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("spop", key, "-1"))
+	asserts.AssertErrReply(t, result, "ERR value is out of range, must be positive")
+}
+
+func TestSMove(t *testing.T) {
+	testDB.Flush()
+	src := utils.RandString(10)
+	dest := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("sadd", src, "a", "b"))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("smove", src, dest, "a")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("smove", src, dest, "a")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("smove", src, src, "b")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("smove", src, dest, "b")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("exists", src)), 0)
+	assertSameMembers(t, testDB.Exec(nil, utils.ToCmdLine("smembers", dest)), []string{"a", "b"})
+
+	str := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", str, "1"))
+	result := testDB.Exec(nil, utils.ToCmdLine("smove", dest, str, "a"))
+	asserts.AssertErrReply(t, result, "WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestSMIsMember(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("sadd", key, "a", "b"))
+	result := testDB.Exec(nil, utils.ToCmdLine("smismember", key, "a", "c", "b"))
+	expected := "*3\r\n:1\r\n:0\r\n:1\r\n"
+	if string(result.ToBytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, string(result.ToBytes()))
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("smismember", utils.RandString(10), "a"))
+	expected = "*1\r\n:0\r\n"
+	if string(result.ToBytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, string(result.ToBytes()))
+	}
+}
+
+func TestSInterCard(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("sadd", key1, "a", "b", "c", "d"))
+	testDB.Exec(nil, utils.ToCmdLine("sadd", key2, "b", "c", "d", "e"))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("sintercard", "2", key1, key2)), 3)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("sintercard", "1", key1)), 4)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("sintercard", "2", key1, key2, "limit", "2")), 2)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("sintercard", "2", key1, key2, "limit", "0")), 3)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("sintercard", "2", key1, utils.RandString(10))), 0)
+
+	result := testDB.Exec(nil, utils.ToCmdLine("sintercard", "0", key1))
+	asserts.AssertErrReply(t, result, "ERR numkeys should be greater than 0")
+	result = testDB.Exec(nil, utils.ToCmdLine("sintercard", "3", key1, key2))
+	asserts.AssertErrReply(t, result, "ERR Number of keys can't be greater than number of args")
+	result = testDB.Exec(nil, utils.ToCmdLine("sintercard", "2", key1, key2, "limit", "-1"))
+	asserts.AssertErrReply(t, result, "ERR LIMIT can't be negative")
+}
+
+func TestUndoSetCommands(t *testing.T) {
+	testDB.Flush()
+	src := utils.RandString(10)
+	dest := utils.RandString(10)
+	cmdLines := [][][]byte{
+		utils.ToCmdLine("spop", src),
+		utils.ToCmdLine("spop", src, "2"),
+		utils.ToCmdLine("spop", src, "10"),
+		utils.ToCmdLine("smove", src, dest, "a"),
+		utils.ToCmdLine("smove", src, dest, "x"),
+	}
+	for _, cmdLine := range cmdLines {
+		testDB.Remove(src)
+		testDB.Remove(dest)
+		testDB.Exec(nil, utils.ToCmdLine("sadd", src, "a", "b", "c"))
+		testDB.Exec(nil, utils.ToCmdLine("expire", src, "1000"))
+		undoCmdLines := testDB.GetUndoLog(cmdLine)
+		testDB.Exec(nil, cmdLine)
+		for _, undoCmdLine := range undoCmdLines {
+			testDB.Exec(nil, undoCmdLine)
+		}
+		assertSameMembers(t, testDB.Exec(nil, utils.ToCmdLine("smembers", src)), []string{"a", "b", "c"})
+		asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("exists", dest)), 0)
+		result := testDB.Exec(nil, utils.ToCmdLine("ttl", src))
+		if intResult, _ := result.(*reply.IntReply); intResult == nil || intResult.Code <= 0 {
+			t.Errorf("%s: ttl lost after undo", cmdLine[0])
+		}
+	}
+}
+
+func TestSPopAof(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "Tiny-Godis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	props := config.Properties
+	defer func() {
+		config.Properties = props
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: path.Join(tmpDir, "a.aof"),
+	}
+	aofWriteDB := MakeDB()
+	key := utils.RandString(10)
+	for i := 0; i < 100; i++ {
+		aofWriteDB.Exec(nil, utils.ToCmdLine("sadd", key, strconv.Itoa(i)))
+	}
+	for i := 0; i < 10; i++ {
+		aofWriteDB.Exec(nil, utils.ToCmdLine("spop", key))
+	}
+	aofWriteDB.Exec(nil, utils.ToCmdLine("spop", key, "20"))
+	expected := aofWriteDB.Exec(nil, utils.ToCmdLine("smembers", key)).(*reply.MultiBulkReply)
+	aofWriteDB.Close()
+
+	aofReadDB := MakeDB()
+	defer aofReadDB.Close()
+	members := make([]string, len(expected.Args))
+	for i, arg := range expected.Args {
+		members[i] = string(arg)
+	}
+	assertSameMembers(t, aofReadDB.Exec(nil, utils.ToCmdLine("smembers", key)), members)
+}
+
+func TestSetEncoding(t *testing.T) {
+	testDB.Flush()
+	props := *config.Properties
+	defer func() {
+		*config.Properties = props
+	}()
+	config.Properties.SetMaxIntsetEntries = 8
+	config.Properties.SetMaxListpackEntries = 4
+	config.Properties.SetMaxListpackValue = 8
+
+	// intset grows into hashtable
+	key := utils.RandString(10)
+	for i := 0; i < 8; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("SADD", key, strconv.Itoa(i*100000)))
+	}
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "ENCODING", key)), "intset")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("SISMEMBER", key, "700000")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("SISMEMBER", key, "0700000")), 0)
+	testDB.Exec(nil, utils.ToCmdLine("SADD", key, "-1"))
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "ENCODING", key)), "hashtable")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("SCARD", key)), 9)
+
+	// intset turns into listpack on a non-integer member
+	key = utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("SADD", key, "1", "2"))
+	testDB.Exec(nil, utils.ToCmdLine("SADD", key, "a", "01"))
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "ENCODING", key)), "listpack")
+	assertSameMembers(t, testDB.Exec(nil, utils.ToCmdLine("SMEMBERS", key)), []string{"1", "2", "a", "01"})
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("SREM", key, "a", "b")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("SADD", key, "c", "d")), 2)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "ENCODING", key)), "hashtable")
+	assertSameMembers(t, testDB.Exec(nil, utils.ToCmdLine("SMEMBERS", key)), []string{"1", "2", "01", "c", "d"})
+
+	// long members are stored in hashtable
+	key = utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("SADD", key, "a", "abcdefghijk"))
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "ENCODING", key)), "hashtable")
+
+	// members of integers out of listpack value limit
+	key = utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("SADD", key, "1234567890", "a"))
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "ENCODING", key)), "hashtable")
+	assertSameMembers(t, testDB.Exec(nil, utils.ToCmdLine("SMEMBERS", key)), []string{"1234567890", "a"})
 }
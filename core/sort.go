@@ -0,0 +1,296 @@
+package core
+
+import (
+	"Tiny-Godis/data_struct/dict"
+	"Tiny-Godis/data_struct/list"
+	"Tiny-Godis/data_struct/set"
+	"Tiny-Godis/data_struct/sortedset"
+	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/redis/reply"
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sortArgs is the parsed arguments of SORT
+type sortArgs struct {
+	key    string
+	by     string
+	gets   []string
+	offset int64
+	count  int64
+	desc   bool
+	alpha  bool
+	store  string
+	// dontSort is set by a BY pattern without '*', elements are returned in their original order
+	dontSort bool
+}
+
+// parseSort parses SORT key [BY pattern] [LIMIT offset count] [GET pattern [GET pattern ...]] [ASC|DESC] [ALPHA] [STORE destination]
+func parseSort(args [][]byte, readOnly bool) (*sortArgs, redis.Reply) {
+	sa := &sortArgs{
+		key:   string(args[0]),
+		count: -1,
+	}
+	for i := 1; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i]))
+		left := len(args) - i - 1
+		switch {
+		case option == "ASC":
+			sa.desc = false
+		case option == "DESC":
+			sa.desc = true
+		case option == "ALPHA":
+			sa.alpha = true
+		case option == "LIMIT" && left >= 2:
+			offset, err1 := strconv.ParseInt(string(args[i+1]), 10, 64)
+			count, err2 := strconv.ParseInt(string(args[i+2]), 10, 64)
+			if err1 != nil || err2 != nil {
+				return nil, reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			sa.offset, sa.count = offset, count
+			i += 2
+		case option == "STORE" && left >= 1 && !readOnly:
+			sa.store = string(args[i+1])
+			i++
+		case option == "BY" && left >= 1:
+			sa.by = string(args[i+1])
+			sa.dontSort = !strings.Contains(sa.by, "*")
+			i++
+		case option == "GET" && left >= 1:
+			sa.gets = append(sa.gets, string(args[i+1]))
+			i++
+		default:
+			return nil, &reply.SyntaxErrReply{}
+		}
+	}
+	return sa, nil
+}
+
+// lookupByPattern replaces the first '*' of pattern with element and returns the string value or hash field of the key.
+// "#" returns the element itself, a pattern without '*' or a missing value returns nil
+func (db *DB) lookupByPattern(pattern string, element []byte) []byte {
+	if pattern == "#" {
+		return element
+	}
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return nil
+	}
+	keyPattern, field := pattern, ""
+	// key->field looks up field of hash
+	if arrow := strings.Index(pattern[star+1:], "->"); arrow >= 0 {
+		arrow += star + 1
+		if arrow+2 < len(pattern) {
+			keyPattern, field = pattern[:arrow], pattern[arrow+2:]
+		}
+	}
+	key := keyPattern[:star] + string(element) + keyPattern[star+1:]
+	entity, ok := db.GetEntity(key)
+	if !ok {
+		return nil
+	}
+	if field == "" {
+		val, _ := stringValue(entity.Data)
+		return val
+	}
+	hash, ok := entity.Data.(dict.Dict)
+	if !ok {
+		return nil
+	}
+	val, ok := hash.Get(field)
+	if !ok {
+		return nil
+	}
+	return val.([]byte)
+}
+
+// sortElements returns elements of list or set at key, nil if key does not exist
+func (db *DB) sortElements(key string) ([][]byte, reply.ErrorReply) {
+	entity, ok := db.GetEntity(key)
+	if !ok {
+		return nil, nil
+	}
+	var elements [][]byte
+	switch val := entity.Data.(type) {
+	case list.List:
+		elements = make([][]byte, 0, val.Len())
+		val.ForEach(func(v interface{}) bool {
+			elements = append(elements, v.([]byte))
+			return true
+		})
+	case *set.Set:
+		for _, member := range val.ToSlice() {
+			elements = append(elements, []byte(member))
+		}
+	case *sortedset.SortedSet:
+		elements = make([][]byte, 0, val.Len())
+		val.ForEach(func(member string, _ float64) bool {
+			elements = append(elements, []byte(member))
+			return true
+		})
+	default:
+		return nil, &reply.WrongTypeErrReply{}
+	}
+	return elements, nil
+}
+
+type sortItem struct {
+	element []byte
+	weight  []byte
+	score   float64
+}
+
+// sortItems orders items like redis: by score or weight, ties are broken by comparing elements
+func sortItems(items []*sortItem, sa *sortArgs) {
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		var cmp int
+		if sa.alpha {
+			if sa.by != "" {
+				cmp = bytes.Compare(a.weight, b.weight)
+			} else {
+				cmp = bytes.Compare(a.element, b.element)
+			}
+		} else if a.score < b.score {
+			cmp = -1
+		} else if a.score > b.score {
+			cmp = 1
+		}
+		if cmp == 0 {
+			cmp = bytes.Compare(a.element, b.element)
+		}
+		if sa.desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+}
+
+func execSortGeneric(db *DB, args [][]byte, readOnly bool) redis.Reply {
+	sa, errReply := parseSort(args, readOnly)
+	if errReply != nil {
+		return errReply
+	}
+	elements, errReply := db.sortElements(sa.key)
+	if errReply != nil {
+		return errReply
+	}
+
+	items := make([]*sortItem, len(elements))
+	for i, element := range elements {
+		items[i] = &sortItem{element: element}
+	}
+	if !sa.dontSort {
+		for _, item := range items {
+			value := item.element
+			if sa.by != "" {
+				item.weight = db.lookupByPattern(sa.by, item.element)
+				value = item.weight
+			}
+			// a missing weight is taken as 0
+			if sa.alpha || value == nil {
+				continue
+			}
+			score, err := strconv.ParseFloat(string(value), 64)
+			if err != nil || math.IsNaN(score) {
+				return reply.MakeErrReply("ERR One or more scores can't be converted into double")
+			}
+			item.score = score
+		}
+		sortItems(items, sa)
+	}
+
+	start, end := sa.offset, int64(len(items))
+	if start < 0 {
+		start = 0
+	}
+	if start > end {
+		start = end
+	}
+	if sa.count >= 0 && start+sa.count < end {
+		end = start + sa.count
+	}
+	items = items[start:end]
+
+	var result [][]byte
+	if len(sa.gets) == 0 {
+		result = make([][]byte, len(items))
+		for i, item := range items {
+			result[i] = item.element
+		}
+	} else {
+		result = make([][]byte, 0, len(items)*len(sa.gets))
+		for _, item := range items {
+			for _, pattern := range sa.gets {
+				result = append(result, db.lookupByPattern(pattern, item.element))
+			}
+		}
+	}
+
+	if sa.store == "" {
+		return reply.MakeMultiBulkReply(result)
+	}
+	// the result depends on keys unknown in advance, so effects are written to aof rather than the command
+	db.Remove(sa.store)
+	db.AddAof(makeAofCmd("DEL", [][]byte{[]byte(sa.store)}))
+	if len(result) == 0 {
+		return reply.MakeIntReply(0)
+	}
+	stored := makeList()
+	for i, val := range result {
+		if val == nil {
+			// nil is stored as empty string
+			result[i] = []byte{}
+		}
+		stored.RPush(result[i])
+	}
+	db.PutEntity(sa.store, &DataEntity{Data: stored})
+	db.AddAof(makeAofCmd("RPUSH", append([][]byte{[]byte(sa.store)}, result...)))
+	db.signalBlocked(sa.store)
+	return reply.MakeIntReply(int64(len(result)))
+}
+
+// execSort sorts elements of list, set or sorted set: SORT key [BY pattern] [LIMIT offset count] [GET pattern ...] [ASC|DESC] [ALPHA] [STORE destination]
+func execSort(db *DB, args [][]byte) redis.Reply {
+	return execSortGeneric(db, args, false)
+}
+
+// execSortRO is SORT without STORE: SORT_RO key [BY pattern] [LIMIT offset count] [GET pattern ...] [ASC|DESC] [ALPHA]
+func execSortRO(db *DB, args [][]byte) redis.Reply {
+	return execSortGeneric(db, args, true)
+}
+
+// prepareSort returns destination as write key. Keys referenced by BY and GET patterns
+// depend on elements, so the command locks the whole database if there is any
+func prepareSort(args [][]byte) ([]string, []string) {
+	var writeKeys []string
+	readKeys := []string{string(args[0])}
+	for i := 1; i+1 < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "STORE":
+			writeKeys = []string{string(args[i+1])}
+			i++
+		case "BY", "GET":
+			if strings.Contains(string(args[i+1]), "*") {
+				readKeys = append(readKeys, lockAllKeys)
+			}
+			i++
+		case "LIMIT":
+			i += 2
+		}
+	}
+	return writeKeys, readKeys
+}
+
+func undoSort(db *DB, args [][]byte) []CmdLine {
+	writeKeys, _ := prepareSort(args)
+	return rollbackGivenKeys(db, writeKeys...)
+}
+
+func init() {
+	RegisterCommand("Sort", execSort, prepareSort, undoSort, -2)
+	RegisterCommand("Sort_RO", execSortRO, prepareSort, nil, -2)
+}
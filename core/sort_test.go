@@ -0,0 +1,103 @@
+package core
+
+import (
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/reply/asserts"
+	"testing"
+	"time"
+)
+
+func TestSort(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("RPUSH", "list", "3", "1", "10", "2"))
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "list")), []string{"1", "2", "3", "10"})
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "list", "DESC")), []string{"10", "3", "2", "1"})
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "list", "ALPHA")), []string{"1", "10", "2", "3"})
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "list", "LIMIT", "1", "2")), []string{"2", "3"})
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "list", "LIMIT", "3", "-1")), []string{"10"})
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "list", "LIMIT", "5", "1")), []string{})
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "none")), []string{})
+
+	testDB.Exec(nil, utils.ToCmdLine("SADD", "set", "b", "a", "c"))
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "set", "ALPHA", "DESC")), []string{"c", "b", "a"})
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "set")), "ERR One or more scores can't be converted into double")
+
+	testDB.Exec(nil, utils.ToCmdLine("SET", "str", "v"))
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "str")), "WRONGTYPE Operation against a key holding the wrong kind of value")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "list", "LIMIT", "1")), "Err syntax error")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT_RO", "list", "STORE", "dst")), "Err syntax error")
+}
+
+func TestSortByGet(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("RPUSH", "uid", "1", "2", "3"))
+	testDB.Exec(nil, utils.ToCmdLine("SET", "weight_1", "30"))
+	testDB.Exec(nil, utils.ToCmdLine("SET", "weight_2", "10"))
+	testDB.Exec(nil, utils.ToCmdLine("SET", "weight_3", "20"))
+	testDB.Exec(nil, utils.ToCmdLine("HSET", "user_1", "name", "alice"))
+	testDB.Exec(nil, utils.ToCmdLine("HSET", "user_1", "level", "2"))
+	testDB.Exec(nil, utils.ToCmdLine("HSET", "user_2", "name", "bob"))
+	testDB.Exec(nil, utils.ToCmdLine("HSET", "user_2", "level", "1"))
+	testDB.Exec(nil, utils.ToCmdLine("HSET", "user_3", "level", "3"))
+
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "uid", "BY", "weight_*")), []string{"2", "3", "1"})
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "uid", "BY", "user_*->level", "DESC")), []string{"3", "1", "2"})
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "uid", "BY", "nosort", "LIMIT", "0", "2")), []string{"1", "2"})
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "uid", "BY", "user_*->name", "ALPHA")), []string{"3", "1", "2"})
+	// missing weights are taken as 0 and ties are ordered by elements
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "uid", "BY", "missing_*")), []string{"1", "2", "3"})
+
+	result := testDB.Exec(nil, utils.ToCmdLine("SORT_RO", "uid", "BY", "weight_*", "GET", "#", "GET", "user_*->name", "GET", "weight_*", "GET", "fixed"))
+	expected := "*12\r\n" +
+		"$1\r\n2\r\n$3\r\nbob\r\n$2\r\n10\r\n$-1\r\n" +
+		"$1\r\n3\r\n$-1\r\n$2\r\n20\r\n$-1\r\n" +
+		"$1\r\n1\r\n$5\r\nalice\r\n$2\r\n30\r\n$-1\r\n"
+	if string(result.ToBytes()) != expected {
+		t.Errorf("expected %q, actual %q", expected, result.ToBytes())
+	}
+
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "uid", "BY", "weight_*", "GET", "user_*->name", "STORE", "dst")), 3)
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("LRANGE", "dst", "0", "-1")), []string{"bob", "", "alice"})
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "none", "STORE", "dst")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXISTS", "dst")), 0)
+}
+
+func TestSortPrepare(t *testing.T) {
+	wk, rk := prepareSort(utils.ToCmdLine("list", "LIMIT", "0", "1", "GET", "#", "STORE", "dst"))
+	if len(wk) != 1 || wk[0] != "dst" || len(rk) != 1 || rk[0] != "list" {
+		t.Errorf("unexpected keys %v %v", wk, rk)
+	}
+	_, rk = prepareSort(utils.ToCmdLine("list", "BY", "weight_*"))
+	if !needLockAll(rk) {
+		t.Error("expect database locked by pattern")
+	}
+
+	// other commands wait for a sort with patterns
+	testDB.Flush()
+	testDB.RWLocks(nil, rk)
+	done := make(chan struct{})
+	go func() {
+		testDB.Exec(nil, utils.ToCmdLine("SET", "k", "v"))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Error("expect command blocked by database lock")
+	case <-time.After(20 * time.Millisecond):
+	}
+	testDB.RWUnLocks(nil, rk)
+	<-done
+}
+
+func TestUndoSort(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("RPUSH", "list", "2", "1"))
+	testDB.Exec(nil, utils.ToCmdLine("SET", "dst", "v"))
+	cmdLine := utils.ToCmdLine("SORT", "list", "STORE", "dst")
+	undoCmdLines := testDB.GetUndoLog(cmdLine)
+	testDB.Exec(nil, cmdLine)
+	for _, undoCmdLine := range undoCmdLines {
+		testDB.Exec(nil, undoCmdLine)
+	}
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", "dst")), "v")
+}
@@ -0,0 +1,306 @@
+package core
+
+import (
+	"Tiny-Godis/data_struct/sortedset"
+	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/redis/reply"
+	"math"
+	"strconv"
+	"strings"
+)
+
+func (db *DB) getAsSortedSet(key string) (*sortedset.SortedSet, reply.ErrorReply) {
+	entity, ok := db.GetEntity(key)
+	if !ok {
+		return nil, nil
+	}
+	value, ok := entity.Data.(*sortedset.SortedSet)
+	if !ok {
+		return nil, &reply.WrongTypeErrReply{}
+	}
+	return value, nil
+}
+
+func (db *DB) getOrInitSortedSet(key string) (*sortedset.SortedSet, reply.ErrorReply) {
+	zset, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return nil, errReply
+	}
+	if zset == nil {
+		zset = sortedset.Make()
+		db.PutEntity(key, &DataEntity{Data: zset})
+	}
+	return zset, nil
+}
+
+// parseScore parses score of sorted set, inf and -inf are accepted while NaN is not
+func parseScore(arg []byte) (float64, bool) {
+	score, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, false
+	}
+	return score, true
+}
+
+// formatScore formats score in the shortest form which parses back into the same score
+func formatScore(score float64) string {
+	abs := math.Abs(score)
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	case abs == 0 || (abs >= 1e-6 && abs < 1e21):
+		return strconv.FormatFloat(score, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// execZAdd adds members or updates their scores: ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+func execZAdd(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	var nx, xx, gt, lt, ch, incr bool
+	scoreIndex := 1
+options:
+	for ; scoreIndex < len(args); scoreIndex++ {
+		switch strings.ToUpper(string(args[scoreIndex])) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+	}
+	pairs := args[scoreIndex:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return &reply.SyntaxErrReply{}
+	}
+	if nx && xx {
+		return reply.MakeErrReply("ERR XX and NX options at the same time are not compatible")
+	}
+	if (gt && nx) || (lt && nx) || (gt && lt) {
+		return reply.MakeErrReply("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if incr && len(pairs) > 2 {
+		return reply.MakeErrReply("ERR INCR option supports a single increment-element pair")
+	}
+	scores := make([]float64, len(pairs)/2)
+	for i := range scores {
+		score, ok := parseScore(pairs[2*i])
+		if !ok {
+			return reply.MakeErrReply("ERR value is not a valid float")
+		}
+		scores[i] = score
+	}
+
+	zset, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if zset == nil && xx {
+		if incr {
+			return &reply.NullBulkReply{}
+		}
+		return reply.MakeIntReply(0)
+	}
+	if zset == nil {
+		zset = sortedset.Make()
+		db.PutEntity(key, &DataEntity{Data: zset})
+	}
+
+	var added, updated, processed int64
+	var result float64
+	for i, score := range scores {
+		member := string(pairs[2*i+1])
+		current, exists := zset.Get(member)
+		if !exists {
+			if xx {
+				continue
+			}
+			zset.Add(member, score)
+			added++
+			processed++
+			result = score
+			continue
+		}
+		if nx {
+			continue
+		}
+		if incr {
+			score += current
+			if math.IsNaN(score) {
+				return reply.MakeErrReply("ERR resulting score is not a number (NaN)")
+			}
+		}
+		if (lt && score >= current) || (gt && score <= current) {
+			continue
+		}
+		processed++
+		result = score
+		if score != current {
+			zset.Add(member, score)
+			updated++
+		}
+	}
+	if added+updated > 0 {
+		db.AddAof(makeAofCmd("ZADD", args))
+	}
+	if incr {
+		if processed == 0 {
+			return &reply.NullBulkReply{}
+		}
+		return reply.MakeBulkReply([]byte(formatScore(result)))
+	}
+	if ch {
+		return reply.MakeIntReply(added + updated)
+	}
+	return reply.MakeIntReply(added)
+}
+
+// execZScore returns score of member: ZSCORE key member
+func execZScore(db *DB, args [][]byte) redis.Reply {
+	zset, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if zset == nil {
+		return &reply.NullBulkReply{}
+	}
+	score, ok := zset.Get(string(args[1]))
+	if !ok {
+		return &reply.NullBulkReply{}
+	}
+	return reply.MakeBulkReply([]byte(formatScore(score)))
+}
+
+// execZRem removes members: ZREM key member [member ...]
+func execZRem(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	zset, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if zset == nil {
+		return reply.MakeIntReply(0)
+	}
+	var removed int64
+	for _, member := range args[1:] {
+		if zset.Remove(string(member)) {
+			removed++
+		}
+	}
+	if zset.Len() == 0 {
+		db.Remove(key)
+	}
+	if removed > 0 {
+		db.AddAof(makeAofCmd("ZREM", args))
+	}
+	return reply.MakeIntReply(removed)
+}
+
+// execZCard returns number of members: ZCARD key
+func execZCard(db *DB, args [][]byte) redis.Reply {
+	zset, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if zset == nil {
+		return reply.MakeIntReply(0)
+	}
+	return reply.MakeIntReply(int64(zset.Len()))
+}
+
+// execZRange returns members by rank: ZRANGE key start stop [REV] [WITHSCORES]
+func execZRange(db *DB, args [][]byte) redis.Reply {
+	start, err1 := strconv.ParseInt(string(args[1]), 10, 64)
+	stop, err2 := strconv.ParseInt(string(args[2]), 10, 64)
+	if err1 != nil || err2 != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	var rev, withScores bool
+	for _, arg := range args[3:] {
+		switch strings.ToUpper(string(arg)) {
+		case "REV":
+			rev = true
+		case "WITHSCORES":
+			withScores = true
+		default:
+			return &reply.SyntaxErrReply{}
+		}
+	}
+	zset, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if zset == nil {
+		return reply.MakeEmptyMultiBulkReply()
+	}
+
+	size := int64(zset.Len())
+	if start < 0 {
+		start += size
+	}
+	if stop < 0 {
+		stop += size
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= size {
+		stop = size - 1
+	}
+	if start > stop {
+		return reply.MakeEmptyMultiBulkReply()
+	}
+	var result [][]byte
+	zset.ForEachByRank(start, stop, rev, func(member string, score float64) bool {
+		result = append(result, []byte(member))
+		if withScores {
+			result = append(result, []byte(formatScore(score)))
+		}
+		return true
+	})
+	return reply.MakeMultiBulkReply(result)
+}
+
+func undoZAdd(db *DB, args [][]byte) []CmdLine {
+	// members follow the options and scores
+	index := 1
+	for ; index < len(args); index++ {
+		switch strings.ToUpper(string(args[index])) {
+		case "NX", "XX", "GT", "LT", "CH", "INCR":
+			continue
+		}
+		break
+	}
+	var members []string
+	for i := index + 1; i < len(args); i += 2 {
+		members = append(members, string(args[i]))
+	}
+	return rollbackZSetMembers(db, string(args[0]), members...)
+}
+
+func undoZRem(db *DB, args [][]byte) []CmdLine {
+	members := make([]string, len(args)-1)
+	for i, member := range args[1:] {
+		members[i] = string(member)
+	}
+	return rollbackZSetMembers(db, string(args[0]), members...)
+}
+
+func init() {
+	RegisterCommand("ZAdd", execZAdd, writeFirstKey, undoZAdd, -4)
+	RegisterCommand("ZScore", execZScore, readFirstKey, nil, 3)
+	RegisterCommand("ZRem", execZRem, writeFirstKey, undoZRem, -3)
+	RegisterCommand("ZCard", execZCard, readFirstKey, nil, 2)
+	RegisterCommand("ZRange", execZRange, readFirstKey, nil, -4)
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/reply/asserts"
+	"testing"
+)
+
+func TestZAdd(t *testing.T) {
+	testDB.Flush()
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "1", "a", "2", "b", "1.5", "c")), 3)
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("ZRANGE", "zset", "0", "-1", "WITHSCORES")),
+		[]string{"a", "1", "c", "1.5", "b", "2"})
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "CH", "3", "a", "4", "d")), 2)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "NX", "0", "a", "5", "e")), 1)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("ZSCORE", "zset", "a")), "3")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "XX", "CH", "0", "a", "6", "f")), 1)
+	asserts.AssertNullBulk(t, testDB.Exec(nil, utils.ToCmdLine("ZSCORE", "zset", "f")))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "GT", "CH", "-1", "a", "10", "b")), 1)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("ZSCORE", "zset", "a")), "0")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("ZSCORE", "zset", "b")), "10")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "LT", "CH", "20", "b")), 0)
+
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "INCR", "2.5", "a")), "2.5")
+	asserts.AssertNullBulk(t, testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "NX", "INCR", "1", "a")))
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "INCR", "+inf", "a")), "inf")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "INCR", "-inf", "a")), "ERR resulting score is not a number (NaN)")
+	asserts.AssertNullBulk(t, testDB.Exec(nil, utils.ToCmdLine("ZADD", "none", "XX", "INCR", "1", "a")))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXISTS", "none")), 0)
+
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "nan", "a")), "ERR value is not a valid float")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "1", "a", "2")), "Err syntax error")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "NX", "XX", "1", "a")), "ERR XX and NX options at the same time are not compatible")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "GT", "LT", "1", "a")), "ERR GT, LT, and/or NX options at the same time are not compatible")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "INCR", "1", "a", "2", "b")), "ERR INCR option supports a single increment-element pair")
+}
+
+func TestZRemRange(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "1", "a", "2", "b", "3", "c", "4", "d"))
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("ZRANGE", "zset", "1", "2")), []string{"b", "c"})
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("ZRANGE", "zset", "-2", "100", "REV")), []string{"b", "a"})
+	asserts.AssertMultiBulkReplySize(t, testDB.Exec(nil, utils.ToCmdLine("ZRANGE", "zset", "3", "1")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("ZREM", "zset", "a", "e")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("ZCARD", "zset")), 3)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("ZREM", "zset", "b", "c", "d")), 3)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXISTS", "zset")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("ZCARD", "zset")), 0)
+}
+
+func TestZSetAsValue(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "1", "a", "2.5", "b", "-inf", "c"))
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "ENCODING", "zset")), "skiplist")
+
+	testDB.Exec(nil, utils.ToCmdLine("COPY", "zset", "copy"))
+	testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "3", "d"))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("ZCARD", "copy")), 3)
+
+	payload := dump(t, testDB, "copy")
+	testDB.Exec(nil, [][]byte{[]byte("RESTORE"), []byte("restored"), []byte("0"), payload})
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("ZRANGE", "restored", "0", "-1", "WITHSCORES")),
+		[]string{"c", "-inf", "a", "1", "b", "2.5"})
+
+	// rewritten into aof as ZADD
+	entity, _ := testDB.GetEntity("restored")
+	testDB.Exec(nil, EntityToCmd("rewritten", entity).Args)
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("ZRANGE", "rewritten", "0", "-1", "WITHSCORES")),
+		[]string{"c", "-inf", "a", "1", "b", "2.5"})
+
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("SORT", "copy", "ALPHA", "DESC")), []string{"c", "b", "a"})
+}
+
+func TestUndoZAdd(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "1", "a", "2", "b"))
+	cmdLine := utils.ToCmdLine("ZADD", "zset", "CH", "5", "a", "3", "c")
+	undoCmdLines := testDB.GetUndoLog(cmdLine)
+	testDB.Exec(nil, cmdLine)
+	for _, undo := range undoCmdLines {
+		testDB.Exec(nil, undo)
+	}
+	asserts.AssertMultiBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("ZRANGE", "zset", "0", "-1", "WITHSCORES")), []string{"a", "1", "b", "2"})
+
+	cmdLine = utils.ToCmdLine("GEOADD", "geo", "13.361389", "38.115556", "Palermo")
+	undoCmdLines = testDB.GetUndoLog(cmdLine)
+	testDB.Exec(nil, cmdLine)
+	for _, undo := range undoCmdLines {
+		testDB.Exec(nil, undo)
+	}
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXISTS", "geo")), 0)
+}
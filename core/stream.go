@@ -0,0 +1,733 @@
+package core
+
+import (
+	"Tiny-Godis/data_struct/stream"
+	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/reply"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const streamIDErr = "ERR Invalid stream ID specified as stream command argument"
+
+func (db *DB) getAsStream(key string) (*stream.Stream, reply.ErrorReply) {
+	entity, ok := db.GetEntity(key)
+	if !ok {
+		return nil, nil
+	}
+	s, ok := entity.Data.(*stream.Stream)
+	if !ok {
+		return nil, &reply.WrongTypeErrReply{}
+	}
+	return s, nil
+}
+
+// parseStreamID parses ID in form of ms-seq, seq is missingSeq if omitted.
+// The special IDs "-" and "+" are accepted unless strict
+func parseStreamID(arg []byte, strict bool, missingSeq uint64) (stream.ID, reply.ErrorReply) {
+	str := string(arg)
+	if len(str) > 127 {
+		return stream.ID{}, reply.MakeErrReply(streamIDErr)
+	}
+	if !strict {
+		switch str {
+		case "-":
+			return stream.ID{}, nil
+		case "+":
+			return stream.MaxID, nil
+		}
+	}
+	msPart, seqPart := str, ""
+	hasSeq := false
+	if i := strings.IndexByte(str, '-'); i >= 0 {
+		msPart, seqPart, hasSeq = str[:i], str[i+1:], true
+	}
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return stream.ID{}, reply.MakeErrReply(streamIDErr)
+	}
+	seq := missingSeq
+	if hasSeq {
+		seq, err = strconv.ParseUint(seqPart, 10, 64)
+		if err != nil {
+			return stream.ID{}, reply.MakeErrReply(streamIDErr)
+		}
+	}
+	return stream.ID{Ms: ms, Seq: seq}, nil
+}
+
+// parseStreamRange parses bounds of range, a bound prefixed with "(" is exclusive.
+// Returns the inclusive bounds
+func parseStreamRange(startArg []byte, endArg []byte) (stream.ID, stream.ID, reply.ErrorReply) {
+	start, startEx, errReply := parseStreamIntervalID(startArg, 0)
+	if errReply != nil {
+		return stream.ID{}, stream.ID{}, errReply
+	}
+	end, endEx, errReply := parseStreamIntervalID(endArg, math.MaxUint64)
+	if errReply != nil {
+		return stream.ID{}, stream.ID{}, errReply
+	}
+	if startEx {
+		var ok bool
+		if start, ok = start.Next(); !ok {
+			return stream.ID{}, stream.ID{}, reply.MakeErrReply("ERR invalid start ID for the interval")
+		}
+	}
+	if endEx {
+		var ok bool
+		if end, ok = end.Prev(); !ok {
+			return stream.ID{}, stream.ID{}, reply.MakeErrReply("ERR invalid end ID for the interval")
+		}
+	}
+	return start, end, nil
+}
+
+func parseStreamIntervalID(arg []byte, missingSeq uint64) (stream.ID, bool, reply.ErrorReply) {
+	if len(arg) > 1 && arg[0] == '(' {
+		id, errReply := parseStreamID(arg[1:], true, missingSeq)
+		return id, true, errReply
+	}
+	id, errReply := parseStreamID(arg, false, missingSeq)
+	return id, false, errReply
+}
+
+func streamIDReply(id stream.ID) *reply.BulkReply {
+	return reply.MakeBulkReply([]byte(id.String()))
+}
+
+// streamEntryReply replies entry as [id, [field, value ...]]
+func streamEntryReply(entry *stream.Entry) redis.Reply {
+	return reply.MakeMultiRawReply([]redis.Reply{
+		streamIDReply(entry.ID),
+		reply.MakeMultiBulkReply(entry.Fields),
+	})
+}
+
+// streamRangeReply replies at most count entries in [start, end], 0 count means no limit
+func streamRangeReply(s *stream.Stream, start stream.ID, end stream.ID, desc bool, count int64) redis.Reply {
+	var replies []redis.Reply
+	s.Range(start, end, desc, func(entry *stream.Entry) bool {
+		replies = append(replies, streamEntryReply(entry))
+		return count == 0 || int64(len(replies)) < count
+	})
+	return reply.MakeMultiRawReply(replies)
+}
+
+const (
+	streamTrimNone = iota
+	streamTrimMaxLen
+	streamTrimMinID
+)
+
+// streamAddArgs holds options of XADD and XTRIM
+type streamAddArgs struct {
+	trim   int
+	approx bool
+	maxLen int64
+	minID  stream.ID
+	limit  int64
+	// options of XADD
+	noMkStream bool
+	idGiven    bool
+	seqGiven   bool
+	id         stream.ID
+	// fields starts from the index of args
+	fields int
+}
+
+// approxTrimLimit is the default limit of approximate trimming, like 100 * stream-node-max-entries of redis
+const approxTrimLimit = 100 * 100
+
+// parseStreamAddArgs parses options of XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] *|id
+// and XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count]
+func parseStreamAddArgs(args [][]byte, xadd bool) (*streamAddArgs, reply.ErrorReply) {
+	addArgs := &streamAddArgs{}
+	limitGiven := false
+	i := 1
+	for ; i < len(args); i++ {
+		moreArgs := len(args) - 1 - i
+		arg := strings.ToUpper(string(args[i]))
+		if xadd && arg == "*" {
+			break
+		}
+		if (arg == "MAXLEN" || arg == "MINID") && moreArgs > 0 {
+			addArgs.approx = false
+			next := string(args[i+1])
+			if (next == "~" || next == "=") && moreArgs >= 2 {
+				addArgs.approx = next == "~"
+				i++
+			}
+			i++
+			if arg == "MAXLEN" {
+				maxLen, err := strconv.ParseInt(string(args[i]), 10, 64)
+				if err != nil {
+					return nil, reply.MakeErrReply("ERR value is not an integer or out of range")
+				}
+				if maxLen < 0 {
+					return nil, reply.MakeErrReply("ERR The MAXLEN argument must be >= 0.")
+				}
+				addArgs.trim, addArgs.maxLen = streamTrimMaxLen, maxLen
+			} else {
+				minID, errReply := parseStreamID(args[i], true, 0)
+				if errReply != nil {
+					return nil, errReply
+				}
+				addArgs.trim, addArgs.minID = streamTrimMinID, minID
+			}
+		} else if arg == "LIMIT" && moreArgs > 0 {
+			i++
+			limit, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return nil, reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if limit < 0 {
+				return nil, reply.MakeErrReply("ERR The LIMIT argument must be >= 0.")
+			}
+			addArgs.limit, limitGiven = limit, true
+		} else if xadd && arg == "NOMKSTREAM" {
+			addArgs.noMkStream = true
+		} else if xadd {
+			id, seqGiven, errReply := parseStreamAddID(args[i])
+			if errReply != nil {
+				return nil, errReply
+			}
+			addArgs.id, addArgs.idGiven, addArgs.seqGiven = id, true, seqGiven
+			break
+		} else {
+			return nil, &reply.SyntaxErrReply{}
+		}
+	}
+	addArgs.fields = i + 1
+	if limitGiven && addArgs.trim == streamTrimNone {
+		return nil, reply.MakeErrReply("ERR syntax error, LIMIT cannot be used without specifying a trimming strategy")
+	}
+	if !xadd && addArgs.trim == streamTrimNone {
+		return nil, reply.MakeErrReply("ERR syntax error, XTRIM must be called with a trimming strategy")
+	}
+	if limitGiven {
+		if !addArgs.approx {
+			return nil, reply.MakeErrReply("ERR syntax error, LIMIT cannot be used without the special ~ option")
+		}
+	} else if addArgs.approx {
+		addArgs.limit = approxTrimLimit
+	} else {
+		addArgs.limit = 0
+	}
+	return addArgs, nil
+}
+
+// parseStreamAddID parses ID of XADD, seq could be "*" to generate it
+func parseStreamAddID(arg []byte) (stream.ID, bool, reply.ErrorReply) {
+	str := string(arg)
+	if strings.HasSuffix(str, "-*") {
+		ms, err := strconv.ParseUint(str[:len(str)-2], 10, 64)
+		if err != nil {
+			return stream.ID{}, false, reply.MakeErrReply(streamIDErr)
+		}
+		return stream.ID{Ms: ms}, false, nil
+	}
+	id, errReply := parseStreamID(arg, true, 0)
+	return id, true, errReply
+}
+
+// trimStream trims stream by options of XADD or XTRIM, returns the number of removed entries
+func trimStream(s *stream.Stream, addArgs *streamAddArgs) int {
+	switch addArgs.trim {
+	case streamTrimMaxLen:
+		return s.TrimMaxLen(int(addArgs.maxLen), addArgs.approx, int(addArgs.limit))
+	case streamTrimMinID:
+		return s.TrimMinID(addArgs.minID, addArgs.approx, int(addArgs.limit))
+	}
+	return 0
+}
+
+// streamTrimAofArgs returns the exact trimming which has the same effect as the trimming done just now
+func streamTrimAofArgs(s *stream.Stream, addArgs *streamAddArgs) []string {
+	if addArgs.trim == streamTrimNone {
+		return nil
+	}
+	return []string{"MAXLEN", "=", strconv.Itoa(s.Len())}
+}
+
+var streamAddIDErr = reply.MakeErrReply("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+
+// nextStreamID returns ID of the new entry
+func nextStreamID(last stream.ID, addArgs *streamAddArgs) (stream.ID, reply.ErrorReply) {
+	if !addArgs.idGiven {
+		ms := uint64(nowMillis())
+		if ms > last.Ms {
+			return stream.ID{Ms: ms}, nil
+		}
+		id, _ := last.Next()
+		return id, nil
+	}
+	id := addArgs.id
+	if !addArgs.seqGiven && id.Ms == last.Ms {
+		if last.Seq == math.MaxUint64 {
+			return stream.ID{}, streamAddIDErr
+		}
+		id.Seq = last.Seq + 1
+	}
+	if !last.Less(id) {
+		return stream.ID{}, streamAddIDErr
+	}
+	return id, nil
+}
+
+// execXAdd appends an entry: XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] *|id field value [field value ...]
+func execXAdd(db *DB, args [][]byte) redis.Reply {
+	addArgs, errReply := parseStreamAddArgs(args, true)
+	if errReply != nil {
+		return errReply
+	}
+	if addArgs.fields > len(args) {
+		return reply.MakeArgNumErrReply("xadd")
+	}
+	fields := args[addArgs.fields:]
+	if len(fields) < 2 || len(fields)%2 == 1 {
+		return reply.MakeArgNumErrReply("xadd")
+	}
+	if addArgs.idGiven && addArgs.seqGiven && addArgs.id.IsZero() {
+		return reply.MakeErrReply("ERR The ID specified in XADD must be greater than 0-0")
+	}
+	key := string(args[0])
+	s, errReply := db.getAsStream(key)
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil && addArgs.noMkStream {
+		return &reply.NullBulkReply{}
+	}
+	if s != nil && s.LastID == stream.MaxID {
+		return reply.MakeErrReply("ERR The stream has exhausted the last possible ID, unable to add more items")
+	}
+	var last stream.ID
+	if s != nil {
+		last = s.LastID
+	}
+	id, errReply := nextStreamID(last, addArgs)
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		s = stream.Make()
+		db.PutEntity(key, &DataEntity{Data: s})
+	}
+	values := make([][]byte, len(fields))
+	for i, field := range fields {
+		values[i] = append([]byte{}, field...)
+	}
+	s.Append(id, values)
+	trimStream(s, addArgs)
+
+	aofArgs := []string{key}
+	aofArgs = append(aofArgs, streamTrimAofArgs(s, addArgs)...)
+	aofArgs = append(aofArgs, id.String())
+	aofCmd := utils.ToCmdLine2("XADD", aofArgs...)
+	aofCmd = append(aofCmd, fields...)
+	db.AddAof(reply.MakeMultiBulkReply(aofCmd))
+	db.signalBlocked(key)
+	return streamIDReply(id)
+}
+
+// execXLen returns number of entries: XLEN key
+func execXLen(db *DB, args [][]byte) redis.Reply {
+	s, errReply := db.getAsStream(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		return reply.MakeIntReply(0)
+	}
+	return reply.MakeIntReply(int64(s.Len()))
+}
+
+func execXRangeGeneric(db *DB, args [][]byte, desc bool) redis.Reply {
+	startArg, endArg := args[1], args[2]
+	if desc {
+		startArg, endArg = endArg, startArg
+	}
+	start, end, errReply := parseStreamRange(startArg, endArg)
+	if errReply != nil {
+		return errReply
+	}
+	count := int64(-1)
+	for i := 3; i < len(args); i++ {
+		if strings.ToUpper(string(args[i])) == "COUNT" && i+1 < len(args) {
+			var err error
+			count, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if count < 0 {
+				count = 0
+			}
+			i++
+		} else {
+			return &reply.SyntaxErrReply{}
+		}
+	}
+	s, errReply := db.getAsStream(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		return reply.MakeEmptyMultiBulkReply()
+	}
+	if count == 0 {
+		return reply.MakeNullMultiBulkReply()
+	}
+	if count < 0 {
+		count = 0
+	}
+	return streamRangeReply(s, start, end, desc, count)
+}
+
+// execXRange returns entries in range: XRANGE key start end [COUNT count]
+func execXRange(db *DB, args [][]byte) redis.Reply {
+	return execXRangeGeneric(db, args, false)
+}
+
+// execXRevRange returns entries in range in reverse order: XREVRANGE key end start [COUNT count]
+func execXRevRange(db *DB, args [][]byte) redis.Reply {
+	return execXRangeGeneric(db, args, true)
+}
+
+// execXDel removes entries: XDEL key id [id ...]
+func execXDel(db *DB, args [][]byte) redis.Reply {
+	ids := make([]stream.ID, len(args)-1)
+	for i, arg := range args[1:] {
+		id, errReply := parseStreamID(arg, true, 0)
+		if errReply != nil {
+			return errReply
+		}
+		ids[i] = id
+	}
+	key := string(args[0])
+	s, errReply := db.getAsStream(key)
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		return reply.MakeIntReply(0)
+	}
+	deleted := 0
+	for _, id := range ids {
+		if s.Delete(id) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		db.AddAof(makeAofCmd("xdel", args))
+	}
+	return reply.MakeIntReply(int64(deleted))
+}
+
+// execXTrim removes the oldest entries: XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count]
+func execXTrim(db *DB, args [][]byte) redis.Reply {
+	addArgs, errReply := parseStreamAddArgs(args, false)
+	if errReply != nil {
+		return errReply
+	}
+	key := string(args[0])
+	s, errReply := db.getAsStream(key)
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		return reply.MakeIntReply(0)
+	}
+	deleted := trimStream(s, addArgs)
+	if deleted > 0 {
+		db.AddAof(reply.MakeMultiBulkReply(utils.ToCmdLine2("XTRIM", append([]string{key}, streamTrimAofArgs(s, addArgs)...)...)))
+	}
+	return reply.MakeIntReply(int64(deleted))
+}
+
+// execXSetID sets the last ID of stream: XSETID key last-id [ENTRIESADDED entries-added] [MAXDELETEDID max-deleted-id]
+func execXSetID(db *DB, args [][]byte) redis.Reply {
+	id, errReply := parseStreamID(args[1], true, 0)
+	if errReply != nil {
+		return errReply
+	}
+	entriesAdded := int64(-1)
+	var maxDeletedID stream.ID
+	for i := 2; i < len(args); i++ {
+		moreArgs := i+1 < len(args)
+		switch strings.ToUpper(string(args[i])) {
+		case "ENTRIESADDED":
+			if !moreArgs {
+				return &reply.SyntaxErrReply{}
+			}
+			var err error
+			entriesAdded, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if entriesAdded < 0 {
+				return reply.MakeErrReply("ERR entries_added must be positive")
+			}
+		case "MAXDELETEDID":
+			if !moreArgs {
+				return &reply.SyntaxErrReply{}
+			}
+			maxDeletedID, errReply = parseStreamID(args[i+1], true, 0)
+			if errReply != nil {
+				return errReply
+			}
+			if id.Less(maxDeletedID) {
+				return reply.MakeErrReply("ERR The ID specified in XSETID is smaller than the provided max_deleted_entry_id")
+			}
+		default:
+			return &reply.SyntaxErrReply{}
+		}
+		i++
+	}
+	s, errReply := db.getAsStream(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		return reply.MakeErrReply("ERR no such key")
+	}
+	if last, ok := s.Last(); ok {
+		if id.Less(last.ID) {
+			return reply.MakeErrReply("ERR The ID specified in XSETID is smaller than the target stream top item")
+		}
+		if entriesAdded != -1 && int64(s.Len()) > entriesAdded {
+			return reply.MakeErrReply("ERR The entries_added specified in XSETID is smaller than the target stream length")
+		}
+	}
+	s.LastID = id
+	if entriesAdded != -1 {
+		s.EntriesAdded = uint64(entriesAdded)
+	}
+	if !maxDeletedID.IsZero() {
+		s.MaxDeletedID = maxDeletedID
+	}
+	db.AddAof(makeAofCmd("xsetid", args))
+	return &reply.OkReply{}
+}
+
+// streamReadArgs holds options of XREAD and XREADGROUP
+type streamReadArgs struct {
+	count    int64
+	block    bool
+	timeout  time.Duration
+	group    string
+	consumer string
+	noAck    bool
+	keys     [][]byte
+	ids      [][]byte
+}
+
+// parseStreamReadArgs parses XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+// and XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+func parseStreamReadArgs(args [][]byte, xreadgroup bool) (*streamReadArgs, reply.ErrorReply) {
+	readArgs := &streamReadArgs{}
+	streamsArg := -1
+	hasGroup := false
+	for i := 0; i < len(args); i++ {
+		moreArgs := len(args) - 1 - i
+		switch strings.ToUpper(string(args[i])) {
+		case "BLOCK":
+			if moreArgs == 0 {
+				return nil, &reply.SyntaxErrReply{}
+			}
+			i++
+			ms, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return nil, reply.MakeErrReply("ERR timeout is not an integer or out of range")
+			}
+			if ms < 0 {
+				return nil, reply.MakeErrReply("ERR timeout is negative")
+			}
+			readArgs.block, readArgs.timeout = true, time.Duration(ms)*time.Millisecond
+			continue
+		case "COUNT":
+			if moreArgs == 0 {
+				return nil, &reply.SyntaxErrReply{}
+			}
+			i++
+			count, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return nil, reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if count < 0 {
+				count = 0
+			}
+			readArgs.count = count
+			continue
+		case "STREAMS":
+			if moreArgs == 0 {
+				return nil, &reply.SyntaxErrReply{}
+			}
+			streamsArg = i + 1
+		case "GROUP":
+			if moreArgs < 2 {
+				return nil, &reply.SyntaxErrReply{}
+			}
+			if !xreadgroup {
+				return nil, reply.MakeErrReply("ERR The GROUP option is only supported by XREADGROUP. You called XREAD instead.")
+			}
+			readArgs.group, readArgs.consumer = string(args[i+1]), string(args[i+2])
+			hasGroup = true
+			i += 2
+			continue
+		case "NOACK":
+			if !xreadgroup {
+				return nil, reply.MakeErrReply("ERR The NOACK option is only supported by XREADGROUP. You called XREAD instead.")
+			}
+			readArgs.noAck = true
+			continue
+		default:
+			return nil, &reply.SyntaxErrReply{}
+		}
+		break
+	}
+	if streamsArg < 0 {
+		return nil, &reply.SyntaxErrReply{}
+	}
+	streams := args[streamsArg:]
+	if len(streams)%2 != 0 {
+		if xreadgroup {
+			return nil, reply.MakeErrReply("ERR Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '>' must be specified.")
+		}
+		return nil, reply.MakeErrReply("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+	}
+	if xreadgroup && !hasGroup {
+		return nil, reply.MakeErrReply("ERR Missing GROUP option for XREADGROUP")
+	}
+	readArgs.keys = streams[:len(streams)/2]
+	readArgs.ids = streams[len(streams)/2:]
+	return readArgs, nil
+}
+
+// execXRead reads entries after given IDs from streams, returns null if there is nothing to read.
+// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...].
+// Blocking is done by execBlockingCmd, it also resolves "$" before retries
+func execXRead(db *DB, args [][]byte) redis.Reply {
+	readArgs, errReply := parseStreamReadArgs(args, false)
+	if errReply != nil {
+		return errReply
+	}
+	streams := make([]*stream.Stream, len(readArgs.keys))
+	after := make([]stream.ID, len(readArgs.keys))
+	for i, key := range readArgs.keys {
+		s, errReply := db.getAsStream(string(key))
+		if errReply != nil {
+			return errReply
+		}
+		streams[i] = s
+		switch string(readArgs.ids[i]) {
+		case "$":
+			if s != nil {
+				after[i] = s.LastID
+			}
+		case ">":
+			return reply.MakeErrReply("ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.")
+		default:
+			id, errReply := parseStreamID(readArgs.ids[i], true, 0)
+			if errReply != nil {
+				return errReply
+			}
+			after[i] = id
+		}
+	}
+	var results []redis.Reply
+	for i, s := range streams {
+		if s == nil {
+			continue
+		}
+		last, ok := s.Last()
+		if !ok || !after[i].Less(last.ID) {
+			continue
+		}
+		start, _ := after[i].Next()
+		results = append(results, reply.MakeMultiRawReply([]redis.Reply{
+			reply.MakeBulkReply(readArgs.keys[i]),
+			streamRangeReply(s, start, stream.MaxID, false, readArgs.count),
+		}))
+	}
+	if len(results) == 0 {
+		return reply.MakeNullMultiBulkReply()
+	}
+	return reply.MakeMultiRawReply(results)
+}
+
+// streamReadKeys returns keys of XREAD and XREADGROUP
+func streamReadKeys(args [][]byte, xreadgroup bool) []string {
+	readArgs, errReply := parseStreamReadArgs(args, xreadgroup)
+	if errReply != nil {
+		return nil
+	}
+	keys := make([]string, len(readArgs.keys))
+	for i, key := range readArgs.keys {
+		keys[i] = string(key)
+	}
+	return keys
+}
+
+func prepareXRead(args [][]byte) ([]string, []string) {
+	return nil, streamReadKeys(args, false)
+}
+
+// prepareStreamBlocking returns keys and timeout of XREAD and XREADGROUP with BLOCK option.
+// "$" is replaced by the last ID of stream, so that retries only get entries added after blocking
+func (db *DB) prepareStreamBlocking(cmdLine CmdLine) (CmdLine, []string, time.Duration, bool, redis.Reply) {
+	xreadgroup := strings.ToLower(string(cmdLine[0])) == "xreadgroup"
+	readArgs, errReply := parseStreamReadArgs(cmdLine[1:], xreadgroup)
+	if errReply != nil {
+		return nil, nil, 0, false, errReply
+	}
+	if !readArgs.block {
+		return cmdLine, nil, 0, false, nil
+	}
+	keys := make([]string, 0, len(readArgs.keys))
+	seen := make(map[string]struct{})
+	for _, key := range readArgs.keys {
+		if _, ok := seen[string(key)]; ok {
+			continue
+		}
+		seen[string(key)] = struct{}{}
+		keys = append(keys, string(key))
+	}
+	if xreadgroup {
+		return cmdLine, keys, readArgs.timeout, true, nil
+	}
+
+	resolved := make(CmdLine, len(cmdLine))
+	copy(resolved, cmdLine)
+	idStart := len(cmdLine) - len(readArgs.ids)
+	db.RWLocks(nil, keys)
+	defer db.RWUnLocks(nil, keys)
+	for i, id := range readArgs.ids {
+		if string(id) != "$" {
+			continue
+		}
+		s, errReply := db.getAsStream(string(readArgs.keys[i]))
+		if errReply != nil {
+			return nil, nil, 0, false, errReply
+		}
+		last := stream.ID{}
+		if s != nil {
+			last = s.LastID
+		}
+		resolved[idStart+i] = []byte(last.String())
+	}
+	return resolved, keys, readArgs.timeout, true, nil
+}
+
+func init() {
+	RegisterCommand("XAdd", execXAdd, writeFirstKey, rollbackFirstKey, -5)
+	RegisterCommand("XLen", execXLen, readFirstKey, nil, 2)
+	RegisterCommand("XRange", execXRange, readFirstKey, nil, -4)
+	RegisterCommand("XRevRange", execXRevRange, readFirstKey, nil, -4)
+	RegisterCommand("XDel", execXDel, writeFirstKey, rollbackFirstKey, -3)
+	RegisterCommand("XTrim", execXTrim, writeFirstKey, rollbackFirstKey, -4)
+	RegisterCommand("XSetID", execXSetID, writeFirstKey, rollbackFirstKey, -3)
+	RegisterCommand("XRead", execXRead, prepareXRead, nil, -4)
+}
@@ -0,0 +1,870 @@
+package core
+
+import (
+	"Tiny-Godis/data_struct/stream"
+	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/reply"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// consumer groups of stream
+
+func noStreamGroupErr(key string, group string) reply.ErrorReply {
+	return reply.MakeErrReply("NOGROUP No such key '" + key + "' or consumer group '" + group + "'")
+}
+
+// getStreamGroup returns stream and its consumer group, group is nil if any of them does not exist
+func (db *DB) getStreamGroup(key string, group string) (*stream.Stream, *stream.Group, reply.ErrorReply) {
+	s, errReply := db.getAsStream(key)
+	if errReply != nil || s == nil {
+		return nil, nil, errReply
+	}
+	return s, s.Group(group), nil
+}
+
+// makeStreamClaimCmd returns the XCLAIM which sets pending entry as it is now.
+// If the entry has been deleted from stream, the XCLAIM removes the pending entry
+func makeStreamClaimCmd(key string, g *stream.Group, pe *stream.PendingEntry) *reply.MultiBulkReply {
+	return reply.MakeMultiBulkReply(utils.ToCmdLine("XCLAIM", key, g.Name, pe.Consumer.Name, "0", pe.ID.String(),
+		"TIME", strconv.FormatInt(pe.DeliveryTime, 10),
+		"RETRYCOUNT", strconv.FormatInt(pe.DeliveryCount, 10),
+		"FORCE", "JUSTID", "LASTID", g.LastID.String()))
+}
+
+// makeStreamSetIDCmd returns the XGROUP SETID which sets last delivered ID of group as it is now
+func makeStreamSetIDCmd(key string, g *stream.Group) *reply.MultiBulkReply {
+	return reply.MakeMultiBulkReply(utils.ToCmdLine("XGROUP", "SETID", key, g.Name, g.LastID.String(),
+		"ENTRIESREAD", strconv.FormatInt(g.EntriesRead, 10)))
+}
+
+func makeStreamCreateConsumerCmd(key string, g *stream.Group, consumer string) *reply.MultiBulkReply {
+	return reply.MakeMultiBulkReply(utils.ToCmdLine("XGROUP", "CREATECONSUMER", key, g.Name, consumer))
+}
+
+// execXGroup manages consumer groups:
+// XGROUP CREATE key group id|$ [MKSTREAM] [ENTRIESREAD entries-read],
+// XGROUP SETID key group id|$ [ENTRIESREAD entries-read], XGROUP DESTROY key group,
+// XGROUP CREATECONSUMER key group consumer and XGROUP DELCONSUMER key group consumer
+func execXGroup(db *DB, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "create", "setid":
+		if len(args) < 4 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'xgroup|" + subCmd + "' command")
+		}
+	case "destroy":
+		if len(args) != 3 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'xgroup|destroy' command")
+		}
+	case "createconsumer", "delconsumer":
+		if len(args) != 4 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'xgroup|" + subCmd + "' command")
+		}
+	default:
+		return reply.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try XGROUP HELP.")
+	}
+	key, groupName := string(args[1]), string(args[2])
+
+	mkStream := false
+	entriesRead := int64(stream.InvalidEntriesRead)
+	if subCmd == "create" || subCmd == "setid" {
+		for i := 4; i < len(args); i++ {
+			option := strings.ToUpper(string(args[i]))
+			if option == "MKSTREAM" && subCmd == "create" {
+				mkStream = true
+			} else if option == "ENTRIESREAD" && i+1 < len(args) {
+				var err error
+				entriesRead, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+				if err != nil {
+					return reply.MakeErrReply("ERR value is not an integer or out of range")
+				}
+				if entriesRead < 0 && entriesRead != stream.InvalidEntriesRead {
+					return reply.MakeErrReply("ERR value for ENTRIESREAD must be positive or -1")
+				}
+				i++
+			} else {
+				return &reply.SyntaxErrReply{}
+			}
+		}
+	}
+
+	s, errReply := db.getAsStream(key)
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil && !mkStream {
+		return reply.MakeErrReply("ERR The XGROUP subcommand requires the key to exist. " +
+			"Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	}
+	var g *stream.Group
+	if s != nil {
+		g = s.Group(groupName)
+	}
+	if g == nil && subCmd != "create" && subCmd != "destroy" {
+		return reply.MakeErrReply("NOGROUP No such consumer group '" + groupName + "' for key name '" + key + "'")
+	}
+
+	switch subCmd {
+	case "create":
+		var id stream.ID
+		if string(args[3]) == "$" {
+			if s != nil {
+				id = s.LastID
+			}
+		} else if id, errReply = parseStreamID(args[3], true, 0); errReply != nil {
+			return errReply
+		}
+		if s == nil {
+			s = stream.Make()
+			db.PutEntity(key, &DataEntity{Data: s})
+		}
+		if _, ok := s.CreateGroup(groupName, id, entriesRead); !ok {
+			return reply.MakeErrReply("BUSYGROUP Consumer Group name already exists")
+		}
+		db.AddAof(reply.MakeMultiBulkReply(utils.ToCmdLine("XGROUP", "CREATE", key, groupName, id.String(),
+			"MKSTREAM", "ENTRIESREAD", strconv.FormatInt(entriesRead, 10))))
+		return &reply.OkReply{}
+	case "setid":
+		id := s.LastID
+		if string(args[3]) != "$" {
+			if id, errReply = parseStreamID(args[3], false, 0); errReply != nil {
+				return errReply
+			}
+		}
+		g.LastID = id
+		g.EntriesRead = entriesRead
+		db.AddAof(makeStreamSetIDCmd(key, g))
+		return &reply.OkReply{}
+	case "destroy":
+		if !s.DestroyGroup(groupName) {
+			return reply.MakeIntReply(0)
+		}
+		db.AddAof(makeAofCmd("xgroup", args))
+		// consumers blocked by the group get an error
+		db.signalBlocked(key)
+		return reply.MakeIntReply(1)
+	case "createconsumer":
+		consumer := string(args[3])
+		if _, created := g.CreateConsumer(consumer, nowMillis()); !created {
+			return reply.MakeIntReply(0)
+		}
+		db.AddAof(makeStreamCreateConsumerCmd(key, g, consumer))
+		return reply.MakeIntReply(1)
+	default:
+		pending, ok := g.DeleteConsumer(string(args[3]))
+		if ok {
+			db.AddAof(makeAofCmd("xgroup", args))
+		}
+		return reply.MakeIntReply(int64(pending))
+	}
+}
+
+func prepareXGroup(args [][]byte) ([]string, []string) {
+	if len(args) < 2 {
+		return nil, nil
+	}
+	return []string{string(args[1])}, nil
+}
+
+func undoXGroup(db *DB, args [][]byte) []CmdLine {
+	if len(args) < 2 {
+		return nil
+	}
+	return rollbackGivenKeys(db, string(args[1]))
+}
+
+// execXReadGroup reads entries as a consumer of group, returns null if there is nothing to read.
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...].
+// ">" reads entries never delivered to the group, other IDs read history pending for the consumer
+func execXReadGroup(db *DB, args [][]byte) redis.Reply {
+	readArgs, errReply := parseStreamReadArgs(args, true)
+	if errReply != nil {
+		return errReply
+	}
+	streams := make([]*stream.Stream, len(readArgs.keys))
+	groups := make([]*stream.Group, len(readArgs.keys))
+	after := make([]stream.ID, len(readArgs.keys))
+	newOnly := make([]bool, len(readArgs.keys))
+	for i, key := range readArgs.keys {
+		s, g, errReply := db.getStreamGroup(string(key), readArgs.group)
+		if errReply != nil {
+			return errReply
+		}
+		if g == nil {
+			return reply.MakeErrReply("NOGROUP No such key '" + string(key) + "' or consumer group '" +
+				readArgs.group + "' in XREADGROUP with GROUP option")
+		}
+		streams[i], groups[i] = s, g
+		switch string(readArgs.ids[i]) {
+		case "$":
+			return reply.MakeErrReply("ERR The $ ID is meaningless in the context of XREADGROUP: " +
+				"you want to read the history of this consumer by specifying a proper ID, " +
+				"or use the > ID to get new messages. The $ ID would just return an empty result set.")
+		case ">":
+			newOnly[i] = true
+		default:
+			id, errReply := parseStreamID(readArgs.ids[i], true, 0)
+			if errReply != nil {
+				return errReply
+			}
+			after[i] = id
+		}
+	}
+
+	now := nowMillis()
+	var results []redis.Reply
+	for i, s := range streams {
+		g := groups[i]
+		if newOnly[i] {
+			last, ok := s.Last()
+			if !ok || !g.LastID.Less(last.ID) {
+				continue
+			}
+			after[i] = g.LastID
+		}
+		key := string(readArgs.keys[i])
+		c := g.Consumer(readArgs.consumer)
+		if c == nil {
+			c, _ = g.CreateConsumer(readArgs.consumer, now)
+			db.AddAof(makeStreamCreateConsumerCmd(key, g, readArgs.consumer))
+		}
+		c.SeenTime = now
+		var entries []redis.Reply
+		if start, ok := after[i].Next(); ok && newOnly[i] {
+			entries = db.readStreamGroup(key, s, g, c, start, readArgs, now)
+		} else if ok {
+			entries = db.readStreamHistory(key, s, g, c, start, readArgs.count, now)
+		}
+		results = append(results, reply.MakeMultiRawReply([]redis.Reply{
+			reply.MakeBulkReply(readArgs.keys[i]),
+			reply.MakeMultiRawReply(entries),
+		}))
+	}
+	if len(results) == 0 {
+		return reply.MakeNullMultiBulkReply()
+	}
+	return reply.MakeMultiRawReply(results)
+}
+
+// readStreamGroup delivers entries from start to consumer, they are pending until acknowledged unless NOACK
+func (db *DB) readStreamGroup(key string, s *stream.Stream, g *stream.Group, c *stream.Consumer,
+	start stream.ID, readArgs *streamReadArgs, now int64) []redis.Reply {
+	lastID := g.LastID
+	var entries []redis.Reply
+	s.Range(start, stream.MaxID, false, func(entry *stream.Entry) bool {
+		s.Advance(g, entry.ID)
+		if !readArgs.noAck {
+			pe := g.Deliver(entry.ID, c, now)
+			c.ActiveTime = now
+			db.AddAof(makeStreamClaimCmd(key, g, pe))
+		}
+		entries = append(entries, streamEntryReply(entry))
+		return readArgs.count == 0 || int64(len(entries)) < readArgs.count
+	})
+	if g.LastID != lastID {
+		db.AddAof(makeStreamSetIDCmd(key, g))
+	}
+	return entries
+}
+
+// readStreamHistory delivers entries pending for consumer again, deleted entries are replied as [id, nil]
+func (db *DB) readStreamHistory(key string, s *stream.Stream, g *stream.Group, c *stream.Consumer,
+	start stream.ID, count int64, now int64) []redis.Reply {
+	var entries []redis.Reply
+	c.RangePending(start, stream.MaxID, func(pe *stream.PendingEntry) bool {
+		entry, ok := s.Get(pe.ID)
+		if ok {
+			pe.DeliveryTime = now
+			pe.DeliveryCount++
+			db.AddAof(makeStreamClaimCmd(key, g, pe))
+			entries = append(entries, streamEntryReply(entry))
+		} else {
+			entries = append(entries, reply.MakeMultiRawReply([]redis.Reply{
+				streamIDReply(pe.ID),
+				reply.MakeNullMultiBulkReply(),
+			}))
+		}
+		return count == 0 || int64(len(entries)) < count
+	})
+	return entries
+}
+
+func prepareXReadGroup(args [][]byte) ([]string, []string) {
+	return streamReadKeys(args, true), nil
+}
+
+func undoXReadGroup(db *DB, args [][]byte) []CmdLine {
+	return rollbackGivenKeys(db, streamReadKeys(args, true)...)
+}
+
+// execXAck acknowledges pending entries: XACK key group id [id ...]
+func execXAck(db *DB, args [][]byte) redis.Reply {
+	ids := make([]stream.ID, len(args)-2)
+	for i, arg := range args[2:] {
+		id, errReply := parseStreamID(arg, true, 0)
+		if errReply != nil {
+			return errReply
+		}
+		ids[i] = id
+	}
+	_, g, errReply := db.getStreamGroup(string(args[0]), string(args[1]))
+	if errReply != nil {
+		return errReply
+	}
+	if g == nil {
+		return reply.MakeIntReply(0)
+	}
+	acked := 0
+	for _, id := range ids {
+		if g.Ack(id) {
+			acked++
+		}
+	}
+	if acked > 0 {
+		db.AddAof(makeAofCmd("xack", args))
+	}
+	return reply.MakeIntReply(int64(acked))
+}
+
+// execXPending inspects pending entries: XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+func execXPending(db *DB, args [][]byte) redis.Reply {
+	if len(args) != 2 && (len(args) < 5 || len(args) > 8) {
+		return &reply.SyntaxErrReply{}
+	}
+	var minIdle, count int64
+	var start, end stream.ID
+	var consumer string
+	hasConsumer := false
+	if len(args) > 2 {
+		startIdx := 2
+		if strings.ToUpper(string(args[2])) == "IDLE" {
+			var err error
+			minIdle, err = strconv.ParseInt(string(args[3]), 10, 64)
+			if err != nil {
+				return reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if len(args) < 7 {
+				return &reply.SyntaxErrReply{}
+			}
+			startIdx += 2
+		}
+		if len(args) > startIdx+4 {
+			return &reply.SyntaxErrReply{}
+		}
+		var err error
+		count, err = strconv.ParseInt(string(args[startIdx+2]), 10, 64)
+		if err != nil {
+			return reply.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		if count < 0 {
+			count = 0
+		}
+		var errReply reply.ErrorReply
+		start, end, errReply = parseStreamRange(args[startIdx], args[startIdx+1])
+		if errReply != nil {
+			return errReply
+		}
+		if startIdx+3 < len(args) {
+			consumer, hasConsumer = string(args[startIdx+3]), true
+		}
+	}
+	key, groupName := string(args[0]), string(args[1])
+	_, g, errReply := db.getStreamGroup(key, groupName)
+	if errReply != nil {
+		return errReply
+	}
+	if g == nil {
+		return noStreamGroupErr(key, groupName)
+	}
+
+	if len(args) == 2 {
+		if g.PendingLen() == 0 {
+			return reply.MakeMultiRawReply([]redis.Reply{
+				reply.MakeIntReply(0),
+				&reply.NullBulkReply{},
+				&reply.NullBulkReply{},
+				reply.MakeNullMultiBulkReply(),
+			})
+		}
+		var first, last stream.ID
+		g.RangePending(stream.ID{}, stream.MaxID, func(pe *stream.PendingEntry) bool {
+			if first.IsZero() {
+				first = pe.ID
+			}
+			last = pe.ID
+			return true
+		})
+		var consumers []redis.Reply
+		for _, c := range g.Consumers() {
+			if c.PendingLen() == 0 {
+				continue
+			}
+			consumers = append(consumers, reply.MakeMultiBulkReply([][]byte{
+				[]byte(c.Name),
+				[]byte(strconv.Itoa(c.PendingLen())),
+			}))
+		}
+		return reply.MakeMultiRawReply([]redis.Reply{
+			reply.MakeIntReply(int64(g.PendingLen())),
+			streamIDReply(first),
+			streamIDReply(last),
+			reply.MakeMultiRawReply(consumers),
+		})
+	}
+
+	now := nowMillis()
+	var entries []redis.Reply
+	visit := func(pe *stream.PendingEntry) bool {
+		if int64(len(entries)) >= count {
+			return false
+		}
+		idle := now - pe.DeliveryTime
+		if idle < 0 {
+			idle = 0
+		}
+		if minIdle > 0 && idle < minIdle {
+			return true
+		}
+		entries = append(entries, reply.MakeMultiRawReply([]redis.Reply{
+			streamIDReply(pe.ID),
+			reply.MakeBulkReply([]byte(pe.Consumer.Name)),
+			reply.MakeIntReply(idle),
+			reply.MakeIntReply(pe.DeliveryCount),
+		}))
+		return true
+	}
+	if hasConsumer {
+		if c := g.Consumer(consumer); c != nil {
+			c.RangePending(start, end, visit)
+		}
+	} else {
+		g.RangePending(start, end, visit)
+	}
+	return reply.MakeMultiRawReply(entries)
+}
+
+// execXClaim changes owner of pending entries:
+// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-milliseconds] [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID lastid]
+func execXClaim(db *DB, args [][]byte) redis.Reply {
+	key, groupName, consumerName := string(args[0]), string(args[1]), string(args[2])
+	s, g, errReply := db.getStreamGroup(key, groupName)
+	if errReply != nil {
+		return errReply
+	}
+	if g == nil {
+		return noStreamGroupErr(key, groupName)
+	}
+	minIdle, err := strconv.ParseInt(string(args[3]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR Invalid min-idle-time argument for XCLAIM")
+	}
+	if minIdle < 0 {
+		minIdle = 0
+	}
+	var ids []stream.ID
+	j := 4
+	for ; j < len(args); j++ {
+		id, errReply := parseStreamID(args[j], true, 0)
+		if errReply != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	now := nowMillis()
+	deliveryTime := int64(-1)
+	retryCount := int64(-1)
+	force, justID := false, false
+	var lastID stream.ID
+	for ; j < len(args); j++ {
+		moreArgs := j+1 < len(args)
+		option := strings.ToUpper(string(args[j]))
+		if option == "FORCE" {
+			force = true
+		} else if option == "JUSTID" {
+			justID = true
+		} else if option == "IDLE" && moreArgs {
+			j++
+			idle, err := strconv.ParseInt(string(args[j]), 10, 64)
+			if err != nil {
+				return reply.MakeErrReply("ERR Invalid IDLE option argument for XCLAIM")
+			}
+			deliveryTime = now - idle
+		} else if option == "TIME" && moreArgs {
+			j++
+			deliveryTime, err = strconv.ParseInt(string(args[j]), 10, 64)
+			if err != nil {
+				return reply.MakeErrReply("ERR Invalid TIME option argument for XCLAIM")
+			}
+		} else if option == "RETRYCOUNT" && moreArgs {
+			j++
+			retryCount, err = strconv.ParseInt(string(args[j]), 10, 64)
+			if err != nil {
+				return reply.MakeErrReply("ERR Invalid RETRYCOUNT option argument for XCLAIM")
+			}
+		} else if option == "LASTID" && moreArgs {
+			j++
+			if lastID, errReply = parseStreamID(args[j], true, 0); errReply != nil {
+				return errReply
+			}
+		} else {
+			return reply.MakeErrReply("ERR Unrecognized XCLAIM option '" + string(args[j]) + "'")
+		}
+	}
+	// a bogus time is not an error, since clients may compute it with their own clock
+	if deliveryTime < 0 || deliveryTime > now {
+		deliveryTime = now
+	}
+	if g.LastID.Less(lastID) {
+		g.LastID = lastID
+		db.AddAof(makeStreamSetIDCmd(key, g))
+	}
+
+	var c *stream.Consumer
+	var claimed []redis.Reply
+	for _, id := range ids {
+		pe := g.Pending(id)
+		entry, exists := s.Get(id)
+		if !exists {
+			if pe != nil {
+				db.AddAof(makeStreamClaimCmd(key, g, pe))
+				g.Ack(id)
+			}
+			continue
+		}
+		if force && pe == nil {
+			pe = g.AddPending(id, now)
+		}
+		if pe == nil {
+			continue
+		}
+		// a pending entry just created by FORCE has no owner, its idle time is ignored
+		if pe.Consumer != nil && minIdle > 0 && now-pe.DeliveryTime < minIdle {
+			continue
+		}
+		if c == nil {
+			c, _ = g.CreateConsumer(consumerName, now)
+			c.SeenTime = now
+		}
+		pe.DeliveryTime = deliveryTime
+		if retryCount >= 0 {
+			pe.DeliveryCount = retryCount
+		} else if !justID {
+			pe.DeliveryCount++
+		}
+		g.Transfer(pe, c)
+		if justID {
+			claimed = append(claimed, streamIDReply(id))
+		} else {
+			claimed = append(claimed, streamEntryReply(entry))
+		}
+		c.ActiveTime = now
+		db.AddAof(makeStreamClaimCmd(key, g, pe))
+	}
+	return reply.MakeMultiRawReply(claimed)
+}
+
+// execXAutoClaim claims pending entries idle for long, it returns a cursor for the next call with claimed and deleted entries:
+// XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+func execXAutoClaim(db *DB, args [][]byte) redis.Reply {
+	key, groupName, consumerName := string(args[0]), string(args[1]), string(args[2])
+	s, g, errReply := db.getStreamGroup(key, groupName)
+	if errReply != nil {
+		return errReply
+	}
+	if g == nil {
+		return noStreamGroupErr(key, groupName)
+	}
+	minIdle, err := strconv.ParseInt(string(args[3]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR Invalid min-idle-time argument for XAUTOCLAIM")
+	}
+	if minIdle < 0 {
+		minIdle = 0
+	}
+	start, exclusive, errReply := parseStreamIntervalID(args[4], 0)
+	if errReply != nil {
+		return errReply
+	}
+	if exclusive {
+		var ok bool
+		if start, ok = start.Next(); !ok {
+			return reply.MakeErrReply("ERR invalid start ID for the interval")
+		}
+	}
+	// each entry could take at most attemptsFactor attempts
+	const attemptsFactor = 10
+	count := int64(100)
+	justID := false
+	for j := 5; j < len(args); j++ {
+		option := strings.ToUpper(string(args[j]))
+		if option == "COUNT" && j+1 < len(args) {
+			j++
+			count, err = strconv.ParseInt(string(args[j]), 10, 64)
+			if err != nil || count < 1 || count > math.MaxInt64/attemptsFactor {
+				return reply.MakeErrReply("ERR COUNT must be > 0")
+			}
+		} else if option == "JUSTID" {
+			justID = true
+		} else {
+			return &reply.SyntaxErrReply{}
+		}
+	}
+
+	// pending entries are removed while claiming, so candidates are collected in advance
+	attempts := count * attemptsFactor
+	var candidates []*stream.PendingEntry
+	g.RangePending(start, stream.MaxID, func(pe *stream.PendingEntry) bool {
+		candidates = append(candidates, pe)
+		return int64(len(candidates)) <= attempts
+	})
+	now := nowMillis()
+	var c *stream.Consumer
+	var claimed, deleted []redis.Reply
+	i := 0
+	for ; int64(i) < attempts && count > 0 && i < len(candidates); i++ {
+		pe := candidates[i]
+		entry, exists := s.Get(pe.ID)
+		if !exists {
+			db.AddAof(makeStreamClaimCmd(key, g, pe))
+			g.Ack(pe.ID)
+			deleted = append(deleted, streamIDReply(pe.ID))
+			count--
+			continue
+		}
+		if minIdle > 0 && now-pe.DeliveryTime < minIdle {
+			continue
+		}
+		if c == nil {
+			c, _ = g.CreateConsumer(consumerName, now)
+			c.SeenTime = now
+		}
+		pe.DeliveryTime = now
+		if !justID {
+			pe.DeliveryCount++
+		}
+		g.Transfer(pe, c)
+		if justID {
+			claimed = append(claimed, streamIDReply(pe.ID))
+		} else {
+			claimed = append(claimed, streamEntryReply(entry))
+		}
+		count--
+		c.ActiveTime = now
+		db.AddAof(makeStreamClaimCmd(key, g, pe))
+	}
+	cursor := stream.ID{}
+	if i < len(candidates) {
+		cursor = candidates[i].ID
+	}
+	return reply.MakeMultiRawReply([]redis.Reply{
+		streamIDReply(cursor),
+		reply.MakeMultiRawReply(claimed),
+		reply.MakeMultiRawReply(deleted),
+	})
+}
+
+func nullableIntReply(n int64, ok bool) redis.Reply {
+	if !ok {
+		return &reply.NullBulkReply{}
+	}
+	return reply.MakeIntReply(n)
+}
+
+func bulkStringReply(str string) redis.Reply {
+	return reply.MakeBulkReply([]byte(str))
+}
+
+// execXInfo inspects stream: XINFO STREAM key [FULL [COUNT count]], XINFO GROUPS key and XINFO CONSUMERS key group
+func execXInfo(db *DB, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "stream":
+		if len(args) < 2 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'xinfo|stream' command")
+		}
+	case "groups":
+		if len(args) != 2 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'xinfo|groups' command")
+		}
+	case "consumers":
+		if len(args) != 3 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'xinfo|consumers' command")
+		}
+	default:
+		return reply.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try XINFO HELP.")
+	}
+	full := false
+	count := int64(10)
+	if subCmd == "stream" && len(args) > 2 {
+		if strings.ToUpper(string(args[2])) != "FULL" {
+			return &reply.SyntaxErrReply{}
+		}
+		full = true
+		if len(args) == 5 && strings.ToUpper(string(args[3])) == "COUNT" {
+			var err error
+			count, err = strconv.ParseInt(string(args[4]), 10, 64)
+			if err != nil {
+				return reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if count < 0 {
+				count = 0
+			}
+		} else if len(args) != 3 {
+			return &reply.SyntaxErrReply{}
+		}
+	}
+
+	key := string(args[1])
+	s, errReply := db.getAsStream(key)
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		return reply.MakeErrReply("ERR no such key")
+	}
+	now := nowMillis()
+	switch subCmd {
+	case "stream":
+		if full {
+			return streamFullInfo(s, count, now)
+		}
+		return streamInfo(s)
+	case "groups":
+		var groups []redis.Reply
+		for _, g := range s.Groups() {
+			lag, ok := s.Lag(g)
+			groups = append(groups, reply.MakeMultiRawReply([]redis.Reply{
+				bulkStringReply("name"), bulkStringReply(g.Name),
+				bulkStringReply("consumers"), reply.MakeIntReply(int64(g.ConsumerCount())),
+				bulkStringReply("pending"), reply.MakeIntReply(int64(g.PendingLen())),
+				bulkStringReply("last-delivered-id"), streamIDReply(g.LastID),
+				bulkStringReply("entries-read"), nullableIntReply(g.EntriesRead, g.EntriesRead != stream.InvalidEntriesRead),
+				bulkStringReply("lag"), nullableIntReply(lag, ok),
+			}))
+		}
+		return reply.MakeMultiRawReply(groups)
+	default:
+		groupName := string(args[2])
+		g := s.Group(groupName)
+		if g == nil {
+			return reply.MakeErrReply("NOGROUP No such consumer group '" + groupName + "' for key name '" + key + "'")
+		}
+		var consumers []redis.Reply
+		for _, c := range g.Consumers() {
+			inactive := int64(-1)
+			if c.ActiveTime != -1 {
+				inactive = now - c.ActiveTime
+			}
+			consumers = append(consumers, reply.MakeMultiRawReply([]redis.Reply{
+				bulkStringReply("name"), bulkStringReply(c.Name),
+				bulkStringReply("pending"), reply.MakeIntReply(int64(c.PendingLen())),
+				bulkStringReply("idle"), reply.MakeIntReply(now - c.SeenTime),
+				bulkStringReply("inactive"), reply.MakeIntReply(inactive),
+			}))
+		}
+		return reply.MakeMultiRawReply(consumers)
+	}
+}
+
+// streamInfoHeader returns the fields shared by XINFO STREAM and XINFO STREAM FULL.
+// Nodes are indexed by a sorted array rather than a radix tree, radix-tree-* report the number of nodes
+func streamInfoHeader(s *stream.Stream) []redis.Reply {
+	return []redis.Reply{
+		bulkStringReply("length"), reply.MakeIntReply(int64(s.Len())),
+		bulkStringReply("radix-tree-keys"), reply.MakeIntReply(int64(s.NodeCount())),
+		bulkStringReply("radix-tree-nodes"), reply.MakeIntReply(int64(s.NodeCount())),
+		bulkStringReply("last-generated-id"), streamIDReply(s.LastID),
+		bulkStringReply("max-deleted-entry-id"), streamIDReply(s.MaxDeletedID),
+		bulkStringReply("entries-added"), reply.MakeIntReply(int64(s.EntriesAdded)),
+		bulkStringReply("recorded-first-entry-id"), streamIDReply(s.FirstID()),
+	}
+}
+
+func streamInfo(s *stream.Stream) redis.Reply {
+	info := streamInfoHeader(s)
+	info = append(info, bulkStringReply("groups"), reply.MakeIntReply(int64(len(s.Groups()))))
+	var first, last redis.Reply = &reply.NullBulkReply{}, &reply.NullBulkReply{}
+	if entry, ok := s.First(); ok {
+		first = streamEntryReply(entry)
+	}
+	if entry, ok := s.Last(); ok {
+		last = streamEntryReply(entry)
+	}
+	info = append(info, bulkStringReply("first-entry"), first, bulkStringReply("last-entry"), last)
+	return reply.MakeMultiRawReply(info)
+}
+
+// streamFullInfo replies all details of stream, entries and pending entries are limited by count, 0 count means no limit
+func streamFullInfo(s *stream.Stream, count int64, now int64) redis.Reply {
+	info := streamInfoHeader(s)
+	info = append(info, bulkStringReply("entries"), streamRangeReply(s, stream.ID{}, stream.MaxID, false, count))
+	limited := func(n int) bool {
+		return count == 0 || int64(n) < count
+	}
+
+	var groups []redis.Reply
+	for _, g := range s.Groups() {
+		lag, ok := s.Lag(g)
+		var pending []redis.Reply
+		g.RangePending(stream.ID{}, stream.MaxID, func(pe *stream.PendingEntry) bool {
+			pending = append(pending, reply.MakeMultiRawReply([]redis.Reply{
+				streamIDReply(pe.ID),
+				bulkStringReply(pe.Consumer.Name),
+				reply.MakeIntReply(pe.DeliveryTime),
+				reply.MakeIntReply(pe.DeliveryCount),
+			}))
+			return limited(len(pending))
+		})
+		var consumers []redis.Reply
+		for _, c := range g.Consumers() {
+			var consumerPending []redis.Reply
+			c.RangePending(stream.ID{}, stream.MaxID, func(pe *stream.PendingEntry) bool {
+				consumerPending = append(consumerPending, reply.MakeMultiRawReply([]redis.Reply{
+					streamIDReply(pe.ID),
+					reply.MakeIntReply(pe.DeliveryTime),
+					reply.MakeIntReply(pe.DeliveryCount),
+				}))
+				return limited(len(consumerPending))
+			})
+			consumers = append(consumers, reply.MakeMultiRawReply([]redis.Reply{
+				bulkStringReply("name"), bulkStringReply(c.Name),
+				bulkStringReply("seen-time"), reply.MakeIntReply(c.SeenTime),
+				bulkStringReply("active-time"), reply.MakeIntReply(c.ActiveTime),
+				bulkStringReply("pel-count"), reply.MakeIntReply(int64(c.PendingLen())),
+				bulkStringReply("pending"), reply.MakeMultiRawReply(consumerPending),
+			}))
+		}
+		groups = append(groups, reply.MakeMultiRawReply([]redis.Reply{
+			bulkStringReply("name"), bulkStringReply(g.Name),
+			bulkStringReply("last-delivered-id"), streamIDReply(g.LastID),
+			bulkStringReply("entries-read"), nullableIntReply(g.EntriesRead, g.EntriesRead != stream.InvalidEntriesRead),
+			bulkStringReply("lag"), nullableIntReply(lag, ok),
+			bulkStringReply("pel-count"), reply.MakeIntReply(int64(g.PendingLen())),
+			bulkStringReply("pending"), reply.MakeMultiRawReply(pending),
+			bulkStringReply("consumers"), reply.MakeMultiRawReply(consumers),
+		}))
+	}
+	info = append(info, bulkStringReply("groups"), reply.MakeMultiRawReply(groups))
+	return reply.MakeMultiRawReply(info)
+}
+
+func prepareXInfo(args [][]byte) ([]string, []string) {
+	if len(args) < 2 {
+		return nil, nil
+	}
+	return nil, []string{string(args[1])}
+}
+
+func init() {
+	RegisterCommand("XGroup", execXGroup, prepareXGroup, undoXGroup, -2)
+	RegisterCommand("XReadGroup", execXReadGroup, prepareXReadGroup, undoXReadGroup, -7)
+	RegisterCommand("XAck", execXAck, writeFirstKey, rollbackFirstKey, -4)
+	RegisterCommand("XPending", execXPending, readFirstKey, nil, -3)
+	RegisterCommand("XClaim", execXClaim, writeFirstKey, rollbackFirstKey, -6)
+	RegisterCommand("XAutoClaim", execXAutoClaim, writeFirstKey, rollbackFirstKey, -6)
+	RegisterCommand("XInfo", execXInfo, prepareXInfo, nil, -2)
+}
@@ -0,0 +1,290 @@
+package core
+
+import (
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/connection"
+	"Tiny-Godis/redis/reply"
+	"Tiny-Godis/redis/reply/asserts"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// addEntries adds entries 1-1 to 1-n with field i
+func addEntries(key string, n int) {
+	for i := 1; i <= n; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("XADD", key, "1-"+strconv.Itoa(i), "i", strconv.Itoa(i)))
+	}
+}
+
+var idleFieldPattern = regexp.MustCompile(`(\$4\r\nidle\r\n:)\d+`)
+
+// maskIdle hides values of idle fields in XINFO replies
+func maskIdle(raw []byte) string {
+	return idleFieldPattern.ReplaceAllString(string(raw), "${1}*")
+}
+
+func TestXGroup(t *testing.T) {
+	testDB.Flush()
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XGROUP", "CREATE", "s", "g", "$")),
+		"ERR The XGROUP subcommand requires the key to exist. "+
+			"Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("XGROUP", "CREATE", "s", "g", "$", "MKSTREAM")), "OK")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XLEN", "s")), 0)
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XGROUP", "CREATE", "s", "g", "0")),
+		"BUSYGROUP Consumer Group name already exists")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XGROUP", "CREATE", "s", "g2", "0", "ENTRIESREAD", "-2")),
+		"ERR value for ENTRIESREAD must be positive or -1")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XGROUP", "CREATE", "s")),
+		"ERR wrong number of arguments for 'xgroup|create' command")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XGROUP", "SETID", "s", "none", "0")),
+		"NOGROUP No such consumer group 'none' for key name 's'")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XGROUP", "FOO", "s")),
+		"ERR unknown subcommand 'FOO'. Try XGROUP HELP.")
+
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XGROUP", "CREATECONSUMER", "s", "g", "c")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XGROUP", "CREATECONSUMER", "s", "g", "c")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XGROUP", "DELCONSUMER", "s", "g", "c")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XGROUP", "DELCONSUMER", "s", "g", "c")), 0)
+
+	addEntries("s", 3)
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("XGROUP", "SETID", "s", "g", "1-1", "ENTRIESREAD", "1")), "OK")
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XINFO", "GROUPS", "s")),
+		arrayRESP(arrayRESP(
+			bulkRESP("name"), bulkRESP("g"),
+			bulkRESP("consumers"), ":0\r\n",
+			bulkRESP("pending"), ":0\r\n",
+			bulkRESP("last-delivered-id"), bulkRESP("1-1"),
+			bulkRESP("entries-read"), ":1\r\n",
+			bulkRESP("lag"), ":2\r\n",
+		)))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XGROUP", "DESTROY", "s", "g")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XGROUP", "DESTROY", "s", "g")), 0)
+}
+
+func TestXReadGroup(t *testing.T) {
+	testDB.Flush()
+	addEntries("s", 4)
+	testDB.Exec(nil, utils.ToCmdLine("XGROUP", "CREATE", "s", "g", "0"))
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XREADGROUP", "GROUP", "g", "alice", "COUNT", "2", "STREAMS", "s", ">")),
+		arrayRESP(arrayRESP(bulkRESP("s"), arrayRESP(entryRESP("1-1", "i", "1"), entryRESP("1-2", "i", "2")))))
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XREADGROUP", "GROUP", "g", "bob", "COUNT", "1", "STREAMS", "s", ">")),
+		arrayRESP(arrayRESP(bulkRESP("s"), arrayRESP(entryRESP("1-3", "i", "3")))))
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XREADGROUP", "GROUP", "g", "bob", "NOACK", "STREAMS", "s", ">")),
+		arrayRESP(arrayRESP(bulkRESP("s"), arrayRESP(entryRESP("1-4", "i", "4")))))
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XREADGROUP", "GROUP", "g", "bob", "STREAMS", "s", ">")), "*-1\r\n")
+
+	// history of consumer
+	testDB.Exec(nil, utils.ToCmdLine("XDEL", "s", "1-2"))
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s", "0")),
+		arrayRESP(arrayRESP(bulkRESP("s"), arrayRESP(entryRESP("1-1", "i", "1"), arrayRESP(bulkRESP("1-2"), "*-1\r\n")))))
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XREADGROUP", "GROUP", "g", "carol", "STREAMS", "s", "0")),
+		arrayRESP(arrayRESP(bulkRESP("s"), "*0\r\n")))
+
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XPENDING", "s", "g")),
+		arrayRESP(":3\r\n", bulkRESP("1-1"), bulkRESP("1-3"), arrayRESP(
+			arrayRESP(bulkRESP("alice"), bulkRESP("2")),
+			arrayRESP(bulkRESP("bob"), bulkRESP("1")),
+		)))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XACK", "s", "g", "1-1", "1-2", "1-4")), 2)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XACK", "s", "none", "1-3")), 0)
+	assertArrayLen(t, testDB.Exec(nil, utils.ToCmdLine("XPENDING", "s", "g", "-", "+", "10")), 1)
+	assertArrayLen(t, testDB.Exec(nil, utils.ToCmdLine("XPENDING", "s", "g", "-", "+", "10", "alice")), 0)
+	assertArrayLen(t, testDB.Exec(nil, utils.ToCmdLine("XPENDING", "s", "g", "IDLE", "100000", "-", "+", "10")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XGROUP", "DELCONSUMER", "s", "g", "bob")), 1)
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XPENDING", "s", "g")),
+		arrayRESP(":0\r\n", "$-1\r\n", "$-1\r\n", "*-1\r\n"))
+
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XREADGROUP", "GROUP", "none", "c", "STREAMS", "s", ">")),
+		"NOGROUP No such key 's' or consumer group 'none' in XREADGROUP with GROUP option")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XPENDING", "s", "none")),
+		"NOGROUP No such key 's' or consumer group 'none'")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XREADGROUP", "GROUP", "g", "c", "STREAMS", "s", "t", ">")),
+		"ERR Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '>' must be specified.")
+}
+
+func TestXClaim(t *testing.T) {
+	testDB.Flush()
+	addEntries("s", 5)
+	testDB.Exec(nil, utils.ToCmdLine("XGROUP", "CREATE", "s", "g", "0"))
+	testDB.Exec(nil, utils.ToCmdLine("XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s", ">"))
+
+	assertArrayLen(t, testDB.Exec(nil, utils.ToCmdLine("XCLAIM", "s", "g", "bob", "100000", "1-1")), 0)
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XCLAIM", "s", "g", "bob", "0", "1-1", "1-2")),
+		arrayRESP(entryRESP("1-1", "i", "1"), entryRESP("1-2", "i", "2")))
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XCLAIM", "s", "g", "bob", "0", "1-3", "RETRYCOUNT", "7", "JUSTID")),
+		arrayRESP(bulkRESP("1-3")))
+	result := testDB.Exec(nil, utils.ToCmdLine("XPENDING", "s", "g", "1-1", "1-3", "3", "bob"))
+	pending, _ := result.(*reply.MultiRawReply)
+	if pending == nil || len(pending.Replies) != 3 {
+		t.Fatalf("expect 3 entries pending for bob, actual %q", result.ToBytes())
+	}
+	for i, count := range []int{2, 2, 7} {
+		item := pending.Replies[i].(*reply.MultiRawReply)
+		asserts.AssertIntReply(t, item.Replies[3], count)
+	}
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XCLAIM", "s", "g", "bob", "x", "1-1")),
+		"ERR Invalid min-idle-time argument for XCLAIM")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XCLAIM", "s", "g", "bob", "0", "1-1", "FOO")),
+		"ERR Unrecognized XCLAIM option 'FOO'")
+
+	// deleted entries are removed from pending entries
+	testDB.Exec(nil, utils.ToCmdLine("XDEL", "s", "1-4"))
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XAUTOCLAIM", "s", "g", "carol", "0", "0", "COUNT", "1")),
+		arrayRESP(bulkRESP("1-2"), arrayRESP(entryRESP("1-1", "i", "1")), "*0\r\n"))
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XAUTOCLAIM", "s", "g", "carol", "0", "(1-2", "JUSTID")),
+		arrayRESP(bulkRESP("0-0"), arrayRESP(bulkRESP("1-3"), bulkRESP("1-5")), arrayRESP(bulkRESP("1-4"))))
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XAUTOCLAIM", "s", "g", "carol", "0", "0", "COUNT", "0")),
+		"ERR COUNT must be > 0")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XACK", "s", "g", "1-4")), 0)
+
+	// FORCE creates pending entry not delivered
+	testDB.Exec(nil, utils.ToCmdLine("XACK", "s", "g", "1-1"))
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XCLAIM", "s", "g", "dave", "0", "1-1", "FORCE", "JUSTID", "LASTID", "1-9")),
+		arrayRESP(bulkRESP("1-1")))
+	assertArrayLen(t, testDB.Exec(nil, utils.ToCmdLine("XINFO", "CONSUMERS", "s", "g")), 4)
+	result = testDB.Exec(nil, utils.ToCmdLine("XPENDING", "s", "g", "-", "+", "10", "dave"))
+	item := result.(*reply.MultiRawReply).Replies[0].(*reply.MultiRawReply)
+	asserts.AssertBulkReply(t, item.Replies[0], "1-1")
+	asserts.AssertIntReply(t, item.Replies[3], 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("XINFO", "GROUPS", "s"))
+	group := result.(*reply.MultiRawReply).Replies[0].(*reply.MultiRawReply)
+	asserts.AssertBulkReply(t, group.Replies[7], "1-9")
+}
+
+func TestXInfo(t *testing.T) {
+	testDB.Flush()
+	addEntries("s", 3)
+	testDB.Exec(nil, utils.ToCmdLine("XGROUP", "CREATE", "s", "g", "0"))
+	testDB.Exec(nil, utils.ToCmdLine("XREADGROUP", "GROUP", "g", "alice", "COUNT", "1", "STREAMS", "s", ">"))
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XINFO", "STREAM", "s")),
+		arrayRESP(
+			bulkRESP("length"), ":3\r\n",
+			bulkRESP("radix-tree-keys"), ":1\r\n",
+			bulkRESP("radix-tree-nodes"), ":1\r\n",
+			bulkRESP("last-generated-id"), bulkRESP("1-3"),
+			bulkRESP("max-deleted-entry-id"), bulkRESP("0-0"),
+			bulkRESP("entries-added"), ":3\r\n",
+			bulkRESP("recorded-first-entry-id"), bulkRESP("1-1"),
+			bulkRESP("groups"), ":1\r\n",
+			bulkRESP("first-entry"), entryRESP("1-1", "i", "1"),
+			bulkRESP("last-entry"), entryRESP("1-3", "i", "3"),
+		))
+	result := testDB.Exec(nil, utils.ToCmdLine("XINFO", "STREAM", "s", "FULL", "COUNT", "2"))
+	full := result.(*reply.MultiRawReply)
+	asserts.AssertBulkReply(t, full.Replies[14], "entries")
+	assertArrayLen(t, full.Replies[15], 2)
+	groups := full.Replies[17].(*reply.MultiRawReply)
+	group := groups.Replies[0].(*reply.MultiRawReply)
+	asserts.AssertBulkReply(t, group.Replies[1], "g")
+	asserts.AssertIntReply(t, group.Replies[7], 2)
+	assertArrayLen(t, group.Replies[11], 1)
+	assertArrayLen(t, group.Replies[13], 1)
+
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XINFO", "STREAM", "none")), "ERR no such key")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XINFO", "CONSUMERS", "s", "none")),
+		"NOGROUP No such consumer group 'none' for key name 's'")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XINFO", "STREAM", "s", "FOO")), "Err syntax error")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XINFO", "FOO", "s")),
+		"ERR unknown subcommand 'FOO'. Try XINFO HELP.")
+}
+
+func TestBlockingXReadGroup(t *testing.T) {
+	db := makeTestDB()
+	conn := connection.MakeConn(nil)
+	key := utils.RandString(10)
+	db.Exec(nil, utils.ToCmdLine("XGROUP", "CREATE", key, "g", "$", "MKSTREAM"))
+	ch := execAsync(t, db, conn, utils.ToCmdLine("XREADGROUP", "GROUP", "g", "c", "BLOCK", "0", "STREAMS", key, ">"))
+	db.Exec(nil, utils.ToCmdLine("XADD", key, "1-1", "a", "1"))
+	assertRawReply(t, waitReply(t, ch), arrayRESP(arrayRESP(bulkRESP(key), arrayRESP(entryRESP("1-1", "a", "1")))))
+	assertRawReply(t, db.Exec(nil, utils.ToCmdLine("XPENDING", key, "g")),
+		arrayRESP(":1\r\n", bulkRESP("1-1"), bulkRESP("1-1"), arrayRESP(arrayRESP(bulkRESP("c"), bulkRESP("1")))))
+
+	// blocked consumer gets error when group is destroyed
+	ch = execAsync(t, db, conn, utils.ToCmdLine("XREADGROUP", "GROUP", "g", "c", "BLOCK", "0", "STREAMS", key, ">"))
+	db.Exec(nil, utils.ToCmdLine("XGROUP", "DESTROY", key, "g"))
+	asserts.AssertErrReply(t, waitReply(t, ch),
+		"NOGROUP No such key '"+key+"' or consumer group 'g' in XREADGROUP with GROUP option")
+}
+
+func TestStreamGroupRewrite(t *testing.T) {
+	testDB.Flush()
+	addEntries("s", 5)
+	testDB.Exec(nil, utils.ToCmdLine("XGROUP", "CREATE", "s", "g1", "0"))
+	testDB.Exec(nil, utils.ToCmdLine("XGROUP", "CREATE", "s", "g2", "1-3"))
+	testDB.Exec(nil, utils.ToCmdLine("XREADGROUP", "GROUP", "g1", "alice", "COUNT", "2", "STREAMS", "s", ">"))
+	testDB.Exec(nil, utils.ToCmdLine("XREADGROUP", "GROUP", "g1", "bob", "COUNT", "1", "STREAMS", "s", ">"))
+	testDB.Exec(nil, utils.ToCmdLine("XCLAIM", "s", "g1", "bob", "0", "1-1", "RETRYCOUNT", "5"))
+	testDB.Exec(nil, utils.ToCmdLine("XGROUP", "CREATECONSUMER", "s", "g2", "idle"))
+	testDB.Exec(nil, utils.ToCmdLine("XDEL", "s", "1-5"))
+
+	entity, _ := testDB.GetEntity("s")
+	for _, cmd := range EntityToCmds("rewritten", entity) {
+		asserts.AssertNotError(t, testDB.Exec(nil, cmd.Args))
+	}
+	payload := dump(t, testDB, "s")
+	asserts.AssertStatusReply(t, testDB.Exec(nil, [][]byte{[]byte("RESTORE"), []byte("restored"), []byte("0"), payload}), "OK")
+
+	withKey := func(cmd []string, key string) CmdLine {
+		args := make([]string, len(cmd))
+		for i, arg := range cmd {
+			if arg == "%s" {
+				arg = key
+			}
+			args[i] = arg
+		}
+		return utils.ToCmdLine(args...)
+	}
+	for _, cmd := range [][]string{
+		{"XRANGE", "%s", "-", "+"},
+		{"XPENDING", "%s", "g1"},
+		{"XPENDING", "%s", "g2"},
+	} {
+		expected := testDB.Exec(nil, withKey(cmd, "s")).ToBytes()
+		for _, key := range []string{"rewritten", "restored"} {
+			assertRawReply(t, testDB.Exec(nil, withKey(cmd, key)), string(expected))
+		}
+	}
+	// metadata of stream and groups is not saved in rdb version 9, so only rewriting keeps them
+	for _, cmd := range [][]string{
+		{"XINFO", "GROUPS", "%s"},
+		{"XINFO", "CONSUMERS", "%s", "g2"},
+	} {
+		// idle time of consumers depends on when they are rewritten
+		expected := maskIdle(testDB.Exec(nil, withKey(cmd, "s")).ToBytes())
+		actual := maskIdle(testDB.Exec(nil, withKey(cmd, "rewritten")).ToBytes())
+		if actual != expected {
+			t.Errorf("expected %q, actually %q", expected, actual)
+		}
+	}
+	result := testDB.Exec(nil, utils.ToCmdLine("XPENDING", "rewritten", "g1", "1-1", "1-1", "1"))
+	item := result.(*reply.MultiRawReply).Replies[0].(*reply.MultiRawReply)
+	asserts.AssertBulkReply(t, item.Replies[1], "bob")
+	asserts.AssertIntReply(t, item.Replies[3], 5)
+}
+
+func TestUndoXReadGroup(t *testing.T) {
+	testDB.Flush()
+	addEntries("s", 3)
+	testDB.Exec(nil, utils.ToCmdLine("XGROUP", "CREATE", "s", "g", "0"))
+	for _, cmdLine := range []CmdLine{
+		utils.ToCmdLine("XREADGROUP", "GROUP", "g", "c", "COUNT", "2", "STREAMS", "s", ">"),
+		utils.ToCmdLine("XACK", "s", "g", "1-1"),
+		utils.ToCmdLine("XCLAIM", "s", "g", "d", "0", "1-2", "RETRYCOUNT", "9"),
+		utils.ToCmdLine("XGROUP", "DESTROY", "s", "g"),
+	} {
+		before := testDB.Exec(nil, utils.ToCmdLine("XINFO", "GROUPS", "s")).ToBytes()
+		beforePending := testDB.Exec(nil, utils.ToCmdLine("XPENDING", "s", "g")).ToBytes()
+		undoCmdLines := testDB.GetUndoLog(cmdLine)
+		asserts.AssertNotError(t, testDB.Exec(nil, cmdLine))
+		for _, undo := range undoCmdLines {
+			testDB.Exec(nil, undo)
+		}
+		after := testDB.Exec(nil, utils.ToCmdLine("XINFO", "GROUPS", "s")).ToBytes()
+		afterPending := testDB.Exec(nil, utils.ToCmdLine("XPENDING", "s", "g")).ToBytes()
+		if string(before) != string(after) || string(beforePending) != string(afterPending) {
+			t.Errorf("%s: expect %q %q after undo, actual %q %q", cmdLine, before, beforePending, after, afterPending)
+		}
+		testDB.Exec(nil, cmdLine)
+	}
+}
@@ -0,0 +1,247 @@
+package core
+
+import (
+	"Tiny-Godis/interface/redis"
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/connection"
+	"Tiny-Godis/redis/reply"
+	"Tiny-Godis/redis/reply/asserts"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func bulkRESP(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func arrayRESP(items ...string) string {
+	s := "*" + strconv.Itoa(len(items)) + "\r\n"
+	for _, item := range items {
+		s += item
+	}
+	return s
+}
+
+func assertArrayLen(t *testing.T, actual redis.Reply, expected int) {
+	t.Helper()
+	if !strings.HasPrefix(string(actual.ToBytes()), "*"+strconv.Itoa(expected)+"\r\n") {
+		t.Errorf("expected array of %d elements, actually %q", expected, actual.ToBytes())
+	}
+}
+
+// entryRESP returns the reply of a stream entry
+func entryRESP(id string, fields ...string) string {
+	bulks := make([]string, len(fields))
+	for i, field := range fields {
+		bulks[i] = bulkRESP(field)
+	}
+	return arrayRESP(bulkRESP(id), arrayRESP(bulks...))
+}
+
+func TestXAdd(t *testing.T) {
+	testDB.Flush()
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("XADD", "s", "1-1", "a", "1")), "1-1")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("XADD", "s", "1-*", "b", "2")), "1-2")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("XADD", "s", "2", "c", "3")), "2-0")
+	result := testDB.Exec(nil, utils.ToCmdLine("XADD", "s", "*", "d", "4"))
+	if bulk, ok := result.(*reply.BulkReply); !ok || string(bulk.Arg) == "2-0" {
+		t.Errorf("unexpected id %q", result.ToBytes())
+	}
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XLEN", "s")), 4)
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("TYPE", "s")), "stream")
+
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XADD", "s", "1-5", "a", "1")),
+		"ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XADD", "t", "0-0", "a", "1")),
+		"ERR The ID specified in XADD must be greater than 0-0")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XADD", "t", "1-x", "a", "1")),
+		"ERR Invalid stream ID specified as stream command argument")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XADD", "t", "*", "a", "1", "b")),
+		"ERR wrong number of arguments for 'xadd' command")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XADD", "t", "MAXLEN", "-1", "*", "a", "1")),
+		"ERR The MAXLEN argument must be >= 0.")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XADD", "t", "MAXLEN", "1", "LIMIT", "10", "*", "a", "1")),
+		"ERR syntax error, LIMIT cannot be used without the special ~ option")
+	asserts.AssertNullBulk(t, testDB.Exec(nil, utils.ToCmdLine("XADD", "t", "NOMKSTREAM", "*", "a", "1")))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXISTS", "t")), 0)
+
+	testDB.Exec(nil, utils.ToCmdLine("SET", "str", "a"))
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XADD", "str", "*", "a", "1")),
+		"WRONGTYPE Operation against a key holding the wrong kind of value")
+
+	// trimming
+	for i := 1; i <= 10; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("XADD", "trim", strconv.Itoa(i), "i", strconv.Itoa(i)))
+	}
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("XADD", "trim", "MAXLEN", "=", "5", "11", "i", "11")), "11-0")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XLEN", "trim")), 5)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("XADD", "trim", "MINID", "9", "12", "i", "12")), "12-0")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XLEN", "trim")), 4)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XTRIM", "trim", "MAXLEN", "2")), 2)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XTRIM", "trim", "MINID", "12")), 1)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XTRIM", "trim", "MAXLEN", "~", "1")), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XTRIM", "none", "MAXLEN", "0")), 0)
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XTRIM", "trim", "LIMIT", "1")),
+		"ERR syntax error, LIMIT cannot be used without specifying a trimming strategy")
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XRANGE", "trim", "-", "+")),
+		arrayRESP(entryRESP("12-0", "i", "12")))
+}
+
+func TestXRange(t *testing.T) {
+	testDB.Flush()
+	for i := 1; i <= 5; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("XADD", "s", "1-"+strconv.Itoa(i), "i", strconv.Itoa(i)))
+	}
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XRANGE", "s", "1-2", "1-3")),
+		arrayRESP(entryRESP("1-2", "i", "2"), entryRESP("1-3", "i", "3")))
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XRANGE", "s", "(1-2", "+", "COUNT", "2")),
+		arrayRESP(entryRESP("1-3", "i", "3"), entryRESP("1-4", "i", "4")))
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XREVRANGE", "s", "+", "(1-3")),
+		arrayRESP(entryRESP("1-5", "i", "5"), entryRESP("1-4", "i", "4")))
+	assertArrayLen(t, testDB.Exec(nil, utils.ToCmdLine("XRANGE", "s", "-", "+")), 5)
+	assertArrayLen(t, testDB.Exec(nil, utils.ToCmdLine("XRANGE", "s", "2", "+")), 0)
+	assertArrayLen(t, testDB.Exec(nil, utils.ToCmdLine("XRANGE", "none", "-", "+")), 0)
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XRANGE", "s", "(18446744073709551615-18446744073709551615", "+")),
+		"ERR invalid start ID for the interval")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XRANGE", "s", "-", "+", "COUNT")),
+		"Err syntax error")
+
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XDEL", "s", "1-2", "1-4", "1-9")), 2)
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XRANGE", "s", "-", "+")),
+		arrayRESP(entryRESP("1-1", "i", "1"), entryRESP("1-3", "i", "3"), entryRESP("1-5", "i", "5")))
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XDEL", "s", "1-1", "bad")),
+		"ERR Invalid stream ID specified as stream command argument")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XLEN", "s")), 3)
+}
+
+func TestXSetID(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("XADD", "s", "5-0", "a", "1"))
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XSETID", "s", "4-0")),
+		"ERR The ID specified in XSETID is smaller than the target stream top item")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XSETID", "none", "4-0")), "ERR no such key")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XSETID", "s", "9-0", "ENTRIESADDED", "0", "MAXDELETEDID", "1-0")),
+		"ERR The entries_added specified in XSETID is smaller than the target stream length")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XSETID", "s", "9-0", "ENTRIESADDED", "5", "MAXDELETEDID", "10-0")),
+		"ERR The ID specified in XSETID is smaller than the provided max_deleted_entry_id")
+	asserts.AssertStatusReply(t, testDB.Exec(nil, utils.ToCmdLine("XSETID", "s", "9-0", "ENTRIESADDED", "5", "MAXDELETEDID", "8-0")), "OK")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XADD", "s", "9-0", "a", "1")),
+		"ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("XADD", "s", "9-*", "a", "1")), "9-1")
+}
+
+func TestXRead(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("XADD", "s1", "1-1", "a", "1"))
+	testDB.Exec(nil, utils.ToCmdLine("XADD", "s1", "1-2", "b", "2"))
+	testDB.Exec(nil, utils.ToCmdLine("XADD", "s2", "2-1", "c", "3"))
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XREAD", "COUNT", "1", "STREAMS", "s1", "s2", "0", "2-1")),
+		arrayRESP(arrayRESP(bulkRESP("s1"), arrayRESP(entryRESP("1-1", "a", "1")))))
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XREAD", "STREAMS", "s1", "s2", "1-1", "0")),
+		arrayRESP(
+			arrayRESP(bulkRESP("s1"), arrayRESP(entryRESP("1-2", "b", "2"))),
+			arrayRESP(bulkRESP("s2"), arrayRESP(entryRESP("2-1", "c", "3"))),
+		))
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XREAD", "STREAMS", "s1", "none", "$", "0")), "*-1\r\n")
+	// without connection BLOCK doesn't block
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XREAD", "BLOCK", "0", "STREAMS", "s1", "$")), "*-1\r\n")
+
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XREAD", "STREAMS", "s1", "s2", "0")),
+		"ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XREAD", "STREAMS", "s1", ">")),
+		"ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XREAD", "BLOCK", "-1", "STREAMS", "s1", "0")),
+		"ERR timeout is negative")
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XREAD", "NOACK", "STREAMS", "s1", "0")),
+		"ERR The NOACK option is only supported by XREADGROUP. You called XREAD instead.")
+}
+
+func TestBlockingXRead(t *testing.T) {
+	db := makeTestDB()
+	conn := connection.MakeConn(nil)
+	key := utils.RandString(10)
+	db.Exec(nil, utils.ToCmdLine("XADD", key, "1-1", "a", "1"))
+
+	// entries added before blocking are not read since $ is resolved at first
+	ch := execAsync(t, db, conn, utils.ToCmdLine("XREAD", "BLOCK", "0", "STREAMS", key, "$"))
+	db.Exec(nil, utils.ToCmdLine("XADD", key, "2-1", "b", "2"))
+	assertRawReply(t, waitReply(t, ch), arrayRESP(arrayRESP(bulkRESP(key), arrayRESP(entryRESP("2-1", "b", "2")))))
+
+	// stream created after blocking
+	other := utils.RandString(10)
+	ch = execAsync(t, db, conn, utils.ToCmdLine("XREAD", "BLOCK", "0", "STREAMS", other, "$"))
+	db.Exec(nil, utils.ToCmdLine("XADD", other, "1-1", "c", "3"))
+	assertRawReply(t, waitReply(t, ch), arrayRESP(arrayRESP(bulkRESP(other), arrayRESP(entryRESP("1-1", "c", "3")))))
+
+	result := db.Exec(conn, utils.ToCmdLine("XREAD", "BLOCK", "10", "STREAMS", key, "$"))
+	assertRawReply(t, result, "*-1\r\n")
+	result = db.Exec(conn, utils.ToCmdLine("XREAD", "BLOCK", "10", "STREAMS", key, "0"))
+	assertArrayLen(t, result, 1)
+}
+
+func TestStreamDumpAndRewrite(t *testing.T) {
+	testDB.Flush()
+	for i := 1; i <= 250; i++ {
+		fields := []string{"i", strconv.Itoa(i), "name", "entry-" + strconv.Itoa(i)}
+		if i%7 == 0 {
+			fields = append(fields, "extra", "-12345678901")
+		}
+		testDB.Exec(nil, utils.ToCmdLine("XADD", "s", "100-"+strconv.Itoa(i), fields[0], fields[1], fields[2], fields[3], fields[len(fields)-2], fields[len(fields)-1]))
+	}
+	testDB.Exec(nil, utils.ToCmdLine("XDEL", "s", "100-3", "100-150"))
+	testDB.Exec(nil, utils.ToCmdLine("XADD", "empty", "MAXLEN", "0", "5-5", "a", "1"))
+	expected := testDB.Exec(nil, utils.ToCmdLine("XRANGE", "s", "-", "+")).ToBytes()
+
+	payload := dump(t, testDB, "s")
+	asserts.AssertStatusReply(t, testDB.Exec(nil, [][]byte{[]byte("RESTORE"), []byte("restored"), []byte("0"), payload}), "OK")
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XRANGE", "restored", "-", "+")), string(expected))
+	asserts.AssertErrReply(t, testDB.Exec(nil, utils.ToCmdLine("XADD", "restored", "100-250", "a", "1")),
+		"ERR The ID specified in XADD is equal or smaller than the target stream top item")
+
+	payload = dump(t, testDB, "empty")
+	asserts.AssertStatusReply(t, testDB.Exec(nil, [][]byte{[]byte("RESTORE"), []byte("restored-empty"), []byte("0"), payload}), "OK")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XLEN", "restored-empty")), 0)
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("XADD", "restored-empty", "5-*", "a", "1")), "5-6")
+
+	for _, key := range []string{"s", "empty"} {
+		entity, _ := testDB.GetEntity(key)
+		for _, cmd := range EntityToCmds("rewritten-"+key, entity) {
+			asserts.AssertNotError(t, testDB.Exec(nil, cmd.Args))
+		}
+	}
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XRANGE", "rewritten-s", "-", "+")), string(expected))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XLEN", "rewritten-empty")), 0)
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XINFO", "STREAM", "rewritten-empty")),
+		string(testDB.Exec(nil, utils.ToCmdLine("XINFO", "STREAM", "empty")).ToBytes()))
+
+	testDB.Exec(nil, utils.ToCmdLine("COPY", "s", "copy"))
+	testDB.Exec(nil, utils.ToCmdLine("XTRIM", "s", "MAXLEN", "0"))
+	assertRawReply(t, testDB.Exec(nil, utils.ToCmdLine("XRANGE", "copy", "-", "+")), string(expected))
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("OBJECT", "ENCODING", "copy")), "stream")
+}
+
+func TestUndoXAdd(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("XADD", "s", "1-1", "a", "1"))
+	testDB.Exec(nil, utils.ToCmdLine("XADD", "s", "1-2", "b", "2"))
+	testDB.Exec(nil, utils.ToCmdLine("XDEL", "s", "1-2"))
+	for _, cmdLine := range []CmdLine{
+		utils.ToCmdLine("XADD", "s", "MAXLEN", "0", "2-1", "c", "3"),
+		utils.ToCmdLine("XDEL", "s", "1-1"),
+		utils.ToCmdLine("XTRIM", "s", "MAXLEN", "0"),
+		utils.ToCmdLine("XADD", "new", "1-1", "a", "1"),
+	} {
+		before := testDB.Exec(nil, utils.ToCmdLine("XINFO", "STREAM", "s")).ToBytes()
+		undoCmdLines := testDB.GetUndoLog(cmdLine)
+		testDB.Exec(nil, cmdLine)
+		for _, undo := range undoCmdLines {
+			testDB.Exec(nil, undo)
+		}
+		after := testDB.Exec(nil, utils.ToCmdLine("XINFO", "STREAM", "s")).ToBytes()
+		if string(before) != string(after) {
+			t.Errorf("%s: expect %q after undo, actual %q", cmdLine, before, after)
+		}
+	}
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXISTS", "new")), 0)
+}
@@ -3,17 +3,93 @@ package core
 import (
 	"Tiny-Godis/interface/redis"
 	"Tiny-Godis/redis/reply"
+	"math"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// sharedIntegerSize is the number of shared small integers, the same as OBJ_SHARED_INTEGERS of redis
+const sharedIntegerSize = 10000
+
+// sharedIntegers holds boxed small integers, entities of small integers refer to them instead of allocating
+var sharedIntegers = func() []interface{} {
+	integers := make([]interface{}, sharedIntegerSize)
+	for i := range integers {
+		integers[i] = int64(i)
+	}
+	return integers
+}()
+
+// maxIntEncodingLen is the length of the longest int64 in decimal
+const maxIntEncodingLen = 20
+
+// embstrSizeLimit is the max length of embstr encoding, the same as OBJ_ENCODING_EMBSTR_SIZE_LIMIT of redis
+const embstrSizeLimit = 44
+
+// makeIntEntity makes an int encoded string entity
+func makeIntEntity(n int64) *DataEntity {
+	if n >= 0 && n < sharedIntegerSize {
+		return &DataEntity{Data: sharedIntegers[n]}
+	}
+	return &DataEntity{Data: n}
+}
+
+// parseCanonicalInt parses val only if it is the canonical form of an int64,
+// values like "007", "+1" or " 1" are rejected as redis does
+func parseCanonicalInt(val []byte) (int64, bool) {
+	n, err := strconv.ParseInt(string(val), 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != string(val) {
+		return 0, false
+	}
+	return n, true
+}
+
+// makeStringEntity makes a string entity, value which is the canonical form of an int64 is stored as int64
+func makeStringEntity(val []byte) *DataEntity {
+	if len(val) > 0 && len(val) <= maxIntEncodingLen {
+		if n, ok := parseCanonicalInt(val); ok {
+			return makeIntEntity(n)
+		}
+	}
+	return &DataEntity{Data: val}
+}
+
+// makeRawStringEntity makes a string entity which is never int or embstr encoded, like a hyperloglog
+func makeRawStringEntity(val []byte) *DataEntity {
+	return &DataEntity{Data: val, raw: true}
+}
+
+// stringValue returns value of a string entity in bytes, int encoded value will be formatted
+func stringValue(data interface{}) ([]byte, bool) {
+	switch val := data.(type) {
+	case []byte:
+		return val, true
+	case int64:
+		return strconv.AppendInt(nil, val, 10), true
+	}
+	return nil, false
+}
+
+// stringEncoding returns encoding of a string entity which is reported by OBJECT ENCODING
+func stringEncoding(entity *DataEntity) string {
+	switch val := entity.Data.(type) {
+	case int64:
+		return "int"
+	case []byte:
+		if len(val) <= embstrSizeLimit && !entity.raw {
+			return "embstr"
+		}
+	}
+	return "raw"
+}
+
 func (db *DB) getAsString(key string) ([]byte, reply.ErrorReply) {
 	entity, ok := db.GetEntity(key)
 	if !ok {
 		return nil, nil
 	}
-	value, ok := entity.Data.([]byte)
+	value, ok := stringValue(entity.Data)
 	if !ok {
 		return nil, &reply.WrongTypeErrReply{}
 	}
@@ -40,84 +116,112 @@ const (
 	updatePolicy
 )
 
+// parseExpireOption parses the argument of EX/PX/EXAT/PXAT into absolute expire time
+func parseExpireOption(option string, arg []byte) (time.Time, reply.ErrorReply) {
+	raw, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return time.Time{}, reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if raw <= 0 {
+		return time.Time{}, reply.MakeErrReply("Err Invalid expire time to set")
+	}
+	switch option {
+	case "EX":
+		return time.Now().Add(time.Duration(raw) * time.Second), nil
+	case "PX":
+		return time.Now().Add(time.Duration(raw) * time.Millisecond), nil
+	case "EXAT":
+		return time.Unix(raw, 0), nil
+	default:
+		return time.Unix(0, raw*int64(time.Millisecond)), nil
+	}
+}
+
+// execSet sets string value, supported options: NX, XX, EX, PX, EXAT, PXAT, KEEPTTL and GET
 func execSet(db *DB, args [][]byte) redis.Reply {
-	key := args[0]
+	key := string(args[0])
 	val := args[1]
 	policy := upsertPolicy
-	ttl := unlimitedTTL
-
-	if len(args) > 2 {
-		for i := 2; i < len(args); i++ {
-			switch strings.ToUpper(string(args[i])) {
-			case "NX":
-				if policy == updatePolicy {
-					return &reply.SyntaxErrReply{}
-				}
-				policy = insertPolicy
-			case "XX":
-				if policy == insertPolicy {
-					return &reply.SyntaxErrReply{}
-				}
-				policy = updatePolicy
-			case "EX":
-				if ttl != unlimitedTTL || i+1 > len(args) {
-					return &reply.SyntaxErrReply{}
-				}
-				temp := args[i+1]
-				expireTime, err := strconv.ParseInt(string(temp), 10, 64)
-				if err != nil {
-					return &reply.SyntaxErrReply{}
-				}
-				if expireTime < 0 {
-					return reply.MakeErrReply("Err Invalid expire time to set")
-				}
-				ttl = expireTime * 1000
-				i++
-			case "PX":
-				if ttl != unlimitedTTL || i+1 > len(args) {
-					return &reply.SyntaxErrReply{}
-				}
-				temp := args[i+1]
-				expireTime, err := strconv.ParseInt(string(temp), 10, 64)
-				if err != nil {
-					return &reply.SyntaxErrReply{}
-				}
-				if expireTime < 0 {
-					return reply.MakeErrReply("Err Invalid expire time to set")
-				}
-				ttl = expireTime
-				i++
-			default:
+	var expireAt time.Time
+	keepTTL := false
+	returnOld := false
+
+	for i := 2; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i]))
+		switch option {
+		case "NX":
+			if policy == updatePolicy {
 				return &reply.SyntaxErrReply{}
 			}
+			policy = insertPolicy
+		case "XX":
+			if policy == insertPolicy {
+				return &reply.SyntaxErrReply{}
+			}
+			policy = updatePolicy
+		case "EX", "PX", "EXAT", "PXAT":
+			if !expireAt.IsZero() || keepTTL || i+1 >= len(args) {
+				return &reply.SyntaxErrReply{}
+			}
+			var errReply reply.ErrorReply
+			expireAt, errReply = parseExpireOption(option, args[i+1])
+			if errReply != nil {
+				return errReply
+			}
+			i++
+		case "KEEPTTL":
+			if !expireAt.IsZero() {
+				return &reply.SyntaxErrReply{}
+			}
+			keepTTL = true
+		case "GET":
+			returnOld = true
+		default:
+			return &reply.SyntaxErrReply{}
 		}
 	}
 
-	entity := DataEntity{Data: val}
+	var old []byte
+	if returnOld {
+		var errReply reply.ErrorReply
+		old, errReply = db.getAsString(key)
+		if errReply != nil {
+			return errReply
+		}
+	}
+
+	entity := makeStringEntity(val)
 	var result int
-	db.Persist(string(key))
 	switch policy {
 	case upsertPolicy:
-		result = db.PutEntity(string(key), &entity)
+		db.PutEntity(key, entity)
+		result = 1
 	case insertPolicy:
-		result = db.PutIfAbsent(string(key), &entity)
+		result = db.PutIfAbsent(key, entity)
 	case updatePolicy:
-		result = db.PutIfExists(string(key), &entity)
+		result = db.PutIfExists(key, entity)
 	}
 
-	if ttl != unlimitedTTL {
-		expireTime := time.Now().Add(time.Duration(ttl) * time.Millisecond)
-		db.Expire(string(key), expireTime)
-		db.AddAof(makeAofCmd("SET", args))
-		db.AddAof(makeExpireAofCmd(string(key), expireTime))
-	} else if result > 0 {
-		db.Persist(string(key))
-		db.AddAof(makeAofCmd("SET", args))
-	} else {
-		db.AddAof(makeAofCmd("SET", args))
+	if result > 0 {
+		aofArgs := [][]byte{args[0], val}
+		if keepTTL {
+			aofArgs = append(aofArgs, []byte("KEEPTTL"))
+		} else {
+			db.Persist(key)
+		}
+		db.AddAof(makeAofCmd("SET", aofArgs))
+		if !expireAt.IsZero() {
+			db.setExpire(key, expireAt)
+		}
 	}
 
-	if policy == upsertPolicy || result > 0 {
+	if returnOld {
+		if old == nil {
+			return &reply.NullBulkReply{}
+		}
+		return reply.MakeBulkReply(old)
+	}
+	if result > 0 {
 		return &reply.OkReply{}
 	}
 	return &reply.NullBulkReply{}
@@ -126,36 +230,393 @@ func execSet(db *DB, args [][]byte) redis.Reply {
 func execSetNx(db *DB, args [][]byte) redis.Reply {
 	key := args[0]
 	val := args[1]
-	entity := DataEntity{Data: val}
-	result := db.PutIfAbsent(string(key), &entity)
+	result := db.PutIfAbsent(string(key), makeStringEntity(val))
 	db.AddAof(makeAofCmd("SETNx", args))
 	return reply.MakeIntReply(int64(result))
 }
 
+// execSetEx sets value and ttl in seconds: SETEX key seconds value
 func execSetEx(db *DB, args [][]byte) redis.Reply {
 	key := args[0]
-	val := args[1]
-	entity := DataEntity{Data: val}
-	db.PutEntity(string(key), &entity)
-	temp := args[2]
-	raw, err := strconv.ParseInt(string(temp), 10, 64)
+	val := args[2]
+	raw, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return &reply.SyntaxErrReply{}
+	}
+	if raw <= 0 {
+		return reply.MakeErrReply("Err Invalid expire time to set")
+	}
+	db.PutEntity(string(key), makeStringEntity(val))
+	expireTime := time.Now().Add(time.Duration(raw) * time.Second)
+	db.AddAof(makeAofCmd("SET", [][]byte{key, val}))
+	db.setExpire(string(key), expireTime)
+	return &reply.OkReply{}
+}
+
+// execPSetEx sets value and ttl in milliseconds: PSETEX key milliseconds value
+func execPSetEx(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	val := args[2]
+	raw, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
 		return &reply.SyntaxErrReply{}
 	}
-	if raw < 0 {
+	if raw <= 0 {
 		return reply.MakeErrReply("Err Invalid expire time to set")
 	}
-	ttl := raw * 1000
-	expireTime := time.Now().Add(time.Duration(ttl) * time.Millisecond)
-	db.Expire(string(key), expireTime)
-	db.AddAof(makeAofCmd("setex", args))
-	db.AddAof(makeExpireAofCmd(string(key), expireTime))
+	db.PutEntity(key, makeStringEntity(val))
+	expireTime := time.Now().Add(time.Duration(raw) * time.Millisecond)
+	db.AddAof(makeAofCmd("SET", [][]byte{args[0], val}))
+	db.setExpire(key, expireTime)
+	return &reply.OkReply{}
+}
+
+func prepareMSet(args [][]byte) ([]string, []string) {
+	size := len(args) / 2
+	keys := make([]string, size)
+	for i := 0; i < size; i++ {
+		keys[i] = string(args[2*i])
+	}
+	return keys, nil
+}
+
+func undoMSet(db *DB, args [][]byte) []CmdLine {
+	writeKeys, _ := prepareMSet(args)
+	return rollbackGivenKeys(db, writeKeys...)
+}
+
+// execMSet sets multiple keys, keys has been locked by RWLocks in order of lock index, so it is atomic
+func execMSet(db *DB, args [][]byte) redis.Reply {
+	if len(args)%2 != 0 {
+		return reply.MakeArgNumErrReply("mset")
+	}
+	for i := 0; i < len(args); i += 2 {
+		key := string(args[i])
+		db.PutEntity(key, makeStringEntity(args[i+1]))
+		db.Persist(key)
+	}
+	db.AddAof(makeAofCmd("MSET", args))
 	return &reply.OkReply{}
 }
 
+// execMSetNX sets multiple keys only if none of them exists
+func execMSetNX(db *DB, args [][]byte) redis.Reply {
+	if len(args)%2 != 0 {
+		return reply.MakeArgNumErrReply("msetnx")
+	}
+	for i := 0; i < len(args); i += 2 {
+		if _, exists := db.GetEntity(string(args[i])); exists {
+			return reply.MakeIntReply(0)
+		}
+	}
+	for i := 0; i < len(args); i += 2 {
+		db.PutEntity(string(args[i]), makeStringEntity(args[i+1]))
+	}
+	db.AddAof(makeAofCmd("MSETNX", args))
+	return reply.MakeIntReply(1)
+}
+
+// execMGet returns values of keys, null for keys not exist or not holding a string
+func execMGet(db *DB, args [][]byte) redis.Reply {
+	result := make([][]byte, len(args))
+	for i, k := range args {
+		val, err := db.getAsString(string(k))
+		if err != nil {
+			continue
+		}
+		result[i] = val
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+// execGetSet sets value and returns the old one, ttl will be discarded
+func execGetSet(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	val := args[1]
+	old, err := db.getAsString(key)
+	if err != nil {
+		return err
+	}
+	db.PutEntity(key, makeStringEntity(val))
+	db.Persist(key)
+	db.AddAof(makeAofCmd("SET", args))
+	if old == nil {
+		return &reply.NullBulkReply{}
+	}
+	return reply.MakeBulkReply(old)
+}
+
+func execGetDel(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	old, err := db.getAsString(key)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return &reply.NullBulkReply{}
+	}
+	db.Remove(key)
+	db.AddAof(makeAofCmd("DEL", args))
+	return reply.MakeBulkReply(old)
+}
+
+// execGetEx returns value and sets or removes ttl, supported options: EX, PX, EXAT, PXAT and PERSIST
+func execGetEx(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	var expireAt time.Time
+	persist := false
+	for i := 1; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i]))
+		switch option {
+		case "EX", "PX", "EXAT", "PXAT":
+			if !expireAt.IsZero() || persist || i+1 >= len(args) {
+				return &reply.SyntaxErrReply{}
+			}
+			var errReply reply.ErrorReply
+			expireAt, errReply = parseExpireOption(option, args[i+1])
+			if errReply != nil {
+				return errReply
+			}
+			i++
+		case "PERSIST":
+			if !expireAt.IsZero() {
+				return &reply.SyntaxErrReply{}
+			}
+			persist = true
+		default:
+			return &reply.SyntaxErrReply{}
+		}
+	}
+
+	val, err := db.getAsString(key)
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		return &reply.NullBulkReply{}
+	}
+	if !expireAt.IsZero() {
+		db.setExpire(key, expireAt)
+	} else if persist {
+		if _, ok := db.ttlMap.Get(key); ok {
+			db.Persist(key)
+			db.AddAof(makeAofCmd("PERSIST", args[:1]))
+		}
+	}
+	return reply.MakeBulkReply(val)
+}
+
+// incrBy adds delta to the integer stored at key, ttl of key is kept
+func (db *DB) incrBy(key string, delta int64) redis.Reply {
+	var num int64
+	entity, exists := db.GetEntity(key)
+	if exists {
+		switch val := entity.Data.(type) {
+		case int64:
+			num = val
+		case []byte:
+			var ok bool
+			num, ok = parseCanonicalInt(val)
+			if !ok {
+				return reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+		default:
+			return &reply.WrongTypeErrReply{}
+		}
+	}
+	if (delta > 0 && num > math.MaxInt64-delta) || (delta < 0 && num < math.MinInt64-delta) {
+		return reply.MakeErrReply("ERR increment or decrement would overflow")
+	}
+	num += delta
+	db.PutEntity(key, makeIntEntity(num))
+	return reply.MakeIntReply(num)
+}
+
+func execIncr(db *DB, args [][]byte) redis.Reply {
+	result := db.incrBy(string(args[0]), 1)
+	if _, ok := result.(*reply.IntReply); ok {
+		db.AddAof(makeAofCmd("INCR", args))
+	}
+	return result
+}
+
+func execIncrBy(db *DB, args [][]byte) redis.Reply {
+	delta, ok := parseCanonicalInt(args[1])
+	if !ok {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	result := db.incrBy(string(args[0]), delta)
+	if _, ok := result.(*reply.IntReply); ok {
+		db.AddAof(makeAofCmd("INCRBY", args))
+	}
+	return result
+}
+
+func execDecr(db *DB, args [][]byte) redis.Reply {
+	result := db.incrBy(string(args[0]), -1)
+	if _, ok := result.(*reply.IntReply); ok {
+		db.AddAof(makeAofCmd("DECR", args))
+	}
+	return result
+}
+
+func execDecrBy(db *DB, args [][]byte) redis.Reply {
+	delta, ok := parseCanonicalInt(args[1])
+	if !ok || delta == math.MinInt64 {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	result := db.incrBy(string(args[0]), -delta)
+	if _, ok := result.(*reply.IntReply); ok {
+		db.AddAof(makeAofCmd("DECRBY", args))
+	}
+	return result
+}
+
+// execIncrByFloat adds a float delta, it is written into aof as SET of the result
+// since float arithmetic may differ between platforms
+func execIncrByFloat(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	delta, err := strconv.ParseFloat(string(args[1]), 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return reply.MakeErrReply("ERR value is not a valid float")
+	}
+	val, errReply := db.getAsString(key)
+	if errReply != nil {
+		return errReply
+	}
+	var num float64
+	if val != nil {
+		num, err = strconv.ParseFloat(string(val), 64)
+		if err != nil {
+			return reply.MakeErrReply("ERR value is not a valid float")
+		}
+	}
+	num += delta
+	if math.IsNaN(num) || math.IsInf(num, 0) {
+		return reply.MakeErrReply("ERR increment would produce NaN or Infinity")
+	}
+	result := []byte(strconv.FormatFloat(num, 'f', -1, 64))
+	db.PutEntity(key, makeStringEntity(result))
+	db.AddAof(makeAofCmd("SET", [][]byte{args[0], result, []byte("KEEPTTL")}))
+	return reply.MakeBulkReply(result)
+}
+
+func execAppend(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	val, err := db.getAsString(key)
+	if err != nil {
+		return err
+	}
+	result := make([]byte, 0, len(val)+len(args[1]))
+	result = append(append(result, val...), args[1]...)
+	db.PutEntity(key, makeStringEntity(result))
+	db.AddAof(makeAofCmd("APPEND", args))
+	return reply.MakeIntReply(int64(len(result)))
+}
+
+func execStrLen(db *DB, args [][]byte) redis.Reply {
+	val, err := db.getAsString(string(args[0]))
+	if err != nil {
+		return err
+	}
+	return reply.MakeIntReply(int64(len(val)))
+}
+
+// maxStringLen is the max length of a string value which SETRANGE could make
+const maxStringLen = 512 << 20
+
+// execSetRange overwrites part of the string starting at offset, the string is padded with zero bytes if needed
+func execSetRange(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	offset, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	value := args[2]
+	if offset < 0 || offset+int64(len(value)) > maxStringLen {
+		return reply.MakeErrReply("ERR offset is out of range")
+	}
+	val, errReply := db.getAsString(key)
+	if errReply != nil {
+		return errReply
+	}
+	if val == nil && len(value) == 0 {
+		return reply.MakeIntReply(0)
+	}
+	if len(value) == 0 {
+		return reply.MakeIntReply(int64(len(val)))
+	}
+	size := int64(len(val))
+	if end := offset + int64(len(value)); end > size {
+		size = end
+	}
+	result := make([]byte, size)
+	copy(result, val)
+	copy(result[offset:], value)
+	db.PutEntity(key, makeStringEntity(result))
+	db.AddAof(makeAofCmd("SETRANGE", args))
+	return reply.MakeIntReply(size)
+}
+
+// execGetRange returns substring between start and end, both are inclusive and could be negative
+func execGetRange(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	startIdx, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+	endIdx, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+
+	val, errReply := db.getAsString(key)
+	if errReply != nil {
+		return errReply
+	}
+	if val == nil {
+		return &reply.NullBulkReply{}
+	}
+	size := int64(len(val))
+	if startIdx < -size || startIdx >= size {
+		return &reply.NullBulkReply{}
+	} else if startIdx < 0 {
+		startIdx = size + startIdx
+	}
+	if endIdx < -size {
+		return &reply.NullBulkReply{}
+	} else if endIdx < 0 {
+		endIdx = size + endIdx + 1
+	} else if endIdx < size {
+		endIdx = endIdx + 1
+	} else {
+		endIdx = size
+	}
+	if startIdx >= endIdx {
+		return &reply.NullBulkReply{}
+	}
+	return reply.MakeBulkReply(val[startIdx:endIdx])
+}
+
 func init() {
 	RegisterCommand("Set", execSet, writeFirstKey, rollbackFirstKey, -3)
 	RegisterCommand("SetNx", execSetNx, writeFirstKey, rollbackFirstKey, -3)
-	RegisterCommand("SetEx", execSetEx, writeFirstKey, rollbackFirstKey, -3)
+	RegisterCommand("SetEx", execSetEx, writeFirstKey, rollbackFirstKey, 4)
+	RegisterCommand("PSetEx", execPSetEx, writeFirstKey, rollbackFirstKey, 4)
+	RegisterCommand("MSet", execMSet, prepareMSet, undoMSet, -3)
+	RegisterCommand("MSetNX", execMSetNX, prepareMSet, undoMSet, -3)
 	RegisterCommand("Get", execGet, readFirstKey, nil, 2)
+	RegisterCommand("MGet", execMGet, readAllKeys, nil, -2)
+	RegisterCommand("GetSet", execGetSet, writeFirstKey, rollbackFirstKey, 3)
+	RegisterCommand("GetDel", execGetDel, writeFirstKey, rollbackFirstKey, 2)
+	RegisterCommand("GetEx", execGetEx, writeFirstKey, rollbackFirstKey, -2)
+	RegisterCommand("Incr", execIncr, writeFirstKey, rollbackFirstKey, 2)
+	RegisterCommand("IncrBy", execIncrBy, writeFirstKey, rollbackFirstKey, 3)
+	RegisterCommand("IncrByFloat", execIncrByFloat, writeFirstKey, rollbackFirstKey, 3)
+	RegisterCommand("Decr", execDecr, writeFirstKey, rollbackFirstKey, 2)
+	RegisterCommand("DecrBy", execDecrBy, writeFirstKey, rollbackFirstKey, 3)
+	RegisterCommand("Append", execAppend, writeFirstKey, rollbackFirstKey, 3)
+	RegisterCommand("StrLen", execStrLen, readFirstKey, nil, 2)
+	RegisterCommand("SetRange", execSetRange, writeFirstKey, rollbackFirstKey, 4)
+	RegisterCommand("GetRange", execGetRange, readFirstKey, nil, 4)
 }
@@ -11,5 +11,8 @@ func makeTestDB() *DB {
 		versionMap: dict.MakeConcurrent(dataDictSize),
 		ttlMap:     dict.MakeConcurrent(ttlDictSize),
 		locker:     lock.Make(lockerSize),
+		blocking:   makeBlockingKeys(),
+		scripts:    makeScriptCache(),
+		functions:  makeFunctionLibs(),
 	}
 }
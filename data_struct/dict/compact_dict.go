@@ -0,0 +1,161 @@
+package dict
+
+import (
+	"Tiny-Godis/data_struct/listpack"
+	"math/rand"
+)
+
+// CompactDict stores small dicts in a listpack of alternating keys and values,
+// it converts itself into SimpleDict once it has more than maxEntries keys,
+// a key or value is longer than maxValue, or a value is not []byte
+type CompactDict struct {
+	lp *listpack.ListPack
+	// d is not nil after conversion
+	d          *SimpleDict
+	maxEntries int
+	maxValue   int
+}
+
+func MakeCompactDict(maxEntries int, maxValue int) *CompactDict {
+	return &CompactDict{
+		lp:         listpack.Make(),
+		maxEntries: maxEntries,
+		maxValue:   maxValue,
+	}
+}
+
+// Encoding returns listpack or hashtable
+func (cd *CompactDict) Encoding() string {
+	if cd.d != nil {
+		return "hashtable"
+	}
+	return "listpack"
+}
+
+func (cd *CompactDict) convert() {
+	cd.d = MakeSimpleDict()
+	for i := 0; i+1 < cd.lp.Len(); i += 2 {
+		cd.d.Put(string(cd.lp.Get(i)), cd.lp.Get(i+1))
+	}
+	cd.lp = nil
+}
+
+// fits returns whether key and val could be stored in listpack
+func (cd *CompactDict) fits(key string, val interface{}) bool {
+	bytes, ok := val.([]byte)
+	return ok && len(key) <= cd.maxValue && len(bytes) <= cd.maxValue
+}
+
+func (cd *CompactDict) find(key string) int {
+	return cd.lp.Find([]byte(key), 2)
+}
+
+func (cd *CompactDict) Put(key string, val interface{}) (result int) {
+	if cd.d == nil {
+		i := cd.find(key)
+		if i >= 0 && cd.fits(key, val) {
+			cd.lp.Replace(i+1, val.([]byte))
+			return 0
+		}
+		if i < 0 && cd.fits(key, val) && cd.Len() < cd.maxEntries {
+			cd.lp.Append([]byte(key), val.([]byte))
+			return 1
+		}
+		cd.convert()
+	}
+	return cd.d.Put(key, val)
+}
+
+func (cd *CompactDict) Get(key string) (val interface{}, exists bool) {
+	if cd.d != nil {
+		return cd.d.Get(key)
+	}
+	i := cd.find(key)
+	if i < 0 {
+		return nil, false
+	}
+	return cd.lp.Get(i + 1), true
+}
+
+func (cd *CompactDict) Len() int {
+	if cd.d != nil {
+		return cd.d.Len()
+	}
+	return cd.lp.Len() / 2
+}
+
+func (cd *CompactDict) PutIfAbsent(key string, val interface{}) (result int) {
+	if _, ok := cd.Get(key); ok {
+		return 0
+	}
+	return cd.Put(key, val)
+}
+
+func (cd *CompactDict) PutIfExists(key string, val interface{}) (result int) {
+	if _, ok := cd.Get(key); !ok {
+		return 0
+	}
+	cd.Put(key, val)
+	return 1
+}
+
+func (cd *CompactDict) Remove(key string) (result int) {
+	if cd.d != nil {
+		return cd.d.Remove(key)
+	}
+	i := cd.find(key)
+	if i < 0 {
+		return 0
+	}
+	cd.lp.Delete(i, 2)
+	return 1
+}
+
+func (cd *CompactDict) ForEach(recall RecallFunc) {
+	if cd.d != nil {
+		cd.d.ForEach(recall)
+		return
+	}
+	var key []byte
+	cd.lp.ForEach(func(i int, entry []byte) bool {
+		if i%2 == 0 {
+			key = entry
+			return true
+		}
+		return recall(string(key), entry)
+	})
+}
+
+func (cd *CompactDict) Keys() []string {
+	keys := make([]string, 0, cd.Len())
+	cd.ForEach(func(key string, val interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+func (cd *CompactDict) RandomKeys(limit int) []string {
+	if cd.d != nil {
+		return cd.d.RandomKeys(limit)
+	}
+	size := cd.Len()
+	if limit <= 0 || size == 0 {
+		return nil
+	}
+	result := make([]string, 0, randomPrealloc(limit))
+	for len(result) < limit {
+		result = append(result, string(cd.lp.Get(rand.Intn(size)*2)))
+	}
+	return result
+}
+
+func (cd *CompactDict) RandomDistinctKeys(limit int) []string {
+	if cd.d != nil {
+		return cd.d.RandomDistinctKeys(limit)
+	}
+	if limit >= cd.Len() {
+		return cd.Keys()
+	}
+	return selectKeys(cd.ForEach, cd.Len(), limit)
+}
@@ -2,6 +2,7 @@ package dict
 
 import (
 	"math"
+	"math/rand"
 	"sync"
 	"sync/atomic"
 )
@@ -187,13 +188,101 @@ func (dict *ConcurrentDict) ForEach(recall RecallFunc) {
 	for _, t := range dict.table {
 		// 这段加锁再释放的代码很精彩，灵活运用了匿名函数
 		t.mutex.RLock()
-		func() {
+		goOn := func() bool {
 			defer t.mutex.RUnlock()
 			for k, v := range t.m {
-				if recall(k, v) {
-					return
+				if !recall(k, v) {
+					return false
 				}
 			}
+			return true
 		}()
+		if !goOn {
+			return
+		}
+	}
+}
+
+func (dict *ConcurrentDict) Keys() []string {
+	keys := make([]string, 0, dict.Len())
+	dict.ForEach(func(key string, val interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// randomKey returns a key of shard, the start of map iteration is random so the whole shard is not walked
+func (shard *Shard) randomKey() (string, bool) {
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+	for key := range shard.m {
+		return key, true
+	}
+	return "", false
+}
+
+// randomShardTries is the number of random shards probed before walking shards one by one
+const randomShardTries = 8
+
+// randomKey returns a key of a random non-empty shard.
+// Probing random shards is fast for a dense dict, walking from a random shard bounds the cost for a sparse one
+func (dict *ConcurrentDict) randomKey() (string, bool) {
+	if atomic.LoadInt32(&dict.count) <= 0 {
+		return "", false
+	}
+	n := len(dict.table)
+	for i := 0; i < randomShardTries; i++ {
+		if key, ok := dict.table[rand.Intn(n)].randomKey(); ok {
+			return key, true
+		}
+	}
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		if key, ok := dict.table[(start+i)%n].randomKey(); ok {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// RandomKeys returns keys selected randomly, may contain duplicated keys
+func (dict *ConcurrentDict) RandomKeys(limit int) []string {
+	if limit <= 0 {
+		return nil
+	}
+	result := make([]string, 0, randomPrealloc(limit))
+	for len(result) < limit {
+		key, ok := dict.randomKey()
+		if !ok {
+			break
+		}
+		result = append(result, key)
+	}
+	return result
+}
+
+// RandomDistinctKeys returns keys selected randomly without duplication, at most Len() keys
+func (dict *ConcurrentDict) RandomDistinctKeys(limit int) []string {
+	size := int(atomic.LoadInt32(&dict.count))
+	if limit >= size {
+		return dict.Keys()
+	}
+	if limit*3 > size {
+		// sampling is slow when most keys are needed, select keys while walking instead
+		return selectKeys(dict.ForEach, size, limit)
+	}
+	result := make(map[string]struct{}, limit)
+	for len(result) < limit {
+		key, ok := dict.randomKey()
+		if !ok {
+			break
+		}
+		result[key] = struct{}{}
+	}
+	keys := make([]string, 0, len(result))
+	for key := range result {
+		keys = append(keys, key)
 	}
+	return keys
 }
@@ -1,5 +1,7 @@
 package dict
 
+import "math/rand"
+
 // RecallFunc is used to traversal dict, if it returns false the traversal will be break
 type RecallFunc func(key string, val interface{}) bool
 
@@ -12,4 +14,41 @@ type Dict interface {
 	PutIfExists(key string, val interface{}) (result int)
 	Remove(key string) (result int)
 	ForEach(recallFunc RecallFunc)
+	Keys() []string
+	// RandomKeys returns keys selected randomly, may contain duplicated keys
+	RandomKeys(limit int) []string
+	// RandomDistinctKeys returns keys selected randomly without duplication, at most Len() keys
+	RandomDistinctKeys(limit int) []string
+}
+
+// maxRandomPrealloc bounds the capacity allocated ahead by RandomKeys, limit is given by clients and may be huge
+const maxRandomPrealloc = 1024
+
+func randomPrealloc(limit int) int {
+	if limit > maxRandomPrealloc {
+		return maxRandomPrealloc
+	}
+	return limit
+}
+
+// selectKeys picks limit keys randomly from size keys by selection sampling,
+// keys are visited once without being copied into a slice
+func selectKeys(forEach func(RecallFunc), size int, limit int) []string {
+	result := make([]string, 0, limit)
+	remaining := size
+	forEach(func(key string, val interface{}) bool {
+		if remaining <= 0 {
+			return false
+		}
+		if rand.Intn(remaining) < limit-len(result) {
+			result = append(result, key)
+		}
+		remaining--
+		return len(result) < limit
+	})
+	// selected keys are in the order of traversal
+	rand.Shuffle(len(result), func(i, j int) {
+		result[i], result[j] = result[j], result[i]
+	})
+	return result
 }
@@ -88,3 +88,49 @@ func (sd *SimpleDict) ForEach(recall RecallFunc) {
 		}
 	}
 }
+
+func (sd *SimpleDict) Keys() []string {
+	keys := make([]string, 0, len(sd.table))
+	for k := range sd.table {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// randomKey returns a key, the start of map iteration is random so the whole table is not walked
+func (sd *SimpleDict) randomKey() string {
+	for k := range sd.table {
+		return k
+	}
+	return ""
+}
+
+func (sd *SimpleDict) RandomKeys(limit int) []string {
+	if limit <= 0 || len(sd.table) == 0 {
+		return nil
+	}
+	result := make([]string, 0, randomPrealloc(limit))
+	for len(result) < limit {
+		result = append(result, sd.randomKey())
+	}
+	return result
+}
+
+func (sd *SimpleDict) RandomDistinctKeys(limit int) []string {
+	if limit >= len(sd.table) {
+		return sd.Keys()
+	}
+	if limit*3 > len(sd.table) {
+		// sampling is slow when most keys are needed, select keys while walking instead
+		return selectKeys(sd.ForEach, len(sd.table), limit)
+	}
+	result := make(map[string]struct{}, limit)
+	for len(result) < limit {
+		result[sd.randomKey()] = struct{}{}
+	}
+	keys := make([]string, 0, limit)
+	for k := range result {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,583 @@
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// HyperLogLog is stored as a string in the same format as redis:
+// 16 bytes header ("HYLL", encoding, 3 unused bytes, cached cardinality in little endian) followed by registers.
+// Dense encoding packs 16384 registers of 6 bits, sparse encoding is a sequence of run-length opcodes:
+//
+//	ZERO  00xxxxxx          1-64 zero registers
+//	XZERO 01xxxxxx yyyyyyyy 1-16384 zero registers
+//	VAL   1vvvvvxx          1-4 registers of value 1-32
+const (
+	p         = 14
+	q         = 64 - p
+	Registers = 1 << p
+	pMask     = Registers - 1
+	bits      = 6
+	regMax    = 1<<bits - 1
+
+	HeaderSize = 16
+	DenseSize  = HeaderSize + (Registers*bits+7)/8
+
+	encodingDense  = 0
+	encodingSparse = 1
+	encodingMax    = encodingSparse
+
+	sparseXZeroBit    = 0x40
+	sparseValBit      = 0x80
+	sparseValMaxValue = 32
+	sparseValMaxLen   = 4
+	sparseZeroMaxLen  = 64
+	sparseXZeroMaxLen = 16384
+
+	alphaInf = 0.721347520444481703680 // 0.5/ln(2)
+	seed     = 0xadc83b19
+)
+
+var magic = []byte("HYLL")
+
+// ErrCorrupted is returned when registers of HyperLogLog is malformed
+var ErrCorrupted = errors.New("corrupted HLL object")
+
+// Make returns an empty HyperLogLog in sparse encoding
+func Make() []byte {
+	buf := make([]byte, HeaderSize, HeaderSize+2)
+	copy(buf, magic)
+	buf[4] = encodingSparse
+	buf = append(buf, 0, 0)
+	setXZero(buf[HeaderSize:], Registers)
+	return buf
+}
+
+// IsValid checks header of a string, registers are checked while being read
+func IsValid(buf []byte) bool {
+	if len(buf) < HeaderSize || string(buf[:4]) != string(magic) || buf[4] > encodingMax {
+		return false
+	}
+	return buf[4] != encodingDense || len(buf) == DenseSize
+}
+
+// Encoding returns "dense" or "sparse"
+func Encoding(buf []byte) string {
+	if buf[4] == encodingDense {
+		return "dense"
+	}
+	return "sparse"
+}
+
+// CachedCount returns the cached cardinality, which is invalidated by modifications
+func CachedCount(buf []byte) (uint64, bool) {
+	if buf[15]&(1<<7) != 0 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(buf[8:16]), true
+}
+
+// SetCachedCount caches cardinality in header
+func SetCachedCount(buf []byte, card uint64) {
+	binary.LittleEndian.PutUint64(buf[8:16], card)
+}
+
+func invalidateCache(buf []byte) {
+	buf[15] |= 1 << 7
+}
+
+/* ---- hash ---- */
+
+// murmurHash64A is the hash function used by redis
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ (uint64(len(key)) * m)
+	n := len(key) - len(key)&7
+	for i := 0; i < n; i += 8 {
+		k := binary.LittleEndian.Uint64(key[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+	tail := key[n:]
+	switch len(tail) {
+	case 7:
+		h ^= uint64(tail[6]) << 48
+		fallthrough
+	case 6:
+		h ^= uint64(tail[5]) << 40
+		fallthrough
+	case 5:
+		h ^= uint64(tail[4]) << 32
+		fallthrough
+	case 4:
+		h ^= uint64(tail[3]) << 24
+		fallthrough
+	case 3:
+		h ^= uint64(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint64(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint64(tail[0])
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// patLen returns the register of element and the length of 000..1 pattern in its hash
+func patLen(element []byte) (int, uint8) {
+	hash := murmurHash64A(element, seed)
+	index := int(hash & pMask)
+	hash >>= p
+	hash |= 1 << q
+	count := uint8(1)
+	for bit := uint64(1); hash&bit == 0; bit <<= 1 {
+		count++
+	}
+	return index, count
+}
+
+/* ---- dense ---- */
+
+func denseGet(registers []byte, i int) uint8 {
+	byteIndex := i * bits / 8
+	fb := uint(i * bits & 7)
+	b0 := uint(registers[byteIndex])
+	var b1 uint
+	if byteIndex+1 < len(registers) {
+		b1 = uint(registers[byteIndex+1])
+	}
+	return uint8((b0>>fb | b1<<(8-fb)) & regMax)
+}
+
+func denseSet(registers []byte, i int, val uint8) {
+	byteIndex := i * bits / 8
+	fb := uint(i * bits & 7)
+	v := uint(val)
+	registers[byteIndex] &^= byte(regMax << fb)
+	registers[byteIndex] |= byte(v << fb)
+	if byteIndex+1 < len(registers) {
+		registers[byteIndex+1] &^= byte(regMax >> (8 - fb))
+		registers[byteIndex+1] |= byte(v >> (8 - fb))
+	}
+}
+
+// denseUpdate sets register if val is greater than it, returns whether it is updated
+func denseUpdate(registers []byte, i int, val uint8) bool {
+	if denseGet(registers, i) >= val {
+		return false
+	}
+	denseSet(registers, i, val)
+	return true
+}
+
+/* ---- sparse ---- */
+
+func isZero(op byte) bool {
+	return op&0xc0 == 0
+}
+
+func isXZero(op byte) bool {
+	return op&0xc0 == sparseXZeroBit
+}
+
+func zeroLen(op byte) int {
+	return int(op&0x3f) + 1
+}
+
+func xzeroLen(ops []byte) int {
+	return (int(ops[0]&0x3f)<<8 | int(ops[1])) + 1
+}
+
+func valValue(op byte) uint8 {
+	return (op>>2)&0x1f + 1
+}
+
+func valLen(op byte) int {
+	return int(op&0x3) + 1
+}
+
+func makeVal(val uint8, length int) byte {
+	return (val-1)<<2 | byte(length-1) | sparseValBit
+}
+
+func setXZero(ops []byte, length int) {
+	l := length - 1
+	ops[0] = byte(l>>8) | sparseXZeroBit
+	ops[1] = byte(l & 0xff)
+}
+
+// appendZero appends the shortest opcode of zero registers
+func appendZero(ops []byte, length int) []byte {
+	if length > sparseZeroMaxLen {
+		ops = append(ops, 0, 0)
+		setXZero(ops[len(ops)-2:], length)
+		return ops
+	}
+	return append(ops, byte(length-1))
+}
+
+// opcode is a decoded opcode of sparse encoding, value of zero runs is 0
+type opcode struct {
+	value  uint8
+	length int
+	size   int
+}
+
+func decodeOp(ops []byte) (opcode, bool) {
+	switch {
+	case isZero(ops[0]):
+		return opcode{length: zeroLen(ops[0]), size: 1}, true
+	case isXZero(ops[0]):
+		if len(ops) < 2 {
+			return opcode{}, false
+		}
+		return opcode{length: xzeroLen(ops), size: 2}, true
+	default:
+		return opcode{value: valValue(ops[0]), length: valLen(ops[0]), size: 1}, true
+	}
+}
+
+// forEachRun visits runs of registers in sparse encoding, it returns ErrCorrupted if runs don't cover all registers
+func forEachRun(ops []byte, consumer func(index int, op opcode)) error {
+	index := 0
+	for i := 0; i < len(ops); {
+		op, ok := decodeOp(ops[i:])
+		if !ok || index+op.length > Registers {
+			return ErrCorrupted
+		}
+		consumer(index, op)
+		index += op.length
+		i += op.size
+	}
+	if index != Registers {
+		return ErrCorrupted
+	}
+	return nil
+}
+
+// sparseSet sets register if val is greater than it like hllSparseSet of redis.
+// It returns the new buffer, whether register is updated, and whether the buffer has to be promoted to dense encoding
+func sparseSet(buf []byte, index int, val uint8, maxBytes int) ([]byte, bool, bool, error) {
+	if val > sparseValMaxValue {
+		return buf, false, true, nil
+	}
+	ops := buf[HeaderSize:]
+	// step 1: locate the opcode covering register
+	first, prev, pos := 0, -1, 0
+	var op opcode
+	for {
+		if pos >= len(ops) {
+			return buf, false, false, ErrCorrupted
+		}
+		var ok bool
+		op, ok = decodeOp(ops[pos:])
+		if !ok {
+			return buf, false, false, ErrCorrupted
+		}
+		if index <= first+op.length-1 {
+			break
+		}
+		prev = pos
+		pos += op.size
+		first += op.length
+	}
+
+	isVal := op.value > 0
+	var seq []byte
+	switch {
+	case isVal && op.value >= val:
+		return buf, false, false, nil
+	case op.length == 1 && op.size == 1:
+		// a VAL or ZERO of one register is replaced in place
+		seq = []byte{makeVal(val, 1)}
+	default:
+		// step 2: split the opcode into up to 3 opcodes
+		last := first + op.length - 1
+		seq = make([]byte, 0, 5)
+		if index != first {
+			if isVal {
+				seq = append(seq, makeVal(op.value, index-first))
+			} else {
+				seq = appendZero(seq, index-first)
+			}
+		}
+		seq = append(seq, makeVal(val, 1))
+		if index != last {
+			if isVal {
+				seq = append(seq, makeVal(op.value, last-index))
+			} else {
+				seq = appendZero(seq, last-index)
+			}
+		}
+	}
+
+	// step 3: substitute the new sequence for the old opcode
+	delta := len(seq) - op.size
+	if delta > 0 && len(buf)+delta > maxBytes {
+		return buf, false, true, nil
+	}
+	result := make([]byte, 0, len(buf)+delta)
+	result = append(result, buf[:HeaderSize+pos]...)
+	result = append(result, seq...)
+	result = append(result, buf[HeaderSize+pos+op.size:]...)
+
+	// step 4: merge adjacent VAL opcodes of the same value, up to 5 opcodes from the previous one are scanned
+	ops = result[HeaderSize:]
+	i := 0
+	if prev >= 0 {
+		i = prev
+	}
+	for scan := 5; i < len(ops) && scan > 0; scan-- {
+		if isXZero(ops[i]) {
+			i += 2
+			continue
+		}
+		if isZero(ops[i]) {
+			i++
+			continue
+		}
+		if i+1 < len(ops) && ops[i+1]&sparseValBit != 0 && valValue(ops[i]) == valValue(ops[i+1]) {
+			length := valLen(ops[i]) + valLen(ops[i+1])
+			if length <= sparseValMaxLen {
+				ops[i+1] = makeVal(valValue(ops[i]), length)
+				ops = append(ops[:i], ops[i+1:]...)
+				// try to merge the merged opcode with the next one
+				continue
+			}
+		}
+		i++
+	}
+	result = result[:HeaderSize+len(ops)]
+	invalidateCache(result)
+	return result, true, false, nil
+}
+
+// ToDense converts HyperLogLog into dense encoding, the cached cardinality is kept
+func ToDense(buf []byte) ([]byte, error) {
+	if buf[4] == encodingDense {
+		return buf, nil
+	}
+	dense := make([]byte, DenseSize)
+	copy(dense, buf[:HeaderSize])
+	dense[4] = encodingDense
+	registers := dense[HeaderSize:]
+	err := forEachRun(buf[HeaderSize:], func(index int, op opcode) {
+		if op.value == 0 {
+			return
+		}
+		for i := index; i < index+op.length; i++ {
+			denseSet(registers, i, op.value)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dense, nil
+}
+
+/* ---- operations ---- */
+
+// set updates a register and converts sparse encoding into dense if necessary
+func set(buf []byte, index int, val uint8, sparseMaxBytes int) ([]byte, bool, error) {
+	if buf[4] == encodingDense {
+		updated := denseUpdate(buf[HeaderSize:], index, val)
+		if updated {
+			invalidateCache(buf)
+		}
+		return buf, updated, nil
+	}
+	result, updated, promote, err := sparseSet(buf, index, val, sparseMaxBytes)
+	if err != nil || !promote {
+		return result, updated, err
+	}
+	result, err = ToDense(buf)
+	if err != nil {
+		return nil, false, err
+	}
+	// a register needs update since its value can't be represented in sparse encoding
+	denseSet(result[HeaderSize:], index, val)
+	invalidateCache(result)
+	return result, true, nil
+}
+
+// Add adds elements into a copy of buf, it returns the new buffer and whether any register is updated.
+// Sparse encoding is converted into dense encoding once it is larger than sparseMaxBytes
+func Add(buf []byte, elements [][]byte, sparseMaxBytes int) ([]byte, bool, error) {
+	result := make([]byte, len(buf))
+	copy(result, buf)
+	updated := false
+	for _, element := range elements {
+		index, count := patLen(element)
+		var ok bool
+		var err error
+		result, ok, err = set(result, index, count, sparseMaxBytes)
+		if err != nil {
+			return nil, false, err
+		}
+		updated = updated || ok
+	}
+	return result, updated, nil
+}
+
+// Merge sets max[i] to the greater one of max[i] and the i-th register of buf
+func Merge(max []uint8, buf []byte) error {
+	if buf[4] == encodingDense {
+		registers := buf[HeaderSize:]
+		for i := 0; i < Registers; i++ {
+			if val := denseGet(registers, i); val > max[i] {
+				max[i] = val
+			}
+		}
+		return nil
+	}
+	return forEachRun(buf[HeaderSize:], func(index int, op opcode) {
+		for i := index; i < index+op.length; i++ {
+			if op.value > max[i] {
+				max[i] = op.value
+			}
+		}
+	})
+}
+
+// SetRegisters merges registers into a copy of buf, it is used by PFMERGE
+func SetRegisters(buf []byte, max []uint8, dense bool, sparseMaxBytes int) ([]byte, error) {
+	result := make([]byte, len(buf))
+	copy(result, buf)
+	var err error
+	if dense {
+		result, err = ToDense(result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, val := range max {
+		if val == 0 {
+			continue
+		}
+		result, _, err = set(result, i, val, sparseMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	invalidateCache(result)
+	return result, nil
+}
+
+// Count estimates cardinality of HyperLogLog
+func Count(buf []byte) (uint64, error) {
+	var histogram [64]int
+	if buf[4] == encodingDense {
+		registers := buf[HeaderSize:]
+		for i := 0; i < Registers; i++ {
+			histogram[denseGet(registers, i)]++
+		}
+	} else {
+		err := forEachRun(buf[HeaderSize:], func(index int, op opcode) {
+			histogram[op.value] += op.length
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return estimate(&histogram), nil
+}
+
+// CountRegisters estimates cardinality from registers merged by Merge
+func CountRegisters(registers []uint8) uint64 {
+	var histogram [64]int
+	for _, val := range registers {
+		histogram[val]++
+	}
+	return estimate(&histogram)
+}
+
+// estimate is the estimator of "New cardinality estimation algorithms for HyperLogLog sketches", Otmar Ertl, arXiv:1702.01284
+func estimate(histogram *[64]int) uint64 {
+	m := float64(Registers)
+	z := m * tau((m-float64(histogram[q+1]))/m)
+	for j := q; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * sigma(float64(histogram[0])/m)
+	return uint64(math.Round(alphaInf * m * m / z))
+}
+
+func sigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+func tau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
+
+/* ---- debug ---- */
+
+// GetRegisters returns all registers of dense encoding
+func GetRegisters(buf []byte) []uint8 {
+	registers := make([]uint8, Registers)
+	for i := range registers {
+		registers[i] = denseGet(buf[HeaderSize:], i)
+	}
+	return registers
+}
+
+// Decode describes opcodes of sparse encoding like PFDEBUG DECODE of redis
+func Decode(buf []byte) (string, error) {
+	ops := buf[HeaderSize:]
+	var parts []string
+	for i := 0; i < len(ops); {
+		op, ok := decodeOp(ops[i:])
+		if !ok {
+			return "", ErrCorrupted
+		}
+		switch {
+		case isZero(ops[i]):
+			parts = append(parts, "z:"+strconv.Itoa(op.length))
+		case isXZero(ops[i]):
+			parts = append(parts, "Z:"+strconv.Itoa(op.length))
+		default:
+			parts = append(parts, "v:"+strconv.Itoa(int(op.value))+","+strconv.Itoa(op.length))
+		}
+		i += op.size
+	}
+	return strings.Join(parts, " "), nil
+}
@@ -0,0 +1,100 @@
+package hll
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestSparseDenseConsistency(t *testing.T) {
+	sparse := Make()
+	dense, _ := ToDense(Make())
+	for i := 0; i < 2000; i++ {
+		element := []byte(strconv.Itoa(rand.Int()))
+		var err error
+		sparse, _, err = Add(sparse, [][]byte{element}, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dense, _, _ = Add(dense, [][]byte{element}, 1<<20)
+	}
+	if Encoding(sparse) != "sparse" {
+		t.Fatal("expect sparse encoding")
+	}
+	converted, err := ToDense(sparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(converted[HeaderSize:]) != string(dense[HeaderSize:]) {
+		t.Error("registers of sparse and dense encoding are different")
+	}
+	c1, _ := Count(sparse)
+	c2, _ := Count(dense)
+	if c1 != c2 {
+		t.Errorf("cardinality of sparse %d, dense %d", c1, c2)
+	}
+}
+
+func TestPromote(t *testing.T) {
+	buf := Make()
+	for i := 0; i < 10000 && Encoding(buf) == "sparse"; i++ {
+		buf, _, _ = Add(buf, [][]byte{[]byte(strconv.Itoa(i))}, 3000)
+		if Encoding(buf) == "sparse" && len(buf) > 3000 {
+			t.Fatalf("sparse encoding exceeds limit: %d", len(buf))
+		}
+	}
+	if Encoding(buf) != "dense" || len(buf) != DenseSize {
+		t.Errorf("expect promoted to dense encoding, actual %s of %d bytes", Encoding(buf), len(buf))
+	}
+}
+
+func TestAccuracy(t *testing.T) {
+	buf, _ := ToDense(Make())
+	registers := make([]uint8, Registers)
+	checkpoints := map[int]bool{10: true, 1000: true, 100000: true, 500000: true}
+	for i := 1; i <= 500000; i++ {
+		buf, _, _ = Add(buf, [][]byte{[]byte("element:" + strconv.Itoa(i))}, 3000)
+		if checkpoints[i] {
+			card, _ := Count(buf)
+			if relErr := math.Abs(float64(card)-float64(i)) / float64(i); relErr > 0.05 {
+				t.Errorf("cardinality of %d elements is %d", i, card)
+			}
+			_ = Merge(registers, buf)
+			if merged := CountRegisters(registers); merged != card {
+				t.Errorf("cardinality of merged registers %d, expected %d", merged, card)
+			}
+		}
+	}
+}
+
+func TestCorrupted(t *testing.T) {
+	buf := Make()
+	// runs cover fewer registers than expected
+	buf[HeaderSize] = 0x7f
+	buf[HeaderSize+1] = 0xfe
+	if _, err := Count(buf); err != ErrCorrupted {
+		t.Error("expect corruption detected by Count")
+	}
+	if _, err := ToDense(buf); err != ErrCorrupted {
+		t.Error("expect corruption detected by ToDense")
+	}
+	if IsValid([]byte("HYLL")) || IsValid(append([]byte{}, make([]byte, DenseSize)...)) {
+		t.Error("expect invalid header detected")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	buf := Make()
+	decoded, _ := Decode(buf)
+	if decoded != "Z:16384" {
+		t.Errorf("unexpected decoded %s", decoded)
+	}
+	buf, _, _ = set(buf, 100, 3, 3000)
+	buf, _, _ = set(buf, 101, 3, 3000)
+	buf, _, _ = set(buf, 16383, 2, 3000)
+	decoded, _ = Decode(buf)
+	if decoded != "Z:100 v:3,2 Z:16281 v:2,1" {
+		t.Errorf("unexpected decoded %s", decoded)
+	}
+}
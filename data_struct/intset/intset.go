@@ -0,0 +1,124 @@
+package intset
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// IntSet is a sorted array of distinct integers.
+// All elements are stored in the smallest width which could hold each of them, like intset of redis
+type IntSet struct {
+	// width is the size of each element in bytes: 2, 4 or 8
+	width    int
+	contents []byte
+}
+
+func Make() *IntSet {
+	return &IntSet{width: 2}
+}
+
+// widthOf returns the smallest width which could hold v
+func widthOf(v int64) int {
+	if v >= math.MinInt16 && v <= math.MaxInt16 {
+		return 2
+	}
+	if v >= math.MinInt32 && v <= math.MaxInt32 {
+		return 4
+	}
+	return 8
+}
+
+func (s *IntSet) Len() int {
+	return len(s.contents) / s.width
+}
+
+// Get returns the i-th smallest element
+func (s *IntSet) Get(i int) int64 {
+	b := s.contents[i*s.width:]
+	switch s.width {
+	case 2:
+		return int64(int16(binary.LittleEndian.Uint16(b)))
+	case 4:
+		return int64(int32(binary.LittleEndian.Uint32(b)))
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+func (s *IntSet) set(i int, v int64) {
+	b := s.contents[i*s.width:]
+	switch s.width {
+	case 2:
+		binary.LittleEndian.PutUint16(b, uint16(v))
+	case 4:
+		binary.LittleEndian.PutUint32(b, uint32(v))
+	default:
+		binary.LittleEndian.PutUint64(b, uint64(v))
+	}
+}
+
+// search returns the position of v, or the position to insert v if it's absent
+func (s *IntSet) search(v int64) (int, bool) {
+	n := s.Len()
+	i := sort.Search(n, func(i int) bool {
+		return s.Get(i) >= v
+	})
+	return i, i < n && s.Get(i) == v
+}
+
+// upgrade re-encodes all elements with a larger width
+func (s *IntSet) upgrade(width int) {
+	old := *s
+	s.width = width
+	s.contents = make([]byte, old.Len()*width, (old.Len()+1)*width)
+	for i := 0; i < old.Len(); i++ {
+		s.set(i, old.Get(i))
+	}
+}
+
+// Add inserts v and returns true if it's absent
+func (s *IntSet) Add(v int64) bool {
+	if w := widthOf(v); w > s.width {
+		s.upgrade(w)
+	}
+	i, ok := s.search(v)
+	if ok {
+		return false
+	}
+	n := s.Len()
+	s.contents = append(s.contents, make([]byte, s.width)...)
+	copy(s.contents[(i+1)*s.width:], s.contents[i*s.width:n*s.width])
+	s.set(i, v)
+	return true
+}
+
+// Remove deletes v and returns true if it exists
+func (s *IntSet) Remove(v int64) bool {
+	if widthOf(v) > s.width {
+		return false
+	}
+	i, ok := s.search(v)
+	if !ok {
+		return false
+	}
+	copy(s.contents[i*s.width:], s.contents[(i+1)*s.width:])
+	s.contents = s.contents[:len(s.contents)-s.width]
+	return true
+}
+
+func (s *IntSet) Has(v int64) bool {
+	if widthOf(v) > s.width {
+		return false
+	}
+	_, ok := s.search(v)
+	return ok
+}
+
+// ForEach visits elements in ascending order, it breaks if consumer returns false
+func (s *IntSet) ForEach(consumer func(v int64) bool) {
+	for i := 0; i < s.Len(); i++ {
+		if !consumer(s.Get(i)) {
+			return
+		}
+	}
+}
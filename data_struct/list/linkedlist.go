@@ -46,7 +46,12 @@ func (ll *LinkedList) find(index int) *list.Element {
 	return ele
 }
 
+// Insert puts value before the index-th element, value is appended if index equals Len
 func (ll *LinkedList) Insert(index int, value interface{}) {
+	if index == ll.Len() {
+		ll.l.PushBack(value)
+		return
+	}
 	ele := ll.find(index)
 	if ele == nil {
 		return
@@ -64,12 +69,18 @@ func (ll LinkedList) Set(index int, value interface{}) {
 
 func (ll *LinkedList) LPop() interface{} {
 	e := ll.l.Front()
+	if e == nil {
+		return nil
+	}
 	ll.l.Remove(e)
 	return e.Value
 }
 
 func (ll *LinkedList) RPop() interface{} {
 	e := ll.l.Back()
+	if e == nil {
+		return nil
+	}
 	ll.l.Remove(e)
 	return e.Value
 }
@@ -81,15 +92,13 @@ func (ll *LinkedList) Len() int {
 func (ll *LinkedList) RemoveAllByVal(value interface{}) int {
 	ele := ll.l.Front()
 	removed := 0
-	for i := 0; i < ll.Len(); i++ {
+	for ele != nil {
+		next := ele.Next()
 		if utils.Equals(ele.Value, value) {
-			temp := ele
-			ele = ele.Next()
-			ll.l.Remove(temp)
+			ll.l.Remove(ele)
 			removed++
-			continue
 		}
-		ele = ele.Next()
+		ele = next
 	}
 	return removed
 }
@@ -100,16 +109,13 @@ func (ll *LinkedList) RemoveByVal(value interface{}, count int) int {
 	}
 	removed := 0
 	ele := ll.l.Front()
-	for i := 0; i < ll.Len(); i++ {
+	for ele != nil && removed < count {
+		next := ele.Next()
 		if utils.Equals(ele.Value, value) {
-			temp := ele
-			ele = ele.Next()
-			ll.l.Remove(temp)
+			ll.l.Remove(ele)
 			removed++
-			if removed >= count {
-				break
-			}
 		}
+		ele = next
 	}
 	return removed
 }
@@ -121,20 +127,37 @@ func (ll *LinkedList) ReverseRemove(value interface{}, count int) int {
 	count = -count
 	removed := 0
 	ele := ll.l.Back()
-	for i := 0; i < ll.Len(); i++ {
+	for ele != nil && removed < count {
+		prev := ele.Prev()
 		if utils.Equals(ele.Value, value) {
-			temp := ele
-			ele = ele.Prev()
-			ll.l.Remove(temp)
+			ll.l.Remove(ele)
 			removed++
-			if removed >= count {
-				break
-			}
 		}
+		ele = prev
 	}
 	return removed
 }
 
+// Trim removes elements out of [start, stop)
+func (ll *LinkedList) Trim(start int, stop int) {
+	if start < 0 {
+		start = 0
+	}
+	if stop > ll.Len() {
+		stop = ll.Len()
+	}
+	if start >= stop {
+		ll.l.Init()
+		return
+	}
+	for i := 0; i < start; i++ {
+		ll.l.Remove(ll.l.Front())
+	}
+	for i := ll.Len() - (stop - start); i > 0; i-- {
+		ll.l.Remove(ll.l.Back())
+	}
+}
+
 func (ll *LinkedList) Get(index int) (val interface{}) {
 	if ll == nil {
 		panic("list is nil")
@@ -168,11 +191,24 @@ func (ll *LinkedList) Range(start int, stop int) []interface{} {
 func (ll *LinkedList) ForEach(recall RecallFunc) {
 	ele := ll.l.Front()
 	for ele != nil {
-		recall(ele)
+		if !recall(ele.Value) {
+			break
+		}
 		ele = ele.Next()
 	}
 }
 
+// ReverseForEach visits elements from tail to head
+func (ll *LinkedList) ReverseForEach(recall RecallFunc) {
+	ele := ll.l.Back()
+	for ele != nil {
+		if !recall(ele.Value) {
+			break
+		}
+		ele = ele.Prev()
+	}
+}
+
 func (ll LinkedList) Contain(value interface{}) bool {
 	ele := ll.l.Front()
 	for i := 0; i < ll.Len(); i++ {
@@ -14,7 +14,9 @@ type List interface {
 	Get(index int) (val interface{})
 	Range(start int, stop int) []interface{}
 	ForEach(recallFunc RecallFunc)
+	ReverseForEach(recallFunc RecallFunc)
 	RemoveAllByVal(value interface{}) int
 	RemoveByVal(value interface{}, count int) int
 	ReverseRemove(value interface{}, count int) int
+	Trim(start int, stop int)
 }
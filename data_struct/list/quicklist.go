@@ -0,0 +1,555 @@
+package list
+
+import (
+	"Tiny-Godis/lib/utils"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// quickNodeSize is the max number of entries in a node
+const quickNodeSize = 128
+
+// QuickList is a doubly linked list of nodes, each node packs up to quickNodeSize entries in a slice.
+// Nodes more than compressDepth away from both ends could be compressed if all entries are []byte
+type QuickList struct {
+	head *quickNode
+	tail *quickNode
+	// size is the number of entries
+	size int
+	// nodes is the number of nodes
+	nodes int
+	// compressDepth is the number of nodes at each end kept uncompressed, 0 disables compression
+	compressDepth int
+}
+
+type quickNode struct {
+	prev *quickNode
+	next *quickNode
+	// entries is nil while node is compressed
+	entries []interface{}
+	// packed is entries encoded and compressed by flate
+	packed []byte
+	size   int
+	// incompressible means compress failed and entries are not changed since then
+	incompressible bool
+}
+
+func MakeQuickList(compressDepth int) *QuickList {
+	if compressDepth < 0 {
+		compressDepth = 0
+	}
+	return &QuickList{compressDepth: compressDepth}
+}
+
+/* ---- node ----- */
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+func (n *quickNode) compressed() bool {
+	return n.packed != nil
+}
+
+// compress packs entries, node is kept raw if some entry is not []byte or compression saves nothing
+func (n *quickNode) compress() {
+	if n.compressed() || n.incompressible {
+		return
+	}
+	n.incompressible = true
+	var raw bytes.Buffer
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	for _, e := range n.entries {
+		b, ok := e.([]byte)
+		if !ok {
+			return
+		}
+		k := binary.PutUvarint(lenBuf, uint64(len(b)))
+		raw.Write(lenBuf[:k])
+		raw.Write(b)
+	}
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	_, _ = w.Write(raw.Bytes())
+	_ = w.Close()
+	if buf.Len() >= raw.Len() {
+		return
+	}
+	n.packed = buf.Bytes()
+	n.entries = nil
+	n.incompressible = false
+}
+
+// unpack decodes entries of a compressed node
+func (n *quickNode) unpack() []interface{} {
+	data, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(n.packed)))
+	if err != nil {
+		panic(fmt.Sprintf("corrupted quicklist node: %v", err))
+	}
+	entries := make([]interface{}, 0, n.size)
+	for len(data) > 0 {
+		l, k := binary.Uvarint(data)
+		data = data[k:]
+		entries = append(entries, data[:l:l])
+		data = data[l:]
+	}
+	return entries
+}
+
+func (n *quickNode) decompress() {
+	if !n.compressed() {
+		return
+	}
+	n.entries = n.unpack()
+	n.packed = nil
+}
+
+// edit decompresses node before changing its entries, a changed node is worth compressing again
+func (n *quickNode) edit() {
+	n.decompress()
+	n.incompressible = false
+}
+
+// values returns entries of node, a compressed node is decoded without changing it
+func (n *quickNode) values() []interface{} {
+	if n.compressed() {
+		return n.unpack()
+	}
+	return n.entries
+}
+
+/* ---- nodes ----- */
+
+// linkBefore puts node before mark, node is appended if mark is nil
+func (ql *QuickList) linkBefore(mark *quickNode, node *quickNode) {
+	ql.nodes++
+	if mark == nil {
+		node.prev = ql.tail
+		if ql.tail != nil {
+			ql.tail.next = node
+		} else {
+			ql.head = node
+		}
+		ql.tail = node
+		return
+	}
+	node.next = mark
+	node.prev = mark.prev
+	if mark.prev != nil {
+		mark.prev.next = node
+	} else {
+		ql.head = node
+	}
+	mark.prev = node
+}
+
+func (ql *QuickList) unlink(node *quickNode) {
+	ql.nodes--
+	if node.prev != nil {
+		node.prev.next = node.next
+	} else {
+		ql.head = node.next
+	}
+	if node.next != nil {
+		node.next.prev = node.prev
+	} else {
+		ql.tail = node.prev
+	}
+	node.prev = nil
+	node.next = nil
+}
+
+// compressEdges keeps nodes within depth raw and compresses the nodes next to them.
+// It is enough after adding or removing a node at ends
+func (ql *QuickList) compressEdges() {
+	if ql.compressDepth <= 0 {
+		return
+	}
+	node := ql.head
+	for i := 0; node != nil && i < ql.compressDepth; i++ {
+		node.decompress()
+		node = node.next
+	}
+	if node != nil && ql.compressDepth < ql.nodes-ql.compressDepth {
+		node.compress()
+	}
+	node = ql.tail
+	for i := 0; node != nil && i < ql.compressDepth; i++ {
+		node.decompress()
+		node = node.prev
+	}
+	if node != nil && ql.nodes-1-ql.compressDepth >= ql.compressDepth {
+		node.compress()
+	}
+}
+
+// recompress compresses a node after modification if it is in the middle
+func (ql *QuickList) recompress(node *quickNode) {
+	if ql.compressDepth <= 0 {
+		return
+	}
+	head, tail := node, node
+	for i := 0; i < ql.compressDepth; i++ {
+		if head == nil || tail == nil {
+			return
+		}
+		head = head.prev
+		tail = tail.next
+	}
+	if head != nil && tail != nil {
+		node.compress()
+	}
+}
+
+// find returns the node containing the index-th entry and the offset in node, it walks from the nearer end
+func (ql *QuickList) find(index int) (*quickNode, int) {
+	if index < ql.size/2 {
+		node := ql.head
+		for index >= node.size {
+			index -= node.size
+			node = node.next
+		}
+		return node, index
+	}
+	back := ql.size - 1 - index
+	node := ql.tail
+	for back >= node.size {
+		back -= node.size
+		node = node.prev
+	}
+	return node, node.size - 1 - back
+}
+
+func (ql *QuickList) checkIndex(index int) {
+	if index < 0 || index >= ql.size {
+		panic(fmt.Sprintf("index '%d' out of bound '%d'", index, ql.size))
+	}
+}
+
+/* ---- list ----- */
+
+func (ql *QuickList) LPush(value interface{}) {
+	if ql.head == nil || ql.head.size >= quickNodeSize {
+		ql.linkBefore(ql.head, &quickNode{})
+		ql.compressEdges()
+	}
+	node := ql.head
+	node.edit()
+	node.entries = append(node.entries, nil)
+	copy(node.entries[1:], node.entries)
+	node.entries[0] = value
+	node.size++
+	ql.size++
+}
+
+func (ql *QuickList) RPush(value interface{}) {
+	if ql.tail == nil || ql.tail.size >= quickNodeSize {
+		ql.linkBefore(nil, &quickNode{entries: make([]interface{}, 0, quickNodeSize)})
+		ql.compressEdges()
+	}
+	node := ql.tail
+	node.edit()
+	node.entries = append(node.entries, value)
+	node.size++
+	ql.size++
+}
+
+func (ql *QuickList) LPop() interface{} {
+	node := ql.head
+	if node == nil {
+		return nil
+	}
+	node.edit()
+	value := node.entries[0]
+	node.entries[0] = nil
+	node.entries = node.entries[1:]
+	node.size--
+	ql.size--
+	if node.size == 0 {
+		ql.unlink(node)
+		ql.compressEdges()
+	}
+	return value
+}
+
+func (ql *QuickList) RPop() interface{} {
+	node := ql.tail
+	if node == nil {
+		return nil
+	}
+	node.edit()
+	last := node.size - 1
+	value := node.entries[last]
+	node.entries[last] = nil
+	node.entries = node.entries[:last]
+	node.size--
+	ql.size--
+	if node.size == 0 {
+		ql.unlink(node)
+		ql.compressEdges()
+	}
+	return value
+}
+
+// Insert puts value before the index-th element, value is appended if index equals Len
+func (ql *QuickList) Insert(index int, value interface{}) {
+	if index == ql.size {
+		ql.RPush(value)
+		return
+	}
+	if index < 0 || index > ql.size {
+		return
+	}
+	node, offset := ql.find(index)
+	node.edit()
+	var split *quickNode
+	if node.size >= quickNodeSize {
+		// split full node into halves
+		half := node.size / 2
+		split = &quickNode{
+			entries: append(make([]interface{}, 0, quickNodeSize), node.entries[half:]...),
+			size:    node.size - half,
+		}
+		node.entries = append(make([]interface{}, 0, quickNodeSize), node.entries[:half]...)
+		node.size = half
+		ql.linkBefore(node.next, split)
+		if offset >= half {
+			node, split = split, node
+			offset -= half
+		}
+	}
+	node.entries = append(node.entries, nil)
+	copy(node.entries[offset+1:], node.entries[offset:])
+	node.entries[offset] = value
+	node.size++
+	ql.size++
+	if split != nil {
+		// a new node pushes its neighbours out of depth
+		ql.compressEdges()
+		ql.recompress(split)
+	}
+	ql.recompress(node)
+}
+
+func (ql *QuickList) Set(index int, value interface{}) {
+	if index < 0 || index >= ql.size {
+		return
+	}
+	node, offset := ql.find(index)
+	node.edit()
+	node.entries[offset] = value
+	ql.recompress(node)
+}
+
+func (ql *QuickList) Len() int {
+	return ql.size
+}
+
+func (ql *QuickList) Get(index int) (val interface{}) {
+	ql.checkIndex(index)
+	node, offset := ql.find(index)
+	return node.values()[offset]
+}
+
+func (ql *QuickList) Range(start int, stop int) []interface{} {
+	if start < 0 || start >= ql.size {
+		panic("`start` out of range")
+	}
+	if stop < start || stop > ql.size {
+		panic("`stop` out of range")
+	}
+	result := make([]interface{}, 0, stop-start)
+	node, offset := ql.find(start)
+	for len(result) < stop-start {
+		values := node.values()
+		end := offset + stop - start - len(result)
+		if end > len(values) {
+			end = len(values)
+		}
+		result = append(result, values[offset:end]...)
+		node = node.next
+		offset = 0
+	}
+	return result
+}
+
+func (ql *QuickList) ForEach(recall RecallFunc) {
+	for node := ql.head; node != nil; node = node.next {
+		for _, v := range node.values() {
+			if !recall(v) {
+				return
+			}
+		}
+	}
+}
+
+// ReverseForEach visits elements from tail to head
+func (ql *QuickList) ReverseForEach(recall RecallFunc) {
+	for node := ql.tail; node != nil; node = node.prev {
+		values := node.values()
+		for i := len(values) - 1; i >= 0; i-- {
+			if !recall(values[i]) {
+				return
+			}
+		}
+	}
+}
+
+// removeFromNode removes entries equal to value from node and returns removed count,
+// at most limit entries are removed if limit is positive, reverse means removing from tail of node
+func (ql *QuickList) removeFromNode(node *quickNode, value interface{}, limit int, reverse bool) int {
+	values := node.values()
+	matched := 0
+	for _, v := range values {
+		if utils.Equals(v, value) {
+			matched++
+		}
+	}
+	if matched == 0 {
+		return 0
+	}
+	if limit > 0 && matched > limit {
+		matched = limit
+	}
+	kept := make([]interface{}, 0, quickNodeSize)
+	removed := 0
+	if reverse {
+		for i := len(values) - 1; i >= 0; i-- {
+			if removed < matched && utils.Equals(values[i], value) {
+				removed++
+				continue
+			}
+			kept = append(kept, values[i])
+		}
+		for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+			kept[i], kept[j] = kept[j], kept[i]
+		}
+	} else {
+		for _, v := range values {
+			if removed < matched && utils.Equals(v, value) {
+				removed++
+				continue
+			}
+			kept = append(kept, v)
+		}
+	}
+	node.entries = kept
+	node.packed = nil
+	node.incompressible = false
+	node.size = len(kept)
+	ql.size -= removed
+	if node.size == 0 {
+		ql.unlink(node)
+	} else {
+		ql.recompress(node)
+	}
+	return removed
+}
+
+func (ql *QuickList) RemoveAllByVal(value interface{}) int {
+	removed := 0
+	for node := ql.head; node != nil; {
+		next := node.next
+		removed += ql.removeFromNode(node, value, 0, false)
+		node = next
+	}
+	if removed > 0 {
+		// nodes only move towards ends after removing, some of them may come within depth
+		ql.compressEdges()
+	}
+	return removed
+}
+
+func (ql *QuickList) RemoveByVal(value interface{}, count int) int {
+	if count <= 0 {
+		return 0
+	}
+	removed := 0
+	for node := ql.head; node != nil && removed < count; {
+		next := node.next
+		removed += ql.removeFromNode(node, value, count-removed, false)
+		node = next
+	}
+	if removed > 0 {
+		// nodes only move towards ends after removing, some of them may come within depth
+		ql.compressEdges()
+	}
+	return removed
+}
+
+func (ql *QuickList) ReverseRemove(value interface{}, count int) int {
+	if count >= 0 {
+		return 0
+	}
+	count = -count
+	removed := 0
+	for node := ql.tail; node != nil && removed < count; {
+		prev := node.prev
+		removed += ql.removeFromNode(node, value, count-removed, true)
+		node = prev
+	}
+	if removed > 0 {
+		// nodes only move towards ends after removing, some of them may come within depth
+		ql.compressEdges()
+	}
+	return removed
+}
+
+// Trim removes elements out of [start, stop)
+func (ql *QuickList) Trim(start int, stop int) {
+	if start < 0 {
+		start = 0
+	}
+	if stop > ql.size {
+		stop = ql.size
+	}
+	if start >= stop {
+		ql.head = nil
+		ql.tail = nil
+		ql.size = 0
+		ql.nodes = 0
+		return
+	}
+	tailRemoved := ql.size - stop
+	for start > 0 {
+		node := ql.head
+		if start >= node.size {
+			start -= node.size
+			ql.size -= node.size
+			ql.unlink(node)
+			continue
+		}
+		node.edit()
+		node.entries = append(make([]interface{}, 0, quickNodeSize), node.entries[start:]...)
+		node.size -= start
+		ql.size -= start
+		start = 0
+	}
+	for tailRemoved > 0 {
+		node := ql.tail
+		if tailRemoved >= node.size {
+			tailRemoved -= node.size
+			ql.size -= node.size
+			ql.unlink(node)
+			continue
+		}
+		node.edit()
+		for i := node.size - tailRemoved; i < node.size; i++ {
+			node.entries[i] = nil
+		}
+		node.entries = node.entries[:node.size-tailRemoved]
+		node.size -= tailRemoved
+		ql.size -= tailRemoved
+		tailRemoved = 0
+	}
+	ql.compressEdges()
+}
@@ -0,0 +1,222 @@
+package list
+
+import (
+	"Tiny-Godis/lib/utils"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func assertSameList(t *testing.T, expected List, actual List, step int) {
+	if expected.Len() != actual.Len() {
+		t.Fatalf("step %d: expected len %d, actually %d", step, expected.Len(), actual.Len())
+	}
+	if expected.Len() == 0 {
+		return
+	}
+	e := expected.Range(0, expected.Len())
+	a := actual.Range(0, actual.Len())
+	for i := range e {
+		if !utils.Equals(e[i], a[i]) {
+			t.Fatalf("step %d: expected %s at %d, actually %s", step, e[i], i, a[i])
+		}
+	}
+}
+
+// assertCompressed checks that nodes within depth are raw and others are compressed unless incompressible
+func assertCompressed(t *testing.T, ql *QuickList, step int) {
+	if ql.compressDepth <= 0 {
+		return
+	}
+	i := 0
+	for node := ql.head; node != nil; node = node.next {
+		middle := i >= ql.compressDepth && i < ql.nodes-ql.compressDepth
+		if !middle && node.compressed() {
+			t.Fatalf("step %d: expect node %d raw", step, i)
+		}
+		if middle && !node.compressed() && !node.incompressible {
+			t.Fatalf("step %d: expect node %d compressed", step, i)
+		}
+		i++
+	}
+	if i != ql.nodes {
+		t.Fatalf("step %d: expect %d nodes, actually %d", step, ql.nodes, i)
+	}
+}
+
+func TestQuickList(t *testing.T) {
+	for _, depth := range []int{0, 1, 3} {
+		expected := MakeLinkedList()
+		actual := MakeQuickList(depth)
+		for i := 0; i < 20000; i++ {
+			value := []byte(strconv.Itoa(rand.Intn(50)))
+			index := 0
+			if expected.Len() > 0 {
+				index = rand.Intn(expected.Len())
+			}
+			switch op := rand.Intn(100); {
+			case op < 30:
+				expected.RPush(value)
+				actual.RPush(value)
+			case op < 60:
+				expected.LPush(value)
+				actual.LPush(value)
+			case op < 70:
+				if !utils.Equals(expected.LPop(), actual.LPop()) {
+					t.Fatalf("step %d: LPop returns different values", i)
+				}
+			case op < 80:
+				if !utils.Equals(expected.RPop(), actual.RPop()) {
+					t.Fatalf("step %d: RPop returns different values", i)
+				}
+			case op < 85:
+				expected.Insert(index, value)
+				actual.Insert(index, value)
+			case op < 90:
+				expected.Set(index, value)
+				actual.Set(index, value)
+			case op < 93:
+				if expected.RemoveByVal(value, 2) != actual.RemoveByVal(value, 2) {
+					t.Fatalf("step %d: RemoveByVal returns different counts", i)
+				}
+			case op < 96:
+				if expected.ReverseRemove(value, -2) != actual.ReverseRemove(value, -2) {
+					t.Fatalf("step %d: ReverseRemove returns different counts", i)
+				}
+			case op < 97:
+				if expected.RemoveAllByVal(value) != actual.RemoveAllByVal(value) {
+					t.Fatalf("step %d: RemoveAllByVal returns different counts", i)
+				}
+			case op < 98:
+				stop := index + rand.Intn(expected.Len()+1)
+				expected.Trim(index, stop)
+				actual.Trim(index, stop)
+			default:
+				if expected.Len() > 0 && !utils.Equals(expected.Get(index), actual.Get(index)) {
+					t.Fatalf("step %d: Get(%d) returns different values", i, index)
+				}
+			}
+			assertCompressed(t, actual, i)
+			if i%100 == 0 {
+				assertSameList(t, expected, actual, i)
+			}
+		}
+		assertSameList(t, expected, actual, -1)
+	}
+}
+
+func TestQuickListIncompressible(t *testing.T) {
+	ql := MakeQuickList(1)
+	for i := 0; i < quickNodeSize*3; i++ {
+		ql.RPush(i)
+	}
+	middle := ql.head.next
+	if middle.compressed() || !middle.incompressible {
+		t.Fatal("expect node with non-bytes entries marked incompressible")
+	}
+	for i := range middle.entries {
+		middle.entries[i] = []byte("value")
+	}
+	// an unchanged node is not compressed again
+	ql.recompress(middle)
+	if middle.compressed() {
+		t.Fatal("expect incompressible node skipped")
+	}
+	ql.Set(quickNodeSize, []byte("value"))
+	if !middle.compressed() {
+		t.Fatal("expect changed node compressed")
+	}
+}
+
+const benchListSize = 1000000
+
+func makeBenchList(makeList func() List) List {
+	l := makeList()
+	for i := 0; i < benchListSize; i++ {
+		l.RPush([]byte("task:" + strconv.Itoa(i)))
+	}
+	return l
+}
+
+// benchmarkQueue pushes and pops a 1M-element queue
+func benchmarkQueue(b *testing.B, makeList func() List) {
+	l := makeBenchList(makeList)
+	value := []byte("task")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.RPush(value)
+		l.LPop()
+	}
+}
+
+// benchmarkIndex gets random elements of a 1M-element list
+func benchmarkIndex(b *testing.B, makeList func() List) {
+	l := makeBenchList(makeList)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.Get(rand.Intn(benchListSize))
+	}
+}
+
+// benchmarkMemory reports memory used by each element of a 1M-element list
+func benchmarkMemory(b *testing.B, makeList func() List) {
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		l := makeBenchList(makeList)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/benchListSize, "bytes/element")
+		runtime.KeepAlive(l)
+	}
+}
+
+func makeLinkedList() List {
+	return MakeLinkedList()
+}
+
+func makeQuickList() List {
+	return MakeQuickList(0)
+}
+
+func makeCompressedQuickList() List {
+	return MakeQuickList(1)
+}
+
+func BenchmarkLinkedListQueue(b *testing.B) {
+	benchmarkQueue(b, makeLinkedList)
+}
+
+func BenchmarkQuickListQueue(b *testing.B) {
+	benchmarkQueue(b, makeQuickList)
+}
+
+func BenchmarkCompressedQuickListQueue(b *testing.B) {
+	benchmarkQueue(b, makeCompressedQuickList)
+}
+
+func BenchmarkLinkedListIndex(b *testing.B) {
+	benchmarkIndex(b, makeLinkedList)
+}
+
+func BenchmarkQuickListIndex(b *testing.B) {
+	benchmarkIndex(b, makeQuickList)
+}
+
+func BenchmarkCompressedQuickListIndex(b *testing.B) {
+	benchmarkIndex(b, makeCompressedQuickList)
+}
+
+func BenchmarkLinkedListMemory(b *testing.B) {
+	benchmarkMemory(b, makeLinkedList)
+}
+
+func BenchmarkQuickListMemory(b *testing.B) {
+	benchmarkMemory(b, makeQuickList)
+}
+
+func BenchmarkCompressedQuickListMemory(b *testing.B) {
+	benchmarkMemory(b, makeCompressedQuickList)
+}
@@ -0,0 +1,117 @@
+package listpack
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// ListPack stores entries in a flat byte array, each entry is its length in uvarint followed by its content.
+// Entries returned by ListPack are never modified, since Replace and Delete build a new array
+type ListPack struct {
+	buf  []byte
+	size int
+}
+
+func Make() *ListPack {
+	return &ListPack{}
+}
+
+// Len returns the number of entries
+func (lp *ListPack) Len() int {
+	return lp.size
+}
+
+// Bytes returns the size of the array
+func (lp *ListPack) Bytes() int {
+	return len(lp.buf)
+}
+
+// next returns the entry starting at offset and the offset of the next entry
+func (lp *ListPack) next(offset int) ([]byte, int) {
+	l, k := binary.Uvarint(lp.buf[offset:])
+	start := offset + k
+	end := start + int(l)
+	return lp.buf[start:end:end], end
+}
+
+// ForEach visits entries in order, it breaks if consumer returns false
+func (lp *ListPack) ForEach(consumer func(i int, entry []byte) bool) {
+	offset := 0
+	for i := 0; i < lp.size; i++ {
+		var entry []byte
+		entry, offset = lp.next(offset)
+		if !consumer(i, entry) {
+			return
+		}
+	}
+}
+
+// Get returns the i-th entry
+func (lp *ListPack) Get(i int) []byte {
+	var result []byte
+	lp.ForEach(func(j int, entry []byte) bool {
+		if j == i {
+			result = entry
+			return false
+		}
+		return true
+	})
+	return result
+}
+
+// Find returns the index of the first entry equal to target among entries at 0, step, 2*step ..., or -1 if not found
+func (lp *ListPack) Find(target []byte, step int) int {
+	index := -1
+	lp.ForEach(func(i int, entry []byte) bool {
+		if i%step == 0 && bytes.Equal(entry, target) {
+			index = i
+			return false
+		}
+		return true
+	})
+	return index
+}
+
+func appendEntry(buf []byte, entry []byte) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	k := binary.PutUvarint(lenBuf[:], uint64(len(entry)))
+	buf = append(buf, lenBuf[:k]...)
+	return append(buf, entry...)
+}
+
+// Append puts entries at the end
+func (lp *ListPack) Append(entries ...[]byte) {
+	for _, entry := range entries {
+		lp.buf = appendEntry(lp.buf, entry)
+		lp.size++
+	}
+}
+
+// Replace sets the i-th entry
+func (lp *ListPack) Replace(i int, entry []byte) {
+	buf := make([]byte, 0, len(lp.buf)+len(entry))
+	lp.ForEach(func(j int, e []byte) bool {
+		if j == i {
+			e = entry
+		}
+		buf = appendEntry(buf, e)
+		return true
+	})
+	lp.buf = buf
+}
+
+// Delete removes n entries starting from the i-th one
+func (lp *ListPack) Delete(i int, n int) {
+	buf := make([]byte, 0, len(lp.buf))
+	removed := 0
+	lp.ForEach(func(j int, e []byte) bool {
+		if j >= i && j < i+n {
+			removed++
+			return true
+		}
+		buf = appendEntry(buf, e)
+		return true
+	})
+	lp.buf = buf
+	lp.size -= removed
+}
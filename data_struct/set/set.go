@@ -1,11 +1,32 @@
 package set
 
-import "Tiny-Godis/data_struct/dict"
+import (
+	"Tiny-Godis/data_struct/dict"
+	"Tiny-Godis/data_struct/intset"
+	"Tiny-Godis/data_struct/listpack"
+	"math/rand"
+	"strconv"
+)
 
+// Limits defines when a compact set converts into a larger encoding
+type Limits struct {
+	// max number of members of an intset
+	MaxIntsetEntries int
+	// max number of members of a listpack
+	MaxListpackEntries int
+	// max length of each member of a listpack
+	MaxListpackValue int
+}
+
+// Set is encoded as an intset, a listpack or a dict, only one of them is not nil
 type Set struct {
-	d dict.Dict
+	ints   *intset.IntSet
+	lp     *listpack.ListPack
+	d      dict.Dict
+	limits *Limits
 }
 
+// MakeSet returns a set encoded as dict
 func MakeSet(members ...string) *Set {
 	s := Set{d: dict.MakeSimpleDict()}
 	for _, m := range members {
@@ -14,20 +35,142 @@ func MakeSet(members ...string) *Set {
 	return &s
 }
 
+// MakeCompactSet returns a set starting as an intset, which is converted to listpack or dict when exceeding limits
+func MakeCompactSet(limits Limits, members ...string) *Set {
+	s := Set{ints: intset.Make(), limits: &limits}
+	for _, m := range members {
+		s.Add(m)
+	}
+	return &s
+}
+
+// makeEmpty returns an empty set with the same limits
+func (s *Set) makeEmpty() *Set {
+	if s.limits == nil {
+		return MakeSet()
+	}
+	return MakeCompactSet(*s.limits)
+}
+
+// Encoding returns intset, listpack or hashtable
+func (s *Set) Encoding() string {
+	if s.ints != nil {
+		return "intset"
+	}
+	if s.lp != nil {
+		return "listpack"
+	}
+	return "hashtable"
+}
+
+// parseInt returns the integer of val only if val is its canonical form, so members are kept intact in intset
+func parseInt(val string) (int64, bool) {
+	v, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || strconv.FormatInt(v, 10) != val {
+		return 0, false
+	}
+	return v, true
+}
+
+func (s *Set) toDict() {
+	d := dict.MakeSimpleDict()
+	s.ForEach(func(member string, val interface{}) bool {
+		d.Put(member, struct{}{})
+		return true
+	})
+	s.ints, s.lp, s.d = nil, nil, d
+}
+
+func (s *Set) toListPack() {
+	lp := listpack.Make()
+	s.ForEach(func(member string, val interface{}) bool {
+		lp.Append([]byte(member))
+		return true
+	})
+	s.ints, s.lp = nil, lp
+}
+
+// fitsListPack returns whether the set could be a listpack after adding val
+func (s *Set) fitsListPack(val string) bool {
+	if s.Len() >= s.limits.MaxListpackEntries || len(val) > s.limits.MaxListpackValue {
+		return false
+	}
+	if s.ints != nil && s.ints.Len() > 0 {
+		// the longest member of an intset is one of its ends
+		first := strconv.FormatInt(s.ints.Get(0), 10)
+		last := strconv.FormatInt(s.ints.Get(s.ints.Len()-1), 10)
+		return len(first) <= s.limits.MaxListpackValue && len(last) <= s.limits.MaxListpackValue
+	}
+	return true
+}
+
 func (s *Set) Add(val string) int {
+	if s.ints != nil {
+		if v, ok := parseInt(val); ok {
+			if !s.ints.Add(v) {
+				return 0
+			}
+			if s.ints.Len() > s.limits.MaxIntsetEntries {
+				s.toDict()
+			}
+			return 1
+		}
+		if s.fitsListPack(val) {
+			s.toListPack()
+		} else {
+			s.toDict()
+		}
+	}
+	if s.lp != nil {
+		if s.lp.Find([]byte(val), 1) >= 0 {
+			return 0
+		}
+		if s.fitsListPack(val) {
+			s.lp.Append([]byte(val))
+			return 1
+		}
+		s.toDict()
+	}
 	return s.d.Put(val, struct{}{})
 }
 
 func (s *Set) Remove(val string) int {
+	if s.ints != nil {
+		if v, ok := parseInt(val); ok && s.ints.Remove(v) {
+			return 1
+		}
+		return 0
+	}
+	if s.lp != nil {
+		i := s.lp.Find([]byte(val), 1)
+		if i < 0 {
+			return 0
+		}
+		s.lp.Delete(i, 1)
+		return 1
+	}
 	return s.d.Remove(val)
 }
 
 func (s *Set) Has(val string) bool {
+	if s.ints != nil {
+		v, ok := parseInt(val)
+		return ok && s.ints.Has(v)
+	}
+	if s.lp != nil {
+		return s.lp.Find([]byte(val), 1) >= 0
+	}
 	_, ok := s.d.Get(val)
 	return ok
 }
 
 func (s *Set) Len() int {
+	if s.ints != nil {
+		return s.ints.Len()
+	}
+	if s.lp != nil {
+		return s.lp.Len()
+	}
 	return s.d.Len()
 }
 
@@ -41,11 +184,67 @@ func (s *Set) ToSlice() []string {
 }
 
 func (s *Set) ForEach(recall dict.RecallFunc) {
+	if s.ints != nil {
+		s.ints.ForEach(func(v int64) bool {
+			return recall(strconv.FormatInt(v, 10), struct{}{})
+		})
+		return
+	}
+	if s.lp != nil {
+		s.lp.ForEach(func(i int, entry []byte) bool {
+			return recall(string(entry), struct{}{})
+		})
+		return
+	}
 	s.d.ForEach(recall)
 }
 
+// get returns the i-th member of a compact set
+func (s *Set) get(i int) string {
+	if s.ints != nil {
+		return strconv.FormatInt(s.ints.Get(i), 10)
+	}
+	return string(s.lp.Get(i))
+}
+
+// RandomMembers returns members selected randomly, may contain duplicated members
+func (s *Set) RandomMembers(limit int) []string {
+	if s.d != nil {
+		return s.d.RandomKeys(limit)
+	}
+	if limit <= 0 || s.Len() == 0 {
+		return nil
+	}
+	// limit is given by clients and may be huge, compact sets are small so their size bounds the capacity
+	capacity := limit
+	if capacity > s.Len() {
+		capacity = s.Len()
+	}
+	result := make([]string, 0, capacity)
+	for len(result) < limit {
+		result = append(result, s.get(rand.Intn(s.Len())))
+	}
+	return result
+}
+
+// RandomDistinctMembers returns members selected randomly without duplication, at most Len() members
+func (s *Set) RandomDistinctMembers(limit int) []string {
+	if s.d != nil {
+		return s.d.RandomDistinctKeys(limit)
+	}
+	if limit >= s.Len() {
+		return s.ToSlice()
+	}
+	// compact sets are small, a permutation of indexes is cheap
+	result := make([]string, 0, limit)
+	for _, i := range rand.Perm(s.Len())[:limit] {
+		result = append(result, s.get(i))
+	}
+	return result
+}
+
 func (s *Set) Intersect(another *Set) *Set {
-	result := MakeSet()
+	result := s.makeEmpty()
 	s.ForEach(func(key string, val interface{}) bool {
 		if another.Has(key) {
 			result.Add(key)
@@ -56,7 +255,7 @@ func (s *Set) Intersect(another *Set) *Set {
 }
 
 func (s *Set) Union(another *Set) *Set {
-	result := MakeSet()
+	result := s.makeEmpty()
 	s.ForEach(func(key string, val interface{}) bool {
 		result.Add(key)
 		return true
@@ -69,7 +268,7 @@ func (s *Set) Union(another *Set) *Set {
 }
 
 func (s *Set) Diff(another *Set) *Set {
-	result := MakeSet()
+	result := s.makeEmpty()
 	s.ForEach(func(key string, val interface{}) bool {
 		if !another.Has(key) {
 			result.Add(key)
@@ -0,0 +1,193 @@
+package sortedset
+
+import "math/rand"
+
+const maxLevel = 32
+
+// Element is a member with its score
+type Element struct {
+	Member string
+	Score  float64
+}
+
+type level struct {
+	forward *node
+	// number of nodes skipped by forward
+	span int64
+}
+
+type node struct {
+	Element
+	backward *node
+	level    []*level
+}
+
+// skiplist orders elements by score and then by member
+type skiplist struct {
+	header *node
+	tail   *node
+	length int64
+	level  int
+}
+
+func makeNode(lv int, score float64, member string) *node {
+	n := &node{
+		Element: Element{Member: member, Score: score},
+		level:   make([]*level, lv),
+	}
+	for i := range n.level {
+		n.level[i] = &level{}
+	}
+	return n
+}
+
+func makeSkiplist() *skiplist {
+	return &skiplist{
+		level:  1,
+		header: makeNode(maxLevel, 0, ""),
+	}
+}
+
+// randomLevel returns a level in [1, maxLevel], each higher level is taken with probability 1/4 like redis
+func randomLevel() int {
+	lv := 1
+	for lv < maxLevel && rand.Int31n(4) == 0 {
+		lv++
+	}
+	return lv
+}
+
+// less reports whether (score, member) is ordered before n
+func (n *node) less(score float64, member string) bool {
+	return n.Score < score || (n.Score == score && n.Member < member)
+}
+
+func (sl *skiplist) insert(member string, score float64) *node {
+	update := make([]*node, maxLevel)
+	rank := make([]int64, maxLevel)
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		if i < sl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.less(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	lv := randomLevel()
+	if lv > sl.level {
+		for i := sl.level; i < lv; i++ {
+			rank[i] = 0
+			update[i] = sl.header
+			update[i].level[i].span = sl.length
+		}
+		sl.level = lv
+	}
+
+	x = makeNode(lv, score, member)
+	for i := 0; i < lv; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	// levels above the new node skip it as well
+	for i := lv; i < sl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != sl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		sl.tail = x
+	}
+	sl.length++
+	return x
+}
+
+func (sl *skiplist) removeNode(x *node, update []*node) {
+	for i := 0; i < sl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		sl.tail = x.backward
+	}
+	for sl.level > 1 && sl.header.level[sl.level-1].forward == nil {
+		sl.level--
+	}
+	sl.length--
+}
+
+func (sl *skiplist) remove(member string, score float64) bool {
+	update := make([]*node, maxLevel)
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.less(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x != nil && x.Score == score && x.Member == member {
+		sl.removeNode(x, update)
+		return true
+	}
+	return false
+}
+
+// getRank returns 1-based rank of element, 0 if not found
+func (sl *skiplist) getRank(member string, score float64) int64 {
+	var rank int64
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !(score < x.level[i].forward.Score ||
+			(score == x.level[i].forward.Score && member < x.level[i].forward.Member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != sl.header && x.Member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// getByRank returns node of 1-based rank
+func (sl *skiplist) getByRank(rank int64) *node {
+	var traversed int64
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// firstNotLess returns the first node whose score is not less than min
+func (sl *skiplist) firstNotLess(min float64) *node {
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.Score < min {
+			x = x.level[i].forward
+		}
+	}
+	return x.level[0].forward
+}
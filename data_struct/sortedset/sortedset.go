@@ -0,0 +1,104 @@
+package sortedset
+
+// SortedSet keeps members ordered by score, members of the same score are ordered lexicographically
+type SortedSet struct {
+	dict     map[string]*Element
+	skiplist *skiplist
+}
+
+// Make returns an empty sorted set
+func Make() *SortedSet {
+	return &SortedSet{
+		dict:     make(map[string]*Element),
+		skiplist: makeSkiplist(),
+	}
+}
+
+// Add puts member into set or updates its score, returns true if member is new
+func (s *SortedSet) Add(member string, score float64) bool {
+	element, ok := s.dict[member]
+	if ok {
+		if element.Score != score {
+			s.skiplist.remove(member, element.Score)
+			s.dict[member] = &s.skiplist.insert(member, score).Element
+		}
+		return false
+	}
+	s.dict[member] = &s.skiplist.insert(member, score).Element
+	return true
+}
+
+// Len returns number of members
+func (s *SortedSet) Len() int {
+	return len(s.dict)
+}
+
+// Get returns score of member
+func (s *SortedSet) Get(member string) (float64, bool) {
+	element, ok := s.dict[member]
+	if !ok {
+		return 0, false
+	}
+	return element.Score, true
+}
+
+// Remove deletes member, returns true if member existed
+func (s *SortedSet) Remove(member string) bool {
+	element, ok := s.dict[member]
+	if !ok {
+		return false
+	}
+	s.skiplist.remove(member, element.Score)
+	delete(s.dict, member)
+	return true
+}
+
+// GetRank returns 0-based rank of member, in descending order if desc is set
+func (s *SortedSet) GetRank(member string, desc bool) (int64, bool) {
+	element, ok := s.dict[member]
+	if !ok {
+		return 0, false
+	}
+	rank := s.skiplist.getRank(member, element.Score) - 1
+	if desc {
+		rank = s.skiplist.length - 1 - rank
+	}
+	return rank, true
+}
+
+// ForEachByRank iterates members of 0-based rank in [start, stop], until consumer returns false
+func (s *SortedSet) ForEachByRank(start int64, stop int64, desc bool, consumer func(member string, score float64) bool) {
+	if start < 0 || start > stop || stop >= s.skiplist.length {
+		return
+	}
+	var n *node
+	if desc {
+		n = s.skiplist.getByRank(s.skiplist.length - start)
+	} else {
+		n = s.skiplist.getByRank(start + 1)
+	}
+	for i := start; i <= stop && n != nil; i++ {
+		if !consumer(n.Member, n.Score) {
+			return
+		}
+		if desc {
+			n = n.backward
+		} else {
+			n = n.level[0].forward
+		}
+	}
+}
+
+// ForEach iterates all members in ascending order, until consumer returns false
+func (s *SortedSet) ForEach(consumer func(member string, score float64) bool) {
+	s.ForEachByRank(0, s.skiplist.length-1, false, consumer)
+}
+
+// ForEachByScore iterates members whose score is in [min, max) in ascending order, until consumer returns false
+func (s *SortedSet) ForEachByScore(min float64, max float64, consumer func(member string, score float64) bool) {
+	for n := s.skiplist.firstNotLess(min); n != nil && n.Score < max; n = n.level[0].forward {
+		if !consumer(n.Member, n.Score) {
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package sortedset
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestSortedSet(t *testing.T) {
+	s := Make()
+	expected := make(map[string]float64)
+	for i := 0; i < 2000; i++ {
+		member := strconv.Itoa(rand.Intn(500))
+		if rand.Intn(4) == 0 {
+			_, existed := expected[member]
+			if s.Remove(member) != existed {
+				t.Fatalf("unexpected result of removing %s", member)
+			}
+			delete(expected, member)
+			continue
+		}
+		score := float64(rand.Intn(100))
+		_, existed := expected[member]
+		if s.Add(member, score) == existed {
+			t.Fatalf("unexpected result of adding %s", member)
+		}
+		expected[member] = score
+	}
+	if s.Len() != len(expected) {
+		t.Fatalf("expect %d members, actual %d", len(expected), s.Len())
+	}
+
+	sorted := make([]Element, 0, len(expected))
+	for member, score := range expected {
+		sorted = append(sorted, Element{Member: member, Score: score})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Score != sorted[j].Score {
+			return sorted[i].Score < sorted[j].Score
+		}
+		return sorted[i].Member < sorted[j].Member
+	})
+	for i, e := range sorted {
+		if score, ok := s.Get(e.Member); !ok || score != e.Score {
+			t.Fatalf("unexpected score of %s", e.Member)
+		}
+		if rank, _ := s.GetRank(e.Member, false); rank != int64(i) {
+			t.Fatalf("expect rank %d of %s, actual %d", i, e.Member, rank)
+		}
+		if rank, _ := s.GetRank(e.Member, true); rank != int64(len(sorted)-1-i) {
+			t.Fatalf("expect reversed rank %d of %s, actual %d", len(sorted)-1-i, e.Member, rank)
+		}
+	}
+
+	i := 10
+	s.ForEachByRank(10, 20, false, func(member string, score float64) bool {
+		if member != sorted[i].Member {
+			t.Errorf("expect %s of rank %d, actual %s", sorted[i].Member, i, member)
+		}
+		i++
+		return true
+	})
+	i = len(sorted) - 1
+	s.ForEachByRank(0, int64(len(sorted)-1), true, func(member string, score float64) bool {
+		if member != sorted[i].Member {
+			t.Errorf("expect %s in reversed order, actual %s", sorted[i].Member, member)
+		}
+		i--
+		return true
+	})
+
+	var inRange []string
+	for _, e := range sorted {
+		if e.Score >= 30 && e.Score < 60 {
+			inRange = append(inRange, e.Member)
+		}
+	}
+	i = 0
+	s.ForEachByScore(30, 60, func(member string, score float64) bool {
+		if i >= len(inRange) || member != inRange[i] {
+			t.Errorf("unexpected member %s of score %f", member, score)
+		}
+		i++
+		return true
+	})
+	if i != len(inRange) {
+		t.Errorf("expect %d members in range, actual %d", len(inRange), i)
+	}
+}
@@ -0,0 +1,239 @@
+package stream
+
+import "sort"
+
+// InvalidEntriesRead means the number of entries read by group is unknown
+const InvalidEntriesRead = -1
+
+// PendingEntry is an entry delivered to a consumer but not acknowledged yet
+type PendingEntry struct {
+	ID ID
+	// Consumer owns the entry, it is nil only before a forced claim completes
+	Consumer *Consumer
+	// DeliveryTime is the unix time in milliseconds of the last delivery
+	DeliveryTime  int64
+	DeliveryCount int64
+}
+
+// pendingList holds pending entries ordered by ID
+type pendingList []*PendingEntry
+
+func (pl pendingList) search(id ID) (int, bool) {
+	i := sort.Search(len(pl), func(i int) bool {
+		return !pl[i].ID.Less(id)
+	})
+	return i, i < len(pl) && pl[i].ID == id
+}
+
+func (pl pendingList) get(id ID) *PendingEntry {
+	i, ok := pl.search(id)
+	if !ok {
+		return nil
+	}
+	return pl[i]
+}
+
+func (pl *pendingList) put(pe *PendingEntry) {
+	i, ok := pl.search(pe.ID)
+	if ok {
+		(*pl)[i] = pe
+		return
+	}
+	*pl = append(*pl, nil)
+	copy((*pl)[i+1:], (*pl)[i:])
+	(*pl)[i] = pe
+}
+
+func (pl *pendingList) remove(id ID) {
+	i, ok := pl.search(id)
+	if !ok {
+		return
+	}
+	copy((*pl)[i:], (*pl)[i+1:])
+	(*pl)[len(*pl)-1] = nil
+	*pl = (*pl)[:len(*pl)-1]
+}
+
+func (pl pendingList) rangeOf(start ID, end ID, consumer func(pe *PendingEntry) bool) {
+	i, _ := pl.search(start)
+	for ; i < len(pl) && !end.Less(pl[i].ID); i++ {
+		if !consumer(pl[i]) {
+			return
+		}
+	}
+}
+
+// Consumer is a member of consumer group
+type Consumer struct {
+	Name string
+	// SeenTime is the unix time in milliseconds of the last attempted interaction
+	SeenTime int64
+	// ActiveTime is the unix time in milliseconds of the last successful interaction, -1 means never
+	ActiveTime int64
+	pending    pendingList
+}
+
+// PendingLen returns the number of entries pending for the consumer
+func (c *Consumer) PendingLen() int {
+	return len(c.pending)
+}
+
+// RangePending visits entries pending for the consumer with ID in [start, end]
+func (c *Consumer) RangePending(start ID, end ID, consumer func(pe *PendingEntry) bool) {
+	c.pending.rangeOf(start, end, consumer)
+}
+
+// Group is a consumer group of stream
+type Group struct {
+	Name string
+	// LastID is the ID of the last entry delivered to the group
+	LastID ID
+	// EntriesRead is the logical position of LastID in stream, or InvalidEntriesRead
+	EntriesRead int64
+	pending     pendingList
+	consumers   map[string]*Consumer
+}
+
+func makeGroup(name string, lastID ID, entriesRead int64) *Group {
+	return &Group{
+		Name:        name,
+		LastID:      lastID,
+		EntriesRead: entriesRead,
+		consumers:   make(map[string]*Consumer),
+	}
+}
+
+// Consumer returns the consumer of name, or nil if it does not exist
+func (g *Group) Consumer(name string) *Consumer {
+	return g.consumers[name]
+}
+
+// CreateConsumer adds a consumer seen at now, returns false if the consumer exists
+func (g *Group) CreateConsumer(name string, now int64) (*Consumer, bool) {
+	if c, ok := g.consumers[name]; ok {
+		return c, false
+	}
+	c := &Consumer{
+		Name:       name,
+		SeenTime:   now,
+		ActiveTime: -1,
+	}
+	g.consumers[name] = c
+	return c, true
+}
+
+// DeleteConsumer removes the consumer with its pending entries, returns the number of its pending entries
+func (g *Group) DeleteConsumer(name string) (int, bool) {
+	c, ok := g.consumers[name]
+	if !ok {
+		return 0, false
+	}
+	for _, pe := range c.pending {
+		g.pending.remove(pe.ID)
+	}
+	delete(g.consumers, name)
+	return len(c.pending), true
+}
+
+// Consumers returns consumers ordered by name
+func (g *Group) Consumers() []*Consumer {
+	consumers := make([]*Consumer, 0, len(g.consumers))
+	for _, c := range g.consumers {
+		consumers = append(consumers, c)
+	}
+	sort.Slice(consumers, func(i, j int) bool {
+		return consumers[i].Name < consumers[j].Name
+	})
+	return consumers
+}
+
+// ConsumerCount returns the number of consumers
+func (g *Group) ConsumerCount() int {
+	return len(g.consumers)
+}
+
+// PendingLen returns the number of entries pending in the group
+func (g *Group) PendingLen() int {
+	return len(g.pending)
+}
+
+// Pending returns the pending entry of id, or nil
+func (g *Group) Pending(id ID) *PendingEntry {
+	return g.pending.get(id)
+}
+
+// RangePending visits entries pending in the group with ID in [start, end]
+func (g *Group) RangePending(start ID, end ID, consumer func(pe *PendingEntry) bool) {
+	g.pending.rangeOf(start, end, consumer)
+}
+
+// Deliver records that entry of id is delivered to consumer at now for the first time,
+// an entry pending for another consumer is reassigned
+func (g *Group) Deliver(id ID, c *Consumer, now int64) *PendingEntry {
+	pe := g.pending.get(id)
+	if pe == nil {
+		pe = &PendingEntry{ID: id}
+		g.pending.put(pe)
+	}
+	g.Transfer(pe, c)
+	pe.DeliveryTime = now
+	pe.DeliveryCount = 1
+	return pe
+}
+
+// AddPending creates a pending entry without consumer, it must be transferred to a consumer later
+func (g *Group) AddPending(id ID, now int64) *PendingEntry {
+	pe := &PendingEntry{
+		ID:            id,
+		DeliveryTime:  now,
+		DeliveryCount: 1,
+	}
+	g.pending.put(pe)
+	return pe
+}
+
+// Transfer makes consumer the owner of pending entry
+func (g *Group) Transfer(pe *PendingEntry, c *Consumer) {
+	if pe.Consumer == c {
+		return
+	}
+	if pe.Consumer != nil {
+		pe.Consumer.pending.remove(pe.ID)
+	}
+	pe.Consumer = c
+	c.pending.put(pe)
+}
+
+// Ack removes the pending entry of id, returns false if it is not pending
+func (g *Group) Ack(id ID) bool {
+	pe := g.pending.get(id)
+	if pe == nil {
+		return false
+	}
+	g.pending.remove(id)
+	if pe.Consumer != nil {
+		pe.Consumer.pending.remove(id)
+	}
+	return true
+}
+
+func (g *Group) copy() *Group {
+	c := makeGroup(g.Name, g.LastID, g.EntriesRead)
+	for name, consumer := range g.consumers {
+		c.consumers[name] = &Consumer{
+			Name:       consumer.Name,
+			SeenTime:   consumer.SeenTime,
+			ActiveTime: consumer.ActiveTime,
+		}
+	}
+	c.pending = make(pendingList, len(g.pending))
+	for i, pe := range g.pending {
+		copied := *pe
+		if pe.Consumer != nil {
+			copied.Consumer = c.consumers[pe.Consumer.Name]
+			copied.Consumer.pending = append(copied.Consumer.pending, &copied)
+		}
+		c.pending[i] = &copied
+	}
+	return c
+}
@@ -0,0 +1,83 @@
+package stream
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+)
+
+// ID identifies an entry of stream, IDs are ordered by milliseconds then sequence number
+type ID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+// MaxID is the greatest ID
+var MaxID = ID{Ms: math.MaxUint64, Seq: math.MaxUint64}
+
+// Compare returns -1, 0 or 1 if id is less than, equal to or greater than other
+func (id ID) Compare(other ID) int {
+	switch {
+	case id.Ms < other.Ms:
+		return -1
+	case id.Ms > other.Ms:
+		return 1
+	case id.Seq < other.Seq:
+		return -1
+	case id.Seq > other.Seq:
+		return 1
+	}
+	return 0
+}
+
+// Less reports whether id is less than other
+func (id ID) Less(other ID) bool {
+	return id.Compare(other) < 0
+}
+
+// IsZero reports whether id is 0-0
+func (id ID) IsZero() bool {
+	return id.Ms == 0 && id.Seq == 0
+}
+
+func (id ID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+// Next returns the smallest ID greater than id, returns false if id is MaxID
+func (id ID) Next() (ID, bool) {
+	if id.Seq < math.MaxUint64 {
+		return ID{Ms: id.Ms, Seq: id.Seq + 1}, true
+	}
+	if id.Ms < math.MaxUint64 {
+		return ID{Ms: id.Ms + 1}, true
+	}
+	return id, false
+}
+
+// Prev returns the greatest ID less than id, returns false if id is 0-0
+func (id ID) Prev() (ID, bool) {
+	if id.Seq > 0 {
+		return ID{Ms: id.Ms, Seq: id.Seq - 1}, true
+	}
+	if id.Ms > 0 {
+		return ID{Ms: id.Ms - 1, Seq: math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// Bytes encodes id in 16 bytes big endian, so encoded IDs have the same order as IDs
+func (id ID) Bytes() []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, id.Ms)
+	binary.BigEndian.PutUint64(buf[8:], id.Seq)
+	return buf
+}
+
+// IDFromBytes decodes id encoded by Bytes
+func IDFromBytes(buf []byte) ID {
+	return ID{
+		Ms:  binary.BigEndian.Uint64(buf),
+		Seq: binary.BigEndian.Uint64(buf[8:]),
+	}
+}
@@ -0,0 +1,430 @@
+package stream
+
+import (
+	"Tiny-Godis/data_struct/listpack"
+	"encoding/binary"
+	"sort"
+)
+
+// Entry is an entry of stream, Fields holds field and value pairs alternately.
+// Fields of entries got from stream must not be modified
+type Entry struct {
+	ID     ID
+	Fields [][]byte
+}
+
+const (
+	// a node is closed when it reaches the limits, like stream-node-max-entries and stream-node-max-bytes of redis
+	nodeMaxEntries = 100
+	nodeMaxBytes   = 4096
+)
+
+// node holds consecutive entries in a listpack, an entry is encoded into a single listpack entry
+type node struct {
+	lp *listpack.ListPack
+	// deleted entries still take room of node, like tombstones in redis
+	deleted int
+}
+
+// encodeEntry encodes ID in 16 bytes followed by fields prefixed with their lengths
+func encodeEntry(id ID, fields [][]byte) []byte {
+	size := 16
+	for _, field := range fields {
+		size += binary.MaxVarintLen64 + len(field)
+	}
+	buf := make([]byte, 0, size)
+	buf = append(buf, id.Bytes()...)
+	var lenBuf [binary.MaxVarintLen64]byte
+	for _, field := range fields {
+		k := binary.PutUvarint(lenBuf[:], uint64(len(field)))
+		buf = append(buf, lenBuf[:k]...)
+		buf = append(buf, field...)
+	}
+	return buf
+}
+
+func decodeEntry(buf []byte) *Entry {
+	entry := &Entry{ID: IDFromBytes(buf)}
+	for offset := 16; offset < len(buf); {
+		l, k := binary.Uvarint(buf[offset:])
+		start := offset + k
+		end := start + int(l)
+		entry.Fields = append(entry.Fields, buf[start:end:end])
+		offset = end
+	}
+	return entry
+}
+
+func (n *node) firstID() ID {
+	return IDFromBytes(n.lp.Get(0))
+}
+
+func (n *node) lastID() ID {
+	return IDFromBytes(n.lp.Get(n.lp.Len() - 1))
+}
+
+// Stream is an append only log of entries ordered by ID.
+// Entries are stored in nodes, nodes are indexed by their first ID
+type Stream struct {
+	nodes  []*node
+	length int
+	// LastID is the greatest ID ever added, it is kept even if the entry is deleted
+	LastID ID
+	// MaxDeletedID is the greatest ID removed by Delete
+	MaxDeletedID ID
+	// EntriesAdded counts all entries ever added
+	EntriesAdded uint64
+	groups       map[string]*Group
+}
+
+// Make returns an empty stream
+func Make() *Stream {
+	return &Stream{
+		groups: make(map[string]*Group),
+	}
+}
+
+// Len returns the number of entries
+func (s *Stream) Len() int {
+	return s.length
+}
+
+// NodeCount returns the number of nodes holding entries
+func (s *Stream) NodeCount() int {
+	return len(s.nodes)
+}
+
+// Append adds an entry at the end, id must be greater than LastID
+func (s *Stream) Append(id ID, fields [][]byte) {
+	raw := encodeEntry(id, fields)
+	var last *node
+	if len(s.nodes) > 0 {
+		last = s.nodes[len(s.nodes)-1]
+		if last.lp.Bytes()+len(raw) >= nodeMaxBytes || last.lp.Len()+last.deleted >= nodeMaxEntries {
+			last = nil
+		}
+	}
+	if last == nil {
+		last = &node{lp: listpack.Make()}
+		s.nodes = append(s.nodes, last)
+	}
+	last.lp.Append(raw)
+	s.length++
+	s.LastID = id
+	s.EntriesAdded++
+}
+
+// seek returns index of the last node whose first ID is not greater than id, or -1 if there is no such node
+func (s *Stream) seek(id ID) int {
+	i := sort.Search(len(s.nodes), func(i int) bool {
+		return id.Less(s.nodes[i].firstID())
+	})
+	return i - 1
+}
+
+// Range visits entries with ID in [start, end], it breaks if consumer returns false
+func (s *Stream) Range(start ID, end ID, desc bool, consumer func(entry *Entry) bool) {
+	if desc {
+		for i := s.seek(end); i >= 0; i-- {
+			raws := make([][]byte, 0, s.nodes[i].lp.Len())
+			s.nodes[i].lp.ForEach(func(_ int, raw []byte) bool {
+				raws = append(raws, raw)
+				return true
+			})
+			for j := len(raws) - 1; j >= 0; j-- {
+				raw := raws[j]
+				id := IDFromBytes(raw)
+				if end.Less(id) {
+					continue
+				}
+				if id.Less(start) || !consumer(decodeEntry(raw)) {
+					return
+				}
+			}
+		}
+		return
+	}
+	i := s.seek(start)
+	if i < 0 {
+		i = 0
+	}
+	for ; i < len(s.nodes); i++ {
+		stop := false
+		s.nodes[i].lp.ForEach(func(_ int, raw []byte) bool {
+			id := IDFromBytes(raw)
+			if id.Less(start) {
+				return true
+			}
+			if end.Less(id) || !consumer(decodeEntry(raw)) {
+				stop = true
+				return false
+			}
+			return true
+		})
+		if stop {
+			return
+		}
+	}
+}
+
+// ForEach visits all entries in order
+func (s *Stream) ForEach(consumer func(entry *Entry) bool) {
+	s.Range(ID{}, MaxID, false, consumer)
+}
+
+// Get returns the entry of id
+func (s *Stream) Get(id ID) (*Entry, bool) {
+	var result *Entry
+	s.Range(id, id, false, func(entry *Entry) bool {
+		result = entry
+		return false
+	})
+	return result, result != nil
+}
+
+// First returns the entry of the smallest ID
+func (s *Stream) First() (*Entry, bool) {
+	if len(s.nodes) == 0 {
+		return nil, false
+	}
+	return decodeEntry(s.nodes[0].lp.Get(0)), true
+}
+
+// Last returns the entry of the greatest ID
+func (s *Stream) Last() (*Entry, bool) {
+	if len(s.nodes) == 0 {
+		return nil, false
+	}
+	lp := s.nodes[len(s.nodes)-1].lp
+	return decodeEntry(lp.Get(lp.Len() - 1)), true
+}
+
+// FirstID returns ID of the first entry, or 0-0 if stream is empty
+func (s *Stream) FirstID() ID {
+	if len(s.nodes) == 0 {
+		return ID{}
+	}
+	return s.nodes[0].firstID()
+}
+
+func (s *Stream) removeNode(i int) {
+	copy(s.nodes[i:], s.nodes[i+1:])
+	s.nodes[len(s.nodes)-1] = nil
+	s.nodes = s.nodes[:len(s.nodes)-1]
+}
+
+// Delete removes entry of id and records it as MaxDeletedID, returns false if the entry does not exist
+func (s *Stream) Delete(id ID) bool {
+	i := s.seek(id)
+	if i < 0 {
+		return false
+	}
+	n := s.nodes[i]
+	index := -1
+	n.lp.ForEach(func(j int, raw []byte) bool {
+		if IDFromBytes(raw) == id {
+			index = j
+			return false
+		}
+		return true
+	})
+	if index < 0 {
+		return false
+	}
+	n.lp.Delete(index, 1)
+	n.deleted++
+	if n.lp.Len() == 0 {
+		s.removeNode(i)
+	}
+	s.length--
+	if s.MaxDeletedID.Less(id) {
+		s.MaxDeletedID = id
+	}
+	return true
+}
+
+// TrimMaxLen removes the oldest entries until at most maxLen entries left, returns the number of removed entries.
+// If approx is set, only whole nodes are removed so more entries may be left.
+// limit is the max number of entries removed with whole nodes, 0 means no limit
+func (s *Stream) TrimMaxLen(maxLen int, approx bool, limit int) int {
+	return s.trim(maxLen, nil, approx, limit)
+}
+
+// TrimMinID removes entries whose ID is less than minID, returns the number of removed entries.
+// approx and limit are the same as TrimMaxLen
+func (s *Stream) TrimMinID(minID ID, approx bool, limit int) int {
+	return s.trim(0, &minID, approx, limit)
+}
+
+func (s *Stream) trim(maxLen int, minID *ID, approx bool, limit int) int {
+	deleted := 0
+	for len(s.nodes) > 0 {
+		if minID == nil && s.length <= maxLen {
+			break
+		}
+		n := s.nodes[0]
+		entries := n.lp.Len()
+		if limit > 0 && deleted+entries > limit {
+			break
+		}
+		var wholeNode bool
+		if minID == nil {
+			wholeNode = s.length-entries >= maxLen
+		} else {
+			wholeNode = n.lastID().Less(*minID)
+		}
+		if wholeNode {
+			s.removeNode(0)
+			s.length -= entries
+			deleted += entries
+			continue
+		}
+		if approx {
+			break
+		}
+		// the rest entries to remove are all in the first node
+		k := 0
+		n.lp.ForEach(func(_ int, raw []byte) bool {
+			if minID == nil && s.length-k <= maxLen {
+				return false
+			}
+			if minID != nil && !IDFromBytes(raw).Less(*minID) {
+				return false
+			}
+			k++
+			return true
+		})
+		n.lp.Delete(0, k)
+		n.deleted += k
+		s.length -= k
+		deleted += k
+		break
+	}
+	return deleted
+}
+
+// Group returns the consumer group of name, or nil if it does not exist
+func (s *Stream) Group(name string) *Group {
+	return s.groups[name]
+}
+
+// CreateGroup adds a consumer group, returns false if the group exists
+func (s *Stream) CreateGroup(name string, lastID ID, entriesRead int64) (*Group, bool) {
+	if _, ok := s.groups[name]; ok {
+		return nil, false
+	}
+	g := makeGroup(name, lastID, entriesRead)
+	s.groups[name] = g
+	return g, true
+}
+
+// DestroyGroup removes the consumer group, returns false if the group does not exist
+func (s *Stream) DestroyGroup(name string) bool {
+	if _, ok := s.groups[name]; !ok {
+		return false
+	}
+	delete(s.groups, name)
+	return true
+}
+
+// Groups returns consumer groups ordered by name
+func (s *Stream) Groups() []*Group {
+	groups := make([]*Group, 0, len(s.groups))
+	for _, g := range s.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+// rangeHasTombstones reports whether an entry after start may have been deleted
+func (s *Stream) rangeHasTombstones(start ID) bool {
+	if s.length == 0 || s.MaxDeletedID.IsZero() {
+		return false
+	}
+	if s.MaxDeletedID.Less(s.FirstID()) {
+		return false
+	}
+	return !s.MaxDeletedID.Less(start)
+}
+
+// EstimateEntriesRead returns the number of entries added up to id, or InvalidEntriesRead if it can't be known
+func (s *Stream) EstimateEntriesRead(id ID) int64 {
+	if s.EntriesAdded == 0 {
+		return 0
+	}
+	if s.length == 0 && !s.LastID.Less(id) {
+		return int64(s.EntriesAdded)
+	}
+	switch id.Compare(s.LastID) {
+	case 0:
+		return int64(s.EntriesAdded)
+	case 1:
+		return InvalidEntriesRead
+	}
+	firstID := s.FirstID()
+	if s.MaxDeletedID.IsZero() || s.MaxDeletedID.Less(firstID) {
+		// there are no deleted entries in the stream
+		switch id.Compare(firstID) {
+		case -1:
+			return int64(s.EntriesAdded) - int64(s.length)
+		case 0:
+			return int64(s.EntriesAdded) - int64(s.length) + 1
+		}
+	}
+	return InvalidEntriesRead
+}
+
+// Lag returns the number of entries not delivered to group yet, returns false if it can't be known
+func (s *Stream) Lag(g *Group) (int64, bool) {
+	if s.EntriesAdded == 0 {
+		return 0, true
+	}
+	if g.EntriesRead != InvalidEntriesRead && !s.rangeHasTombstones(g.LastID) {
+		return int64(s.EntriesAdded) - g.EntriesRead, true
+	}
+	entriesRead := s.EstimateEntriesRead(g.LastID)
+	if entriesRead == InvalidEntriesRead {
+		return 0, false
+	}
+	return int64(s.EntriesAdded) - entriesRead, true
+}
+
+// Advance moves last delivered ID of group forward to id of a delivered entry and counts it as read
+func (s *Stream) Advance(g *Group, id ID) {
+	if !g.LastID.Less(id) {
+		return
+	}
+	if g.EntriesRead != InvalidEntriesRead && !s.rangeHasTombstones(id) {
+		g.EntriesRead++
+	} else if s.EntriesAdded > 0 {
+		g.EntriesRead = s.EstimateEntriesRead(id)
+	}
+	g.LastID = id
+}
+
+// Copy returns a deep copy of stream including consumer groups
+func (s *Stream) Copy() *Stream {
+	c := &Stream{
+		nodes:        make([]*node, len(s.nodes)),
+		length:       s.length,
+		LastID:       s.LastID,
+		MaxDeletedID: s.MaxDeletedID,
+		EntriesAdded: s.EntriesAdded,
+		groups:       make(map[string]*Group, len(s.groups)),
+	}
+	for i, n := range s.nodes {
+		lp := listpack.Make()
+		n.lp.ForEach(func(_ int, raw []byte) bool {
+			lp.Append(append([]byte{}, raw...))
+			return true
+		})
+		c.nodes[i] = &node{lp: lp, deleted: n.deleted}
+	}
+	for name, g := range s.groups {
+		c.groups[name] = g.copy()
+	}
+	return c
+}
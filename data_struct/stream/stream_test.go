@@ -0,0 +1,165 @@
+package stream
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func assertEntries(t *testing.T, s *Stream, expected []ID) {
+	t.Helper()
+	if s.Len() != len(expected) {
+		t.Fatalf("expect %d entries, actual %d", len(expected), s.Len())
+	}
+	i := 0
+	s.ForEach(func(entry *Entry) bool {
+		if entry.ID != expected[i] {
+			t.Fatalf("expect %s at %d, actual %s", expected[i], i, entry.ID)
+		}
+		if string(entry.Fields[1]) != expected[i].String() {
+			t.Fatalf("wrong fields of %s", entry.ID)
+		}
+		i++
+		return true
+	})
+	i = len(expected)
+	s.Range(ID{}, MaxID, true, func(entry *Entry) bool {
+		i--
+		if entry.ID != expected[i] {
+			t.Fatalf("expect %s at %d in reverse, actual %s", expected[i], i, entry.ID)
+		}
+		return true
+	})
+}
+
+func TestStream(t *testing.T) {
+	s := Make()
+	var ids []ID
+	for i := 0; i < 1000; i++ {
+		id := ID{Ms: uint64(i / 3), Seq: uint64(i % 3)}
+		s.Append(id, [][]byte{[]byte("id"), []byte(id.String())})
+		ids = append(ids, id)
+	}
+	assertEntries(t, s, ids)
+	if s.NodeCount() < 2 {
+		t.Fatalf("expect entries in many nodes")
+	}
+
+	for k := 0; k < 300; k++ {
+		i := rand.Intn(len(ids))
+		id := ids[i]
+		if !s.Delete(id) {
+			t.Fatalf("%s should be deleted", id)
+		}
+		if s.Delete(id) {
+			t.Fatalf("%s is deleted twice", id)
+		}
+		ids = append(ids[:i], ids[i+1:]...)
+	}
+	assertEntries(t, s, ids)
+	if s.EntriesAdded != 1000 {
+		t.Fatalf("expect 1000 entries added, actual %d", s.EntriesAdded)
+	}
+
+	start, end := ids[100], ids[200]
+	var ranged []ID
+	s.Range(start, end, false, func(entry *Entry) bool {
+		ranged = append(ranged, entry.ID)
+		return true
+	})
+	if len(ranged) != 101 || ranged[0] != start || ranged[100] != end {
+		t.Fatalf("wrong range [%s, %s]", start, end)
+	}
+	if entry, ok := s.Get(ids[50]); !ok || entry.ID != ids[50] {
+		t.Fatalf("%s not found", ids[50])
+	}
+
+	if removed := s.TrimMaxLen(600, false, 0); removed != 100 {
+		t.Fatalf("expect 100 entries trimmed, actual %d", removed)
+	}
+	ids = ids[100:]
+	assertEntries(t, s, ids)
+	removed := s.TrimMaxLen(10, true, 0)
+	if s.Len() < 10 || removed != len(ids)-s.Len() {
+		t.Fatalf("wrong approximate trimming, %d removed, %d left", removed, s.Len())
+	}
+	ids = ids[removed:]
+	assertEntries(t, s, ids)
+	minID := ids[5]
+	if removed = s.TrimMinID(minID, false, 0); removed != 5 {
+		t.Fatalf("expect 5 entries trimmed, actual %d", removed)
+	}
+	assertEntries(t, s, ids[5:])
+
+	c := s.Copy()
+	s.TrimMaxLen(0, false, 0)
+	assertEntries(t, s, nil)
+	if s.NodeCount() != 0 {
+		t.Fatalf("expect no nodes left")
+	}
+	assertEntries(t, c, ids[5:])
+}
+
+func TestGroup(t *testing.T) {
+	s := Make()
+	for i := 1; i <= 10; i++ {
+		s.Append(ID{Ms: uint64(i)}, [][]byte{[]byte("f"), []byte(strconv.Itoa(i))})
+	}
+	g, ok := s.CreateGroup("g", ID{}, 0)
+	if !ok {
+		t.Fatal("group should be created")
+	}
+	if _, ok = s.CreateGroup("g", ID{}, 0); ok {
+		t.Fatal("group is created twice")
+	}
+	c1, _ := g.CreateConsumer("c1", 0)
+	c2, _ := g.CreateConsumer("c2", 0)
+	for i := 1; i <= 6; i++ {
+		id := ID{Ms: uint64(i)}
+		s.Advance(g, id)
+		if i%2 == 0 {
+			g.Deliver(id, c2, 100)
+		} else {
+			g.Deliver(id, c1, 100)
+		}
+	}
+	if lag, ok := s.Lag(g); !ok || lag != 4 {
+		t.Fatalf("expect lag 4, actual %d", lag)
+	}
+	if g.PendingLen() != 6 || c1.PendingLen() != 3 || c2.PendingLen() != 3 {
+		t.Fatal("wrong pending entries")
+	}
+	g.Transfer(g.Pending(ID{Ms: 1}), c2)
+	if c1.PendingLen() != 2 || c2.PendingLen() != 4 {
+		t.Fatal("pending entry is not transferred")
+	}
+	if !g.Ack(ID{Ms: 2}) || g.Ack(ID{Ms: 2}) {
+		t.Fatal("wrong result of ack")
+	}
+
+	c := s.Copy().Group("g")
+	if pending, ok := g.DeleteConsumer("c2"); !ok || pending != 3 {
+		t.Fatalf("expect 3 pending entries of deleted consumer, actual %d", pending)
+	}
+	if g.PendingLen() != 2 || g.ConsumerCount() != 1 {
+		t.Fatal("pending entries of deleted consumer should be removed")
+	}
+	if c.PendingLen() != 5 || c.Consumer("c2").PendingLen() != 3 || c.Pending(ID{Ms: 1}).Consumer != c.Consumer("c2") {
+		t.Fatal("copied group is changed")
+	}
+
+	// an entry deleted after last delivered ID makes lag unknown
+	s.Advance(g, ID{Ms: 7})
+	if lag, ok := s.Lag(g); !ok || lag != 3 {
+		t.Fatalf("expect lag 3, actual %d", lag)
+	}
+	s.Delete(ID{Ms: 9})
+	if _, ok := s.Lag(g); ok {
+		t.Fatal("lag should be unknown")
+	}
+	s.Advance(g, ID{Ms: 8})
+	s.Advance(g, ID{Ms: 10})
+	if lag, ok := s.Lag(g); !ok || lag != 0 {
+		t.Fatalf("expect lag 0, actual %d", lag)
+	}
+}
@@ -3,6 +3,7 @@ package redis
 // Connection represents a connection with redis client
 type Connection interface {
 	Write([]byte) error
+	ID() int64
 	SetPassword(string)
 	GetPassword() string
 
@@ -19,4 +20,8 @@ type Connection interface {
 	EnqueueCmd([][]byte)
 	ClearQueuedCmds()
 	GetWatching() map[string]uint32
+
+	// closed connections must not be blocked by BLPOP and so on
+	IsClosed() bool
+	MarkClosed()
 }
@@ -7,19 +7,21 @@ import (
 var (
 	cfg     = pflag.StringP("ConfigData", "c", "", "qbus-manager ConfigData file path")
 	version = pflag.BoolP("version", "v", false, "show version info.")
+	until   = pflag.Int64("until", 0, "load aof up to the given unix time in milliseconds into memory, aof files are not changed")
 	Flag    *flags
 )
 
 type flags struct {
 	Cfg     string
 	Version bool
+	Until   int64
 }
 
-func NewFlags(cfg string, version bool) *flags {
-	return &flags{Cfg: cfg, Version: version}
+func NewFlags(cfg string, version bool, until int64) *flags {
+	return &flags{Cfg: cfg, Version: version, Until: until}
 }
 
 func Parse() {
 	pflag.Parse()
-	Flag = NewFlags(*cfg, *version)
+	Flag = NewFlags(*cfg, *version, *until)
 }
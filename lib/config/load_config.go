@@ -14,9 +14,27 @@ var (
 func init() {
 	// default config
 	Properties = &ServerProperties{
-		Bind:       "127.0.0.1",
-		Port:       6379,
-		AppendOnly: false,
+		Bind:           "127.0.0.1",
+		Port:           6379,
+		AppendOnly:     false,
+		AppendFilename: "appendonly.aof",
+		AppendDirname:  "appendonlydir",
+		AppendFsync:    "everysec",
+
+		AofUseRdbPreamble: true,
+		AofLoadTruncated:  true,
+
+		AutoAofRewritePercentage: 100,
+		AutoAofRewriteMinSize:    64 << 20,
+
+		HashMaxListpackEntries: 128,
+		HashMaxListpackValue:   64,
+		SetMaxIntsetEntries:    512,
+		SetMaxListpackEntries:  128,
+		SetMaxListpackValue:    64,
+		HllSparseMaxBytes:      3000,
+
+		LuaTimeLimit: 5000,
 	}
 }
 
@@ -26,8 +44,40 @@ type ServerProperties struct {
 	Port           int    `yaml:"port"`
 	AppendOnly     bool   `yaml:"appendOnly"`
 	AppendFilename string `yaml:"appendFilename"`
-	MaxClients     int    `yaml:"maxclients"`
-	RequirePass    string `yaml:"requirepass"`
+	// directory of multi-part aof files, relative to the directory of appendfilename
+	AppendDirname string `yaml:"appenddirname"`
+	AppendFsync   string `yaml:"appendfsync"`
+	// write base file of aof in rdb format when rewriting
+	AofUseRdbPreamble bool `yaml:"aof-use-rdb-preamble"`
+	// load an aof whose last command is incomplete by truncating the tail, otherwise refuse to start
+	AofLoadTruncated bool `yaml:"aof-load-truncated"`
+	// write timestamp annotations into aof, which makes point-in-time recovery possible
+	AofTimestampEnabled bool `yaml:"aof-timestamp-enabled"`
+	// load aof up to the given unix time in milliseconds into memory only, aof files are left unchanged, 0 means load all
+	AofLoadUntil int64 `yaml:"aof-load-until"`
+	// rewrite aof automatically when it grows by the given percentage since last rewrite, 0 means disabled
+	AutoAofRewritePercentage int    `yaml:"auto-aof-rewrite-percentage"`
+	AutoAofRewriteMinSize    int64  `yaml:"auto-aof-rewrite-min-size"`
+	MaxClients               int    `yaml:"maxclients"`
+	RequirePass              string `yaml:"requirepass"`
+	// number of nodes at each end of a list kept uncompressed, 0 disables list compression
+	ListCompressDepth int `yaml:"list-compress-depth"`
+	// small hashes and sets are stored compactly, and converted into hashtable once exceeding these limits
+	HashMaxListpackEntries int `yaml:"hash-max-listpack-entries"`
+	HashMaxListpackValue   int `yaml:"hash-max-listpack-value"`
+	SetMaxIntsetEntries    int `yaml:"set-max-intset-entries"`
+	SetMaxListpackEntries  int `yaml:"set-max-listpack-entries"`
+	SetMaxListpackValue    int `yaml:"set-max-listpack-value"`
+	// HyperLogLog in sparse encoding is converted into dense encoding once its size exceeds the limit
+	HllSparseMaxBytes int `yaml:"hll-sparse-max-bytes"`
+	// lazyfree-lazy-* options are kept for compatibility of config files and have no effect:
+	// removed values are detached in O(1) and reclaimed by the garbage collector in background anyway
+	LazyfreeLazyEviction  bool `yaml:"lazyfree-lazy-eviction"`
+	LazyfreeLazyExpire    bool `yaml:"lazyfree-lazy-expire"`
+	LazyfreeLazyUserDel   bool `yaml:"lazyfree-lazy-user-del"`
+	LazyfreeLazyUserFlush bool `yaml:"lazyfree-lazy-user-flush"`
+	// milliseconds a script may run before SCRIPT KILL can interrupt it, 0 or negative means never
+	LuaTimeLimit int `yaml:"lua-time-limit"`
 
 	Peers []string `yaml:"peers"`
 	Self  string   `yaml:"self"`
@@ -39,18 +89,64 @@ func SetupConfig() error {
 	if err != nil {
 		return err
 	}
+	viper.SetDefault("appendfilename", "appendonly.aof")
+	viper.SetDefault("appenddirname", "appendonlydir")
+	viper.SetDefault("appendfsync", "everysec")
+	viper.SetDefault("aof-use-rdb-preamble", true)
+	viper.SetDefault("aof-load-truncated", true)
+	viper.SetDefault("aof-timestamp-enabled", false)
+	viper.SetDefault("auto-aof-rewrite-percentage", 100)
+	viper.SetDefault("auto-aof-rewrite-min-size", "64mb")
+	viper.SetDefault("hash-max-listpack-entries", 128)
+	viper.SetDefault("hash-max-listpack-value", 64)
+	viper.SetDefault("set-max-intset-entries", 512)
+	viper.SetDefault("set-max-listpack-entries", 128)
+	viper.SetDefault("set-max-listpack-value", 64)
+	viper.SetDefault("hll-sparse-max-bytes", 3000)
+	viper.SetDefault("lua-time-limit", 5000)
 	onceConfig.Do(func() {
 		Properties = &ServerProperties{
 			Bind:           viper.GetString("bind"),
 			Port:           viper.GetInt("port"),
 			AppendOnly:     viper.GetBool("appendOnly"),
 			AppendFilename: viper.GetString("appendFilename"),
-			MaxClients:     viper.GetInt("maxclients"),
-			RequirePass:    viper.GetString("requirepass"),
+			AppendDirname:  viper.GetString("appenddirname"),
+			AppendFsync:    viper.GetString("appendfsync"),
+
+			AofUseRdbPreamble: viper.GetBool("aof-use-rdb-preamble"),
+			AofLoadTruncated:  viper.GetBool("aof-load-truncated"),
+
+			AofTimestampEnabled: viper.GetBool("aof-timestamp-enabled"),
+			AofLoadUntil:        viper.GetInt64("aof-load-until"),
+
+			AutoAofRewritePercentage: viper.GetInt("auto-aof-rewrite-percentage"),
+			AutoAofRewriteMinSize:    int64(viper.GetSizeInBytes("auto-aof-rewrite-min-size")),
+
+			ListCompressDepth: viper.GetInt("list-compress-depth"),
+
+			HashMaxListpackEntries: viper.GetInt("hash-max-listpack-entries"),
+			HashMaxListpackValue:   viper.GetInt("hash-max-listpack-value"),
+			SetMaxIntsetEntries:    viper.GetInt("set-max-intset-entries"),
+			SetMaxListpackEntries:  viper.GetInt("set-max-listpack-entries"),
+			SetMaxListpackValue:    viper.GetInt("set-max-listpack-value"),
+			HllSparseMaxBytes:      viper.GetInt("hll-sparse-max-bytes"),
+
+			LazyfreeLazyEviction:  viper.GetBool("lazyfree-lazy-eviction"),
+			LazyfreeLazyExpire:    viper.GetBool("lazyfree-lazy-expire"),
+			LazyfreeLazyUserDel:   viper.GetBool("lazyfree-lazy-user-del"),
+			LazyfreeLazyUserFlush: viper.GetBool("lazyfree-lazy-user-flush"),
+
+			LuaTimeLimit: viper.GetInt("lua-time-limit"),
+
+			MaxClients:  viper.GetInt("maxclients"),
+			RequirePass: viper.GetString("requirepass"),
 
 			Peers: viper.GetStringSlice("peers"),
 			Self:  viper.GetString("self"),
 		}
+		if Flag != nil && Flag.Until > 0 {
+			Properties.AofLoadUntil = Flag.Until
+		}
 	})
 	return nil
 }
@@ -0,0 +1,372 @@
+// Package geohash encodes coordinates into interleaved bits like redis, so scores of geo sets are compatible with redis
+package geohash
+
+import "math"
+
+const (
+	// StepMax is the precision of scores, which are 52 bits integers
+	StepMax = 26
+
+	LatMin  = -85.05112878
+	LatMax  = 85.05112878
+	LongMin = -180.0
+	LongMax = 180.0
+
+	// EarthRadius is the earth radius in meters used by redis
+	EarthRadius  = 6372797.560856
+	mercatorMax  = 20037726.37
+	degToRad     = math.Pi / 180.0
+	base32Digits = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+// Range is the interval of a coordinate
+type Range struct {
+	Min float64
+	Max float64
+}
+
+// Bits is a geohash of step*2 bits, latitude is in even bits and longitude in odd bits
+type Bits struct {
+	Bits uint64
+	Step uint
+}
+
+// IsZero reports whether hash is an excluded area
+func (h Bits) IsZero() bool {
+	return h.Bits == 0 && h.Step == 0
+}
+
+// Area is the box of a geohash
+type Area struct {
+	Hash      Bits
+	Longitude Range
+	Latitude  Range
+}
+
+var (
+	wgs84LongRange = Range{Min: LongMin, Max: LongMax}
+	wgs84LatRange  = Range{Min: LatMin, Max: LatMax}
+	// standardLatRange is used by geohash strings
+	standardLatRange = Range{Min: -90, Max: 90}
+)
+
+// interleave spreads bits of x into even bits and bits of y into odd bits
+func interleave(x uint32, y uint32) uint64 {
+	spread := func(v uint32) uint64 {
+		u := uint64(v)
+		u = (u | u<<16) & 0x0000FFFF0000FFFF
+		u = (u | u<<8) & 0x00FF00FF00FF00FF
+		u = (u | u<<4) & 0x0F0F0F0F0F0F0F0F
+		u = (u | u<<2) & 0x3333333333333333
+		u = (u | u<<1) & 0x5555555555555555
+		return u
+	}
+	return spread(x) | spread(y)<<1
+}
+
+// deinterleave returns even bits and odd bits
+func deinterleave(interleaved uint64) (uint32, uint32) {
+	squash := func(u uint64) uint32 {
+		u &= 0x5555555555555555
+		u = (u | u>>1) & 0x3333333333333333
+		u = (u | u>>2) & 0x0F0F0F0F0F0F0F0F
+		u = (u | u>>4) & 0x00FF00FF00FF00FF
+		u = (u | u>>8) & 0x0000FFFF0000FFFF
+		u = (u | u>>16) & 0x00000000FFFFFFFF
+		return uint32(u)
+	}
+	return squash(interleaved), squash(interleaved >> 1)
+}
+
+func encode(longRange Range, latRange Range, longitude float64, latitude float64, step uint) (Bits, bool) {
+	if longitude > LongMax || longitude < LongMin || latitude > LatMax || latitude < LatMin {
+		return Bits{}, false
+	}
+	if latitude < latRange.Min || latitude > latRange.Max || longitude < longRange.Min || longitude > longRange.Max {
+		return Bits{}, false
+	}
+	latOffset := (latitude - latRange.Min) / (latRange.Max - latRange.Min)
+	longOffset := (longitude - longRange.Min) / (longRange.Max - longRange.Min)
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+	return Bits{Bits: interleave(uint32(latOffset), uint32(longOffset)), Step: step}, true
+}
+
+// Encode returns geohash of coordinate in the given step, ok is false if the coordinate is out of range
+func Encode(longitude float64, latitude float64, step uint) (Bits, bool) {
+	return encode(wgs84LongRange, wgs84LatRange, longitude, latitude, step)
+}
+
+// Decode returns the area of hash
+func Decode(hash Bits) Area {
+	return decode(wgs84LongRange, wgs84LatRange, hash)
+}
+
+func decode(longRange Range, latRange Range, hash Bits) Area {
+	lat, long := deinterleave(hash.Bits)
+	latScale := latRange.Max - latRange.Min
+	longScale := longRange.Max - longRange.Min
+	cells := float64(uint64(1) << hash.Step)
+	return Area{
+		Hash: hash,
+		Latitude: Range{
+			Min: latRange.Min + float64(lat)/cells*latScale,
+			Max: latRange.Min + (float64(lat)+1)/cells*latScale,
+		},
+		Longitude: Range{
+			Min: longRange.Min + float64(long)/cells*longScale,
+			Max: longRange.Min + (float64(long)+1)/cells*longScale,
+		},
+	}
+}
+
+// Center returns longitude and latitude of the center of area
+func (area Area) Center() (float64, float64) {
+	longitude := math.Min(math.Max((area.Longitude.Min+area.Longitude.Max)/2, LongMin), LongMax)
+	latitude := math.Min(math.Max((area.Latitude.Min+area.Latitude.Max)/2, LatMin), LatMax)
+	return longitude, latitude
+}
+
+// Align52Bits converts hash into a score of 52 bits
+func Align52Bits(hash Bits) uint64 {
+	return hash.Bits << (52 - hash.Step*2)
+}
+
+// EncodeScore returns the score of coordinate in geo set
+func EncodeScore(longitude float64, latitude float64) (uint64, bool) {
+	hash, ok := Encode(longitude, latitude, StepMax)
+	if !ok {
+		return 0, false
+	}
+	return Align52Bits(hash), true
+}
+
+// DecodeScore returns longitude and latitude of the score in geo set
+func DecodeScore(score uint64) (float64, float64) {
+	return Decode(Bits{Bits: score, Step: StepMax}).Center()
+}
+
+// ToString returns standard geohash string of 11 characters of score.
+// Scores use latitude range [-85, 85] while geohash strings use [-90, 90], so the coordinate is encoded again
+func ToString(score uint64) string {
+	longitude, latitude := DecodeScore(score)
+	hash, _ := encode(wgs84LongRange, standardLatRange, longitude, latitude, StepMax)
+	buf := make([]byte, 11)
+	for i := range buf {
+		// there are only 52 bits, the last character is always 0 for compatibility
+		index := 0
+		if i < 10 {
+			index = int(hash.Bits>>(52-uint(i+1)*5)) & 0x1f
+		}
+		buf[i] = base32Digits[index]
+	}
+	return string(buf)
+}
+
+func moveX(hash *Bits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.Bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.Bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - hash.Step*2)
+	if d > 0 {
+		x = x + (zz + 1)
+	} else {
+		x = x | zz
+		x = x - (zz + 1)
+	}
+	x &= 0xaaaaaaaaaaaaaaaa >> (64 - hash.Step*2)
+	hash.Bits = x | y
+}
+
+func moveY(hash *Bits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.Bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.Bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - hash.Step*2)
+	if d > 0 {
+		y = y + (zz + 1)
+	} else {
+		y = y | zz
+		y = y - (zz + 1)
+	}
+	y &= 0x5555555555555555 >> (64 - hash.Step*2)
+	hash.Bits = x | y
+}
+
+// Neighbors are the 8 areas around a geohash
+type Neighbors struct {
+	North     Bits
+	East      Bits
+	West      Bits
+	South     Bits
+	NorthEast Bits
+	SouthEast Bits
+	NorthWest Bits
+	SouthWest Bits
+}
+
+func neighborOf(hash Bits, dx int, dy int) Bits {
+	moveX(&hash, dx)
+	moveY(&hash, dy)
+	return hash
+}
+
+// GetNeighbors returns the areas around hash
+func GetNeighbors(hash Bits) Neighbors {
+	return Neighbors{
+		East:      neighborOf(hash, 1, 0),
+		West:      neighborOf(hash, -1, 0),
+		South:     neighborOf(hash, 0, -1),
+		North:     neighborOf(hash, 0, 1),
+		NorthWest: neighborOf(hash, -1, 1),
+		SouthWest: neighborOf(hash, -1, -1),
+		NorthEast: neighborOf(hash, 1, 1),
+		SouthEast: neighborOf(hash, 1, -1),
+	}
+}
+
+// EstimateStepsByRadius returns the step whose area covers the radius at the latitude
+func EstimateStepsByRadius(rangeMeters float64, latitude float64) uint {
+	if rangeMeters == 0 {
+		return StepMax
+	}
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	// make sure range is included in most of the base cases
+	step -= 2
+	// areas are narrower near the poles
+	if latitude > 66 || latitude < -66 {
+		step--
+		if latitude > 80 || latitude < -80 {
+			step--
+		}
+	}
+	if step < 1 {
+		step = 1
+	}
+	if step > StepMax {
+		step = StepMax
+	}
+	return uint(step)
+}
+
+// Shape is a circle of radius or a box of width and height around the center, sizes are in meters
+type Shape struct {
+	Longitude float64
+	Latitude  float64
+	IsBox     bool
+	Radius    float64
+	Width     float64
+	Height    float64
+}
+
+// BoundingBox returns min longitude, min latitude, max longitude and max latitude around shape
+func (shape *Shape) BoundingBox() (float64, float64, float64, float64) {
+	height, width := shape.Radius, shape.Radius
+	if shape.IsBox {
+		height, width = shape.Height/2, shape.Width/2
+	}
+	latDelta := height / EarthRadius / degToRad
+	longDeltaTop := width / EarthRadius / math.Cos((shape.Latitude+latDelta)*degToRad) / degToRad
+	longDeltaBottom := width / EarthRadius / math.Cos((shape.Latitude-latDelta)*degToRad) / degToRad
+	// the directions of the northern and southern hemispheres are opposite
+	longDelta := longDeltaTop
+	if shape.Latitude < 0 {
+		longDelta = longDeltaBottom
+	}
+	return shape.Longitude - longDelta, shape.Latitude - latDelta, shape.Longitude + longDelta, shape.Latitude + latDelta
+}
+
+// Radius is the areas to search around the center, excluded neighbors are zero
+type Radius struct {
+	Hash      Bits
+	Area      Area
+	Neighbors Neighbors
+}
+
+// AreasByShape returns the area containing the center and the neighbors which cover the shape
+func AreasByShape(shape *Shape) Radius {
+	minLong, minLat, maxLong, maxLat := shape.BoundingBox()
+	radiusMeters := shape.Radius
+	if shape.IsBox {
+		radiusMeters = math.Sqrt(shape.Width/2*(shape.Width/2) + shape.Height/2*(shape.Height/2))
+	}
+	steps := EstimateStepsByRadius(radiusMeters, shape.Latitude)
+	hash, _ := Encode(shape.Longitude, shape.Latitude, steps)
+	neighbors := GetNeighbors(hash)
+	area := Decode(hash)
+
+	// the step may be too large if the shape is near the edge of the area
+	north, south := Decode(neighbors.North), Decode(neighbors.South)
+	east, west := Decode(neighbors.East), Decode(neighbors.West)
+	if steps > 1 && (north.Latitude.Max < maxLat || south.Latitude.Min > minLat ||
+		east.Longitude.Max < maxLong || west.Longitude.Min > minLong) {
+		steps--
+		hash, _ = Encode(shape.Longitude, shape.Latitude, steps)
+		neighbors = GetNeighbors(hash)
+		area = Decode(hash)
+	}
+
+	// exclude useless areas
+	if steps >= 2 {
+		if area.Latitude.Min < minLat {
+			neighbors.South, neighbors.SouthWest, neighbors.SouthEast = Bits{}, Bits{}, Bits{}
+		}
+		if area.Latitude.Max > maxLat {
+			neighbors.North, neighbors.NorthEast, neighbors.NorthWest = Bits{}, Bits{}, Bits{}
+		}
+		if area.Longitude.Min < minLong {
+			neighbors.West, neighbors.SouthWest, neighbors.NorthWest = Bits{}, Bits{}, Bits{}
+		}
+		if area.Longitude.Max > maxLong {
+			neighbors.East, neighbors.SouthEast, neighbors.NorthEast = Bits{}, Bits{}, Bits{}
+		}
+	}
+	return Radius{Hash: hash, Area: area, Neighbors: neighbors}
+}
+
+// ScoreRange returns scores of members in hash, min is inclusive and max is exclusive
+func ScoreRange(hash Bits) (uint64, uint64) {
+	min := Align52Bits(hash)
+	hash.Bits++
+	return min, Align52Bits(hash)
+}
+
+func latDistance(lat1 float64, lat2 float64) float64 {
+	return EarthRadius * math.Abs(lat2*degToRad-lat1*degToRad)
+}
+
+// Distance returns the haversine great circle distance in meters
+func Distance(long1 float64, lat1 float64, long2 float64, lat2 float64) float64 {
+	long1r, long2r := long1*degToRad, long2*degToRad
+	v := math.Sin((long2r - long1r) / 2)
+	if v == 0 {
+		return latDistance(lat1, lat2)
+	}
+	lat1r, lat2r := lat1*degToRad, lat2*degToRad
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2.0 * EarthRadius * math.Asin(math.Sqrt(a))
+}
+
+// Contains returns distance from the center to the coordinate if it is in shape
+func (shape *Shape) Contains(longitude float64, latitude float64) (float64, bool) {
+	if !shape.IsBox {
+		distance := Distance(shape.Longitude, shape.Latitude, longitude, latitude)
+		return distance, distance <= shape.Radius
+	}
+	if latDistance(latitude, shape.Latitude) > shape.Height/2 {
+		return 0, false
+	}
+	if Distance(longitude, latitude, shape.Longitude, latitude) > shape.Width/2 {
+		return 0, false
+	}
+	return Distance(shape.Longitude, shape.Latitude, longitude, latitude), true
+}
@@ -0,0 +1,51 @@
+package geohash
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEncodeScore(t *testing.T) {
+	score, ok := EncodeScore(13.361389, 38.115556)
+	if !ok || score != 3479099956230698 {
+		t.Errorf("unexpected score %d", score)
+	}
+	if s := ToString(score); s != "sqc8b49rny0" {
+		t.Errorf("unexpected geohash string %s", s)
+	}
+	longitude, latitude := DecodeScore(score)
+	if math.Abs(longitude-13.361389) > 1e-5 || math.Abs(latitude-38.115556) > 1e-5 {
+		t.Errorf("unexpected decoded position %f,%f", longitude, latitude)
+	}
+	if _, ok := EncodeScore(13, 86); ok {
+		t.Error("latitude out of range should be rejected")
+	}
+}
+
+func TestNeighbors(t *testing.T) {
+	hash, _ := Encode(15, 37, 10)
+	neighbors := GetNeighbors(hash)
+	area := Decode(hash)
+	east := Decode(neighbors.East)
+	if east.Longitude.Min != area.Longitude.Max || east.Latitude != area.Latitude {
+		t.Errorf("east neighbor is not adjacent: %v %v", area, east)
+	}
+	north := Decode(neighbors.North)
+	if north.Latitude.Min != area.Latitude.Max || north.Longitude != area.Longitude {
+		t.Errorf("north neighbor is not adjacent: %v %v", area, north)
+	}
+}
+
+func TestShapeContains(t *testing.T) {
+	shape := &Shape{Longitude: 15, Latitude: 37, Radius: 200 * 1000}
+	if dist, ok := shape.Contains(15.087269, 37.502669); !ok || math.Abs(dist-56441) > 1 {
+		t.Errorf("unexpected distance %f", dist)
+	}
+	if _, ok := shape.Contains(17.24151, 38.788135); ok {
+		t.Error("point outside radius")
+	}
+	box := &Shape{Longitude: 15, Latitude: 37, IsBox: true, Width: 400 * 1000, Height: 400 * 1000}
+	if _, ok := box.Contains(17.24151, 38.788135); !ok {
+		t.Error("point inside box")
+	}
+}
@@ -18,3 +18,15 @@ func (b *Boolean) Set(v bool) {
 		atomic.StoreUint32((*uint32)(b), 0)
 	}
 }
+
+// CompareAndSwap sets the value to new only if it is old now, returns whether the swap happened
+func (b *Boolean) CompareAndSwap(old, new bool) bool {
+	var o, n uint32
+	if old {
+		o = 1
+	}
+	if new {
+		n = 1
+	}
+	return atomic.CompareAndSwapUint32((*uint32)(b), o, n)
+}
@@ -139,8 +139,13 @@ func (tw *TimeWheel) addTask(task *task) {
 }
 
 func (tw *TimeWheel) getPosAndCircle(delay time.Duration) (pos int, circle int) {
-	circle = int(delay.Seconds()) / int(tw.interval.Seconds()) / tw.slotNum
-	pos = (tw.currentPos+int(delay.Seconds())/int(tw.interval.Seconds()))%tw.slotNum - 1
+	steps := int(delay.Seconds()) / int(tw.interval.Seconds())
+	if steps < 1 {
+		// the current slot has been handled, tasks due within an interval run at the next tick
+		steps = 1
+	}
+	circle = steps / tw.slotNum
+	pos = (tw.currentPos + steps - 1) % tw.slotNum
 	return circle, pos
 }
 
@@ -15,6 +15,9 @@ const (
 	maxWait  = 3 * time.Second
 )
 
+// TimeoutErrReply is returned by Send if no reply is received in time
+var TimeoutErrReply = reply.MakeErrReply("request timeout")
+
 type Client struct {
 	conn        net.Conn
 	sendingChan chan *request
@@ -22,6 +25,10 @@ type Client struct {
 	waiting     *wait.Wait
 	addr        string
 	ticker      *time.Ticker
+	// closed to stop heartbeat
+	stopChan chan struct{}
+	// max time to wait for a reply
+	timeout time.Duration
 }
 
 type request struct {
@@ -33,7 +40,12 @@ type request struct {
 }
 
 func MakeClient(addr string) (*Client, error) {
-	conn, err := net.Dial("tcp", addr)
+	return MakeClientWithTimeout(addr, maxWait)
+}
+
+// MakeClientWithTimeout creates a client which waits at most timeout for connecting and each reply
+func MakeClientWithTimeout(addr string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -43,6 +55,8 @@ func MakeClient(addr string) (*Client, error) {
 		waitingChan: make(chan *request, chanSize),
 		waiting:     &wait.Wait{},
 		addr:        addr,
+		stopChan:    make(chan struct{}),
+		timeout:     timeout,
 	}, nil
 }
 
@@ -139,7 +153,9 @@ func (c *Client) send(args [][]byte) redis.Reply {
 	c.waiting.Add(1)
 	defer c.waiting.Done()
 	c.sendingChan <- req
-	req.waiting.WaitWithTimeout(maxWait)
+	if req.waiting.WaitWithTimeout(c.timeout) {
+		return TimeoutErrReply
+	}
 	if req.err != nil {
 		return reply.MakeErrReply("request failed: " + req.err.Error())
 	}
@@ -147,8 +163,13 @@ func (c *Client) send(args [][]byte) redis.Reply {
 }
 
 func (c *Client) heartbeat() {
-	for range c.ticker.C {
-		c.doHeartbeat()
+	for {
+		select {
+		case <-c.ticker.C:
+			c.doHeartbeat()
+		case <-c.stopChan:
+			return
+		}
 	}
 }
 
@@ -161,6 +182,7 @@ func (c *Client) Start() {
 
 func (c *Client) Close() {
 	c.ticker.Stop()
+	close(c.stopChan)
 
 	close(c.sendingChan)
 
@@ -5,13 +5,19 @@ import (
 	"Tiny-Godis/lib/sync/wait"
 	"net"
 	"sync"
+	stdatomic "sync/atomic"
 	"time"
 )
 
+// nextID is the id of the latest connection, used by CLIENT ID and CLIENT UNBLOCK
+var nextID int64
+
 // Connection represents a connection with a redis-cli
 type Connection struct {
 	conn net.Conn
 
+	id int64
+
 	// waiting until reply finished
 	waitingReply wait.Wait
 
@@ -28,6 +34,9 @@ type Connection struct {
 
 	// pub/sub
 	subs map[string]struct{}
+
+	// closed is set once the server released resources of the connection
+	closed atomic.Boolean
 }
 
 // RemoteAddr returns the remote network address
@@ -46,6 +55,7 @@ func (c *Connection) Close() error {
 func MakeConn(conn net.Conn) *Connection {
 	return &Connection{
 		conn: conn,
+		id:   stdatomic.AddInt64(&nextID, 1),
 		//watchingQueue: make(map[string]uint32),
 	}
 }
@@ -66,6 +76,11 @@ func (c *Connection) Write(b []byte) error {
 	return err
 }
 
+// ID returns the unique id of connection
+func (c *Connection) ID() int64 {
+	return c.id
+}
+
 func (c *Connection) SetPassword(pw string) {
 	if len(pw) == 0 {
 		return
@@ -86,6 +101,14 @@ func (c *Connection) SetMultiState(state bool) {
 	c.multiState.Set(state)
 }
 
+func (c *Connection) IsClosed() bool {
+	return c.closed.Get()
+}
+
+func (c *Connection) MarkClosed() {
+	c.closed.Set(true)
+}
+
 func (c *Connection) GetQueuedCmdLine() [][][]byte {
 	if c.queue == nil {
 		c.queue = make([][][]byte, 0)
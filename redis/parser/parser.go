@@ -25,6 +25,8 @@ type readState struct {
 	msgType           byte
 	args              [][]byte
 	bulkLen           int64
+	// readingBody is set when the next read is the body of a bulk string, even an empty one
+	readingBody bool
 }
 
 func (s *readState) finished() bool {
@@ -161,7 +163,7 @@ func readLine(reader *bufio.Reader, state *readState) ([]byte, bool, error) {
 	var err error
 	var msg []byte
 
-	if state.bulkLen == 0 {
+	if state.bulkLen == 0 && !state.readingBody {
 		msg, err = reader.ReadBytes('\n')
 		if err != nil {
 			return nil, true, err
@@ -187,15 +189,21 @@ func readLine(reader *bufio.Reader, state *readState) ([]byte, bool, error) {
 func readBody(msg []byte, state *readState) error {
 	line := msg[:len(msg)-2]
 	var err error
-	if line[0] == '$' {
+	if state.readingBody {
+		// body is binary safe, it may be empty or begin with '$'
+		state.args = append(state.args, line)
+		state.readingBody = false
+	} else if line[0] == '$' {
 		state.bulkLen, err = strconv.ParseInt(string(line[1:]), 10, 64)
 		if err != nil {
 			return fmt.Errorf("protocal error: %s", string(msg))
 		}
-		if state.bulkLen <= 0 {
-			// todo: 重复添加空字符串????
+		if state.bulkLen < 0 {
+			// null bulk string has no body
 			state.args = append(state.args, []byte{})
 			state.bulkLen = 0
+		} else {
+			state.readingBody = true
 		}
 	} else {
 		state.args = append(state.args, line)
@@ -232,9 +240,10 @@ func parseBulkHeader(msg []byte, state *readState) error {
 	}
 	if state.bulkLen == -1 {
 		return nil
-	} else if state.bulkLen > 0 {
+	} else if state.bulkLen >= 0 {
 		state.msgType = msg[0]
 		state.readingMultiLine = true
+		state.readingBody = true
 		state.expectedArgsCount = 1
 		state.args = make([][]byte, 0, 1)
 	} else {
@@ -51,6 +51,12 @@ func TestParseStream(t *testing.T) {
 			[]byte("\r\n"),
 		}),
 		reply.MakeEmptyMultiBulkReply(),
+		reply.MakeBulkReply([]byte("$3")),
+		reply.MakeMultiBulkReply([][]byte{
+			[]byte(""),
+			[]byte("$1"),
+			[]byte(""),
+		}),
 	}
 	reqs := bytes.Buffer{}
 	for _, re := range replies {
@@ -56,6 +56,21 @@ func MakeEmptyMultiBulkReply() *EmptyMultiBulkReply {
 	return &EmptyMultiBulkReply{}
 }
 
+var nullMultiBulkBytes = []byte("*-1\r\n")
+
+// NullMultiBulkReply is a nil list
+type NullMultiBulkReply struct{}
+
+// ToBytes marshal redis.Reply
+func (r *NullMultiBulkReply) ToBytes() []byte {
+	return nullMultiBulkBytes
+}
+
+// MakeNullMultiBulkReply creates NullMultiBulkReply
+func MakeNullMultiBulkReply() *NullMultiBulkReply {
+	return &NullMultiBulkReply{}
+}
+
 // NoReply respond nothing, for commands like subscribe
 type NoReply struct{}
 
@@ -19,6 +19,9 @@ var (
 	unknownErrReplyBytes = []byte("-ERR unknown\r\n")
 )
 
+// clientQueueSize is the max number of pipelined commands waiting for a blocking command
+const clientQueueSize = 1024
+
 type Handler struct {
 	activeConn sync.Map
 	db         db.DB
@@ -37,6 +40,24 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 	client := connection.MakeConn(conn)
 	h.activeConn.Store(client, struct{}{})
 
+	// commands are executed in another goroutine,
+	// so that closing connection could be detected while a command is blocking
+	var closed atomic.Boolean
+	queue := make(chan *parser.Payload, clientQueueSize)
+	defer close(queue)
+	go func() {
+		for payload := range queue {
+			if closed.Get() {
+				// commands received before closing are discarded
+				continue
+			}
+			if !h.exec(client, payload) {
+				closed.Set(true)
+				h.closeClient(client)
+			}
+		}
+	}()
+
 	ch := parser.ParseStream(conn)
 	for payload := range ch {
 		if payload.Err != nil {
@@ -44,44 +65,57 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 				payload.Err == io.ErrUnexpectedEOF ||
 				strings.Contains(payload.Err.Error(), "use of closed network connection") {
 				// connection closed
+				closed.Set(true)
 				h.closeClient(client)
 				logger.Info("connection closed: " + client.RemoteAddr().String())
 				return
 			}
-
-			errReply := reply.MakeErrReply(payload.Err.Error())
-			err := client.Write(errReply.ToBytes())
-			if err != nil {
-				h.closeClient(client)
-				logger.Info("connection closed: " + client.RemoteAddr().String())
-				return
-			}
-			continue
 		}
-		if payload.Data == nil {
-			logger.Error("empty payload")
-			continue
-		}
-		r, ok := payload.Data.(*reply.MultiBulkReply)
-		if !ok {
-			logger.Error("require multi bulk reply")
-			continue
-		}
-		result := h.db.Exec(client, r.Args)
-		if result != nil {
-			_ = client.Write(result.ToBytes())
-		} else {
-			_ = client.Write(unknownErrReplyBytes)
+		queue <- payload
+	}
+}
+
+// exec executes a command and sends the reply, returns false if the connection should be closed
+func (h *Handler) exec(client *connection.Connection, payload *parser.Payload) bool {
+	if payload.Err != nil {
+		errReply := reply.MakeErrReply(payload.Err.Error())
+		err := client.Write(errReply.ToBytes())
+		if err != nil {
+			logger.Info("connection closed: " + client.RemoteAddr().String())
+			return false
 		}
+		return true
 	}
+	if payload.Data == nil {
+		logger.Error("empty payload")
+		return true
+	}
+	r, ok := payload.Data.(*reply.MultiBulkReply)
+	if !ok {
+		logger.Error("require multi bulk reply")
+		return true
+	}
+	result := h.db.Exec(client, r.Args)
+	if result != nil {
+		_ = client.Write(result.ToBytes())
+	} else {
+		_ = client.Write(unknownErrReplyBytes)
+	}
+	return true
 }
 
+// Close stops handler and flushes database to disk
 func (h *Handler) Close() error {
+	if h.closing.Get() {
+		return nil
+	}
+	h.closing.Set(true)
+	h.db.Close()
 	return nil
 }
 
 func (h *Handler) closeClient(client *connection.Connection) {
-	client.Close()
-	//h.db.AfterClientClose(client)
+	_ = client.Close()
+	h.db.AfterClientClose(client)
 	h.activeConn.Delete(client)
 }
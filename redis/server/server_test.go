@@ -0,0 +1,77 @@
+package server
+
+import (
+	"Tiny-Godis/lib/utils"
+	"Tiny-Godis/redis/client"
+	"Tiny-Godis/redis/reply"
+	"Tiny-Godis/tcp"
+	"net"
+	"testing"
+)
+
+// startServer serves a new handler on a random local port
+func startServer(t *testing.T) (host string, port string, stop func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeChan := make(chan struct{})
+	go tcp.ListenAndServe(listener, MakeHandler(), closeChan)
+	host, port, _ = net.SplitHostPort(listener.Addr().String())
+	return host, port, func() {
+		close(closeChan)
+	}
+}
+
+func connect(t *testing.T, host string, port string) *client.Client {
+	c, err := client.MakeClient(net.JoinHostPort(host, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	return c
+}
+
+func assertReply(t *testing.T, actual interface{ ToBytes() []byte }, expected string) {
+	t.Helper()
+	if string(actual.ToBytes()) != expected {
+		t.Errorf("expected %q, actual %q", expected, actual.ToBytes())
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	srcHost, srcPort, stopSrc := startServer(t)
+	defer stopSrc()
+	host, port, stopDst := startServer(t)
+	defer stopDst()
+	src := connect(t, srcHost, srcPort)
+	defer src.Close()
+	dst := connect(t, host, port)
+	defer dst.Close()
+
+	src.Send(utils.ToCmdLine("SET", "k1", "v1", "EX", "100"))
+	src.Send(utils.ToCmdLine("RPUSH", "k2", "a", "b"))
+	src.Send(utils.ToCmdLine("SET", "k3", "v3"))
+
+	assertReply(t, src.Send(utils.ToCmdLine("MIGRATE", host, port, "none", "0", "1000")), "+NOKEY\r\n")
+	assertReply(t, src.Send(utils.ToCmdLine("MIGRATE", host, port, "k1", "0", "1000")), "+OK\r\n")
+	assertReply(t, src.Send(utils.ToCmdLine("EXISTS", "k1")), ":0\r\n")
+	assertReply(t, dst.Send(utils.ToCmdLine("GET", "k1")), "$2\r\nv1\r\n")
+	ttl, ok := dst.Send(utils.ToCmdLine("TTL", "k1")).(*reply.IntReply)
+	if !ok || ttl.Code <= 0 || ttl.Code > 100 {
+		t.Errorf("expect ttl migrated")
+	}
+
+	// COPY keeps keys, existing keys are not replaced without REPLACE
+	dst.Send(utils.ToCmdLine("SET", "k3", "old"))
+	assertReply(t, src.Send(utils.ToCmdLine("MIGRATE", host, port, "", "0", "1000", "COPY", "KEYS", "k2", "k3")),
+		"-ERR Target instance replied with error: BUSYKEY Target key name already exists.\r\n")
+	assertReply(t, src.Send(utils.ToCmdLine("EXISTS", "k2", "k3")), ":2\r\n")
+	assertReply(t, src.Send(utils.ToCmdLine("MIGRATE", host, port, "", "0", "1000", "REPLACE", "KEYS", "k2", "k3")), "+OK\r\n")
+	assertReply(t, src.Send(utils.ToCmdLine("EXISTS", "k2", "k3")), ":0\r\n")
+	assertReply(t, dst.Send(utils.ToCmdLine("LRANGE", "k2", "0", "-1")), "*2\r\n$1\r\na\r\n$1\r\nb\r\n")
+	assertReply(t, dst.Send(utils.ToCmdLine("GET", "k3")), "$2\r\nv3\r\n")
+
+	assertReply(t, src.Send(utils.ToCmdLine("MIGRATE", host, port, "k1", "0", "1000", "KEYS", "k1")),
+		"-ERR When using MIGRATE KEYS option, the key argument must be set to the empty string\r\n")
+}